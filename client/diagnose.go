@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+
+	"httpxcommon/diagnostics"
+	"httpxcommon/transports"
+)
+
+// DiagnoseSweep returns comparison runs of a HTTP/3 retrieve with the settings quic-go allows to change.
+// quic-go v0.37 has no choice of congestion control or pacing, so flow control, buffers, GSO and packet size are compared.
+func DiagnoseSweep(report *diagnostics.Report, url string) *Sweep {
+	s := &Sweep{Profile: "diagnose", Repeat: 3, URLs: map[string]string{transports.Http3: url}, Parameters: map[string][]string{}}
+	s.Compare = []string{
+		// receive windows limiting long flows
+		"quic.max-stream-window=32MB,quic.max-connection-window=64MB",
+		// socket buffers up to the limit of the operating system
+		"socket.receive-buffer=8MB,socket.send-buffer=8MB",
+		// packets of at most 1252 bytes
+		"quic.disable-mtu-discovery=true",
+	}
+	if report.GSO && !report.GSOEnabled {
+		s.Compare = append(s.Compare, "quic.gso=true")
+	}
+	return s
+}
+
+// LogDiagnostics prints the UDP capabilities of the operating system after HTTP/3 runs
+func LogDiagnostics(protocol string) {
+	if transports.ProtocolLabel(protocol) == "h3" {
+		diagnostics.Collect().Print(os.Stdout)
+	}
+}
@@ -1,21 +1,68 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"httpxcommon/compression"
+	"httpxcommon/connstats"
+	"httpxcommon/diagnostics"
+	"httpxcommon/dicomweb"
+	"httpxcommon/digest"
+	"httpxcommon/httpcache"
+	"httpxcommon/manifest"
 	"httpxcommon/partscommon"
+	"httpxcommon/terminal"
+	"httpxcommon/transports"
+	"httpxcommon/tuning"
+	"io"
 	"log"
+	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+	"github.com/quic-go/quic-go/qlog"
 	"k8s.io/klog"
 )
 
+// exit codes of the client
+const (
+	exitOk     = 0
+	exitFailed = 1
+	// invalid flags or arguments
+	exitUsage = 2
+	// the overall timeout expired
+	exitTimeout = 124
+	// interrupted by Ctrl-C or SIGTERM
+	exitInterrupted = 130
+)
+
+type bufferedWriteCloser struct {
+	*bufio.Writer
+	io.Closer
+}
+
+// NewBufferedWriteCloser creates an io.WriteCloser from a bufio.Writer and an io.Closer
+func NewBufferedWriteCloser(writer *bufio.Writer, closer io.Closer) io.WriteCloser {
+	return &bufferedWriteCloser{
+		Writer: writer,
+		Closer: closer,
+	}
+}
+
 func (h bufferedWriteCloser) Close() error {
 	if err := h.Writer.Flush(); err != nil {
 		return err
@@ -23,38 +70,128 @@ func (h bufferedWriteCloser) Close() error {
 	return h.Closer.Close()
 }
 
-func AddRootCA(certPath string, certPool *x509.CertPool) {
-	caCertPath := path.Join(certPath, "cert", "cert-public.pem")
-	klog.V(partscommon.KlogDebug).Info("Trying to access public certificate: ", caCertPath)
-	caCertRaw, err := os.ReadFile(caCertPath)
+// QlogTracer writes a qlog file per quic connection into the current directory
+func QlogTracer(ctx context.Context, p logging.Perspective, connID quic.ConnectionID) logging.ConnectionTracer {
+	filename := fmt.Sprintf("client_%x.qlog", connID)
+	f, err := os.Create(filename)
 	if err != nil {
-		panic(err)
+		log.Fatal(err)
 	}
-	if ok := certPool.AppendCertsFromPEM(caCertRaw); !ok {
-		panic("Could not add root ceritificate to pool.")
+	log.Printf("Creating qlog file %s.\n", filename)
+	return qlog.NewConnectionTracer(NewBufferedWriteCloser(bufio.NewWriter(f), f), p, connID)
+}
+
+// LogCompressionInfo prints the compression ratio and CPU time next to the transfer rates
+func LogCompressionInfo(compress *compression.Options, cpu time.Duration) {
+	if compress.SingleEncoding() == "" {
+		return
 	}
+	fmt.Println(" COMPRESSION", compress.Encoding+"/"+compress.Scope, compress.Stats.String(), " cpu time:", cpu)
 }
 
-func HandleCertificate(filename string, certDir string) (*x509.CertPool, error) {
-	pool, err := x509.SystemCertPool()
-	if err != nil {
-		log.Fatal(err)
-		return nil, err
+// LogDigestInfo prints the hashed bytes, the verified digests and the share of the hash time in the CPU time
+func LogDigestInfo(dig *digest.Options, cpu time.Duration) {
+	if !dig.IsEnabled() {
+		return
+	}
+	share := 0.0
+	if cpu > 0 {
+		share = 100 * float64(dig.Stats.HashTime) / float64(cpu)
 	}
-	AddRootCA(certDir, pool)
-	return pool, nil
+	fmt.Printf(" DIGEST sha-256 %s cpu time: %v hash share: %.1f%%\n", dig.Stats.String(), cpu, share)
+}
+
+// VerifyInstances compares the instances with the expected ones in the scope of the retrieve url (all if empty)
+func VerifyInstances(operation string, expected *manifest.Manifest, instances *manifest.Manifest, rawUrl string) bool {
+	if len(rawUrl) > 0 {
+		if u, err := url.Parse(rawUrl); err == nil {
+			expected = expected.Filter(partscommon.GetDICOMInfoFromUrl(u.Path))
+		}
+	}
+	diff := manifest.Compare(expected, instances)
+	if diff.Ok() {
+		fmt.Println(" VERIFY "+operation+" ok:", instances.Len(), "instances match size and SHA-256")
+		return true
+	}
+	fmt.Print(" VERIFY " + operation + " FAILED, the transfer lost or changed data: ")
+	diff.Print(os.Stdout)
+	return false
+}
+
+// NeedsTLS returns true if the http version or one of the sweep is used with TLS
+func NeedsTLS(httpVersion string, sweep *Sweep) bool {
+	protocols := []string{httpVersion}
+	if sweep != nil {
+		protocols = protocols[:0]
+		for protocol := range sweep.URLs {
+			protocols = append(protocols, protocol)
+		}
+	}
+	for _, protocol := range protocols {
+		if factory, err := transports.Lookup(protocol); err != nil || factory.Scheme() == "https" {
+			return true
+		}
+	}
+	return false
+}
+
+// LogRetries prints the retried requests per protocol
+func LogRetries(stats *dicomweb.RetryStats) {
+	stats.Print(os.Stdout)
+}
+
+// LogErrorSummary prints the failed operations by category with the first error of every category
+func LogErrorSummary(summary *dicomweb.ErrorSummary) {
+	if summary.Total() == 0 {
+		return
+	}
+	fmt.Println(" ERRORS total:", summary.Total(), summary.String())
+	counts := summary.Counts()
+	categories := make([]string, 0, len(counts))
+	for category := range counts {
+		categories = append(categories, string(category))
+	}
+	sort.Strings(categories)
+	for _, category := range categories {
+		fmt.Println("  "+category+":", summary.Sample(dicomweb.Category(category)))
+	}
+}
+
+// ExitCode returns the exit code of a run, an expired or interrupted run is reported as such
+func ExitCode(ctx context.Context, failed bool) int {
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return exitTimeout
+	case errors.Is(ctx.Err(), context.Canceled):
+		return exitInterrupted
+	case failed:
+		return exitFailed
+	}
+	return exitOk
+}
+
+// usageError prints the message and returns the exit code of invalid flags
+func usageError(m ...any) int {
+	fmt.Fprintln(os.Stderr, m...)
+	return exitUsage
 }
 
 func main() {
 	// klog default
 	klog.InitFlags(nil)
-	defer klog.Flush()
+	code := run()
+	klog.Flush()
+	os.Exit(code)
+}
+
+// run executes the operation and returns the exit code
+func run() int {
 	s := time.Now()
 
 	// determine root path
 	_, filename, _, ok := runtime.Caller(0)
 	if !ok {
-		panic("Failed to get current frame")
+		return usageError("Failed to get current frame")
 	}
 	certPath := path.Dir(filename)
 	certPath = strings.TrimRight(certPath, filepath.Base(certPath))
@@ -62,94 +199,320 @@ func main() {
 	// additional parameters
 	insecure := flag.Bool("insecure", false, "skip certificate verification")
 	enableQlog := flag.Bool("qlog", false, "output a qlog (in the same directory)")
-	httpVersion := flag.String("http", "1.1", "http version to be used: 1.1 | 2.0 | 3.0")
-	operation := flag.String("operation", "retrieve", "operation to be executed: retrieve | send")
+	httpVersion := flag.String("http", "1.1", "http version to be used: 1.1 | 2.0 | 3.0 | 1.1-plain | 2.0-plain (cleartext, http:// urls)")
+	operation := flag.String("operation", "retrieve", "operation to be executed: retrieve | send | search | delete | diagnose")
 	directory := flag.String("dir", "", "directory to be used")
 	chunking := flag.String("chunking", "single", "chunking in parts to be used: single | multi")
 	mode := flag.String("mode", "sync", "mode to be used: sync | async")
 	dirCert := flag.String("cert", certPath, "directory with public and private certificate: cert-priv.perm, cert-public.pem")
+	resume := flag.Bool("resume", false, "continue partially downloaded instances in the directory using HTTP ranges (instance retrieve only)")
+	cacheDir := flag.String("cache", "", "directory of a local response cache revalidated with the server (retrieve only), empty to disable")
+	transferSyntax := flag.String("transfer-syntax", "", "transfer syntax uid requested on retrieve, the server transcodes if needed (empty: as stored)")
+	showStats := flag.Bool("stats", true, "print the transport statistics per connection when the run ends")
+	encoding := flag.String("compression", "identity", "content encoding to request (retrieve) or to send (send): identity | gzip | zstd | br")
+	scope := flag.String("compression-scope", "body", "compression of the whole body or of every part: body | part")
+	useDigest := flag.Bool("digest", false, "send and check sha-256 digests of bodies and parts (RFC 9530 Content-Digest / Repr-Digest)")
+	verify := flag.Bool("verify", false, "compare size and SHA-256 of the retrieved or stored instances with the expected ones and fail on differences")
+	verifySource := flag.String("verify-source", "", "manifest (.json | .csv) or directory with the expected instances (send: default dir)")
+	timeout := flag.Duration("timeout", 0, "limit of the whole operation, e.g. 5m (0: none)")
+	requestTimeout := flag.Duration("request-timeout", 0, "limit of every request including the body and its retries, e.g. 30s (0: none)")
+	retryAttempts := flag.Int("retry-attempts", 1, "attempts of a request including the first one, GETs are retried after transient errors and STOWs which were not stored (1: no retries)")
+	retryBackoff := flag.Duration("retry-backoff", 200*time.Millisecond, "delay before the first retry, doubled for every further retry with jitter")
+	retryMaxBackoff := flag.Duration("retry-max-backoff", 5*time.Second, "upper limit of the delay between retries and of a Retry-After of the server")
+	tuningFile := flag.String("tuning", "", "file with transport parameters of QUIC, HTTP/2 and the sockets, one name = value per line")
+	tune := flag.String("tune", "", "transport parameters as comma separated name=value pairs, applied after -tuning, e.g. quic.max-stream-window=16MB")
+	sweepFile := flag.String("sweep", "", "sweep file with a network profile, urls and parameter values: runs the retrieve or send for every combination and prints the best settings per protocol")
 	flag.Parse()
 	// urls to be called
 	urls := flag.Args()
-	if len(urls) < 1 {
+	if len(urls) < 1 && *operation != "diagnose" {
 		fmt.Println("Usage: httpx-client flags url")
 		fmt.Println("flags:")
 		flag.PrintDefaults()
 		fmt.Println("Examples:")
 		fmt.Println("Retrieve with HTTPS/2: httpx-client -http 2.0 -dir . https://127.0.0.1:8082/studies/1.3.12.2.1107.5.99.3.30000009040610340869700000002")
+		fmt.Println("Retrieve with cleartext HTTP/2 (h2c) to compare without TLS: httpx-client -http 2.0-plain -dir . http://127.0.0.1:8084/studies/1.3.12.2.1107.5.99.3.30000009040610340869700000002")
 		fmt.Println("Retrieve with HTTPS/3 and use detailed logs: httpx-client -v 8 -http 3.0  -dir . https://127.0.0.1:8083/studies/1.3.12.2.1107.5.99.3.30000009040610340869700000002")
+		fmt.Println("Delete a study with HTTPS/2: httpx-client -http 2.0 -operation delete https://127.0.0.1:8082/studies/1.3.12.2.1107.5.99.3.30000009052811420737800000003")
+		fmt.Println("Search the CT series of a study with HTTPS/2: httpx-client -http 2.0 -operation search \"https://127.0.0.1:8082/studies/1.3.12.2.1107.5.99.3.30000009040610340869700000002/series?Modality=CT\"")
+		fmt.Println("Check UDP buffers, GSO and ECN and compare HTTP/3 settings: httpx-client -operation diagnose -dir . https://127.0.0.1:8083/studies/1.3.12.2.1107.5.99.3.30000009052811420737800000003")
 		fmt.Println("Send with HTTPS/3 in async mode: httpx-client -http 3.0 -operation send -chunking single -mode async -dir . https://127.0.0.1:8083/studies/1.3.12.2.1107.5.99.3.30000009052811420737800000003")
-		return
+		return exitUsage
 	}
 
 	// check parameters
-	if !((*mode == "sync") || (*mode == "async")) {
-		panic("Please provide for mode: sync | async")
+	sendMode, errMode := dicomweb.ParseMode(*mode)
+	if errMode != nil {
+		return usageError("Please provide for mode: sync | async")
 	}
 	// check parameters
-	if !((*chunking == "single") || (*chunking == "multi")) {
-		panic("Please provide for mode: sync | async")
+	chunkingMode, errChunking := dicomweb.ParseChunking(*chunking)
+	if errChunking != nil {
+		return usageError("Please provide for chunking: single | multi")
+	}
+
+	// check parameters
+	if !compression.IsSupported(*encoding) {
+		return usageError("Please provide for compression: identity | gzip | zstd | br")
+	}
+	// check parameters
+	if !((*scope == compression.ScopeBody) || (*scope == compression.ScopePart)) {
+		return usageError("Please provide for compression-scope: body | part")
+	}
+	// check parameters
+	if *timeout < 0 || *requestTimeout < 0 {
+		return usageError("Please provide for timeout and request-timeout: a positive duration or 0")
+	}
+	// check parameters
+	if *retryAttempts < 1 || *retryBackoff < 0 || *retryMaxBackoff < 0 {
+		return usageError("Please provide for retry-attempts: 1 or more, for retry-backoff and retry-max-backoff: a positive duration")
+	}
+
+	// check parameters
+	tuneConfig, errTune := tuning.Parse(*tuningFile, *tune)
+	if errTune != nil {
+		return usageError(errTune)
+	}
+	tuneConfig.ApplyGSO()
+	var sweep *Sweep
+	if len(*sweepFile) > 0 {
+		var errSweep error
+		if sweep, errSweep = LoadSweep(*sweepFile); errSweep != nil {
+			return usageError(errSweep)
+		}
+		if *operation != "retrieve" && *operation != "send" {
+			return usageError("Please provide for operation with sweep: retrieve | send")
+		}
+		if len(sweep.URLs) == 0 {
+			sweep.URLs[*httpVersion] = urls[0]
+		}
+	}
+	// diagnostics of the operating system, with a url followed by HTTP/3 retrieves comparing the settings
+	if *operation == "diagnose" {
+		report := diagnostics.Collect()
+		if len(urls) == 0 {
+			report.Print(os.Stdout)
+			return exitOk
+		}
+		sweep = DiagnoseSweep(report, urls[0])
+		*operation = "retrieve"
 	}
 
 	// check input directory
-	*directory = partscommon.CheckDirectory(*directory)
+	var errDir error
+	if *directory, errDir = partscommon.CheckDirectory(*directory); errDir != nil {
+		return usageError(errDir)
+	}
+
+	// expected instances of the verification
+	var expected *manifest.Manifest
+	if *verify {
+		if len(*transferSyntax) > 0 {
+			return usageError("Please provide either -verify or -transfer-syntax, transcoded instances differ from the source")
+		}
+		if len(*verifySource) == 0 && *operation == "send" {
+			*verifySource = *directory
+		}
+		if len(*verifySource) == 0 {
+			return usageError("Please provide for verify-source: manifest or directory with the expected instances")
+		}
+		var errExpected error
+		if expected, errExpected = manifest.Load(*verifySource); errExpected != nil {
+			return usageError(errExpected)
+		}
+	}
 
-	// handle the certificates
+	// handle the certificates, the system certificates are used with -insecure, cleartext protocols need none
 	var pool *x509.CertPool = nil
-	if !*insecure {
+	if !*insecure && NeedsTLS(*httpVersion, sweep) {
 		var errPool error = nil
-		pool, errPool = HandleCertificate(filename, *dirCert)
+		pool, errPool = transports.LoadCertPool(*dirCert)
 		if errPool != nil {
-			panic("Failed to handle sets of certificates")
+			return usageError("Failed to handle sets of certificates: " + errPool.Error())
 		}
 	}
 
 	// handle operations
-	var size uint64
-	var duration time.Duration
+	stats := connstats.NewRegistry()
+	compress := &compression.Options{Encoding: *encoding, Scope: *scope}
+	dig := &digest.Options{Enabled: *useDigest}
+	cpu := partscommon.ProcessCPUTime()
+	var cache *httpcache.Cache
+	if len(*cacheDir) > 0 {
+		var errCache error
+		if cache, errCache = httpcache.NewCache(*cacheDir); errCache != nil {
+			return usageError(errCache)
+		}
+	}
+
+	// the client of the service of the first url, qlog files are written per connection
+	target, errTarget := dicomweb.ParseURL(urls[0])
+	if errTarget != nil {
+		return usageError(errTarget)
+	}
+	quicConf := &quic.Config{}
+	if *enableQlog {
+		klog.V(partscommon.KlogInfo).Info("Enabling qlog for http3")
+		quicConf.Tracer = QlogTracer
+	}
+	options := dicomweb.Options{
+		Protocol:    *httpVersion,
+		TLS:         transports.TLSOptions{RootCAs: pool, Insecure: *insecure},
+		Stats:       stats,
+		QuicConfig:  quicConf,
+		Tuning:      tuneConfig,
+		Compression: compress,
+		Digest:      dig,
+		Cache:       cache,
+		// failed requests are counted, partial results are kept
+		RequestTimeout: *requestTimeout,
+		Errors:         dicomweb.NewErrorSummary(),
+		Retry:          dicomweb.RetryPolicy{MaxAttempts: *retryAttempts, Backoff: *retryBackoff, MaxBackoff: *retryMaxBackoff},
+		RetryStats:     dicomweb.NewRetryStats(),
+	}
+	client, errClient := dicomweb.NewClient(target.Base, options)
+	if errClient != nil {
+		return usageError(errClient)
+	}
+	defer client.Close()
+
+	// Ctrl-C cancels the operation, a second one terminates immediately
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	// parameter sweep instead of a single operation
+	if sweep != nil {
+		errSweep := RunSweep(ctx, sweep, tuneConfig, options, *operation, *directory, dicomweb.StoreOptions{Directory: *directory, Chunking: chunkingMode, Mode: sendMode})
+		if errSweep != nil {
+			klog.Errorf("SWEEP returned error: %v", errSweep)
+		}
+		return ExitCode(ctx, errSweep != nil)
+	}
+	protocol := "HTTPS/" + *httpVersion
+	if factory, err := transports.Lookup(*httpVersion); err == nil && factory.Scheme() == "http" {
+		protocol = "HTTP/" + strings.TrimSuffix(*httpVersion, "-plain")
+	}
 	if *operation == "retrieve" {
-		// handle request based on http version
-		var errHttpGet error = nil
-		if *httpVersion == "1.1" {
-			var http1 http1Handler
-			errHttpGet, size, duration = http1.HandleHttpGet(urls[0], pool, insecure, *directory)
+		// start spinner
+		terminal.Println()
+		if _, err := terminal.StartSpinner("Retrieve using HTTP GET with " + protocol + " on:" + urls[0]); err != nil {
+			klog.Error(err)
+			terminal.Println()
+		}
+		result, errRetrieve := client.Retrieve(ctx, target.Ref, dicomweb.RetrieveOptions{
+			Directory:      *directory,
+			TransferSyntax: *transferSyntax,
+			Resume:         *resume,
+			Rendition:      target.Rendition,
+			Query:          target.Query,
+			Manifest:       expected != nil,
+		})
+		if errRetrieve != nil {
+			klog.Errorf("HTTP call returned error: %v", errRetrieve)
 		}
-		if *httpVersion == "2.0" {
-			var http2 http2Handler
-			errHttpGet, size, duration = http2.HandleHttpGet(urls[0], pool, insecure, *directory)
+		partscommon.LogTotalTimeInfo(" RETRIEVE", time.Since(s), result.Bytes, result.Duration, true)
+		LogCompressionInfo(compress, partscommon.ProcessCPUTime()-cpu)
+		LogDigestInfo(dig, partscommon.ProcessCPUTime()-cpu)
+		if cache != nil {
+			fmt.Println(" CACHE HTTP/"+*httpVersion, cache.Stats.String())
 		}
-		if *httpVersion == "3.0" {
-			var http3 http3Handler
-			errHttpGet, size, duration = http3.HandleHttpGet(urls[0], enableQlog, pool, insecure, *directory)
+		if *showStats {
+			stats.Print()
 		}
-		if errHttpGet != nil {
-			klog.Errorf("HTTP call returned error: %v", errHttpGet)
+		LogDiagnostics(*httpVersion)
+		LogRetries(options.RetryStats)
+		LogErrorSummary(options.Errors)
+		failed := errRetrieve != nil || dig.Stats.Mismatches > 0
+		if expected != nil && !VerifyInstances("RETRIEVE", expected, result.Instances, urls[0]) {
+			failed = true
 		}
-		partscommon.LogTotalTimeInfo(" RETRIEVE", time.Since(s), size, duration, true)
+		return ExitCode(ctx, failed)
 	} else if *operation == "send" {
-		// handle request based on http version
-		var errHttpPost error = nil
-		if *httpVersion == "1.1" {
-			var http1 http1Handler
-			http1.chunking = *chunking
-			http1.mode = *mode
-			errHttpPost, size, duration = http1.HandleHttpPost(urls[0], pool, insecure, *directory)
-		}
-		if *httpVersion == "2.0" {
-			var http2 http2Handler
-			http2.chunking = *chunking
-			http2.mode = *mode
-			errHttpPost, size, duration = http2.HandleHttpPost(urls[0], pool, insecure, *directory)
-		}
-		if *httpVersion == "3.0" {
-			var http3 http3Handler
-			http3.chunking = *chunking
-			http3.mode = *mode
-			errHttpPost, size, duration = http3.HandleHttpPost(urls[0], enableQlog, pool, insecure, *directory)
-		}
-		if errHttpPost != nil {
-			klog.Errorf("POST call returned error: %v", errHttpPost)
-		}
-		partscommon.LogTotalTimeInfo(" SEND", time.Since(s), size, duration, true)
+		// start spinner
+		if _, err := terminal.StartSpinner("Send using HTTP POST with " + protocol + " on:" + urls[0]); err != nil {
+			klog.Error(err)
+			terminal.Println()
+		}
+		result, errStore := client.Store(ctx, target.Study, dicomweb.StoreOptions{
+			Directory: *directory,
+			Chunking:  chunkingMode,
+			Mode:      sendMode,
+		})
+		if errStore != nil {
+			klog.Errorf("POST call returned error: %v", errStore)
+		}
+		partscommon.LogTotalTimeInfo(" SEND", time.Since(s), result.Bytes, result.Duration, true)
+		if result.FailedRequests > 0 {
+			fmt.Println(" SEND partial:", result.Instances.Len(), "instances stored,", result.FailedRequests, "requests failed")
+		}
+		LogCompressionInfo(compress, partscommon.ProcessCPUTime()-cpu)
+		LogDigestInfo(dig, partscommon.ProcessCPUTime()-cpu)
+		if *showStats {
+			stats.Print()
+		}
+		LogDiagnostics(*httpVersion)
+		LogRetries(options.RetryStats)
+		LogErrorSummary(options.Errors)
+		failed := errStore != nil
+		if expected != nil && !VerifyInstances("SEND", expected, result.Instances, "") {
+			failed = true
+		}
+		return ExitCode(ctx, failed)
+	} else if *operation == "search" {
+		// matching studies, series or instances as one DICOM JSON dataset per line
+		result, errSearch := client.Search(ctx, target.Ref, target.Query)
+		for _, ds := range result.Datasets {
+			line, _ := json.Marshal(ds)
+			fmt.Println(string(line))
+		}
+		fmt.Println(" SEARCH", urls[0], "status:", result.StatusCode, "results:", len(result.Datasets), "time:", result.Duration)
+		if errSearch != nil {
+			klog.Errorf("SEARCH call returned error: %v", errSearch)
+		}
+		LogRetries(options.RetryStats)
+		LogErrorSummary(options.Errors)
+		return ExitCode(ctx, errSearch != nil)
+	} else if *operation == "delete" {
+		// every url is deleted, urls of other services get their own client
+		var errDelete error = nil
+		for _, url := range urls {
+			if ctx.Err() != nil {
+				break
+			}
+			t, err := dicomweb.ParseURL(url)
+			if err != nil {
+				errDelete = err
+				continue
+			}
+			c := client
+			if t.Base != client.BaseURL() {
+				if c, err = dicomweb.NewClient(t.Base, options); err != nil {
+					errDelete = err
+					continue
+				}
+				defer c.Close()
+			}
+			result, errHttpDelete := c.Delete(ctx, t.Ref)
+			fmt.Println(" DELETE", url, "status:", result.StatusCode, "time:", result.Duration)
+			if errHttpDelete != nil {
+				klog.Error(errHttpDelete)
+				errDelete = errHttpDelete
+			}
+		}
+		if errDelete != nil {
+			klog.Errorf("DELETE call returned error: %v", errDelete)
+		}
+		LogRetries(options.RetryStats)
+		LogErrorSummary(options.Errors)
+		return ExitCode(ctx, errDelete != nil)
 	}
+	return usageError("Please provide for operation: retrieve | send | search | delete | diagnose")
 }
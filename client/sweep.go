@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"httpxcommon/diagnostics"
+	"httpxcommon/dicomweb"
+	"httpxcommon/partscommon"
+	"httpxcommon/transports"
+	"httpxcommon/tuning"
+
+	"k8s.io/klog"
+)
+
+// Type representing a parameter sweep on a network profile
+type Sweep struct {
+	// name of the network profile the results are labelled with
+	Profile string
+	// commands applying and removing the network profile, empty to use the network as it is
+	Setup    string
+	Teardown string
+	// runs per combination, the median throughput is compared
+	Repeat int
+	// url per http version
+	URLs map[string]string
+	// values per tuning parameter
+	Parameters map[string][]string
+	// variants of comma separated name=value pairs run in addition to the combinations
+	Compare []string
+	// optional csv file with every run
+	Output string
+}
+
+// Type representing the runs of one combination of parameters
+type SweepResult struct {
+	Protocol string
+	Settings string
+	// throughput of the runs in bytes per second, failed runs are not included
+	Throughput []float64
+	Errors     int
+}
+
+// Median returns the median throughput, 0 if all runs failed
+func (r *SweepResult) Median() float64 {
+	if len(r.Throughput) == 0 {
+		return 0
+	}
+	values := append([]float64(nil), r.Throughput...)
+	sort.Float64s(values)
+	middle := len(values) / 2
+	if len(values)%2 == 0 {
+		return (values[middle-1] + values[middle]) / 2
+	}
+	return values[middle]
+}
+
+// LoadSweep reads a sweep file with one name = value per line, parameters take a comma separated list of values
+func LoadSweep(path string) (*Sweep, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	s := &Sweep{Profile: "default", Repeat: 3, URLs: map[string]string{}, Parameters: map[string][]string{}}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(text, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected name = value", path, line)
+		}
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		switch {
+		case name == "profile":
+			s.Profile = value
+		case name == "setup":
+			s.Setup = value
+		case name == "teardown":
+			s.Teardown = value
+		case name == "output":
+			s.Output = value
+		case name == "repeat":
+			if s.Repeat, err = strconv.Atoi(value); err != nil || s.Repeat < 1 {
+				return nil, fmt.Errorf("%s:%d: repeat needs a number of at least 1", path, line)
+			}
+		case name == "compare":
+			if err := checkClientParameters(value); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+			}
+			s.Compare = append(s.Compare, value)
+		case strings.HasPrefix(name, "url "):
+			protocol := strings.TrimSpace(strings.TrimPrefix(name, "url "))
+			if _, err := transports.Lookup(protocol); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+			}
+			s.URLs[protocol] = value
+		default:
+			var values []string
+			for _, v := range strings.Split(value, ",") {
+				// the values are checked before the first run
+				if err := checkClientParameters(name + "=" + v); err != nil {
+					return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+				}
+				values = append(values, strings.TrimSpace(v))
+			}
+			s.Parameters[name] = values
+		}
+	}
+	return s, scanner.Err()
+}
+
+// checkClientParameters returns an error if a parameter of the name=value pairs is unknown, invalid or a server parameter
+func checkClientParameters(list string) error {
+	if err := (&tuning.Config{}).SetList(list); err != nil {
+		return err
+	}
+	for _, pair := range strings.Split(list, ",") {
+		name, _, _ := strings.Cut(pair, "=")
+		if key, _ := tuning.Lookup(strings.TrimSpace(name)); key.Side == tuning.SideServer {
+			return fmt.Errorf("%s is a server parameter, set it on the server with -tune", key.Name)
+		}
+	}
+	return nil
+}
+
+// applies returns true if the parameter changes the transport of the protocol
+func applies(name string, protocol string) bool {
+	key, err := tuning.Lookup(name)
+	if err != nil {
+		return false
+	}
+	switch key.Scope {
+	case tuning.ScopeQuic:
+		return transports.ProtocolLabel(protocol) == "h3"
+	case tuning.ScopeHttp2:
+		label := transports.ProtocolLabel(protocol)
+		return label == "h2" || label == "h2c"
+	}
+	return true
+}
+
+// combinations returns the base configuration with every combination of the values of the parameters of the protocol
+func (s *Sweep) combinations(protocol string, base tuning.Config) []*tuning.Config {
+	var names []string
+	for name := range s.Parameters {
+		if applies(name, protocol) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	configs := []*tuning.Config{&base}
+	for _, name := range names {
+		var next []*tuning.Config
+		for _, c := range configs {
+			for _, value := range s.Parameters[name] {
+				copied := *c
+				copied.Set(name, value)
+				next = append(next, &copied)
+			}
+		}
+		configs = next
+	}
+	// variants are only run if all of their parameters apply
+	var variants []*tuning.Config
+	for _, list := range s.Compare {
+		if !appliesAll(list, protocol) {
+			continue
+		}
+		for _, c := range configs {
+			copied := *c
+			copied.SetList(list)
+			variants = append(variants, &copied)
+		}
+	}
+	return append(configs, variants...)
+}
+
+// appliesAll returns true if every parameter of the name=value pairs changes the transport of the protocol
+func appliesAll(list string, protocol string) bool {
+	for _, pair := range strings.Split(list, ",") {
+		name, _, _ := strings.Cut(pair, "=")
+		if name = strings.TrimSpace(name); len(name) > 0 && !applies(name, protocol) {
+			return false
+		}
+	}
+	return true
+}
+
+// shell runs a command of the network profile
+func shell(ctx context.Context, command string) error {
+	if len(command) == 0 {
+		return nil
+	}
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	fmt.Println(" PROFILE", command)
+	return cmd.Run()
+}
+
+// sweepRun executes the operation once with a new client and returns the bytes transferred
+func sweepRun(ctx context.Context, target *dicomweb.Target, options dicomweb.Options, operation string, directory string, store dicomweb.StoreOptions) (uint64, error) {
+	client, err := dicomweb.NewClient(target.Base, options)
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+	if operation == "send" {
+		result, err := client.Store(ctx, target.Study, store)
+		return result.Bytes, err
+	}
+
+	// retrieved instances are removed after every run
+	dir, err := os.MkdirTemp(directory, ".sweep-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(dir)
+	result, err := client.Retrieve(ctx, target.Ref, dicomweb.RetrieveOptions{Directory: dir, Rendition: target.Rendition, Query: target.Query})
+	return result.Bytes, err
+}
+
+// RunSweep runs the operation for every protocol and combination of parameters and prints the best settings per protocol
+func RunSweep(ctx context.Context, s *Sweep, base *tuning.Config, options dicomweb.Options, operation string, directory string, store dicomweb.StoreOptions) error {
+	if err := shell(ctx, s.Setup); err != nil {
+		return fmt.Errorf("setup of profile %s: %w", s.Profile, err)
+	}
+	defer func() {
+		if err := shell(context.Background(), s.Teardown); err != nil {
+			klog.Errorf("teardown of profile %s: %v", s.Profile, err)
+		}
+	}()
+	var out *csv.Writer
+	if len(s.Output) > 0 {
+		file, err := os.Create(s.Output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = csv.NewWriter(file)
+		defer out.Flush()
+		out.Write([]string{"profile", "protocol", "settings", "run", "bytes", "seconds", "throughput", "error"})
+	}
+
+	protocols := make([]string, 0, len(s.URLs))
+	for protocol := range s.URLs {
+		protocols = append(protocols, protocol)
+	}
+	sort.Strings(protocols)
+	// the limits of the operating system explain the HTTP/3 results
+	for _, protocol := range protocols {
+		if transports.ProtocolLabel(protocol) == "h3" {
+			diagnostics.Collect().Print(os.Stdout)
+			break
+		}
+	}
+	// the runs change the GSO of the process, the base configuration applies after the sweep
+	defer base.ApplyGSO()
+	var best []*SweepResult
+	for _, protocol := range protocols {
+		target, err := dicomweb.ParseURL(s.URLs[protocol])
+		if err != nil {
+			return err
+		}
+		var results []*SweepResult
+		for _, config := range s.combinations(protocol, *base) {
+			result := &SweepResult{Protocol: protocol, Settings: config.String()}
+			config.ApplyGSO()
+			for run := 1; run <= s.Repeat && ctx.Err() == nil; run++ {
+				opts := options
+				opts.Protocol = protocol
+				opts.Tuning = config
+				opts.Stats = nil
+				start := time.Now()
+				size, errRun := sweepRun(ctx, target, opts, operation, directory, store)
+				duration := time.Since(start)
+				errText := ""
+				if errRun != nil {
+					result.Errors++
+					errText = errRun.Error()
+				} else {
+					result.Throughput = append(result.Throughput, float64(size)/duration.Seconds())
+				}
+				if out != nil {
+					out.Write([]string{s.Profile, protocol, result.Settings, strconv.Itoa(run), strconv.FormatUint(size, 10),
+						strconv.FormatFloat(duration.Seconds(), 'f', 6, 64), strconv.FormatFloat(float64(size)/duration.Seconds(), 'f', 0, 64), errText})
+				}
+			}
+			fmt.Println(" SWEEP", s.Profile, "HTTP/"+protocol, result.Settings, "median:", partscommon.ByteCountSI(uint64(result.Median()))+"/s", "runs:", len(result.Throughput), "errors:", result.Errors)
+			results = append(results, result)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		sort.SliceStable(results, func(i, j int) bool { return results[i].Median() > results[j].Median() })
+		best = append(best, results[0])
+	}
+	for _, result := range best {
+		fmt.Println(" BEST", s.Profile, "HTTP/"+result.Protocol, result.Settings, partscommon.ByteCountSI(uint64(result.Median()))+"/s")
+	}
+	if len(best) == 0 {
+		return errors.New("no url to sweep, add url <http version> = <url> to the sweep file")
+	}
+	return nil
+}
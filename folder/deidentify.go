@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+
+	"httpxcommon/dicomfile"
+)
+
+// actions of the PS3.15 Basic Application Level Confidentiality Profile (Table E.1-1)
+const (
+	// remove the attribute
+	ActionRemove = 'X'
+	// replace with a zero length value
+	ActionZero = 'Z'
+	// replace with a consistent dummy value
+	ActionDummy = 'D'
+	// replace the UID consistently
+	ActionUID = 'U'
+)
+
+// tags written by the de-identification
+const (
+	tagMediaStorageSOPInstanceUID uint32 = 0x00020003
+	tagPatientName                uint32 = 0x00100010
+	tagPatientID                  uint32 = 0x00100020
+	tagPatientIdentityRemoved     uint32 = 0x00120062
+	tagDeidentificationMethod     uint32 = 0x00120063
+	tagDeidentificationMethodCode uint32 = 0x00120064
+	tagCodeValue                  uint32 = 0x00080100
+	tagCodingSchemeDesignator     uint32 = 0x00080102
+	tagCodeMeaning                uint32 = 0x00080104
+	tagStudyInstanceUID           uint32 = 0x0020000D
+	tagSeriesInstanceUID          uint32 = 0x0020000E
+	tagSOPInstanceUID             uint32 = 0x00080018
+)
+
+// root of the well-known UIDs (classes, transfer syntaxes, coding schemes) which are kept
+const dicomUIDRoot = "1.2.840.10008."
+
+// basicProfile holds the actions of the attributes identifying the patient, the study or staff,
+// person names not listed are removed
+var basicProfile = map[uint32]byte{
+	0x00041511: ActionUID,    // Referenced SOP Instance UID in File
+	0x00080014: ActionUID,    // Instance Creator UID
+	0x00080018: ActionUID,    // SOP Instance UID
+	0x00080020: ActionZero,   // Study Date
+	0x00080021: ActionRemove, // Series Date
+	0x00080022: ActionRemove, // Acquisition Date
+	0x00080023: ActionZero,   // Content Date
+	0x00080024: ActionRemove, // Overlay Date
+	0x00080025: ActionRemove, // Curve Date
+	0x0008002A: ActionRemove, // Acquisition DateTime
+	0x00080030: ActionZero,   // Study Time
+	0x00080031: ActionRemove, // Series Time
+	0x00080032: ActionRemove, // Acquisition Time
+	0x00080033: ActionZero,   // Content Time
+	0x00080034: ActionRemove, // Overlay Time
+	0x00080035: ActionRemove, // Curve Time
+	0x00080050: ActionZero,   // Accession Number
+	0x00080058: ActionUID,    // Failed SOP Instance UID List
+	0x00080080: ActionRemove, // Institution Name
+	0x00080081: ActionRemove, // Institution Address
+	0x00080082: ActionRemove, // Institution Code Sequence
+	0x00080090: ActionZero,   // Referring Physician's Name
+	0x00080092: ActionRemove, // Referring Physician's Address
+	0x00080094: ActionRemove, // Referring Physician's Telephone Numbers
+	0x00080096: ActionRemove, // Referring Physician Identification Sequence
+	0x0008009C: ActionZero,   // Consulting Physician's Name
+	0x0008009D: ActionRemove, // Consulting Physician Identification Sequence
+	0x00080116: ActionRemove, // Responsible Organization
+	0x00080201: ActionRemove, // Timezone Offset From UTC
+	0x00081010: ActionRemove, // Station Name
+	0x00081030: ActionRemove, // Study Description
+	0x0008103E: ActionRemove, // Series Description
+	0x00081040: ActionRemove, // Institutional Department Name
+	0x00081048: ActionRemove, // Physician(s) of Record
+	0x00081049: ActionRemove, // Physician(s) of Record Identification Sequence
+	0x00081050: ActionRemove, // Performing Physicians' Name
+	0x00081052: ActionRemove, // Performing Physician Identification Sequence
+	0x00081060: ActionRemove, // Name of Physician(s) Reading Study
+	0x00081062: ActionRemove, // Physician(s) Reading Study Identification Sequence
+	0x00081070: ActionRemove, // Operators' Name
+	0x00081072: ActionRemove, // Operator Identification Sequence
+	0x00081080: ActionRemove, // Admitting Diagnoses Description
+	0x00081084: ActionRemove, // Admitting Diagnoses Code Sequence
+	0x00081110: ActionRemove, // Referenced Study Sequence
+	0x00081111: ActionRemove, // Referenced Performed Procedure Step Sequence
+	0x00081120: ActionRemove, // Referenced Patient Sequence
+	0x00081155: ActionUID,    // Referenced SOP Instance UID
+	0x00082111: ActionRemove, // Derivation Description
+	0x00083010: ActionUID,    // Irradiation Event UID
+	0x00089123: ActionUID,    // Creator-Version UID
+	0x00100010: ActionDummy,  // Patient's Name
+	0x00100020: ActionDummy,  // Patient ID
+	0x00100021: ActionRemove, // Issuer of Patient ID
+	0x00100030: ActionZero,   // Patient's Birth Date
+	0x00100032: ActionRemove, // Patient's Birth Time
+	0x00100040: ActionZero,   // Patient's Sex
+	0x00100050: ActionRemove, // Patient's Insurance Plan Code Sequence
+	0x00101000: ActionRemove, // Other Patient IDs
+	0x00101001: ActionRemove, // Other Patient Names
+	0x00101002: ActionRemove, // Other Patient IDs Sequence
+	0x00101005: ActionRemove, // Patient's Birth Name
+	0x00101010: ActionRemove, // Patient's Age
+	0x00101020: ActionRemove, // Patient's Size
+	0x00101030: ActionRemove, // Patient's Weight
+	0x00101040: ActionRemove, // Patient's Address
+	0x00101060: ActionRemove, // Patient's Mother's Birth Name
+	0x00101080: ActionRemove, // Military Rank
+	0x00101081: ActionRemove, // Branch of Service
+	0x00101090: ActionRemove, // Medical Record Locator
+	0x00101100: ActionRemove, // Referenced Patient Photo Sequence
+	0x00102000: ActionRemove, // Medical Alerts
+	0x00102110: ActionRemove, // Allergies
+	0x00102150: ActionRemove, // Country of Residence
+	0x00102152: ActionRemove, // Region of Residence
+	0x00102154: ActionRemove, // Patient's Telephone Numbers
+	0x00102160: ActionRemove, // Ethnic Group
+	0x00102180: ActionRemove, // Occupation
+	0x001021A0: ActionRemove, // Smoking Status
+	0x001021B0: ActionRemove, // Additional Patient History
+	0x001021C0: ActionRemove, // Pregnancy Status
+	0x001021D0: ActionRemove, // Last Menstrual Date
+	0x001021F0: ActionRemove, // Patient's Religious Preference
+	0x00102297: ActionZero,   // Responsible Person
+	0x00102299: ActionRemove, // Responsible Organization
+	0x00104000: ActionRemove, // Patient Comments
+	0x00181000: ActionRemove, // Device Serial Number
+	0x00181002: ActionUID,    // Device UID
+	0x00181004: ActionRemove, // Plate ID
+	0x00181005: ActionRemove, // Generator ID
+	0x00181007: ActionRemove, // Cassette ID
+	0x00181008: ActionRemove, // Gantry ID
+	0x00181009: ActionRemove, // Unique Device Identifier
+	0x00181030: ActionRemove, // Protocol Name
+	0x00181400: ActionRemove, // Acquisition Device Processing Description
+	0x0018700A: ActionRemove, // Detector ID
+	0x0020000D: ActionUID,    // Study Instance UID
+	0x0020000E: ActionUID,    // Series Instance UID
+	0x00200010: ActionZero,   // Study ID
+	0x00200052: ActionUID,    // Frame of Reference UID
+	0x00200200: ActionUID,    // Synchronization Frame of Reference UID
+	0x00204000: ActionRemove, // Image Comments
+	0x00209161: ActionUID,    // Concatenation UID
+	0x00209164: ActionUID,    // Dimension Organization UID
+	0x00281199: ActionUID,    // Palette Color LUT UID
+	0x00281214: ActionUID,    // Large Palette Color LUT UID
+	0x00321032: ActionRemove, // Requesting Physician
+	0x00321033: ActionRemove, // Requesting Service
+	0x00321060: ActionRemove, // Requested Procedure Description
+	0x00324000: ActionRemove, // Study Comments
+	0x00380004: ActionRemove, // Referenced Patient Alias Sequence
+	0x00380010: ActionRemove, // Admission ID
+	0x00380040: ActionRemove, // Discharge Diagnosis Description
+	0x00380300: ActionRemove, // Current Patient Location
+	0x00380400: ActionRemove, // Patient's Institution Residence
+	0x00380500: ActionRemove, // Patient State
+	0x00400006: ActionRemove, // Scheduled Performing Physician's Name
+	0x00400007: ActionRemove, // Scheduled Procedure Step Description
+	0x0040000B: ActionRemove, // Scheduled Performing Physician Identification Sequence
+	0x00400241: ActionRemove, // Performed Station AE Title
+	0x00400242: ActionRemove, // Performed Station Name
+	0x00400243: ActionRemove, // Performed Location
+	0x00400244: ActionRemove, // Performed Procedure Step Start Date
+	0x00400245: ActionRemove, // Performed Procedure Step Start Time
+	0x00400250: ActionRemove, // Performed Procedure Step End Date
+	0x00400251: ActionRemove, // Performed Procedure Step End Time
+	0x00400253: ActionRemove, // Performed Procedure Step ID
+	0x00400254: ActionRemove, // Performed Procedure Step Description
+	0x00400275: ActionRemove, // Request Attributes Sequence
+	0x00400280: ActionRemove, // Comments on the Performed Procedure Step
+	0x00401001: ActionRemove, // Requested Procedure ID
+	0x00401010: ActionRemove, // Names of Intended Recipients of Results
+	0x00401011: ActionRemove, // Intended Recipients of Results Identification Sequence
+	0x00401102: ActionRemove, // Person Address
+	0x00401103: ActionRemove, // Person Telephone Numbers
+	0x00401400: ActionRemove, // Requested Procedure Comments
+	0x00402016: ActionZero,   // Placer Order Number / Imaging Service Request
+	0x00402017: ActionZero,   // Filler Order Number / Imaging Service Request
+	0x00402400: ActionRemove, // Imaging Service Request Comments
+	0x0040A027: ActionRemove, // Verifying Organization
+	0x0040A073: ActionRemove, // Verifying Observer Sequence
+	0x0040A075: ActionDummy,  // Verifying Observer Name
+	0x0040A078: ActionRemove, // Author Observer Sequence
+	0x0040A088: ActionZero,   // Verifying Observer Identification Code Sequence
+	0x0040A123: ActionDummy,  // Person Name
+	0x0040A124: ActionUID,    // UID
+	0x0040A171: ActionUID,    // Observation UID
+	0x0040A402: ActionUID,    // Observation Subject UID
+	0x0040A730: ActionRemove, // Content Sequence
+	0x0040DB0C: ActionUID,    // Template Extension Organization UID
+	0x0040DB0D: ActionUID,    // Template Extension Creator UID
+	0x0070031A: ActionUID,    // Fiducial UID
+	0x00880140: ActionUID,    // Storage Media File-set UID
+	0x30060024: ActionUID,    // Referenced Frame of Reference UID
+	0x300600C2: ActionUID,    // Related Frame of Reference UID
+	0x300A0013: ActionUID,    // Dose Reference UID
+	0x40084000: ActionRemove, // Results Comments
+}
+
+// Type representing the de-identification of files with consistent pseudonyms kept in a mapping file
+type Deidentifier struct {
+	mu sync.Mutex
+	// replacements of UIDs and patient ids
+	uids     map[string]string
+	patients map[string]string
+	file     *os.File
+	mapping  *csv.Writer
+}
+
+// NewDeidentifier loads an existing mapping file to keep the pseudonyms of earlier runs and appends new ones
+func NewDeidentifier(mapFile string) (*Deidentifier, error) {
+	d := &Deidentifier{uids: make(map[string]string), patients: make(map[string]string)}
+	if in, err := os.Open(mapFile); err == nil {
+		records, err := csv.NewReader(in).ReadAll()
+		in.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading mapping file %s: %w", mapFile, err)
+		}
+		for _, record := range records {
+			if len(record) != 3 {
+				continue
+			}
+			switch record[0] {
+			case "uid":
+				d.uids[record[1]] = record[2]
+			case "patient":
+				d.patients[record[1]] = record[2]
+			}
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	file, err := os.OpenFile(mapFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	d.file = file
+	d.mapping = csv.NewWriter(file)
+	return d, nil
+}
+
+// Close flushes the mapping file
+func (d *Deidentifier) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.mapping.Flush()
+	if err := d.mapping.Error(); err != nil {
+		d.file.Close()
+		return err
+	}
+	return d.file.Close()
+}
+
+// UID returns the replacement of a UID, new UIDs are random below the 2.25 root
+func (d *Deidentifier) UID(original string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if replacement, ok := d.uids[original]; ok {
+		return replacement
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	replacement := "2.25." + new(big.Int).SetBytes(b).String()
+	d.uids[original] = replacement
+	d.mapping.Write([]string{"uid", original, replacement})
+	return replacement
+}
+
+// PatientID returns the pseudonym of a patient id or of the study of files without one
+func (d *Deidentifier) PatientID(original string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if replacement, ok := d.patients[original]; ok {
+		return replacement
+	}
+	replacement := fmt.Sprintf("ANON%06d", len(d.patients)+1)
+	d.patients[original] = replacement
+	d.mapping.Write([]string{"patient", original, replacement})
+	return replacement
+}
+
+// Deidentify changes the parsed file and returns it in the same transfer syntax with the new study, series and instance UIDs
+func (d *Deidentifier) Deidentify(f *dicomfile.File) ([]byte, string, string, string, error) {
+	// files without a patient id get the pseudonym of their study
+	patient := f.Dataset.String(tagPatientID)
+	if len(patient) == 0 {
+		patient = "study:" + f.Dataset.String(tagStudyInstanceUID)
+	}
+	pseudonym := d.PatientID(patient)
+	d.dataset(f.Dataset, pseudonym)
+	if e := f.Meta.Find(tagMediaStorageSOPInstanceUID); e != nil {
+		d.replaceUIDs(e)
+	}
+
+	// mark the dataset as de-identified (PS3.15 E.1.1)
+	f.Dataset.Set(&dicomfile.Element{Tag: tagPatientIdentityRemoved, VR: "CS", Value: dicomfile.PadValue("YES", ' ')})
+	f.Dataset.Set(&dicomfile.Element{Tag: tagDeidentificationMethod, VR: "LO", Value: dicomfile.PadValue("PS3.15 Basic Application Level Confidentiality Profile", ' ')})
+	code := &dicomfile.Dataset{Elements: []*dicomfile.Element{
+		{Tag: tagCodeValue, VR: "SH", Value: dicomfile.PadValue("113100", ' ')},
+		{Tag: tagCodingSchemeDesignator, VR: "SH", Value: dicomfile.PadValue("DCM", ' ')},
+		{Tag: tagCodeMeaning, VR: "LO", Value: dicomfile.PadValue("Basic Application Confidentiality Profile", ' ')},
+	}}
+	f.Dataset.Set(&dicomfile.Element{Tag: tagDeidentificationMethodCode, VR: "SQ", Sequence: true, Items: []*dicomfile.Dataset{code}})
+
+	var out bytes.Buffer
+	if err := f.Write(&out, f.TransferSyntax); err != nil {
+		return nil, "", "", "", err
+	}
+	return out.Bytes(), f.Dataset.String(tagStudyInstanceUID), f.Dataset.String(tagSeriesInstanceUID), f.Dataset.String(tagSOPInstanceUID), nil
+}
+
+// dataset applies the profile to all elements including the items of sequences
+func (d *Deidentifier) dataset(ds *dicomfile.Dataset, pseudonym string) {
+	var elements []*dicomfile.Element
+	for _, e := range ds.Elements {
+		group := e.Tag >> 16
+		// private attributes, curves, overlay comments and data and group lengths are removed
+		if group%2 == 1 || group&0xFF00 == 0x5000 || (group&0xFF00 == 0x6000 && (e.Tag&0xFFFF == 0x3000 || e.Tag&0xFFFF == 0x4000)) || e.Tag&0xFFFF == 0 {
+			continue
+		}
+		action, listed := basicProfile[e.Tag]
+		if !listed && e.VR == "PN" {
+			action = ActionRemove
+		}
+		switch action {
+		case ActionRemove:
+			continue
+		case ActionZero:
+			e.Value, e.Items = nil, nil
+		case ActionDummy:
+			switch e.Tag {
+			case tagPatientID:
+				e.Value = dicomfile.PadValue(pseudonym, ' ')
+			case tagPatientName:
+				e.Value = dicomfile.PadValue("ANONYMOUS^"+pseudonym, ' ')
+			default:
+				e.Value, e.Items = dicomfile.PadValue("ANONYMOUS", ' '), nil
+			}
+		}
+
+		// instance UIDs are replaced, also in sequences, class UIDs are kept to match the meta information
+		if action == ActionUID {
+			d.replaceUIDs(e)
+		}
+		for _, item := range e.Items {
+			d.dataset(item, pseudonym)
+		}
+		elements = append(elements, e)
+	}
+	ds.Elements = elements
+}
+
+// replaceUIDs replaces every value of a multi-valued UID element
+func (d *Deidentifier) replaceUIDs(e *dicomfile.Element) {
+	values := strings.Split(strings.TrimRight(string(e.Value), "\x00 "), "\\")
+	for i, v := range values {
+		if len(v) > 0 && !strings.HasPrefix(v, dicomUIDRoot) {
+			values[i] = d.UID(v)
+		}
+	}
+	e.Value = dicomfile.PadValue(strings.Join(values, "\\"), 0)
+}
+
+// writeFile writes the data into a new file
+func writeFile(filename string, data []byte) (int64, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(file, bytes.NewReader(data))
+	if errClose := file.Close(); err == nil {
+		err = errClose
+	}
+	return n, err
+}
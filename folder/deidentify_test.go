@@ -0,0 +1,108 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"httpxcommon/dicomfile"
+)
+
+// element creates an element with the value padded for its VR
+func element(tag uint32, vr string, value string) *dicomfile.Element {
+	pad := byte(' ')
+	if vr == "UI" {
+		pad = 0
+	}
+	return &dicomfile.Element{Tag: tag, VR: vr, Value: dicomfile.PadValue(value, pad)}
+}
+
+func TestDeidentify(t *testing.T) {
+	const sopClass = "1.2.840.10008.5.1.4.1.1.7"
+	f := &dicomfile.File{
+		Meta:           &dicomfile.Dataset{Elements: []*dicomfile.Element{element(tagMediaStorageSOPInstanceUID, "UI", "1.2.3.4.5")}},
+		TransferSyntax: "1.2.840.10008.1.2.1",
+		Dataset: &dicomfile.Dataset{Elements: []*dicomfile.Element{
+			element(0x00080016, "UI", sopClass),
+			element(tagSOPInstanceUID, "UI", "1.2.3.4.5"),
+			element(0x00080050, "SH", "ACC123"),
+			element(0x0008009C, "PN", "Consulting^Physician"),
+			element(tagPatientName, "PN", "Doe^John"),
+			element(tagPatientID, "LO", "PID42"),
+			element(0x00102297, "PN", "Responsible^Person"),
+			element(tagStudyInstanceUID, "UI", "1.2.3"),
+			element(tagSeriesInstanceUID, "UI", "1.2.3.4"),
+			element(0x00400006, "PN", "Scheduled^Physician"),
+			element(0x00401010, "PN", "Intended^Recipient"),
+			element(0x00402016, "LO", "PLACER1"),
+			element(0x00402017, "LO", "FILLER1"),
+			element(0x0040A075, "PN", "Verifying^Observer"),
+			element(0x0040A123, "PN", "Some^Person"),
+			// person name missing in the profile
+			element(0x00700084, "PN", "Content^Creator"),
+		}},
+	}
+	d, err := NewDeidentifier(filepath.Join(t.TempDir(), "mapping.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	data, study, series, instance, err := d.Deidentify(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := dicomfile.Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// no original value of an identifying attribute is left
+	for _, e := range out.Dataset.Elements {
+		for _, original := range []string{"Doe", "PID42", "ACC123", "Physician", "Person", "Recipient", "PLACER1", "FILLER1", "Observer", "Creator"} {
+			if strings.Contains(string(e.Value), original) {
+				t.Errorf("element %08X keeps %q: %q", e.Tag, original, e.Value)
+			}
+		}
+	}
+	tests := []struct {
+		name  string
+		tag   uint32
+		want  string
+		found bool
+	}{
+		{"patient name", tagPatientName, "ANONYMOUS^ANON000001", true},
+		{"patient id", tagPatientID, "ANON000001", true},
+		{"accession number", 0x00080050, "", true},
+		{"consulting physician", 0x0008009C, "", true},
+		{"responsible person", 0x00102297, "", true},
+		{"placer order", 0x00402016, "", true},
+		{"filler order", 0x00402017, "", true},
+		{"verifying observer", 0x0040A075, "ANONYMOUS", true},
+		{"person name", 0x0040A123, "ANONYMOUS", true},
+		{"scheduled physician", 0x00400006, "", false},
+		{"intended recipients", 0x00401010, "", false},
+		{"unlisted person name", 0x00700084, "", false},
+		{"sop class", 0x00080016, sopClass, true},
+		{"identity removed", tagPatientIdentityRemoved, "YES", true},
+	}
+	for _, tt := range tests {
+		e := out.Dataset.Find(tt.tag)
+		if (e != nil) != tt.found {
+			t.Errorf("%s: found %v, want %v", tt.name, e != nil, tt.found)
+			continue
+		}
+		if got := out.Dataset.String(tt.tag); e != nil && got != tt.want {
+			t.Errorf("%s: %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// the UIDs are replaced consistently in the meta information and the dataset
+	for _, uid := range []string{study, series, instance} {
+		if !strings.HasPrefix(uid, "2.25.") {
+			t.Errorf("UID %q not replaced", uid)
+		}
+	}
+	if got := out.Meta.String(tagMediaStorageSOPInstanceUID); got != instance {
+		t.Errorf("media storage SOP instance UID %q, want %q", got, instance)
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"math"
+	"math/big"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/frame"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// distributions of the instance size
+const (
+	SizeFixed     = "fixed"
+	SizeUniform   = "uniform"
+	SizeNormal    = "normal"
+	SizeLogNormal = "lognormal"
+)
+
+// transfer syntax and implementation of generated files
+const (
+	explicitVRLittleEndian    = "1.2.840.10008.1.2.1"
+	implementationClassUID    = "1.2.826.0.1.3680043.10.1234.1"
+	implementationVersionName = "HTTPX_FOLDER"
+)
+
+// secondary capture classes used for modalities without a multi-frame storage class, frame time of multi-frame instances
+const (
+	secondaryCapture             = "1.2.840.10008.5.1.4.1.1.7"
+	multiFrameGrayscaleWordSC    = "1.2.840.10008.5.1.4.1.1.7.3"
+	multiFrameTrueColorSC        = "1.2.840.10008.5.1.4.1.1.7.4"
+	conversionTypeSyntheticImage = "SYN"
+	multiFrameTimeMilliseconds   = "40"
+)
+
+// Type representing the storage class and image type of a modality
+type ModalityInfo struct {
+	SOPClassUID string
+	// storage class of instances with more than one frame
+	MultiFrameSOPClassUID string
+	// color modalities are written as 8 bit RGB, all others as 16 bit MONOCHROME2
+	Color    bool
+	BodyPart string
+}
+
+// supported modalities
+var Modalities = map[string]ModalityInfo{
+	"CT": {SOPClassUID: "1.2.840.10008.5.1.4.1.1.2", MultiFrameSOPClassUID: multiFrameGrayscaleWordSC, BodyPart: "CHEST"},
+	"MR": {SOPClassUID: "1.2.840.10008.5.1.4.1.1.4", MultiFrameSOPClassUID: multiFrameGrayscaleWordSC, BodyPart: "HEAD"},
+	"CR": {SOPClassUID: "1.2.840.10008.5.1.4.1.1.1", MultiFrameSOPClassUID: multiFrameGrayscaleWordSC, BodyPart: "CHEST"},
+	"DX": {SOPClassUID: "1.2.840.10008.5.1.4.1.1.1.1", MultiFrameSOPClassUID: multiFrameGrayscaleWordSC, BodyPart: "CHEST"},
+	"MG": {SOPClassUID: "1.2.840.10008.5.1.4.1.1.1.2", MultiFrameSOPClassUID: multiFrameGrayscaleWordSC, BodyPart: "BREAST"},
+	"US": {SOPClassUID: "1.2.840.10008.5.1.4.1.1.6.1", MultiFrameSOPClassUID: "1.2.840.10008.5.1.4.1.1.3.1", Color: true, BodyPart: "ABDOMEN"},
+	"XA": {SOPClassUID: "1.2.840.10008.5.1.4.1.1.12.1", MultiFrameSOPClassUID: "1.2.840.10008.5.1.4.1.1.12.1", BodyPart: "HEART"},
+	"OT": {SOPClassUID: secondaryCapture, MultiFrameSOPClassUID: multiFrameTrueColorSC, Color: true},
+}
+
+// SOPClass returns the storage class of an instance with the number of frames
+func (m ModalityInfo) SOPClass(frames int) string {
+	if frames > 1 {
+		return m.MultiFrameSOPClassUID
+	}
+	return m.SOPClassUID
+}
+
+// isSecondaryCapture is true for the classes needing the SC equipment module
+func isSecondaryCapture(sopClassUID string) bool {
+	return sopClassUID == secondaryCapture || strings.HasPrefix(sopClassUID, secondaryCapture+".")
+}
+
+// Type representing the parameters of a synthetic dataset
+type GenerateOptions struct {
+	Studies   int
+	Series    int
+	Instances int
+	Modality  string
+	Rows      int
+	Columns   int
+	// mean instance size in bytes, 0 for one frame per instance
+	Size int64
+	// distribution of the instance size and spread relative to the mean
+	SizeDist   string
+	SizeSpread float64
+	Seed       int64
+}
+
+// ParseMatrix parses pixel dimensions like 512x512 (rows x columns)
+func ParseMatrix(matrix string) (int, int, error) {
+	values := strings.Split(strings.ToLower(matrix), "x")
+	if len(values) != 2 {
+		return 0, 0, fmt.Errorf("invalid matrix %q, use rows x columns like 512x512", matrix)
+	}
+	rows, errRows := strconv.Atoi(values[0])
+	columns, errColumns := strconv.Atoi(values[1])
+	if errRows != nil || errColumns != nil || rows < 1 || columns < 1 || rows > math.MaxUint16 || columns > math.MaxUint16 {
+		return 0, 0, fmt.Errorf("invalid matrix %q, use rows x columns like 512x512", matrix)
+	}
+	return rows, columns, nil
+}
+
+// Type representing the generation of synthetic studies with reproducible content
+type Generator struct {
+	opts     GenerateOptions
+	modality ModalityInfo
+	random   *rand.Rand
+	// base date of the studies
+	date time.Time
+}
+
+func NewGenerator(opts GenerateOptions) (*Generator, error) {
+	modality, ok := Modalities[strings.ToUpper(opts.Modality)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported modality %q", opts.Modality)
+	}
+	opts.Modality = strings.ToUpper(opts.Modality)
+	switch opts.SizeDist {
+	case SizeFixed, SizeUniform, SizeNormal, SizeLogNormal:
+	default:
+		return nil, fmt.Errorf("unsupported size distribution %q", opts.SizeDist)
+	}
+	if opts.Studies < 1 || opts.Series < 1 || opts.Instances < 1 {
+		return nil, fmt.Errorf("studies, series and instances must be at least 1")
+	}
+	if modality.Color && opts.Rows*opts.Columns%2 == 1 {
+		return nil, fmt.Errorf("matrix %dx%d gives an odd pixel data length for RGB", opts.Rows, opts.Columns)
+	}
+	g := &Generator{opts: opts, modality: modality, random: rand.New(rand.NewSource(opts.Seed))}
+	g.date = time.Date(2000, 1, 1, 8, 0, 0, 0, time.UTC).AddDate(0, 0, g.random.Intn(365*20))
+	return g, nil
+}
+
+// NewUID returns a UID below the 2.25 root derived from 128 random bits (PS3.5 B.2)
+func (g *Generator) NewUID() string {
+	b := make([]byte, 16)
+	g.random.Read(b)
+	return "2.25." + new(big.Int).SetBytes(b).String()
+}
+
+// frameSize returns the bytes of one frame
+func (g *Generator) frameSize() int64 {
+	if g.modality.Color {
+		return int64(g.opts.Rows * g.opts.Columns * 3)
+	}
+	return int64(g.opts.Rows * g.opts.Columns * 2)
+}
+
+// frames draws the instance size from the distribution and returns the number of frames to reach it
+func (g *Generator) frames() int {
+	if g.opts.Size <= 0 {
+		return 1
+	}
+	mean := float64(g.opts.Size)
+	size := mean
+	switch g.opts.SizeDist {
+	case SizeUniform:
+		size = mean * (1 + g.opts.SizeSpread*(2*g.random.Float64()-1))
+	case SizeNormal:
+		size = mean * (1 + g.opts.SizeSpread*g.random.NormFloat64())
+	case SizeLogNormal:
+		// median is the mean size, spread is the sigma of the logarithm
+		size = mean * math.Exp(g.opts.SizeSpread*g.random.NormFloat64())
+	}
+	return int(math.Max(1, math.Round(size/float64(g.frameSize()))))
+}
+
+// Generate writes all studies in the Study/Series/Instance.dcm layout
+func (g *Generator) Generate(dirout string) error {
+	log.Println("Generating ", g.opts.Studies, " studies with ", g.opts.Series, " series of ", g.opts.Instances, " ", g.opts.Modality,
+		" instances ", g.opts.Rows, "x", g.opts.Columns, " size: ", g.opts.Size, " ", g.opts.SizeDist, " seed: ", g.opts.Seed)
+	s := time.Now()
+	var files int
+	var size int64
+	for st := 0; st < g.opts.Studies; st++ {
+		study := g.newStudy(st)
+		for se := 0; se < g.opts.Series; se++ {
+			series := study.newSeries(g, se)
+			directoryname := filepath.Join(dirout, study.uid, series.uid)
+			if err := os.MkdirAll(directoryname, os.ModePerm); err != nil {
+				return err
+			}
+			for in := 0; in < g.opts.Instances; in++ {
+				sFile := time.Now()
+				filename, n, err := g.writeInstance(directoryname, study, series, in)
+				if err != nil {
+					return err
+				}
+				files++
+				size += n
+				log.Println(" Result File: ", filename, " now available with size:", n, " in: ", time.Since(sFile))
+			}
+		}
+	}
+	log.Println("Generated files: ", files, " size: ", size, " time total taken: ", time.Since(s))
+	return nil
+}
+
+// Type representing the study level attributes of a synthetic study
+type syntheticStudy struct {
+	uid       string
+	patient   int
+	date      time.Time
+	accession string
+	id        string
+	sex       string
+	birthDate time.Time
+}
+
+// Type representing the series level attributes of a synthetic series
+type syntheticSeries struct {
+	uid              string
+	frameOfReference string
+	number           int
+}
+
+func (g *Generator) newStudy(index int) *syntheticStudy {
+	sex := "F"
+	if g.random.Intn(2) == 1 {
+		sex = "M"
+	}
+	date := g.date.AddDate(0, 0, index).Add(time.Duration(g.random.Intn(10*3600)) * time.Second)
+	return &syntheticStudy{
+		uid:       g.NewUID(),
+		patient:   g.random.Intn(1000000),
+		date:      date,
+		accession: fmt.Sprintf("ACC%08d", g.random.Intn(100000000)),
+		id:        strconv.Itoa(index + 1),
+		sex:       sex,
+		birthDate: date.AddDate(-18-g.random.Intn(70), -g.random.Intn(12), -g.random.Intn(28)),
+	}
+}
+
+func (s *syntheticStudy) newSeries(g *Generator, index int) *syntheticSeries {
+	return &syntheticSeries{uid: g.NewUID(), frameOfReference: g.NewUID(), number: index + 1}
+}
+
+// writeInstance writes one instance, returns the file name and size
+func (g *Generator) writeInstance(dir string, study *syntheticStudy, series *syntheticSeries, index int) (string, int64, error) {
+	sopInstanceUID := g.NewUID()
+	frames := g.frames()
+	ds, err := g.dataset(study, series, sopInstanceUID, index, frames)
+	if err != nil {
+		return "", 0, err
+	}
+	filename := filepath.Join(dir, sopInstanceUID+".dcm")
+	file, err := os.Create(filename)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+	writer := bufio.NewWriter(file)
+	if err := dicom.Write(writer, ds); err != nil {
+		return "", 0, err
+	}
+	if err := writer.Flush(); err != nil {
+		return "", 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return "", 0, err
+	}
+	return filename, info.Size(), nil
+}
+
+// dataset builds the meta information, patient, study, series, image and pixel data
+func (g *Generator) dataset(study *syntheticStudy, series *syntheticSeries, sopInstanceUID string, index int, frames int) (dicom.Dataset, error) {
+	date := study.date.Format("20060102")
+	contentTime := study.date.Add(time.Duration(series.number*60+index) * time.Second).Format("150405")
+	samples, photometric, bits, stored := 1, "MONOCHROME2", 16, 12
+	sopClassUID := g.modality.SOPClass(frames)
+	if g.modality.Color {
+		samples, photometric, bits, stored = 3, "RGB", 8, 8
+	}
+	values := []struct {
+		t    tag.Tag
+		data interface{}
+	}{
+		{tag.FileMetaInformationVersion, []byte{0, 1}},
+		{tag.MediaStorageSOPClassUID, []string{sopClassUID}},
+		{tag.MediaStorageSOPInstanceUID, []string{sopInstanceUID}},
+		{tag.TransferSyntaxUID, []string{explicitVRLittleEndian}},
+		{tag.ImplementationClassUID, []string{implementationClassUID}},
+		{tag.ImplementationVersionName, []string{implementationVersionName}},
+		{tag.SpecificCharacterSet, []string{"ISO_IR 100"}},
+		{tag.ImageType, []string{"ORIGINAL", "PRIMARY", "AXIAL"}},
+		{tag.SOPClassUID, []string{sopClassUID}},
+		{tag.SOPInstanceUID, []string{sopInstanceUID}},
+		{tag.StudyDate, []string{date}},
+		{tag.SeriesDate, []string{date}},
+		{tag.ContentDate, []string{date}},
+		{tag.StudyTime, []string{study.date.Format("150405")}},
+		{tag.ContentTime, []string{contentTime}},
+		{tag.AccessionNumber, []string{study.accession}},
+		{tag.Modality, []string{g.opts.Modality}},
+		{tag.ConversionType, []string{conversionTypeSyntheticImage}},
+		{tag.Manufacturer, []string{"HTTPX SYNTHETIC"}},
+		{tag.InstitutionName, []string{"HTTPX TEST SITE"}},
+		{tag.ReferringPhysicianName, []string{""}},
+		{tag.StudyDescription, []string{"SYNTHETIC " + g.opts.Modality + " STUDY"}},
+		{tag.SeriesDescription, []string{fmt.Sprintf("SYNTHETIC SERIES %d", series.number)}},
+		{tag.PatientName, []string{fmt.Sprintf("SYNTHETIC^PATIENT%06d", study.patient)}},
+		{tag.PatientID, []string{fmt.Sprintf("SYN%06d", study.patient)}},
+		{tag.PatientBirthDate, []string{study.birthDate.Format("20060102")}},
+		{tag.PatientSex, []string{study.sex}},
+		{tag.BodyPartExamined, []string{g.modality.BodyPart}},
+		{tag.SliceThickness, []string{"1"}},
+		{tag.FrameTime, []string{multiFrameTimeMilliseconds}},
+		{tag.StudyInstanceUID, []string{study.uid}},
+		{tag.SeriesInstanceUID, []string{series.uid}},
+		{tag.StudyID, []string{study.id}},
+		{tag.SeriesNumber, []string{strconv.Itoa(series.number)}},
+		{tag.InstanceNumber, []string{strconv.Itoa(index + 1)}},
+		{tag.ImagePositionPatient, []string{"0", "0", strconv.Itoa(index)}},
+		{tag.ImageOrientationPatient, []string{"1", "0", "0", "0", "1", "0"}},
+		{tag.FrameOfReferenceUID, []string{series.frameOfReference}},
+		{tag.SamplesPerPixel, []int{samples}},
+		{tag.PhotometricInterpretation, []string{photometric}},
+	}
+	var elements []*dicom.Element
+	for _, v := range values {
+		if v.t == tag.ConversionType && !isSecondaryCapture(sopClassUID) || v.t == tag.FrameTime && frames == 1 {
+			continue
+		}
+		e, err := dicom.NewElement(v.t, v.data)
+		if err != nil {
+			return dicom.Dataset{}, fmt.Errorf("element %s: %w", tag.DebugString(v.t), err)
+		}
+		elements = append(elements, e)
+	}
+
+	// image pixel module, multi-frame instances advance by the frame time
+	image := []struct {
+		t    tag.Tag
+		data interface{}
+	}{
+		{tag.NumberOfFrames, []string{strconv.Itoa(frames)}},
+		{tag.FrameIncrementPointer, []int{int(tag.FrameTime.Group), int(tag.FrameTime.Element)}},
+		{tag.Rows, []int{g.opts.Rows}},
+		{tag.Columns, []int{g.opts.Columns}},
+		{tag.PixelSpacing, []string{"0.5", "0.5"}},
+		{tag.BitsAllocated, []int{bits}},
+		{tag.BitsStored, []int{stored}},
+		{tag.HighBit, []int{stored - 1}},
+		{tag.PixelRepresentation, []int{0}},
+		{tag.WindowCenter, []string{"2048"}},
+		{tag.WindowWidth, []string{"4096"}},
+		{tag.RescaleIntercept, []string{"0"}},
+		{tag.RescaleSlope, []string{"1"}},
+		{tag.PixelData, dicom.PixelDataInfo{Frames: g.pixelFrames(frames, samples, bits, index)}},
+	}
+	for _, v := range image {
+		if g.modality.Color && (v.t == tag.WindowCenter || v.t == tag.WindowWidth || v.t == tag.RescaleIntercept || v.t == tag.RescaleSlope) {
+			continue
+		}
+		if (v.t == tag.NumberOfFrames || v.t == tag.FrameIncrementPointer) && frames == 1 {
+			continue
+		}
+		if v.t == tag.PixelData && g.modality.Color {
+			planar, _ := dicom.NewElement(tag.PlanarConfiguration, []int{0})
+			elements = append(elements, planar)
+		}
+		e, err := dicom.NewElement(v.t, v.data)
+		if err != nil {
+			return dicom.Dataset{}, fmt.Errorf("element %s: %w", tag.DebugString(v.t), err)
+		}
+		elements = append(elements, e)
+	}
+	return dicom.Dataset{Elements: elements}, nil
+}
+
+// pixelFrames draws a phantom (ellipse on a gradient) moving with the instance and frame, with noise
+func (g *Generator) pixelFrames(frames int, samples int, bits int, index int) []frame.Frame {
+	rows, columns := g.opts.Rows, g.opts.Columns
+	maxValue := 4095.0
+	if bits == 8 {
+		maxValue = 255
+	}
+	result := make([]frame.Frame, frames)
+	for f := range result {
+		data := make([][]int, rows*columns)
+		values := make([]int, rows*columns*samples)
+		phase := float64(index*frames+f) / 16
+		cy, cx := float64(rows)/2*(1+0.2*math.Sin(phase)), float64(columns)/2*(1+0.2*math.Cos(phase))
+		for y := 0; y < rows; y++ {
+			for x := 0; x < columns; x++ {
+				dy, dx := (float64(y)-cy)/(0.35*float64(rows)), (float64(x)-cx)/(0.3*float64(columns))
+				v := 0.15 + 0.1*float64(y)/float64(rows)
+				if dx*dx+dy*dy < 1 {
+					v = 0.6 + 0.2*math.Cos(4*dx)*math.Cos(4*dy)
+				}
+				p := y*columns + x
+				data[p] = values[p*samples : (p+1)*samples]
+				for s := 0; s < samples; s++ {
+					noisy := v*(1-0.15*float64(s)) + 0.02*g.random.NormFloat64()
+					data[p][s] = int(math.Max(0, math.Min(maxValue, noisy*maxValue)))
+				}
+			}
+		}
+		result[f] = frame.Frame{NativeData: frame.NativeFrame{Data: data, Rows: rows, Cols: columns, BitsPerSample: bits}}
+	}
+	return result
+}
@@ -2,9 +2,14 @@ module httpx-folder
 
 go 1.20
 
-require github.com/suyashkumar/dicom v1.0.5
+require (
+	github.com/suyashkumar/dicom v1.0.5
+	httpxcommon v0.0.0-00010101000000-000000000000
+)
 
 require (
 	github.com/google/go-cmp v0.5.8 // indirect
-	golang.org/x/text v0.3.7 // indirect
+	golang.org/x/text v0.11.0 // indirect
 )
+
+replace httpxcommon => ../httpxcommon
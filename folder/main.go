@@ -1,148 +1,130 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
-	"time"
 
-	"github.com/suyashkumar/dicom"
-	"github.com/suyashkumar/dicom/pkg/tag"
+	"httpxcommon/manifest"
+	"httpxcommon/sizes"
 )
 
-func CopyFile(src, dst string) (int64, error) {
+// CopyFile copies the file and returns the size and the hex encoded SHA-256 of the copied bytes
+func CopyFile(src, dst string) (int64, string, error) {
 	sourceFileStat, err := os.Stat(src)
 	if err != nil {
-		return 0, err
+		return 0, "", err
 	}
 
 	if !sourceFileStat.Mode().IsRegular() {
-		return 0, fmt.Errorf("%s is not a regular file", src)
+		return 0, "", fmt.Errorf("%s is not a regular file", src)
 	}
 
 	source, err := os.Open(src)
 	if err != nil {
-		return 0, err
+		return 0, "", err
 	}
 	defer source.Close()
 
 	destination, err := os.Create(dst)
 	if err != nil {
-		return 0, err
+		return 0, "", err
 	}
-	defer destination.Close()
-	nBytes, err := io.Copy(destination, source)
-	return nBytes, err
+	hash := sha256.New()
+	nBytes, err := io.Copy(io.MultiWriter(destination, hash), source)
+	if errClose := destination.Close(); err == nil {
+		err = errClose
+	}
+	return nBytes, hex.EncodeToString(hash.Sum(nil)), err
 }
 
-func PrepareFile(filelocation string, dirout string) error {
-	// parse file and move to target folder
-	if len(filelocation) > 0 {
-		f, err := os.Open(filelocation)
-		if err != nil {
-			log.Printf("Error opening file: %s\n", filelocation)
-			return err
-		}
-		defer f.Close()
+func main() {
+	// additional parameters
+	mode := flag.String("mode", "prepare", "mode to be used: prepare (place files of dirin) | generate (synthetic studies)")
+	dirin := flag.String("dirin", "", "directory to be used as input")
+	dirout := flag.String("dirout", "", "directory to be used as output")
+	studies := flag.Int("studies", 1, "generate: number of studies")
+	series := flag.Int("series", 3, "generate: number of series per study")
+	instances := flag.Int("instances", 10, "generate: number of instances per series")
+	modality := flag.String("modality", "CT", "generate: modality: CT | MR | CR | DX | MG | US | XA | OT")
+	matrix := flag.String("matrix", "512x512", "generate: pixel dimensions rows x columns")
+	size := flag.String("size", "", "generate: mean instance size like 2MB or 1.5M reached with multiple frames, empty for one frame per instance")
+	sizeDist := flag.String("size-dist", SizeFixed, "generate: distribution of the instance size: fixed | uniform | normal | lognormal")
+	sizeSpread := flag.Float64("size-spread", 0.5, "generate: spread of the instance size relative to the mean (sigma for normal and lognormal)")
+	workers := flag.Int("workers", runtime.NumCPU(), "prepare: number of files processed in parallel")
+	deidentify := flag.Bool("deidentify", false, "prepare: de-identify the files (PS3.15 Basic Application Level Confidentiality Profile), the output uses the new uids")
+	deidMap := flag.String("deid-map", "deid-mapping.csv", "prepare: mapping file of original and replaced uids and patient ids, kept outside of dirout")
+	placement := flag.String("placement", PlacementCopy, "prepare: how files reach dirout: copy | move | hardlink (same file system) | symlink (dirin must be kept)")
+	manifestName := flag.String("manifest", manifest.FileName, "name of the manifest in dirout with uid, size and SHA-256 of every instance, .csv for CSV, empty for none")
+	seed := flag.Int64("seed", 1, "generate: seed of the random generator, the same seed creates the same files")
+	flag.Parse()
+	if (*mode != "prepare" && *mode != "generate") || *dirout == "" || (*mode == "prepare" && *dirin == "") {
+		fmt.Println("Usage: httpx-folder.exe -dirin X -dirout Y")
+		fmt.Println("       httpx-folder.exe -mode generate -dirout Y")
+		fmt.Println("flags:")
+		flag.PrintDefaults()
+		fmt.Println("Examples:")
+		fmt.Println("Prepare folder: httpx-folder.exe -dirin d:\\in -dirout d:\\out")
+		fmt.Println("Prepare folder without copies: httpx-folder.exe -placement hardlink -manifest manifest.csv -dirin d:\\in -dirout d:\\out")
+		fmt.Println("Prepare de-identified folder: httpx-folder.exe -deidentify -deid-map d:\\secure\\mapping.csv -dirin d:\\in -dirout d:\\out")
+		fmt.Println("Generate 2 CT studies with 4 series of 100 instances: httpx-folder.exe -mode generate -studies 2 -series 4 -instances 100 -modality CT -matrix 512x512 -seed 42 -dirout d:\\out")
+		fmt.Println("Generate MG instances around 20MB: httpx-folder.exe -mode generate -modality MG -matrix 3328x2560 -size 20MB -size-dist lognormal -size-spread 0.3 -dirout d:\\out")
+		return
+	}
 
-		info, err := f.Stat()
-		if err != nil {
-			log.Println("err reading", err)
-			return err
+	// check output directory
+	_, err2 := os.Stat(*dirout)
+	if err2 != nil {
+		if os.IsNotExist(err2) {
+			// File or directory does not exist
+			panic("Directory " + *dirout + " does not exist. Please provide an existing directory !")
 		}
+	}
 
-		var ds *dicom.Dataset
-		data, err := dicom.Parse(f, info.Size(), nil)
+	// synthetic studies
+	if *mode == "generate" {
+		rows, columns, err := ParseMatrix(*matrix)
 		if err != nil {
-			log.Fatalf("error parsing data: %v", err)
-			return err
+			panic(err)
 		}
-		ds = &data
-
-		// In non-streaming frame mode, we need to find all PixelData elements and generate images.
-		log.Println(" File:: ", filelocation)
-		var studyinstanceuid, seriesinstanceuid, sopinstanceuid string
-		for _, elem := range ds.Elements {
-			if elem.Tag == tag.StudyInstanceUID {
-				studyinstanceuid = strings.Trim(elem.Value.String(), "[]")
-				log.Println("   StudyInstanceUID: ", studyinstanceuid)
-			} else if elem.Tag == tag.SeriesInstanceUID {
-				seriesinstanceuid = strings.Trim(elem.Value.String(), "[]")
-				log.Println("   SeriesInstanceUID: ", seriesinstanceuid)
-			} else if elem.Tag == tag.SOPInstanceUID {
-				sopinstanceuid = strings.Trim(elem.Value.String(), "[]")
-				log.Println("   SOPInstanceUID: ", sopinstanceuid)
-			}
-		}
-		// create directory
-		if len(studyinstanceuid) > 0 && len(seriesinstanceuid) > 0 && len(sopinstanceuid) > 0 {
-			// create target directory
-			directoryname := filepath.Join(dirout, studyinstanceuid)
-			_ = os.Mkdir(directoryname, os.ModePerm)
-			directoryname = filepath.Join(directoryname, seriesinstanceuid)
-			_ = os.Mkdir(directoryname, os.ModePerm)
-
-			// copy file to target and rename
-			filetarget := filepath.Join(directoryname, sopinstanceuid+".dcm")
-			nBytes, err := CopyFile(filelocation, filetarget)
+		var meanSize int64
+		if len(*size) > 0 {
+			n, err := sizes.Parse(*size)
 			if err != nil {
-				log.Println("  Copy failed from:", filelocation, " to:", filetarget)
-				return err
+				panic(err)
 			}
-			log.Println(" Result File: ", filetarget, " now available with size:", nBytes)
-		} else {
-			log.Println("  Ignoring file with wrong DICOM tags: ", filelocation)
+			if n > math.MaxInt64 {
+				panic(fmt.Sprintf("size %q too large", *size))
+			}
+			meanSize = int64(n)
 		}
-	}
-	return nil
-}
-
-func PrepareDirectory(dirin string, dirout string) error {
-	// build path
-	log.Println("Processing directory: ", dirin)
-	s := time.Now()
-
-	// walk through all files
-	errWalk := filepath.Walk(dirin, func(path string, info os.FileInfo, err error) error {
+		generator, err := NewGenerator(GenerateOptions{Studies: *studies, Series: *series, Instances: *instances, Modality: *modality,
+			Rows: rows, Columns: columns, Size: meanSize, SizeDist: *sizeDist, SizeSpread: *sizeSpread, Seed: *seed})
 		if err != nil {
-			log.Println("No files in directory: ", path, err)
-			return err
+			panic(err)
 		}
-
-		// process every file
-		if !info.IsDir() {
-			sFile := time.Now()
-			err := PrepareFile(path, dirout)
+		if err := generator.Generate(*dirout); err != nil {
+			log.Println("Error in generating studies:", err)
+			os.Exit(1)
+		}
+		if len(*manifestName) > 0 {
+			m, err := manifest.Build(*dirout)
+			if err == nil {
+				err = m.Write(filepath.Join(*dirout, *manifestName))
+			}
 			if err != nil {
-				log.Println("Error processing file: ", path, err)
+				log.Println("Error writing manifest:", err)
+				os.Exit(1)
 			}
-			log.Println("Reading file: ", path, " in: ", time.Since(sFile))
 		}
-		return nil
-	})
-	if errWalk != nil {
-		log.Println("No files in directory: ", dirin)
-		return errWalk
-	}
-	log.Println("Time total taken: ", time.Since(s))
-	return nil
-}
-
-func main() {
-	// additional parameters
-	dirin := flag.String("dirin", "", "directory to be used as input")
-	dirout := flag.String("dirout", "", "directory to be used as output")
-	flag.Parse()
-	if *dirin == "" || *dirout == "" {
-		fmt.Println("Usage: httpx-folder.exe -dirin X -dirout Y")
-		fmt.Println("flags:")
-		flag.PrintDefaults()
-		fmt.Println("Examples:")
-		fmt.Println("Prepare folder: httpx-folder.exe -dirin d:\\in -dirout d:\\out")
 		return
 	}
 
@@ -155,17 +137,43 @@ func main() {
 		}
 	}
 
-	// check input directory
-	_, err2 := os.Stat(*dirout)
-	if err2 != nil {
-		if os.IsNotExist(err2) {
-			// File or directory does not exist
-			panic("Directory " + *dirout + " does not exist. Please provide an existing directory !")
+	// de-identified content is always written, links would expose the original files
+	switch *placement {
+	case PlacementCopy, PlacementMove:
+	case PlacementHardlink, PlacementSymlink:
+		if *deidentify {
+			panic("Placement " + *placement + " cannot be combined with -deidentify, use copy or move")
 		}
+	default:
+		panic("Unknown placement " + *placement + ", use copy | move | hardlink | symlink")
+	}
+
+	// optional de-identification, the mapping is kept aside
+	var deid *Deidentifier
+	if *deidentify {
+		if rel, err := filepath.Rel(*dirout, *deidMap); err == nil && !strings.HasPrefix(rel, "..") {
+			log.Println("Warning: mapping file ", *deidMap, " is written into the output directory")
+		}
+		var err error
+		if deid, err = NewDeidentifier(*deidMap); err != nil {
+			panic(err)
+		}
+		defer func() {
+			if err := deid.Close(); err != nil {
+				log.Println("Error writing mapping file:", err)
+			}
+		}()
 	}
 
 	// check input directory
-	err3 := PrepareDirectory(*dirin, *dirout)
+	if *workers < 1 {
+		*workers = 1
+	}
+	preparer, err := NewPreparer(*dirout, deid, *placement, *manifestName)
+	if err != nil {
+		panic(err)
+	}
+	err3 := preparer.PrepareDirectory(*dirin, *workers)
 	if err3 != nil {
 		log.Println("Error in processing directory:", err3)
 	}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"httpxcommon/dicomfile"
+	"httpxcommon/manifest"
+
+	"github.com/suyashkumar/dicom"
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// outcomes of preparing a file
+const (
+	OutcomeWritten = "written"
+	// identical file already present from an earlier run
+	OutcomePresent = "present"
+	// identical instance already prepared from another file of this run
+	OutcomeDuplicate = "duplicate"
+	// same instance uid with different content, the existing file is kept
+	OutcomeConflict = "conflict"
+	// not parseable or without uids
+	OutcomeRejected = "rejected"
+)
+
+// placement of the files in the output directory
+const (
+	PlacementCopy = "copy"
+	// renamed, copied and removed across file systems
+	PlacementMove     = "move"
+	PlacementHardlink = "hardlink"
+	// absolute link to the input file
+	PlacementSymlink = "symlink"
+)
+
+// suffix of files being written, renamed when complete
+const partialSuffix = ".partial"
+
+// Type representing the result of preparing one file
+type PrepareResult struct {
+	Source   string
+	Target   string
+	Study    string
+	Series   string
+	Instance string
+	Outcome  string
+	Size     int64
+	Digest   string
+	Err      error
+}
+
+// Type representing the preparation of a directory with parallel workers
+type Preparer struct {
+	dirout    string
+	deid      *Deidentifier
+	placement string
+	// manifest of the output tree, nil if not written
+	manifest     *manifest.Manifest
+	manifestPath string
+	report       *PrepareReport
+	mu           sync.Mutex
+	// targets handled in this run and the locks of the targets being placed
+	seen  map[string]bool
+	locks map[string]*targetLock
+}
+
+// Type representing the lock of a target and the workers holding or waiting for it
+type targetLock struct {
+	sync.Mutex
+	refs int
+}
+
+// NewPreparer continues the manifest of earlier runs if present, an empty manifest name writes none
+func NewPreparer(dirout string, deid *Deidentifier, placement string, manifestName string) (*Preparer, error) {
+	p := &Preparer{dirout: dirout, deid: deid, placement: placement, report: NewPrepareReport(), seen: make(map[string]bool), locks: make(map[string]*targetLock)}
+	if len(manifestName) == 0 {
+		return p, nil
+	}
+	p.manifestPath = filepath.Join(dirout, manifestName)
+	m, err := manifest.Read(p.manifestPath)
+	switch {
+	case err == nil:
+		p.manifest = m
+	case errors.Is(err, os.ErrNotExist):
+		p.manifest = manifest.New()
+	default:
+		return nil, err
+	}
+	return p, nil
+}
+
+// PrepareDirectory walks the input directory and prepares all files with the number of workers
+func (p *Preparer) PrepareDirectory(dirin string, workers int) error {
+	log.Println("Processing directory: ", dirin, " with workers: ", workers)
+	s := time.Now()
+	paths := make(chan string, 4*workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				sFile := time.Now()
+				result := p.PrepareFile(path)
+				p.report.Add(result)
+				if p.manifest != nil && len(result.Digest) > 0 {
+					p.manifest.Add(manifest.NewEntry(p.dirout, result.Target, result.Digest, result.Size))
+				}
+				if result.Err != nil {
+					log.Println(" File:: ", path, " ", result.Outcome, ": ", result.Err, " in: ", time.Since(sFile))
+				} else {
+					log.Println(" File:: ", path, " ", result.Outcome, ": ", result.Target, " size: ", result.Size, " in: ", time.Since(sFile))
+				}
+			}
+		}()
+	}
+
+	// unreadable directories are listed and skipped
+	errWalk := filepath.Walk(dirin, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == dirin {
+				return err
+			}
+			p.report.Add(PrepareResult{Source: path, Outcome: OutcomeRejected, Err: err})
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() {
+			paths <- path
+		}
+		return nil
+	})
+	close(paths)
+	wg.Wait()
+	if errWalk != nil {
+		log.Println("No files in directory: ", dirin)
+		return errWalk
+	}
+	p.report.Print(os.Stdout, time.Since(s))
+	if p.manifest != nil {
+		if err := p.manifest.Write(p.manifestPath); err != nil {
+			return fmt.Errorf("writing manifest: %w", err)
+		}
+		log.Println("Manifest: ", p.manifestPath, " instances: ", p.manifest.Len())
+	}
+	return nil
+}
+
+// PrepareFile parses the file and places it into the StudyInstanceUid/SeriesInstanceUid/InstanceUid.dcm layout
+func (p *Preparer) PrepareFile(filelocation string) (result PrepareResult) {
+	result = PrepareResult{Source: filelocation, Outcome: OutcomeRejected}
+	defer func() {
+		// the parser may panic on damaged files
+		if r := recover(); r != nil {
+			result.Outcome = OutcomeRejected
+			result.Err = fmt.Errorf("parser failed: %v", r)
+		}
+	}()
+
+	// parse file and read the uids, de-identified files are parsed once and stored with the new uids
+	var studyinstanceuid, seriesinstanceuid, sopinstanceuid string
+	var content []byte
+	var f *dicomfile.File
+	var err error
+	if p.deid != nil {
+		f, err = readFile(filelocation)
+		if f != nil {
+			studyinstanceuid, seriesinstanceuid, sopinstanceuid = f.Dataset.String(tagStudyInstanceUID), f.Dataset.String(tagSeriesInstanceUID), f.Dataset.String(tagSOPInstanceUID)
+		}
+	} else {
+		studyinstanceuid, seriesinstanceuid, sopinstanceuid, err = readUIDs(filelocation)
+	}
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	if len(studyinstanceuid) == 0 || len(seriesinstanceuid) == 0 || len(sopinstanceuid) == 0 {
+		result.Err = fmt.Errorf("missing study, series or instance uid")
+		return result
+	}
+	if f != nil {
+		content, studyinstanceuid, seriesinstanceuid, sopinstanceuid, err = p.deid.Deidentify(f)
+		if err != nil {
+			result.Err = fmt.Errorf("de-identification failed: %w", err)
+			return result
+		}
+	}
+	result.Study, result.Series, result.Instance = studyinstanceuid, seriesinstanceuid, sopinstanceuid
+
+	// create target directory
+	directoryname := filepath.Join(p.dirout, studyinstanceuid, seriesinstanceuid)
+	if err := os.MkdirAll(directoryname, os.ModePerm); err != nil {
+		result.Err = err
+		return result
+	}
+	result.Target = filepath.Join(directoryname, sopinstanceuid+".dcm")
+	result.Outcome, result.Size, result.Digest, result.Err = p.place(filelocation, result.Target, content)
+	return result
+}
+
+// readFile reads and parses the whole file for the de-identification
+func readFile(filelocation string) (*dicomfile.File, error) {
+	data, err := os.ReadFile(filelocation)
+	if err != nil {
+		return nil, err
+	}
+	f, err := dicomfile.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing data: %w", err)
+	}
+	return f, nil
+}
+
+// readUIDs returns the study, series and instance uid of a file
+func readUIDs(filelocation string) (string, string, string, error) {
+	f, err := os.Open(filelocation)
+	if err != nil {
+		return "", "", "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", "", "", err
+	}
+	data, err := dicom.Parse(f, info.Size(), nil)
+	if err != nil {
+		return "", "", "", fmt.Errorf("error parsing data: %w", err)
+	}
+	var studyinstanceuid, seriesinstanceuid, sopinstanceuid string
+	for _, elem := range data.Elements {
+		if elem.Tag == tag.StudyInstanceUID {
+			studyinstanceuid = strings.Trim(elem.Value.String(), "[]")
+		} else if elem.Tag == tag.SeriesInstanceUID {
+			seriesinstanceuid = strings.Trim(elem.Value.String(), "[]")
+		} else if elem.Tag == tag.SOPInstanceUID {
+			sopinstanceuid = strings.Trim(elem.Value.String(), "[]")
+		}
+	}
+	return studyinstanceuid, seriesinstanceuid, sopinstanceuid, nil
+}
+
+// lockTarget serializes the workers preparing the same instance, the lock is removed when no worker needs it
+func (p *Preparer) lockTarget(target string) func() {
+	p.mu.Lock()
+	l, ok := p.locks[target]
+	if !ok {
+		l = &targetLock{}
+		p.locks[target] = l
+	}
+	l.refs++
+	p.mu.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		p.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(p.locks, target)
+		}
+		p.mu.Unlock()
+	}
+}
+
+// place puts the source or the content at the target unless the target is already present, the digest is the SHA-256 of the target
+func (p *Preparer) place(source string, target string, content []byte) (string, int64, string, error) {
+	unlock := p.lockTarget(target)
+	defer unlock()
+	p.mu.Lock()
+	seen := p.seen[target]
+	p.seen[target] = true
+	p.mu.Unlock()
+
+	// existing files and links are never overwritten, also links of earlier runs to missing files
+	if _, err := os.Lstat(target); err == nil {
+		info, err := os.Stat(target)
+		if err != nil {
+			return OutcomeRejected, 0, "", err
+		}
+		same, digest, err := sameContent(target, info.Size(), source, content)
+		switch {
+		case err != nil:
+			return OutcomeRejected, 0, "", err
+		case !same:
+			return OutcomeConflict, info.Size(), digest, fmt.Errorf("different content than %s", target)
+		}
+		// the identical source is consumed by a move unless the target is a link to it
+		if p.placement == PlacementMove {
+			linked, err := isLinkTo(target, source)
+			switch {
+			case err != nil:
+				log.Println(" Cannot check moved file: ", source, ": ", err)
+			case linked:
+				log.Println(" Keeping moved file: ", source, " linked from: ", target)
+			default:
+				if err := os.Remove(source); err != nil {
+					log.Println(" Cannot remove moved file: ", source, ": ", err)
+				}
+			}
+		}
+		if seen {
+			return OutcomeDuplicate, info.Size(), digest, nil
+		}
+		return OutcomePresent, info.Size(), digest, nil
+	}
+
+	var n int64
+	var digest string
+	var err error
+	switch {
+	case content != nil:
+		n, digest, err = writePartial(target, func(partial string) (int64, string, error) {
+			n, err := writeFile(partial, content)
+			sum := sha256.Sum256(content)
+			return n, hex.EncodeToString(sum[:]), err
+		})
+		if err == nil && p.placement == PlacementMove {
+			err = os.Remove(source)
+		}
+	case p.placement == PlacementMove:
+		if err = os.Rename(source, target); err == nil {
+			digest, n, err = manifest.FileDigest(target)
+		} else if errors.Is(err, syscall.EXDEV) {
+			// other file system
+			if n, digest, err = writePartial(target, func(partial string) (int64, string, error) { return CopyFile(source, partial) }); err == nil {
+				err = os.Remove(source)
+			}
+		}
+	case p.placement == PlacementHardlink:
+		if err = os.Link(source, target); err == nil {
+			digest, n, err = manifest.FileDigest(target)
+		}
+	case p.placement == PlacementSymlink:
+		var abs string
+		if abs, err = filepath.Abs(source); err == nil {
+			if err = os.Symlink(abs, target); err == nil {
+				digest, n, err = manifest.FileDigest(target)
+			}
+		}
+	default:
+		n, digest, err = writePartial(target, func(partial string) (int64, string, error) { return CopyFile(source, partial) })
+	}
+	if err != nil {
+		return OutcomeRejected, n, "", err
+	}
+	return OutcomeWritten, n, digest, nil
+}
+
+// isLinkTo is true if the target is a symbolic link resolving to the source, removing the source would leave it dangling
+func isLinkTo(target string, source string) (bool, error) {
+	link, err := os.Lstat(target)
+	if err != nil || link.Mode()&os.ModeSymlink == 0 {
+		return false, err
+	}
+	resolved, err := os.Stat(target)
+	if err != nil {
+		return false, err
+	}
+	info, err := os.Stat(source)
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(resolved, info), nil
+}
+
+// writePartial writes into a partial file renamed when complete, an aborted run leaves no truncated instances
+func writePartial(target string, write func(partial string) (int64, string, error)) (int64, string, error) {
+	partial := target + partialSuffix
+	n, digest, err := write(partial)
+	if err == nil {
+		err = os.Rename(partial, target)
+	}
+	if err != nil {
+		os.Remove(partial)
+	}
+	return n, digest, err
+}
+
+// sameContent compares the target with the source file or the content using SHA-256 and returns the digest of the target
+func sameContent(target string, size int64, source string, content []byte) (bool, string, error) {
+	digestTarget, _, err := manifest.FileDigest(target)
+	if err != nil {
+		return false, "", err
+	}
+	if content != nil {
+		sum := sha256.Sum256(content)
+		return int64(len(content)) == size && digestTarget == hex.EncodeToString(sum[:]), digestTarget, nil
+	}
+	info, err := os.Stat(source)
+	if err != nil || info.Size() != size {
+		return false, digestTarget, err
+	}
+	digestSource, _, err := manifest.FileDigest(source)
+	return digestTarget == digestSource, digestTarget, err
+}
+
+// Type representing the summary of a preparation run
+type PrepareReport struct {
+	mu        sync.Mutex
+	studies   map[string]bool
+	series    map[string]bool
+	instances map[string]bool
+	outcomes  map[string]int
+	bytes     int64
+	conflicts []PrepareResult
+	rejected  []PrepareResult
+}
+
+func NewPrepareReport() *PrepareReport {
+	return &PrepareReport{studies: make(map[string]bool), series: make(map[string]bool), instances: make(map[string]bool), outcomes: make(map[string]int)}
+}
+
+func (r *PrepareReport) Add(result PrepareResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.outcomes[result.Outcome]++
+	switch result.Outcome {
+	case OutcomeRejected:
+		r.rejected = append(r.rejected, result)
+		return
+	case OutcomeConflict:
+		r.conflicts = append(r.conflicts, result)
+		return
+	case OutcomeWritten:
+		r.bytes += result.Size
+	}
+	r.studies[result.Study] = true
+	r.series[result.Study+"/"+result.Series] = true
+	r.instances[result.Target] = true
+}
+
+// Print writes the counts and lists conflicts and rejected files
+func (r *PrepareReport) Print(w io.Writer, duration time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var b bytes.Buffer
+	fmt.Fprintln(&b, "Report:")
+	fmt.Fprintf(&b, "  studies: %d series: %d instances: %d\n", len(r.studies), len(r.series), len(r.instances))
+	fmt.Fprintf(&b, "  written: %d (%d bytes) present: %d duplicates: %d conflicts: %d rejected: %d\n", r.outcomes[OutcomeWritten], r.bytes,
+		r.outcomes[OutcomePresent], r.outcomes[OutcomeDuplicate], r.outcomes[OutcomeConflict], r.outcomes[OutcomeRejected])
+	fmt.Fprintf(&b, "  time total taken: %s\n", duration)
+	for _, list := range []struct {
+		name    string
+		results []PrepareResult
+	}{{"Conflicts (existing file kept)", r.conflicts}, {"Rejected files", r.rejected}} {
+		if len(list.results) == 0 {
+			continue
+		}
+		sort.Slice(list.results, func(i, j int) bool { return list.results[i].Source < list.results[j].Source })
+		fmt.Fprintln(&b, list.name+":")
+		for _, result := range list.results {
+			fmt.Fprintf(&b, "  %s: %v\n", result.Source, result.Err)
+		}
+	}
+	w.Write(b.Bytes())
+}
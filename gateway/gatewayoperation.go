@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"httpxcommon/listeners"
+	"httpxcommon/partscommon"
+
+	"k8s.io/klog"
+)
+
+// hop-by-hop headers not forwarded in any direction
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// size of the buffer used to pass the bodies through
+const forwardBufferSize = 64 * 1024
+
+// Type representing the timing of both legs of a forwarded request
+type LegTiming struct {
+	Count int `json:"count"`
+	// time blocked reading the request body from the client
+	DownstreamRead time.Duration `json:"downstreamRead"`
+	// time from sending the request until the upstream response header (includes the request body)
+	UpstreamHeader time.Duration `json:"upstreamHeader"`
+	// time blocked reading the response body from the upstream
+	UpstreamRead time.Duration `json:"upstreamRead"`
+	// time blocked writing the response body to the client
+	DownstreamWrite time.Duration `json:"downstreamWrite"`
+	Total           time.Duration `json:"total"`
+	BytesIn         uint64        `json:"bytesIn"`
+	BytesOut        uint64        `json:"bytesOut"`
+}
+
+func (l *LegTiming) Add(o *LegTiming) {
+	l.Count += o.Count
+	l.DownstreamRead += o.DownstreamRead
+	l.UpstreamHeader += o.UpstreamHeader
+	l.UpstreamRead += o.UpstreamRead
+	l.DownstreamWrite += o.DownstreamWrite
+	l.Total += o.Total
+	l.BytesIn += o.BytesIn
+	l.BytesOut += o.BytesOut
+}
+
+// Type representing the accumulated leg timing per protocol pair like h3->h1-tls
+type LegStats struct {
+	mu    sync.Mutex
+	pairs map[string]*LegTiming
+}
+
+func NewLegStats() *LegStats {
+	return &LegStats{pairs: make(map[string]*LegTiming)}
+}
+
+func (s *LegStats) Add(pair string, t *LegTiming) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sum, ok := s.pairs[pair]
+	if !ok {
+		sum = &LegTiming{}
+		s.pairs[pair] = sum
+	}
+	sum.Add(t)
+}
+
+// ServeHTTP returns the accumulated timing as JSON
+func (s *LegStats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	enc.Encode(s.pairs)
+}
+
+// Type representing the forwarding of all requests to the upstream
+type GatewayOperation struct {
+	upstream string
+	protocol string
+	client   *http.Client
+	legs     *LegStats
+}
+
+func (g *GatewayOperation) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s := time.Now()
+	partscommon.LogRequest(r)
+	timing := &LegTiming{Count: 1}
+	pair := listeners.Protocol(r) + "->" + g.protocol
+
+	// request body is passed through while the upstream reads it
+	url := strings.TrimRight(g.upstream, "/") + r.URL.RequestURI()
+	body := &timedReader{Reader: r.Body}
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, url, body)
+	if err != nil {
+		klog.Error(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if r.ContentLength == 0 {
+		req.Body = nil
+	}
+	req.ContentLength = r.ContentLength
+	copyHeader(req.Header, r.Header)
+	// trailers of the request are filled when its body is read
+	if len(r.Trailer) > 0 {
+		req.Trailer = r.Trailer
+	}
+
+	// upstream leg until the response header
+	sUpstream := time.Now()
+	res, err := g.client.Do(req)
+	timing.UpstreamHeader = time.Since(sUpstream)
+	if err != nil {
+		klog.Error("Error forwarding to upstream: ", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+	partscommon.LogResponse(res)
+
+	// response body is passed through without buffering the message, announced trailers (e.g. the Content-Digest of the body) follow it
+	copyHeader(w.Header(), res.Header)
+	announced := len(res.Trailer)
+	if announced > 0 {
+		names := make([]string, 0, announced)
+		for name := range res.Trailer {
+			names = append(names, name)
+		}
+		w.Header().Add("Trailer", strings.Join(names, ", "))
+	}
+	w.WriteHeader(res.StatusCode)
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, forwardBufferSize)
+	var errUpstream error
+	for {
+		sRead := time.Now()
+		n, errRead := res.Body.Read(buf)
+		timing.UpstreamRead += time.Since(sRead)
+		if n > 0 {
+			sWrite := time.Now()
+			_, errWrite := w.Write(buf[:n])
+			if flusher != nil {
+				flusher.Flush()
+			}
+			timing.DownstreamWrite += time.Since(sWrite)
+			timing.BytesOut += uint64(n)
+			if errWrite != nil {
+				klog.Error("Error writing to client: ", errWrite)
+				break
+			}
+		}
+		if errRead == io.EOF {
+			break
+		}
+		if errRead != nil {
+			klog.Error("Error reading from upstream: ", errRead)
+			errUpstream = errRead
+			break
+		}
+	}
+	if errUpstream == nil {
+		copyTrailer(w.Header(), res.Trailer, announced)
+	}
+	// the transport may still read the request body, the counters are shared with its goroutine
+	timing.DownstreamRead = time.Duration(body.blocked.Load())
+	timing.BytesIn = body.size.Load()
+	timing.Total = time.Since(s)
+	g.legs.Add(pair, timing)
+
+	// timing of each leg
+	klog.V(partscommon.KlogStatistics).Info("GATEWAY ", pair, " ", r.Method, " ", r.URL.Path, " status: ", res.StatusCode,
+		" total: ", timing.Total, " downstream read: ", timing.DownstreamRead, " upstream header: ", timing.UpstreamHeader,
+		" upstream read: ", timing.UpstreamRead, " downstream write: ", timing.DownstreamWrite,
+		" in: ", partscommon.ByteCountSI(timing.BytesIn), " out: ", partscommon.ByteCountSI(timing.BytesOut))
+
+	// a truncated body must not end like a complete one, the connection or stream is reset
+	if errUpstream != nil {
+		klog.Error("Aborting response of ", r.URL.Path, ": ", errUpstream)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// copyTrailer sets the trailers of the upstream response, trailers not announced before the header are sent with the trailer prefix
+func copyTrailer(dst http.Header, trailer http.Header, announced int) {
+	prefix := ""
+	if len(trailer) != announced {
+		prefix = http.TrailerPrefix
+	}
+	for name, values := range trailer {
+		for _, v := range values {
+			dst.Add(prefix+name, v)
+		}
+	}
+}
+
+// copyHeader copies all end-to-end headers
+func copyHeader(dst http.Header, src http.Header) {
+	for name, values := range src {
+		for _, v := range values {
+			dst.Add(name, v)
+		}
+	}
+	for _, name := range hopHeaders {
+		dst.Del(name)
+	}
+}
+
+// Type representing a reader measuring the time blocked in reading, read by the transport in its own goroutine
+type timedReader struct {
+	io.Reader
+	blocked atomic.Int64
+	size    atomic.Uint64
+}
+
+func (t *timedReader) Read(p []byte) (int, error) {
+	s := time.Now()
+	n, err := t.Reader.Read(p)
+	t.blocked.Add(int64(time.Since(s)))
+	t.size.Add(uint64(n))
+	return n, err
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"httpxcommon/connstats"
+	"httpxcommon/listeners"
+	"httpxcommon/partscommon"
+	"httpxcommon/transports"
+
+	"github.com/quic-go/quic-go"
+	"k8s.io/klog"
+)
+
+// GetCertificatePaths returns the paths to certificate and key
+func GetCertificatePaths(certPath string) (string, string) {
+	pubCert := path.Join(certPath, "cert", "cert-public.pem")
+	privCert := path.Join(certPath, "cert", "cert-priv.pem")
+	klog.V(partscommon.KlogDebug).Info("Public Certificate:", pubCert, " Private Certificate:", privCert)
+	return pubCert, privCert
+}
+
+// usageError prints the message and exits with the exit code of invalid flags
+func usageError(m ...any) {
+	fmt.Fprintln(os.Stderr, m...)
+	os.Exit(2)
+}
+
+func main() {
+	// logging setup
+	klog.InitFlags(nil)
+	defer klog.Flush()
+
+	// determine root path
+	_, filename, _, ok := runtime.Caller(0)
+	if !ok {
+		panic("Failed to get current frame")
+	}
+	certPath := path.Dir(filename)
+	certPath = strings.TrimRight(certPath, filepath.Base(certPath))
+
+	// check parameters
+	dirCert := flag.String("cert", certPath, "directory with public and private certificate: cert-priv.perm, cert-public.pem")
+	port := flag.Int("port", 7080, "first port of the listeners: HTTP/1.1 on port, HTTPS/1.1 on port+1, HTTPS/2 on port+2, HTTP/3 on port+3, h2c on port+4")
+	upstream := flag.String("upstream", "", "base url of the upstream DICOMweb server, e.g. https://localhost:8081")
+	upstreamHttp := flag.String("upstream-http", transports.Http1, "http version used for the upstream: 1.1 | 2.0 | 3.0 | 1.1-plain | 2.0-plain")
+	upstreamInsecure := flag.Bool("upstream-insecure", false, "skip certificate verification of the upstream")
+	admin := flag.String("admin", ":7090", "address of the admin listener with /debug/connections and /debug/legs, empty to disable")
+	flag.Parse()
+	if len(*upstream) == 0 {
+		klog.Fatal("No upstream defined, use -upstream")
+	}
+
+	// calculate cert path
+	if _, err := partscommon.CheckDirectory(*dirCert); err != nil {
+		usageError(err)
+	}
+	certFile, keyFile := GetCertificatePaths(*dirCert)
+
+	// upstream side using the client transports, connections are tracked with the upstream prefix
+	stats := connstats.NewRegistry()
+	pool, err := transports.LoadCertPool(*dirCert)
+	if err != nil {
+		klog.Fatal(err)
+	}
+	client, err := transports.NewClient(*upstreamHttp, pool, *upstreamInsecure, stats, "upstream-")
+	if err != nil {
+		klog.Fatal(err)
+	}
+	legs := NewLegStats()
+	gateway := &GatewayOperation{upstream: *upstream, protocol: transports.ProtocolLabel(*upstreamHttp), client: client, legs: legs}
+
+	// downstream side using the server listeners
+	listen := &listeners.Listeners{
+		Handler:    gateway,
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		ConnState:  stats.ConnState,
+		QuicConfig: &quic.Config{Tracer: stats.QuicTracer(listeners.ProtocolHttps3)},
+	}
+
+	// start admin listener with the connection and leg statistics
+	if len(*admin) > 0 {
+		http.Handle("/debug/connections", stats)
+		http.Handle("/debug/legs", legs)
+		go func() {
+			fmt.Println("Running admin server on", *admin, "in goroutine:", partscommon.GetGID())
+			klog.V(partscommon.KlogDebug).Info(http.ListenAndServe(*admin, nil))
+		}()
+	}
+
+	// start listeners for all protocols
+	fmt.Println("Forwarding to upstream", *upstream, "using HTTP/"+*upstreamHttp)
+	var wg sync.WaitGroup
+	serve := []struct {
+		name   string
+		listen func(string) error
+	}{
+		{"HTTP /1.1", listen.ServeHttp1},
+		{"HTTPS/1.1", listen.ServeHttps1},
+		{"HTTPS/2.0", listen.ServeHttps2},
+		{"HTTPS/3.0", listen.ServeHttps3},
+		{"HTTP /2.0 h2c", listen.ServeH2c},
+	}
+	for i, s := range serve {
+		wg.Add(1)
+		addr := fmt.Sprintf(":%d", *port+i)
+		sCap := s
+		go func() {
+			defer wg.Done()
+			fmt.Println("Running gateway (", sCap.name, ") on", addr, "in goroutine:", partscommon.GetGID())
+			klog.V(partscommon.KlogDebug).Info(sCap.listen(addr))
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,291 @@
+package compression
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"httpxcommon/partscommon"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// content codings supported for retrieve and store
+const (
+	EncodingIdentity = "identity"
+	EncodingGzip     = "gzip"
+	EncodingZstd     = "zstd"
+	EncodingBrotli   = "br"
+)
+
+// scope of the compression: whole body or every part of a multipart message
+const (
+	ScopeBody = "body"
+	ScopePart = "part"
+)
+
+// request header to ask for compressed parts in a multipart response (same syntax as Accept-Encoding)
+const AcceptPartEncodingHeader = "X-Accept-Part-Encoding"
+
+// supported encodings in order of preference
+var SupportedEncodings = []string{EncodingZstd, EncodingBrotli, EncodingGzip}
+
+// IsSupported checks if the encoding can be handled
+func IsSupported(encoding string) bool {
+	if encoding == EncodingIdentity || encoding == "" {
+		return true
+	}
+	for _, e := range SupportedEncodings {
+		if e == encoding {
+			return true
+		}
+	}
+	return false
+}
+
+// Negotiate selects the content coding for an Accept-Encoding header, identity if nothing matches
+func Negotiate(acceptEncoding string) string {
+	best, bestQ := EncodingIdentity, 0.0
+	bestRank := len(SupportedEncodings)
+	for _, item := range strings.Split(acceptEncoding, ",") {
+		coding, q := ParseQuality(item)
+		if q <= 0 {
+			continue
+		}
+		for rank, e := range SupportedEncodings {
+			if (coding == e || coding == "*") && (q > bestQ || (q == bestQ && rank < bestRank)) {
+				best, bestQ, bestRank = e, q, rank
+			}
+		}
+	}
+	return best
+}
+
+// ParseQuality splits a list item like "gzip;q=0.5" into the lower case token and the quality value
+func ParseQuality(item string) (string, float64) {
+	parts := strings.Split(item, ";")
+	token := strings.ToLower(strings.TrimSpace(parts[0]))
+	q := 1.0
+	for _, param := range parts[1:] {
+		key, value, found := strings.Cut(strings.TrimSpace(param), "=")
+		if found && strings.EqualFold(strings.TrimSpace(key), "q") {
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				return token, 0
+			}
+			q = parsed
+		}
+	}
+	return token, q
+}
+
+// Type representing the compression statistics of a run
+type Stats struct {
+	mu           sync.Mutex
+	RawBytes     uint64
+	EncodedBytes uint64
+	CodecTime    time.Duration
+}
+
+func (s *Stats) Add(raw uint64, encoded uint64, codec time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.RawBytes += raw
+	s.EncodedBytes += encoded
+	s.CodecTime += codec
+}
+
+// Ratio returns raw bytes divided by encoded bytes
+func (s *Stats) Ratio() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.EncodedBytes == 0 {
+		return 0
+	}
+	return float64(s.RawBytes) / float64(s.EncodedBytes)
+}
+
+func (s *Stats) String() string {
+	ratio := s.Ratio()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fmt.Sprintf("raw: %s encoded: %s ratio: %.2f codec time: %v", partscommon.ByteCountSI(s.RawBytes), partscommon.ByteCountSI(s.EncodedBytes), ratio, s.CodecTime)
+}
+
+// Type representing the compression used by a client or a request
+type Options struct {
+	Encoding string
+	Scope    string
+	Stats    Stats
+}
+
+// BodyEncoding returns the encoding of the whole body, empty if not compressed
+func (o *Options) BodyEncoding() string {
+	if o == nil || o.Encoding == EncodingIdentity || o.Scope != ScopeBody {
+		return ""
+	}
+	return o.Encoding
+}
+
+// PartEncoding returns the encoding of every part, empty if not compressed
+func (o *Options) PartEncoding() string {
+	if o == nil || o.Encoding == EncodingIdentity || o.Scope != ScopePart {
+		return ""
+	}
+	return o.Encoding
+}
+
+// SingleEncoding returns the encoding of a single part message, empty if not compressed
+func (o *Options) SingleEncoding() string {
+	if o == nil || o.Encoding == EncodingIdentity {
+		return ""
+	}
+	return o.Encoding
+}
+
+// GetStats returns the statistics or nil
+func (o *Options) GetStats() *Stats {
+	if o == nil {
+		return nil
+	}
+	return &o.Stats
+}
+
+// timing writer measuring the time spent in the underlying writer
+type timedWriter struct {
+	w       io.Writer
+	size    uint64
+	elapsed time.Duration
+}
+
+func (t *timedWriter) Write(p []byte) (int, error) {
+	s := time.Now()
+	n, err := t.w.Write(p)
+	t.elapsed += time.Since(s)
+	t.size += uint64(n)
+	return n, err
+}
+
+// Type representing a compressing writer collecting statistics
+type Encoder struct {
+	out   *timedWriter
+	enc   io.WriteCloser
+	stats *Stats
+	raw   uint64
+	total time.Duration
+}
+
+// NewWriter creates a compressing writer for the encoding
+func NewWriter(encoding string, w io.Writer, stats *Stats) (*Encoder, error) {
+	out := &timedWriter{w: w}
+	var enc io.WriteCloser
+	switch encoding {
+	case EncodingGzip:
+		enc = gzip.NewWriter(out)
+	case EncodingZstd:
+		z, err := zstd.NewWriter(out, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		enc = z
+	case EncodingBrotli:
+		enc = brotli.NewWriter(out)
+	default:
+		return nil, errors.New("Unsupported content encoding: " + encoding)
+	}
+	return &Encoder{out: out, enc: enc, stats: stats}, nil
+}
+
+func (e *Encoder) Write(p []byte) (int, error) {
+	s := time.Now()
+	n, err := e.enc.Write(p)
+	e.total += time.Since(s)
+	e.raw += uint64(n)
+	return n, err
+}
+
+// Close flushes the encoder and adds the statistics (time in the underlying writer is not counted)
+func (e *Encoder) Close() error {
+	s := time.Now()
+	err := e.enc.Close()
+	e.total += time.Since(s)
+	e.stats.Add(e.raw, e.out.size, e.total-e.out.elapsed)
+	return err
+}
+
+// timing reader measuring the time spent in the underlying reader
+type timedReader struct {
+	r       io.Reader
+	size    uint64
+	elapsed time.Duration
+}
+
+func (t *timedReader) Read(p []byte) (int, error) {
+	s := time.Now()
+	n, err := t.r.Read(p)
+	t.elapsed += time.Since(s)
+	t.size += uint64(n)
+	return n, err
+}
+
+// Type representing a decompressing reader collecting statistics
+type Decoder struct {
+	in     *timedReader
+	dec    io.ReadCloser
+	stats  *Stats
+	raw    uint64
+	total  time.Duration
+	closed bool
+}
+
+// NewReader creates a decompressing reader for the encoding
+func NewReader(encoding string, r io.Reader, stats *Stats) (*Decoder, error) {
+	in := &timedReader{r: r}
+	var dec io.ReadCloser
+	switch encoding {
+	case EncodingGzip:
+		g, err := gzip.NewReader(in)
+		if err != nil {
+			return nil, err
+		}
+		dec = g
+	case EncodingZstd:
+		z, err := zstd.NewReader(in, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		dec = z.IOReadCloser()
+	case EncodingBrotli:
+		dec = io.NopCloser(brotli.NewReader(in))
+	default:
+		return nil, errors.New("Unsupported content encoding: " + encoding)
+	}
+	return &Decoder{in: in, dec: dec, stats: stats}, nil
+}
+
+func (d *Decoder) Read(p []byte) (int, error) {
+	s := time.Now()
+	n, err := d.dec.Read(p)
+	d.total += time.Since(s)
+	d.raw += uint64(n)
+	return n, err
+}
+
+// Close releases the decoder and adds the statistics (time in the underlying reader is not counted)
+func (d *Decoder) Close() error {
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+	d.stats.Add(d.raw, d.in.size, d.total-d.in.elapsed)
+	return d.dec.Close()
+}
@@ -0,0 +1,354 @@
+package connstats
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"httpxcommon/partscommon"
+	"httpxcommon/terminal"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+	"k8s.io/klog"
+)
+
+// number of closed connections kept for reporting
+const MaxClosedConnections = 256
+
+// Type representing the transport statistics of one connection
+type ConnectionStats struct {
+	Protocol      string        `json:"protocol"`
+	Transport     string        `json:"transport"`
+	Local         string        `json:"local"`
+	Remote        string        `json:"remote"`
+	Open          bool          `json:"open"`
+	Duration      time.Duration `json:"duration"`
+	RTT           time.Duration `json:"rtt"`
+	MinRTT        time.Duration `json:"minRtt"`
+	Cwnd          uint64        `json:"cwnd"`
+	BytesInFlight uint64        `json:"bytesInFlight"`
+	PacketsLost   uint64        `json:"packetsLost"`
+	Retransmits   uint64        `json:"retransmits"`
+	BytesSent     uint64        `json:"bytesSent"`
+	BytesReceived uint64        `json:"bytesReceived"`
+	StreamsOpened uint64        `json:"streamsOpened"`
+	Error         string        `json:"error,omitempty"`
+}
+
+// connection with statistics
+type connection interface {
+	Stats() ConnectionStats
+}
+
+// Type representing all tracked TCP and QUIC connections of a process
+type Registry struct {
+	mu     sync.Mutex
+	open   map[connection]struct{}
+	closed []ConnectionStats
+}
+
+func NewRegistry() *Registry {
+	return &Registry{open: make(map[connection]struct{})}
+}
+
+func (h *Registry) add(c connection) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.open[c] = struct{}{}
+}
+
+func (h *Registry) remove(c connection, stats ConnectionStats) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.open[c]; !ok {
+		return
+	}
+	delete(h.open, c)
+	stats.Open = false
+	h.closed = append(h.closed, stats)
+	if len(h.closed) > MaxClosedConnections {
+		h.closed = h.closed[len(h.closed)-MaxClosedConnections:]
+	}
+}
+
+// Snapshot returns the statistics of all open and the last closed connections
+func (h *Registry) Snapshot() []ConnectionStats {
+	h.mu.Lock()
+	open := make([]connection, 0, len(h.open))
+	for c := range h.open {
+		open = append(open, c)
+	}
+	result := append([]ConnectionStats{}, h.closed...)
+	h.mu.Unlock()
+
+	for _, c := range open {
+		result = append(result, c.Stats())
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Protocol != result[j].Protocol {
+			return result[i].Protocol < result[j].Protocol
+		}
+		return result[i].Local < result[j].Local
+	})
+	return result
+}
+
+// Print renders the statistics as table on the terminal
+func (h *Registry) Print() {
+	snapshot := h.Snapshot()
+	if len(snapshot) == 0 {
+		return
+	}
+	table := [][]string{{"Protocol", "Remote", "Open", "RTT", "MinRTT", "Cwnd", "InFlight", "Lost", "Retrans", "Sent", "Received", "Streams"}}
+	for _, s := range snapshot {
+		if len(s.Error) > 0 {
+			table = append(table, []string{s.Protocol, s.Remote, strconv.FormatBool(s.Open), s.Error, "", "", "", "", "", "", "", ""})
+			continue
+		}
+		table = append(table, []string{
+			s.Protocol, s.Remote, strconv.FormatBool(s.Open),
+			s.RTT.String(), s.MinRTT.String(),
+			partscommon.ByteCountSI(s.Cwnd), partscommon.ByteCountSI(s.BytesInFlight),
+			strconv.FormatUint(s.PacketsLost, 10), strconv.FormatUint(s.Retransmits, 10),
+			partscommon.ByteCountSI(s.BytesSent), partscommon.ByteCountSI(s.BytesReceived),
+			strconv.FormatUint(s.StreamsOpened, 10),
+		})
+	}
+	terminal.PrintTableWithHeaders(table)
+}
+
+// ServeHTTP returns the statistics as JSON (used for the admin endpoint)
+func (h *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(h.Snapshot()); err != nil {
+		klog.Error("Error encoding connection statistics:", err)
+	}
+}
+
+// Type representing a TCP connection tracked with TCP_INFO
+type tcpConnection struct {
+	mu       sync.Mutex
+	conn     net.Conn
+	protocol string
+	start    time.Time
+	last     ConnectionStats
+}
+
+func newTcpConnection(protocol string, conn net.Conn) *tcpConnection {
+	// statistics are read from the raw socket
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	c := &tcpConnection{conn: conn, protocol: protocol, start: time.Now()}
+	c.last = ConnectionStats{
+		Protocol:  protocol,
+		Transport: "tcp",
+		Local:     conn.LocalAddr().String(),
+		Remote:    conn.RemoteAddr().String(),
+		Open:      true,
+	}
+	return c
+}
+
+// update reads TCP_INFO and keeps the values for the time after closing
+func (c *tcpConnection) update() ConnectionStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.last
+	stats.Duration = time.Since(c.start)
+	if err := ReadTCPInfo(c.conn, &stats); err != nil {
+		stats.Error = err.Error()
+	} else {
+		stats.Error = ""
+	}
+	c.last = stats
+	return stats
+}
+
+func (c *tcpConnection) Stats() ConnectionStats {
+	return c.update()
+}
+
+// Type representing a client connection reporting its statistics before closing
+type trackedConn struct {
+	net.Conn
+	registry   *Registry
+	connection *tcpConnection
+	once       sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.registry.remove(c.connection, c.connection.update())
+	})
+	return c.Conn.Close()
+}
+
+// Dial returns a dial function tracking the created TCP connections
+func (h *Registry) Dial(protocol string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	return h.Track(protocol, dialer.DialContext)
+}
+
+// Track returns a dial function tracking the TCP connections created by the dial function
+func (h *Registry) Track(protocol string, dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		c := newTcpConnection(protocol, conn)
+		h.add(c)
+		return &trackedConn{Conn: conn, registry: h, connection: c}, nil
+	}
+}
+
+// DialTLS returns a TLS dial function tracking the created TCP connections
+func (h *Registry) DialTLS(protocol string) func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+	dial := h.Dial(protocol)
+	return func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
+
+// ConnState returns a connection state hook tracking the connections of a http server
+func (h *Registry) ConnState(protocol string) func(net.Conn, http.ConnState) {
+	var mu sync.Mutex
+	connections := make(map[net.Conn]*tcpConnection)
+	return func(conn net.Conn, state http.ConnState) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch state {
+		case http.StateNew:
+			c := newTcpConnection(protocol, conn)
+			connections[conn] = c
+			h.add(c)
+		case http.StateActive, http.StateIdle:
+			// keep the values, the socket is already closed in StateClosed
+			if c, ok := connections[conn]; ok {
+				c.update()
+			}
+		case http.StateClosed, http.StateHijacked:
+			if c, ok := connections[conn]; ok {
+				delete(connections, conn)
+				c.mu.Lock()
+				last := c.last
+				c.mu.Unlock()
+				h.remove(c, last)
+			}
+		}
+	}
+}
+
+// Type representing a QUIC connection tracked with the quic-go tracer
+type quicConnection struct {
+	logging.NullConnectionTracer
+	mu       sync.Mutex
+	registry *Registry
+	start    time.Time
+	stats    ConnectionStats
+	streams  map[logging.StreamID]struct{}
+}
+
+// QuicTracer returns a tracer for the quic.Config collecting the connection statistics
+func (h *Registry) QuicTracer(protocol string) func(context.Context, logging.Perspective, quic.ConnectionID) logging.ConnectionTracer {
+	return func(_ context.Context, _ logging.Perspective, _ quic.ConnectionID) logging.ConnectionTracer {
+		c := &quicConnection{
+			registry: h,
+			start:    time.Now(),
+			stats:    ConnectionStats{Protocol: protocol, Transport: "quic", Open: true},
+			streams:  make(map[logging.StreamID]struct{}),
+		}
+		h.add(c)
+		return c
+	}
+}
+
+func (c *quicConnection) Stats() ConnectionStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Duration = time.Since(c.start)
+	stats.StreamsOpened = uint64(len(c.streams))
+	return stats
+}
+
+func (c *quicConnection) countStreams(frames []logging.Frame) {
+	for _, f := range frames {
+		if sf, ok := f.(*logging.StreamFrame); ok {
+			c.streams[sf.StreamID] = struct{}{}
+		}
+	}
+}
+
+func (c *quicConnection) StartedConnection(local, remote net.Addr, _, _ logging.ConnectionID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.Local = local.String()
+	c.stats.Remote = remote.String()
+}
+
+func (c *quicConnection) SentLongHeaderPacket(_ *logging.ExtendedHeader, size logging.ByteCount, _ *logging.AckFrame, frames []logging.Frame) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.BytesSent += uint64(size)
+	c.countStreams(frames)
+}
+
+func (c *quicConnection) SentShortHeaderPacket(_ *logging.ShortHeader, size logging.ByteCount, _ *logging.AckFrame, frames []logging.Frame) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.BytesSent += uint64(size)
+	c.countStreams(frames)
+}
+
+func (c *quicConnection) ReceivedLongHeaderPacket(_ *logging.ExtendedHeader, size logging.ByteCount, frames []logging.Frame) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.BytesReceived += uint64(size)
+	c.countStreams(frames)
+}
+
+func (c *quicConnection) ReceivedShortHeaderPacket(_ *logging.ShortHeader, size logging.ByteCount, frames []logging.Frame) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.BytesReceived += uint64(size)
+	c.countStreams(frames)
+}
+
+func (c *quicConnection) UpdatedMetrics(rttStats *logging.RTTStats, cwnd, bytesInFlight logging.ByteCount, _ int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.RTT = rttStats.SmoothedRTT()
+	c.stats.MinRTT = rttStats.MinRTT()
+	c.stats.Cwnd = uint64(cwnd)
+	c.stats.BytesInFlight = uint64(bytesInFlight)
+}
+
+func (c *quicConnection) LostPacket(logging.EncryptionLevel, logging.PacketNumber, logging.PacketLossReason) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.PacketsLost++
+}
+
+func (c *quicConnection) Close() {
+	c.registry.remove(c, c.Stats())
+}
@@ -0,0 +1,44 @@
+package connstats
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ReadTCPInfo fills the statistics with TCP_INFO of the socket
+func ReadTCPInfo(conn net.Conn, stats *ConnectionStats) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return errors.New("no raw socket available")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var info *unix.TCPInfo
+	var errInfo error
+	err = raw.Control(func(fd uintptr) {
+		info, errInfo = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	if err != nil {
+		return err
+	}
+	if errInfo != nil {
+		return errInfo
+	}
+
+	// rtt values are in microseconds, cwnd in segments
+	stats.RTT = time.Duration(info.Rtt) * time.Microsecond
+	stats.MinRTT = time.Duration(info.Min_rtt) * time.Microsecond
+	stats.Cwnd = uint64(info.Snd_cwnd) * uint64(info.Snd_mss)
+	stats.BytesInFlight = uint64(info.Unacked) * uint64(info.Snd_mss)
+	stats.PacketsLost = uint64(info.Lost)
+	stats.Retransmits = uint64(info.Total_retrans)
+	stats.BytesSent = info.Bytes_acked
+	stats.BytesReceived = info.Bytes_received
+	return nil
+}
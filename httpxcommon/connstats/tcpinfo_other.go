@@ -0,0 +1,13 @@
+//go:build !linux
+
+package connstats
+
+import (
+	"errors"
+	"net"
+)
+
+// ReadTCPInfo is only available on linux
+func ReadTCPInfo(conn net.Conn, stats *ConnectionStats) error {
+	return errors.New("TCP_INFO not supported on this platform")
+}
@@ -0,0 +1,131 @@
+// Package diagnostics reports the capabilities of the operating system which limit the QUIC throughput:
+// UDP socket buffers, segmentation offload (GSO / GRO) and ECN.
+package diagnostics
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+
+	"httpxcommon/sizes"
+)
+
+// receive and send buffer quic-go asks for on its UDP sockets
+const DesiredBufferSize = 2 * 1024 * 1024
+
+const quicGoModule = "github.com/quic-go/quic-go"
+
+// Type representing the UDP capabilities available to quic-go
+type Report struct {
+	OS string
+	// version of quic-go linked into the executable
+	QuicGo string
+	// limits of the socket buffers of the operating system, 0 if unknown
+	ReceiveBufferMax int
+	SendBufferMax    int
+	// buffers of a UDP socket after asking for DesiredBufferSize the way quic-go does, 0 if unknown
+	ReceiveBuffer int
+	SendBuffer    int
+	// the kernel accepts UDP_SEGMENT (GSO) and UDP_GRO
+	GSO bool
+	GRO bool
+	// quic-go uses GSO (QUIC_GO_ENABLE_GSO, see -tune quic.gso=true)
+	GSOEnabled bool
+	// the ECN bits of received packets can be read (IP_RECVTOS / IPV6_RECVTCLASS)
+	ECN bool
+	// checks which could not be done
+	Notes []string
+}
+
+// Collect probes a UDP socket the same way quic-go sets up its sockets
+func Collect() *Report {
+	r := &Report{OS: runtime.GOOS + "/" + runtime.GOARCH, QuicGo: quicGoVersion()}
+	r.GSOEnabled, _ = strconv.ParseBool(os.Getenv("QUIC_GO_ENABLE_GSO"))
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		r.Notes = append(r.Notes, "no UDP socket available: "+err.Error())
+		return r
+	}
+	defer conn.Close()
+	probe(conn, r)
+	return r
+}
+
+// quicGoVersion returns the version of quic-go of the build information
+func quicGoVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	for _, m := range info.Deps {
+		if m.Path == quicGoModule {
+			if m.Replace != nil {
+				return m.Replace.Version
+			}
+			return m.Version
+		}
+	}
+	return "unknown"
+}
+
+// Warnings returns the findings limiting the QUIC throughput and how to fix them
+func (r *Report) Warnings() []string {
+	var warnings []string
+	if r.ReceiveBuffer > 0 && r.ReceiveBuffer < DesiredBufferSize {
+		warnings = append(warnings, fmt.Sprintf("UDP receive buffer of %s is below the %s quic-go asks for, packets are dropped on long flows: %s",
+			formatSize(r.ReceiveBuffer), formatSize(DesiredBufferSize), raiseReceiveLimit))
+	}
+	if r.SendBuffer > 0 && r.SendBuffer < DesiredBufferSize {
+		warnings = append(warnings, fmt.Sprintf("UDP send buffer of %s is below the %s quic-go asks for: %s",
+			formatSize(r.SendBuffer), formatSize(DesiredBufferSize), raiseSendLimit))
+	}
+	if r.GSO && !r.GSOEnabled {
+		warnings = append(warnings, "GSO is available but not used, enable it with -tune quic.gso=true")
+	}
+	if !r.GSO && r.GSOEnabled {
+		warnings = append(warnings, "GSO is enabled but not supported by the kernel, quic-go sends every packet with its own system call")
+	}
+	return warnings
+}
+
+// Print writes the report as DIAG lines next to the transfer rates
+func (r *Report) Print(w io.Writer) {
+	fmt.Fprintln(w, " DIAG os:", r.OS, "quic-go:", r.QuicGo)
+	fmt.Fprintln(w, " DIAG udp receive buffer:", formatSize(r.ReceiveBuffer), "(quic-go asks for", formatSize(DesiredBufferSize)+",", receiveLimitName, formatSize(r.ReceiveBufferMax)+")")
+	fmt.Fprintln(w, " DIAG udp send buffer:", formatSize(r.SendBuffer), "(quic-go asks for", formatSize(DesiredBufferSize)+",", sendLimitName, formatSize(r.SendBufferMax)+")")
+	fmt.Fprintln(w, " DIAG gso:", available(r.GSO)+",", enabled(r.GSOEnabled))
+	fmt.Fprintln(w, " DIAG gro:", available(r.GRO)+", not used by quic-go v0.37")
+	fmt.Fprintln(w, " DIAG ecn:", available(r.ECN)+" for received packets, quic-go v0.37 does not send ECN-capable packets")
+	fmt.Fprintln(w, " DIAG congestion control: Cubic/NewReno with pacing, not configurable in quic-go v0.37")
+	for _, note := range r.Notes {
+		fmt.Fprintln(w, " DIAG note:", note)
+	}
+	for _, warning := range r.Warnings() {
+		fmt.Fprintln(w, " DIAG warning:", warning)
+	}
+}
+
+func formatSize(size int) string {
+	if size <= 0 {
+		return "unknown"
+	}
+	return sizes.Format(uint64(size))
+}
+
+func available(ok bool) string {
+	if ok {
+		return "available"
+	}
+	return "not available"
+}
+
+func enabled(ok bool) string {
+	if ok {
+		return "enabled"
+	}
+	return "disabled"
+}
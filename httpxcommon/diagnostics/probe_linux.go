@@ -0,0 +1,62 @@
+package diagnostics
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// limits of the socket buffers
+const (
+	receiveLimitName  = "net.core.rmem_max"
+	sendLimitName     = "net.core.wmem_max"
+	raiseReceiveLimit = "sysctl -w net.core.rmem_max=7500000"
+	raiseSendLimit    = "sysctl -w net.core.wmem_max=7500000"
+)
+
+// probe fills the report with the socket buffers, GSO, GRO and ECN of the socket
+func probe(conn *net.UDPConn, r *Report) {
+	r.ReceiveBufferMax = readLimit("/proc/sys/net/core/rmem_max")
+	r.SendBufferMax = readLimit("/proc/sys/net/core/wmem_max")
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		r.Notes = append(r.Notes, err.Error())
+		return
+	}
+	// quic-go ignores the errors and checks the sizes afterwards
+	conn.SetReadBuffer(DesiredBufferSize)
+	conn.SetWriteBuffer(DesiredBufferSize)
+	err = raw.Control(func(fd uintptr) {
+		s := int(fd)
+		// like quic-go: above the limit with CAP_NET_ADMIN, the kernel reports twice the size set
+		if size, _ := unix.GetsockoptInt(s, unix.SOL_SOCKET, unix.SO_RCVBUF); size < DesiredBufferSize {
+			unix.SetsockoptInt(s, unix.SOL_SOCKET, unix.SO_RCVBUFFORCE, DesiredBufferSize)
+		}
+		if size, _ := unix.GetsockoptInt(s, unix.SOL_SOCKET, unix.SO_SNDBUF); size < DesiredBufferSize {
+			unix.SetsockoptInt(s, unix.SOL_SOCKET, unix.SO_SNDBUFFORCE, DesiredBufferSize)
+		}
+		r.ReceiveBuffer, _ = unix.GetsockoptInt(s, unix.SOL_SOCKET, unix.SO_RCVBUF)
+		r.SendBuffer, _ = unix.GetsockoptInt(s, unix.SOL_SOCKET, unix.SO_SNDBUF)
+		r.GSO = unix.SetsockoptInt(s, unix.IPPROTO_UDP, unix.UDP_SEGMENT, 1) == nil
+		r.GRO = unix.SetsockoptInt(s, unix.IPPROTO_UDP, unix.UDP_GRO, 1) == nil
+		errIPv4 := unix.SetsockoptInt(s, unix.IPPROTO_IP, unix.IP_RECVTOS, 1)
+		errIPv6 := unix.SetsockoptInt(s, unix.IPPROTO_IPV6, unix.IPV6_RECVTCLASS, 1)
+		r.ECN = errIPv4 == nil || errIPv6 == nil
+	})
+	if err != nil {
+		r.Notes = append(r.Notes, err.Error())
+	}
+}
+
+// readLimit returns the value of the sysctl file, 0 if it cannot be read
+func readLimit(path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	value, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	return value
+}
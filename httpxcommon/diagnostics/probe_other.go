@@ -0,0 +1,24 @@
+//go:build !linux
+
+package diagnostics
+
+import "net"
+
+// limits of the socket buffers
+const (
+	receiveLimitName  = "limit"
+	sendLimitName     = "limit"
+	raiseReceiveLimit = "raise the socket buffer limit of the operating system (e.g. kern.ipc.maxsockbuf)"
+	raiseSendLimit    = raiseReceiveLimit
+)
+
+// probe asks for the socket buffers, the sizes, GSO, GRO and ECN are only checked on linux
+func probe(conn *net.UDPConn, r *Report) {
+	if err := conn.SetReadBuffer(DesiredBufferSize); err != nil {
+		r.Notes = append(r.Notes, "receive buffer: "+err.Error())
+	}
+	if err := conn.SetWriteBuffer(DesiredBufferSize); err != nil {
+		r.Notes = append(r.Notes, "send buffer: "+err.Error())
+	}
+	r.Notes = append(r.Notes, "buffer sizes, GSO, GRO and ECN are only checked on linux")
+}
@@ -0,0 +1,507 @@
+package dicomfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/suyashkumar/dicom/pkg/tag"
+)
+
+// tags used while parsing and transcoding
+const (
+	TagGroupLength          uint32 = 0x00020000
+	TagTransferSyntax       uint32 = 0x00020010
+	TagSOPInstanceUID       uint32 = 0x00080018
+	TagStudyInstanceUID     uint32 = 0x0020000D
+	TagSeriesInstanceUID    uint32 = 0x0020000E
+	TagSamplesPerPixel      uint32 = 0x00280002
+	TagPhotometric          uint32 = 0x00280004
+	TagPlanarConfiguration  uint32 = 0x00280006
+	TagNumberOfFrames       uint32 = 0x00280008
+	TagRows                 uint32 = 0x00280010
+	TagColumns              uint32 = 0x00280011
+	TagBitsAllocated        uint32 = 0x00280100
+	TagBitsStored           uint32 = 0x00280101
+	TagPixelRepresentation  uint32 = 0x00280103
+	TagWindowCenter         uint32 = 0x00281050
+	TagWindowWidth          uint32 = 0x00281051
+	TagRescaleIntercept     uint32 = 0x00281052
+	TagRescaleSlope         uint32 = 0x00281053
+	TagPixelData            uint32 = 0x7FE00010
+	TagItem                 uint32 = 0xFFFEE000
+	TagItemDelimitation     uint32 = 0xFFFEE00D
+	TagSequenceDelimitation uint32 = 0xFFFEE0DD
+)
+
+// value length used for sequences, items and encapsulated pixel data of undefined length
+const UndefinedLength uint32 = 0xFFFFFFFF
+
+// ErrMalformed is returned if a dataset cannot be parsed
+var ErrMalformed = errors.New("malformed DICOM dataset")
+
+// Type representing a data element
+type Element struct {
+	Tag   uint32
+	VR    string
+	Value []byte
+	// sequence with items
+	Sequence bool
+	Items    []*Dataset
+	// encapsulated pixel data, the first fragment is the basic offset table
+	Encapsulated bool
+	Fragments    [][]byte
+}
+
+// Type representing a list of data elements
+type Dataset struct {
+	Elements []*Element
+}
+
+// Type representing a parsed DICOM file
+type File struct {
+	Meta           *Dataset
+	Dataset        *Dataset
+	TransferSyntax string
+}
+
+// Find returns the element with the tag or nil
+func (d *Dataset) Find(t uint32) *Element {
+	for _, e := range d.Elements {
+		if e.Tag == t {
+			return e
+		}
+	}
+	return nil
+}
+
+// Set replaces the value of the element or inserts it in tag order
+func (d *Dataset) Set(e *Element) {
+	for i, existing := range d.Elements {
+		if existing.Tag == e.Tag {
+			d.Elements[i] = e
+			return
+		}
+		if existing.Tag > e.Tag {
+			d.Elements = append(d.Elements[:i], append([]*Element{e}, d.Elements[i:]...)...)
+			return
+		}
+	}
+	d.Elements = append(d.Elements, e)
+}
+
+// Remove deletes the element with the tag
+func (d *Dataset) Remove(t uint32) {
+	for i, e := range d.Elements {
+		if e.Tag == t {
+			d.Elements = append(d.Elements[:i], d.Elements[i+1:]...)
+			return
+		}
+	}
+}
+
+// String returns the trimmed string value of an element
+func (d *Dataset) String(t uint32) string {
+	e := d.Find(t)
+	if e == nil {
+		return ""
+	}
+	return strings.TrimRight(string(e.Value), "\x00 ")
+}
+
+// Uint16 returns the first value of an US element or the default
+func (d *Dataset) Uint16(t uint32, def int) int {
+	e := d.Find(t)
+	if e == nil || len(e.Value) < 2 {
+		return def
+	}
+	return int(binary.LittleEndian.Uint16(e.Value))
+}
+
+// Int returns the first value of an IS element or the default
+func (d *Dataset) Int(t uint32, def int) int {
+	v, err := strconv.Atoi(strings.TrimSpace(strings.Split(d.String(t), "\\")[0]))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// Float returns the first value of a DS element and whether it is present
+func (d *Dataset) Float(t uint32) (float64, bool) {
+	v, err := strconv.ParseFloat(strings.TrimSpace(strings.Split(d.String(t), "\\")[0]), 64)
+	return v, err == nil
+}
+
+// DictionaryVR returns the value representation of the tag from the data dictionary
+func DictionaryVR(t uint32) string {
+	info, err := tag.Find(tag.Tag{Group: uint16(t >> 16), Element: uint16(t)})
+	if err != nil {
+		return "UN"
+	}
+	switch info.VR {
+	case "UP":
+		return "UL"
+	case "NA", "":
+		return "UN"
+	}
+	return info.VR
+}
+
+// Type representing the parser state over a byte slice
+type parser struct {
+	data     []byte
+	pos      int
+	explicit bool
+	// nesting level of the sequence items
+	depth int
+	// stop at the pixel data of the top level dataset
+	headerOnly bool
+}
+
+func (p *parser) uint16() (uint16, error) {
+	if p.pos+2 > len(p.data) {
+		return 0, ErrMalformed
+	}
+	v := binary.LittleEndian.Uint16(p.data[p.pos:])
+	p.pos += 2
+	return v, nil
+}
+
+func (p *parser) uint32() (uint32, error) {
+	if p.pos+4 > len(p.data) {
+		return 0, ErrMalformed
+	}
+	v := binary.LittleEndian.Uint32(p.data[p.pos:])
+	p.pos += 4
+	return v, nil
+}
+
+func (p *parser) bytes(n uint32) ([]byte, error) {
+	if uint64(p.pos)+uint64(n) > uint64(len(p.data)) {
+		return nil, ErrMalformed
+	}
+	v := p.data[p.pos : p.pos+int(n)]
+	p.pos += int(n)
+	return v, nil
+}
+
+func (p *parser) header() (uint32, string, uint32, error) {
+	group, err := p.uint16()
+	if err != nil {
+		return 0, "", 0, err
+	}
+	element, err := p.uint16()
+	if err != nil {
+		return 0, "", 0, err
+	}
+	t := uint32(group)<<16 | uint32(element)
+
+	// items and delimiters never have a VR
+	if group == 0xFFFE {
+		length, err := p.uint32()
+		return t, "", length, err
+	}
+	if !p.explicit {
+		length, err := p.uint32()
+		return t, DictionaryVR(t), length, err
+	}
+	vrBytes, err := p.bytes(2)
+	if err != nil {
+		return 0, "", 0, err
+	}
+	vr := string(vrBytes)
+	if IsLongVR(vr) {
+		p.pos += 2
+		length, err := p.uint32()
+		return t, vr, length, err
+	}
+	length, err := p.uint16()
+	return t, vr, uint32(length), err
+}
+
+// dataset parses elements until the end offset or an item delimitation
+func (p *parser) dataset(end int) (*Dataset, error) {
+	ds := &Dataset{}
+	for p.pos < end {
+		t, vr, length, err := p.header()
+		if err != nil {
+			return nil, err
+		}
+		if t == TagItemDelimitation {
+			return ds, nil
+		}
+		if p.headerOnly && p.depth == 0 && t >= TagPixelData {
+			p.pos = end
+			return ds, nil
+		}
+		e := &Element{Tag: t, VR: vr}
+		switch {
+		case t == TagPixelData && length == UndefinedLength:
+			e.Encapsulated = true
+			if e.Fragments, err = p.fragments(); err != nil {
+				return nil, err
+			}
+		case vr == "SQ" || length == UndefinedLength:
+			// unknown elements of undefined length are sequences encoded in implicit VR
+			e.VR = "SQ"
+			e.Sequence = true
+			explicit := p.explicit
+			if vr == "UN" {
+				p.explicit = false
+			}
+			e.Items, err = p.items(length)
+			p.explicit = explicit
+			if err != nil {
+				return nil, err
+			}
+		default:
+			if e.Value, err = p.bytes(length); err != nil {
+				return nil, err
+			}
+		}
+		ds.Elements = append(ds.Elements, e)
+	}
+	return ds, nil
+}
+
+// items parses the items of a sequence
+func (p *parser) items(length uint32) ([]*Dataset, error) {
+	end := len(p.data)
+	if length != UndefinedLength {
+		end = p.pos + int(length)
+	}
+	var items []*Dataset
+	for p.pos < end {
+		t, _, itemLength, err := p.header()
+		if err != nil {
+			return nil, err
+		}
+		if t == TagSequenceDelimitation {
+			break
+		}
+		if t != TagItem {
+			return nil, fmt.Errorf("%w: item expected, found %08x", ErrMalformed, t)
+		}
+		itemEnd := len(p.data)
+		if itemLength != UndefinedLength {
+			itemEnd = p.pos + int(itemLength)
+		}
+		p.depth++
+		item, err := p.dataset(itemEnd)
+		p.depth--
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// fragments parses encapsulated pixel data
+func (p *parser) fragments() ([][]byte, error) {
+	var fragments [][]byte
+	for {
+		t, _, length, err := p.header()
+		if err != nil {
+			return nil, err
+		}
+		if t == TagSequenceDelimitation {
+			return fragments, nil
+		}
+		if t != TagItem {
+			return nil, fmt.Errorf("%w: fragment expected, found %08x", ErrMalformed, t)
+		}
+		fragment, err := p.bytes(length)
+		if err != nil {
+			return nil, err
+		}
+		fragments = append(fragments, fragment)
+	}
+}
+
+// Parse parses a DICOM file with meta information
+func Parse(data []byte) (*File, error) {
+	return parse(data, false)
+}
+
+// ParseHeader parses a DICOM file up to the pixel data, the data may end after the header
+func ParseHeader(data []byte) (*File, error) {
+	return parse(data, true)
+}
+
+func parse(data []byte, headerOnly bool) (*File, error) {
+	if len(data) < PreambleLength || !bytes.Equal(data[128:PreambleLength], []byte("DICM")) {
+		return nil, ErrNoDicomFile
+	}
+
+	// meta information is explicit VR little endian
+	p := &parser{data: data, pos: PreambleLength, explicit: true}
+	meta := &Dataset{}
+	for p.pos+2 <= len(data) && binary.LittleEndian.Uint16(data[p.pos:]) == 0x0002 {
+		t, vr, length, err := p.header()
+		if err != nil {
+			return nil, err
+		}
+		value, err := p.bytes(length)
+		if err != nil {
+			return nil, err
+		}
+		meta.Elements = append(meta.Elements, &Element{Tag: t, VR: vr, Value: value})
+	}
+	f := &File{Meta: meta, TransferSyntax: meta.String(TagTransferSyntax)}
+
+	// dataset in the transfer syntax
+	switch f.TransferSyntax {
+	case ImplicitVRLittleEndian:
+		p.explicit = false
+	case ExplicitVRLittleEndian, RLELossless:
+	case DeflatedExplicitVRLittleEndian:
+		inflated, err := Inflate(data[p.pos:])
+		if err != nil {
+			return nil, err
+		}
+		p = &parser{data: inflated, explicit: true}
+	default:
+		if !IsEncapsulatedSyntax(f.TransferSyntax) {
+			return nil, fmt.Errorf("unsupported transfer syntax: %q", f.TransferSyntax)
+		}
+	}
+	p.headerOnly = headerOnly
+	ds, err := p.dataset(len(p.data))
+	if err != nil {
+		return nil, err
+	}
+	f.Dataset = ds
+	return f, nil
+}
+
+// Type representing the writer of elements
+type writer struct {
+	w        io.Writer
+	explicit bool
+	buf      [12]byte
+	err      error
+}
+
+func (w *writer) write(p []byte) {
+	if w.err == nil {
+		_, w.err = w.w.Write(p)
+	}
+}
+
+func (w *writer) header(t uint32, vr string, length uint32) {
+	binary.LittleEndian.PutUint16(w.buf[0:], uint16(t>>16))
+	binary.LittleEndian.PutUint16(w.buf[2:], uint16(t))
+	if t>>16 == 0xFFFE || !w.explicit {
+		binary.LittleEndian.PutUint32(w.buf[4:], length)
+		w.write(w.buf[:8])
+		return
+	}
+	copy(w.buf[4:], vr)
+	if IsLongVR(vr) {
+		binary.LittleEndian.PutUint16(w.buf[6:], 0)
+		binary.LittleEndian.PutUint32(w.buf[8:], length)
+		w.write(w.buf[:12])
+		return
+	}
+	binary.LittleEndian.PutUint16(w.buf[6:], uint16(length))
+	w.write(w.buf[:8])
+}
+
+func (w *writer) dataset(ds *Dataset) {
+	for _, e := range ds.Elements {
+		w.element(e)
+	}
+}
+
+// element writes sequences and items with undefined length, valid in every transfer syntax
+func (w *writer) element(e *Element) {
+	switch {
+	case e.Sequence:
+		w.header(e.Tag, "SQ", UndefinedLength)
+		for _, item := range e.Items {
+			w.header(TagItem, "", UndefinedLength)
+			w.dataset(item)
+			w.header(TagItemDelimitation, "", 0)
+		}
+		w.header(TagSequenceDelimitation, "", 0)
+	case e.Encapsulated:
+		w.header(e.Tag, "OB", UndefinedLength)
+		for _, fragment := range e.Fragments {
+			w.header(TagItem, "", uint32(len(fragment)))
+			w.write(fragment)
+		}
+		w.header(TagSequenceDelimitation, "", 0)
+	default:
+		vr := e.VR
+		if w.explicit && !IsLongVR(vr) && len(e.Value) > 0xFFFF {
+			vr = "UN"
+		}
+		w.header(e.Tag, vr, uint32(len(e.Value)))
+		w.write(e.Value)
+	}
+}
+
+// PadValue pads a string value to even length
+func PadValue(v string, pad byte) []byte {
+	b := []byte(v)
+	if len(b)%2 == 1 {
+		b = append(b, pad)
+	}
+	return b
+}
+
+// WriteMeta writes preamble and meta information with the transfer syntax and recalculated group length
+func WriteMeta(w io.Writer, meta *Dataset, transferSyntax string) error {
+	meta.Set(&Element{Tag: TagTransferSyntax, VR: "UI", Value: PadValue(transferSyntax, 0)})
+	var group bytes.Buffer
+	mw := &writer{w: &group, explicit: true}
+	for _, e := range meta.Elements {
+		if e.Tag != TagGroupLength {
+			mw.element(e)
+		}
+	}
+	length := make([]byte, 4)
+	binary.LittleEndian.PutUint32(length, uint32(group.Len()))
+
+	out := &writer{w: w, explicit: true}
+	out.write(make([]byte, 128))
+	out.write([]byte("DICM"))
+	out.element(&Element{Tag: TagGroupLength, VR: "UL", Value: length})
+	out.write(group.Bytes())
+	return out.err
+}
+
+// Write writes the file in the transfer syntax, the pixel data has to match the transfer syntax
+func (f *File) Write(w io.Writer, transferSyntax string) error {
+	if err := WriteMeta(w, f.Meta, transferSyntax); err != nil {
+		return err
+	}
+	switch transferSyntax {
+	case ImplicitVRLittleEndian:
+		dw := &writer{w: w}
+		dw.dataset(f.Dataset)
+		return dw.err
+	case ExplicitVRLittleEndian, RLELossless:
+		dw := &writer{w: w, explicit: true}
+		dw.dataset(f.Dataset)
+		return dw.err
+	case DeflatedExplicitVRLittleEndian:
+		return Deflate(w, func(dw io.Writer) error {
+			ew := &writer{w: dw, explicit: true}
+			ew.dataset(f.Dataset)
+			return ew.err
+		})
+	}
+	if IsEncapsulatedSyntax(transferSyntax) {
+		dw := &writer{w: w, explicit: true}
+		dw.dataset(f.Dataset)
+		return dw.err
+	}
+	return fmt.Errorf("unsupported transfer syntax: %q", transferSyntax)
+}
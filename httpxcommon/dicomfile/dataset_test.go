@@ -0,0 +1,145 @@
+package dicomfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// us returns the value of an US element
+func us(v int) []byte {
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, uint16(v))
+	return b
+}
+
+// testFile returns a file with a sequence and native 16-bit pixel data of two frames
+func testFile() (*File, PixelLayout) {
+	layout := PixelLayout{Rows: 5, Columns: 7, Samples: 1, BytesPerValue: 2, Frames: 2}
+	return &File{
+		Meta: &Dataset{Elements: []*Element{
+			{Tag: 0x00020002, VR: "UI", Value: PadValue("1.2.840.10008.5.1.4.1.1.7", 0)},
+			{Tag: 0x00020003, VR: "UI", Value: PadValue("1.2.3.4.5", 0)},
+		}},
+		Dataset: &Dataset{Elements: []*Element{
+			{Tag: 0x00080016, VR: "UI", Value: PadValue("1.2.840.10008.5.1.4.1.1.7", 0)},
+			{Tag: TagSOPInstanceUID, VR: "UI", Value: PadValue("1.2.3.4.5", 0)},
+			{Tag: 0x00100010, VR: "PN", Value: PadValue("Doe^John", ' ')},
+			{Tag: TagStudyInstanceUID, VR: "UI", Value: PadValue("1.2.3", 0)},
+			{Tag: 0x00081115, VR: "SQ", Sequence: true, Items: []*Dataset{
+				{Elements: []*Element{{Tag: TagSeriesInstanceUID, VR: "UI", Value: PadValue("1.2.3.4", 0)}}},
+				{Elements: []*Element{{Tag: 0x00081150, VR: "UI", Value: PadValue("1.2.840.10008.5.1.4.1.1.7", 0)}}},
+			}},
+			{Tag: TagSamplesPerPixel, VR: "US", Value: us(layout.Samples)},
+			{Tag: TagPhotometric, VR: "CS", Value: PadValue("MONOCHROME2", ' ')},
+			{Tag: TagNumberOfFrames, VR: "IS", Value: PadValue(fmt.Sprint(layout.Frames), ' ')},
+			{Tag: TagRows, VR: "US", Value: us(layout.Rows)},
+			{Tag: TagColumns, VR: "US", Value: us(layout.Columns)},
+			{Tag: TagBitsAllocated, VR: "US", Value: us(8 * layout.BytesPerValue)},
+			{Tag: TagPixelData, VR: "OW", Value: pixels(layout.FrameSize() * layout.Frames)},
+		}},
+	}, layout
+}
+
+// equalDatasets compares the tags and values of the elements, the VR is lost in implicit VR
+func equalDatasets(t *testing.T, got *Dataset, want *Dataset) {
+	t.Helper()
+	if len(got.Elements) != len(want.Elements) {
+		t.Fatalf("%d elements, want %d", len(got.Elements), len(want.Elements))
+	}
+	for i, w := range want.Elements {
+		g := got.Elements[i]
+		if g.Tag != w.Tag || g.Sequence != w.Sequence || g.Encapsulated != w.Encapsulated || !bytes.Equal(g.Value, w.Value) {
+			t.Errorf("element %08X: got %08X %q, want %q", w.Tag, g.Tag, g.Value, w.Value)
+			continue
+		}
+		if len(g.Items) != len(w.Items) || len(g.Fragments) != len(w.Fragments) {
+			t.Errorf("element %08X: %d items %d fragments, want %d %d", w.Tag, len(g.Items), len(g.Fragments), len(w.Items), len(w.Fragments))
+			continue
+		}
+		for k := range w.Items {
+			equalDatasets(t, g.Items[k], w.Items[k])
+		}
+		for k := range w.Fragments {
+			if !bytes.Equal(g.Fragments[k], w.Fragments[k]) {
+				t.Errorf("element %08X: fragment %d differs", w.Tag, k)
+			}
+		}
+	}
+}
+
+func TestWriteParse(t *testing.T) {
+	tests := []struct {
+		name           string
+		transferSyntax string
+	}{
+		{"implicit", ImplicitVRLittleEndian},
+		{"explicit", ExplicitVRLittleEndian},
+		{"deflate", DeflatedExplicitVRLittleEndian},
+		{"rle", RLELossless},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, layout := testFile()
+			if tt.transferSyntax == RLELossless {
+				fragments, err := EncodeRLE(f.Dataset.Find(TagPixelData).Value, layout)
+				if err != nil {
+					t.Fatal(err)
+				}
+				f.Dataset.Set(&Element{Tag: TagPixelData, VR: "OB", Encapsulated: true, Fragments: append([][]byte{offsetTable(fragments)}, fragments...)})
+			}
+			var out bytes.Buffer
+			if err := f.Write(&out, tt.transferSyntax); err != nil {
+				t.Fatal(err)
+			}
+			if ts, err := ReadTransferSyntax(bytes.NewReader(out.Bytes())); err != nil || ts != tt.transferSyntax {
+				t.Errorf("transfer syntax %q %v, want %q", ts, err, tt.transferSyntax)
+			}
+			parsed, err := Parse(out.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if parsed.TransferSyntax != tt.transferSyntax {
+				t.Errorf("parsed transfer syntax %q, want %q", parsed.TransferSyntax, tt.transferSyntax)
+			}
+			equalDatasets(t, parsed.Dataset, f.Dataset)
+
+			// the header ends before the pixel data
+			header, err := ParseHeader(out.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if header.Dataset.Find(TagPixelData) != nil || header.Dataset.String(TagStudyInstanceUID) != "1.2.3" {
+				t.Error("header not parsed up to the pixel data")
+			}
+		})
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	f, _ := testFile()
+	var out bytes.Buffer
+	if err := f.Write(&out, ExplicitVRLittleEndian); err != nil {
+		t.Fatal(err)
+	}
+	data := out.Bytes()
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"empty", nil, ErrNoDicomFile},
+		{"no prefix", append(make([]byte, 128), []byte("DICX")...), ErrNoDicomFile},
+		{"truncated pixel data", data[:len(data)-10], ErrMalformed},
+		{"truncated header", data[:len(data)-len(f.Dataset.Find(TagPixelData).Value)-5], ErrMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Parse(tt.data); !errors.Is(err, tt.want) {
+				t.Errorf("error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package dicomfile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// transfer syntaxes known by the server
+const (
+	ImplicitVRLittleEndian         = "1.2.840.10008.1.2"
+	ExplicitVRLittleEndian         = "1.2.840.10008.1.2.1"
+	DeflatedExplicitVRLittleEndian = "1.2.840.10008.1.2.1.99"
+	ExplicitVRBigEndian            = "1.2.840.10008.1.2.2"
+	RLELossless                    = "1.2.840.10008.1.2.5"
+)
+
+// length of the preamble and the DICM prefix
+const PreambleLength = 132
+
+// ErrNoDicomFile is returned if the DICM prefix or the file meta information is missing
+var ErrNoDicomFile = errors.New("no DICOM file with meta information")
+
+// IsEncapsulatedSyntax returns true for the compressed transfer syntaxes, their datasets are explicit VR little endian
+func IsEncapsulatedSyntax(transferSyntax string) bool {
+	switch transferSyntax {
+	case ImplicitVRLittleEndian, ExplicitVRLittleEndian, DeflatedExplicitVRLittleEndian, ExplicitVRBigEndian:
+		return false
+	}
+	return strings.HasPrefix(transferSyntax, "1.2.840.10008.1.2.")
+}
+
+// IsLongVR returns true for the value representations using a 4 byte length in explicit VR
+func IsLongVR(vr string) bool {
+	switch vr {
+	case "OB", "OD", "OF", "OL", "OV", "OW", "SQ", "SV", "UC", "UN", "UR", "UT", "UV":
+		return true
+	}
+	return false
+}
+
+// ReadTransferSyntax reads the transfer syntax uid from the file meta information
+func ReadTransferSyntax(r io.Reader) (string, error) {
+	reader := bufio.NewReader(r)
+	preamble := make([]byte, PreambleLength)
+	if _, err := io.ReadFull(reader, preamble); err != nil {
+		return "", ErrNoDicomFile
+	}
+	if !bytes.Equal(preamble[128:], []byte("DICM")) {
+		return "", ErrNoDicomFile
+	}
+
+	// meta information is always explicit VR little endian
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return "", ErrNoDicomFile
+		}
+		group := binary.LittleEndian.Uint16(header[0:])
+		element := binary.LittleEndian.Uint16(header[2:])
+		if group != 0x0002 {
+			return "", ErrNoDicomFile
+		}
+		vr := string(header[4:6])
+		length := uint32(binary.LittleEndian.Uint16(header[6:]))
+		if IsLongVR(vr) {
+			if _, err := io.ReadFull(reader, header[:4]); err != nil {
+				return "", ErrNoDicomFile
+			}
+			length = binary.LittleEndian.Uint32(header[:4])
+		}
+		value := make([]byte, length)
+		if _, err := io.ReadFull(reader, value); err != nil {
+			return "", ErrNoDicomFile
+		}
+		if element == 0x0010 {
+			return strings.TrimRight(string(value), "\x00 "), nil
+		}
+	}
+}
+
+// ReadFileTransferSyntax reads the transfer syntax uid of a file
+func ReadFileTransferSyntax(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	return ReadTransferSyntax(file)
+}
+
+// header bytes read before the whole file is parsed
+const headerPrefixLength = 1024 * 1024
+
+// ReadFileHeader parses the dataset of a file up to the pixel data, large files are read completely only if the header does not fit into the prefix
+func ReadFileHeader(path string) (*File, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	prefix, err := io.ReadAll(io.LimitReader(file, headerPrefixLength))
+	if err != nil {
+		return nil, err
+	}
+	f, err := ParseHeader(prefix)
+	if err == nil || len(prefix) < headerPrefixLength {
+		return f, err
+	}
+	rest, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParseHeader(append(prefix, rest...))
+}
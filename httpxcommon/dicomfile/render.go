@@ -0,0 +1,230 @@
+package dicomfile
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+)
+
+// ErrUnsupportedImage is returned if the pixel data cannot be rendered
+var ErrUnsupportedImage = errors.New("image cannot be rendered")
+
+// Type representing a linear VOI window
+type Window struct {
+	Center float64
+	Width  float64
+}
+
+// WindowFromDataset returns the first window of the header, false if there is none
+func WindowFromDataset(ds *Dataset) (Window, bool) {
+	center, okCenter := ds.Float(TagWindowCenter)
+	width, okWidth := ds.Float(TagWindowWidth)
+	if !okCenter || !okWidth || width < 1 {
+		return Window{}, false
+	}
+	return Window{Center: center, Width: width}, true
+}
+
+// apply maps a modality value to 8 bit (PS3.3 C.11.2.1.2 linear function)
+func (w Window) apply(x float64) uint8 {
+	width := math.Max(w.Width, 1)
+	low := w.Center - 0.5 - (width-1)/2
+	high := w.Center - 0.5 + (width-1)/2
+	switch {
+	case x <= low:
+		return 0
+	case x > high:
+		return 255
+	}
+	return uint8(math.Round(((x-(w.Center-0.5))/(width-1) + 0.5) * 255))
+}
+
+// Frame returns the native pixel data of the frame, RLE fragments are decoded
+func (f *File) Frame(n int) ([]byte, PixelLayout, error) {
+	layout, err := NewPixelLayout(f.Dataset)
+	if err != nil {
+		return nil, layout, err
+	}
+	if n < 0 || n >= layout.Frames {
+		return nil, layout, fmt.Errorf("%w: frame %d of %d", ErrUnsupportedImage, n+1, layout.Frames)
+	}
+	pixel := f.Dataset.Find(TagPixelData)
+	if pixel == nil {
+		return nil, layout, fmt.Errorf("%w: no pixel data", ErrUnsupportedImage)
+	}
+	frame := layout
+	frame.Frames = 1
+	if pixel.Encapsulated {
+		if f.TransferSyntax != RLELossless || len(pixel.Fragments) < n+2 {
+			return nil, layout, fmt.Errorf("%w: encapsulated in %s", ErrUnsupportedImage, f.TransferSyntax)
+		}
+		native, err := DecodeRLE(pixel.Fragments[n+1:n+2], frame)
+		return native, layout, err
+	}
+	size := layout.FrameSize()
+	if len(pixel.Value) < (n+1)*size {
+		return nil, layout, fmt.Errorf("%w: pixel data too short", ErrMalformed)
+	}
+	return pixel.Value[n*size : (n+1)*size], layout, nil
+}
+
+// Render converts the frame to an 8 bit image, monochrome frames use the window or the range of the values without
+func (f *File) Render(n int, window *Window) (image.Image, error) {
+	native, layout, err := f.Frame(n)
+	if err != nil {
+		return nil, err
+	}
+	// decoded fragments and headers of damaged files may not match the layout
+	if len(native) < layout.FrameSize() {
+		return nil, fmt.Errorf("%w: %d bytes of pixel data for %dx%d pixels", ErrUnsupportedImage, len(native), layout.Columns, layout.Rows)
+	}
+	photometric := f.Dataset.String(TagPhotometric)
+	switch {
+	case layout.Samples == 1 && strings.HasPrefix(photometric, "MONOCHROME"):
+		return f.renderMonochrome(native, layout, window, photometric == "MONOCHROME1")
+	case layout.Samples == 3 && layout.BytesPerValue == 1 && (photometric == "RGB" || photometric == "YBR_FULL"):
+		return renderColor(native, layout, photometric == "YBR_FULL"), nil
+	}
+	return nil, fmt.Errorf("%w: %s with %d samples of %d bytes", ErrUnsupportedImage, photometric, layout.Samples, layout.BytesPerValue)
+}
+
+// renderMonochrome applies the modality rescale and the window
+func (f *File) renderMonochrome(native []byte, l PixelLayout, window *Window, inverse bool) (image.Image, error) {
+	if l.BytesPerValue > 2 {
+		return nil, fmt.Errorf("%w: %d bytes per value", ErrUnsupportedImage, l.BytesPerValue)
+	}
+	bitsStored := f.Dataset.Uint16(TagBitsStored, 8*l.BytesPerValue)
+	if bitsStored < 1 || bitsStored > 8*l.BytesPerValue {
+		return nil, fmt.Errorf("%w: %d bits stored in %d bytes", ErrUnsupportedImage, bitsStored, l.BytesPerValue)
+	}
+	signed := f.Dataset.Uint16(TagPixelRepresentation, 0) == 1
+	slope, ok := f.Dataset.Float(TagRescaleSlope)
+	if !ok {
+		slope = 1
+	}
+	intercept, _ := f.Dataset.Float(TagRescaleIntercept)
+
+	// modality values of all pixels
+	pixels := l.Rows * l.Columns
+	values := make([]float64, pixels)
+	mask := uint32(1)<<bitsStored - 1
+	low, high := math.Inf(1), math.Inf(-1)
+	for p := 0; p < pixels; p++ {
+		var raw uint32
+		if l.BytesPerValue == 2 {
+			raw = uint32(binary.LittleEndian.Uint16(native[2*p:]))
+		} else {
+			raw = uint32(native[p])
+		}
+		raw &= mask
+		v := float64(raw)
+		if signed && raw&(1<<(bitsStored-1)) != 0 {
+			v -= float64(mask + 1)
+		}
+		v = v*slope + intercept
+		values[p] = v
+		low = math.Min(low, v)
+		high = math.Max(high, v)
+	}
+
+	// full range of the frame if no window is known
+	w := Window{Center: (low + high + 1) / 2, Width: high - low + 1}
+	if window != nil {
+		w = *window
+	}
+	img := image.NewGray(image.Rect(0, 0, l.Columns, l.Rows))
+	for p, v := range values {
+		g := w.apply(v)
+		if inverse {
+			g = 255 - g
+		}
+		img.Pix[p] = g
+	}
+	return img, nil
+}
+
+// renderColor converts 8 bit color frames in pixel or plane order
+func renderColor(native []byte, l PixelLayout, ybr bool) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, l.Columns, l.Rows))
+	pixels := l.Rows * l.Columns
+	for p := 0; p < pixels; p++ {
+		c0, c1, c2 := native[l.offset(p, 0, 0)], native[l.offset(p, 1, 0)], native[l.offset(p, 2, 0)]
+		if ybr {
+			c0, c1, c2 = color.YCbCrToRGB(c0, c1, c2)
+		}
+		img.Pix[4*p], img.Pix[4*p+1], img.Pix[4*p+2], img.Pix[4*p+3] = c0, c1, c2, 255
+	}
+	return img
+}
+
+// FitViewport returns the size fitting into the viewport with the aspect ratio of the image, a zero dimension is not limited.
+// Images are never enlarged, so the size of the rendered image is bounded by the stored one.
+func FitViewport(width int, height int, viewportWidth int, viewportHeight int) (int, int) {
+	if viewportWidth <= 0 && viewportHeight <= 0 {
+		return width, height
+	}
+	scale := 1.0
+	if viewportWidth > 0 {
+		scale = math.Min(scale, float64(viewportWidth)/float64(width))
+	}
+	if viewportHeight > 0 {
+		scale = math.Min(scale, float64(viewportHeight)/float64(height))
+	}
+	return int(math.Max(1, math.Round(float64(width)*scale))), int(math.Max(1, math.Round(float64(height)*scale)))
+}
+
+// Scale resizes rendered images averaging the covered source pixels, larger sizes repeat pixels
+func Scale(img image.Image, width int, height int) image.Image {
+	b := img.Bounds()
+	if b.Dx() == width && b.Dy() == height {
+		return img
+	}
+	switch src := img.(type) {
+	case *image.Gray:
+		dst := image.NewGray(image.Rect(0, 0, width, height))
+		scalePix(dst.Pix, src.Pix, 1, b.Dx(), b.Dy(), width, height)
+		return dst
+	case *image.RGBA:
+		dst := image.NewRGBA(image.Rect(0, 0, width, height))
+		scalePix(dst.Pix, src.Pix, 4, b.Dx(), b.Dy(), width, height)
+		return dst
+	}
+	return img
+}
+
+// scalePix is a box filter on packed pixels with the given number of channels
+func scalePix(dst []byte, src []byte, channels int, sw int, sh int, dw int, dh int) {
+	sum := make([]int, channels)
+	for y := 0; y < dh; y++ {
+		y0 := y * sh / dh
+		y1 := max((y+1)*sh/dh, y0+1)
+		for x := 0; x < dw; x++ {
+			x0 := x * sw / dw
+			x1 := max((x+1)*sw/dw, x0+1)
+			for c := range sum {
+				sum[c] = 0
+			}
+			for sy := y0; sy < y1; sy++ {
+				row := src[(sy*sw+x0)*channels : (sy*sw+x1)*channels]
+				for i, v := range row {
+					sum[i%channels] += int(v)
+				}
+			}
+			n := (y1 - y0) * (x1 - x0)
+			for c := range sum {
+				dst[(y*dw+x)*channels+c] = uint8((sum[c] + n/2) / n)
+			}
+		}
+	}
+}
+
+func max(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,30 @@
+package dicomfile
+
+import "testing"
+
+func TestFitViewport(t *testing.T) {
+	tests := []struct {
+		name                          string
+		width, height                 int
+		viewportWidth, viewportHeight int
+		wantWidth, wantHeight         int
+	}{
+		{"no viewport", 512, 256, 0, 0, 512, 256},
+		{"smaller width", 512, 256, 128, 0, 128, 64},
+		{"smaller height", 512, 256, 0, 64, 128, 64},
+		{"both limit", 512, 256, 256, 32, 64, 32},
+		{"larger viewport keeps the size", 512, 512, 100000, 100000, 512, 512},
+		{"larger width only", 512, 256, 4096, 0, 512, 256},
+		{"one dimension larger", 512, 256, 4096, 128, 256, 128},
+		{"at least one pixel", 1000, 1, 10, 0, 10, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			width, height := FitViewport(tt.width, tt.height, tt.viewportWidth, tt.viewportHeight)
+			if width != tt.wantWidth || height != tt.wantHeight {
+				t.Errorf("FitViewport(%d, %d, %d, %d) = %d, %d, want %d, %d", tt.width, tt.height, tt.viewportWidth, tt.viewportHeight,
+					width, height, tt.wantWidth, tt.wantHeight)
+			}
+		})
+	}
+}
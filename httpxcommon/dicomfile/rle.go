@@ -0,0 +1,197 @@
+package dicomfile
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// maximum number of segments of an RLE frame
+const rleMaxSegments = 15
+
+// length of the RLE header with number of segments and offsets
+const rleHeaderLength = 64
+
+// ErrRLE is returned if RLE data cannot be encoded or decoded
+var ErrRLE = errors.New("invalid RLE data")
+
+// Type representing the layout of native pixel data
+type PixelLayout struct {
+	Rows          int
+	Columns       int
+	Samples       int
+	BytesPerValue int
+	Planar        bool
+	Frames        int
+}
+
+// NewPixelLayout reads the layout from the image pixel module of the dataset
+func NewPixelLayout(ds *Dataset) (PixelLayout, error) {
+	l := PixelLayout{
+		Rows:          ds.Uint16(TagRows, 0),
+		Columns:       ds.Uint16(TagColumns, 0),
+		Samples:       ds.Uint16(TagSamplesPerPixel, 1),
+		BytesPerValue: (ds.Uint16(TagBitsAllocated, 8) + 7) / 8,
+		Planar:        ds.Uint16(TagPlanarConfiguration, 0) == 1,
+		Frames:        ds.Int(TagNumberOfFrames, 1),
+	}
+	if l.Rows == 0 || l.Columns == 0 || l.Frames < 1 {
+		return l, fmt.Errorf("%w: missing image size", ErrRLE)
+	}
+	if l.Samples*l.BytesPerValue > rleMaxSegments {
+		return l, fmt.Errorf("%w: %d segments not supported", ErrRLE, l.Samples*l.BytesPerValue)
+	}
+	return l, nil
+}
+
+// FrameSize returns the number of bytes of a native frame
+func (l PixelLayout) FrameSize() int {
+	return l.Rows * l.Columns * l.Samples * l.BytesPerValue
+}
+
+// offset returns the position of a byte of a sample of a pixel in a native frame (little endian)
+func (l PixelLayout) offset(pixel int, sample int, b int) int {
+	pixels := l.Rows * l.Columns
+	if l.Planar {
+		return (sample*pixels+pixel)*l.BytesPerValue + b
+	}
+	return (pixel*l.Samples+sample)*l.BytesPerValue + b
+}
+
+// segments are ordered by sample and from the most significant byte
+func (l PixelLayout) segmentByte(segment int) (int, int) {
+	return segment / l.BytesPerValue, l.BytesPerValue - 1 - segment%l.BytesPerValue
+}
+
+// EncodeRLE encodes all frames of native pixel data into RLE fragments (without offset table)
+func EncodeRLE(native []byte, l PixelLayout) ([][]byte, error) {
+	frameSize := l.FrameSize()
+	if len(native) < frameSize*l.Frames {
+		return nil, fmt.Errorf("%w: pixel data too short", ErrRLE)
+	}
+	pixels := l.Rows * l.Columns
+	segments := l.Samples * l.BytesPerValue
+	plane := make([]byte, pixels)
+	var fragments [][]byte
+	for f := 0; f < l.Frames; f++ {
+		frame := native[f*frameSize : (f+1)*frameSize]
+		out := make([]byte, rleHeaderLength, rleHeaderLength+frameSize)
+		binary.LittleEndian.PutUint32(out, uint32(segments))
+		for s := 0; s < segments; s++ {
+			binary.LittleEndian.PutUint32(out[4+4*s:], uint32(len(out)))
+			sample, b := l.segmentByte(s)
+			for p := 0; p < pixels; p++ {
+				plane[p] = frame[l.offset(p, sample, b)]
+			}
+			out = packBits(out, plane)
+			if len(out)%2 == 1 {
+				out = append(out, 0)
+			}
+		}
+		fragments = append(fragments, out)
+	}
+	return fragments, nil
+}
+
+// DecodeRLE decodes the RLE fragments (one per frame, without offset table) into native pixel data
+func DecodeRLE(fragments [][]byte, l PixelLayout) ([]byte, error) {
+	if len(fragments) < l.Frames {
+		return nil, fmt.Errorf("%w: %d fragments for %d frames", ErrRLE, len(fragments), l.Frames)
+	}
+	frameSize := l.FrameSize()
+	pixels := l.Rows * l.Columns
+	native := make([]byte, frameSize*l.Frames)
+	plane := make([]byte, pixels)
+	for f := 0; f < l.Frames; f++ {
+		fragment := fragments[f]
+		if len(fragment) < rleHeaderLength {
+			return nil, ErrRLE
+		}
+		segments := int(binary.LittleEndian.Uint32(fragment))
+		if segments != l.Samples*l.BytesPerValue {
+			return nil, fmt.Errorf("%w: %d segments, expected %d", ErrRLE, segments, l.Samples*l.BytesPerValue)
+		}
+		frame := native[f*frameSize : (f+1)*frameSize]
+		for s := 0; s < segments; s++ {
+			start := int(binary.LittleEndian.Uint32(fragment[4+4*s:]))
+			end := len(fragment)
+			if s+1 < segments {
+				end = int(binary.LittleEndian.Uint32(fragment[4+4*(s+1):]))
+			}
+			if start < rleHeaderLength || start > end || end > len(fragment) {
+				return nil, ErrRLE
+			}
+			if err := unpackBits(plane, fragment[start:end]); err != nil {
+				return nil, err
+			}
+			sample, b := l.segmentByte(s)
+			for p := 0; p < pixels; p++ {
+				frame[l.offset(p, sample, b)] = plane[p]
+			}
+		}
+	}
+	return native, nil
+}
+
+// packBits appends the PackBits encoding of the data
+func packBits(out []byte, data []byte) []byte {
+	for i := 0; i < len(data); {
+		// replicate run
+		run := 1
+		for i+run < len(data) && run < 128 && data[i+run] == data[i] {
+			run++
+		}
+		if run > 1 {
+			out = append(out, byte(257-run), data[i])
+			i += run
+			continue
+		}
+		// literal run until the next repetition
+		start := i
+		for i < len(data) && i-start < 128 {
+			if i+1 < len(data) && data[i+1] == data[i] {
+				break
+			}
+			i++
+		}
+		if i == start {
+			i++
+		}
+		out = append(out, byte(i-start-1))
+		out = append(out, data[start:i]...)
+	}
+	return out
+}
+
+// unpackBits decodes a PackBits segment into the plane
+func unpackBits(plane []byte, segment []byte) error {
+	pos := 0
+	for i := 0; i < len(segment) && pos < len(plane); {
+		n := int8(segment[i])
+		i++
+		switch {
+		case n >= 0:
+			count := int(n) + 1
+			if i+count > len(segment) || pos+count > len(plane) {
+				return ErrRLE
+			}
+			copy(plane[pos:], segment[i:i+count])
+			pos += count
+			i += count
+		case n != -128:
+			count := 1 - int(n)
+			if i >= len(segment) || pos+count > len(plane) {
+				return ErrRLE
+			}
+			for k := 0; k < count; k++ {
+				plane[pos+k] = segment[i]
+			}
+			pos += count
+			i++
+		}
+	}
+	if pos != len(plane) {
+		return fmt.Errorf("%w: segment decoded to %d of %d bytes", ErrRLE, pos, len(plane))
+	}
+	return nil
+}
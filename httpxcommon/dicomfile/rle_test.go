@@ -0,0 +1,110 @@
+package dicomfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// pixels returns native pixel data with replicate and literal runs
+func pixels(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		switch {
+		case i%300 < 140:
+			data[i] = byte(i / 140)
+		default:
+			data[i] = byte(i*31 + i/7)
+		}
+	}
+	return data
+}
+
+func TestRLERoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		layout PixelLayout
+	}{
+		{"8-bit", PixelLayout{Rows: 16, Columns: 32, Samples: 1, BytesPerValue: 1, Frames: 1}},
+		{"16-bit", PixelLayout{Rows: 16, Columns: 32, Samples: 1, BytesPerValue: 2, Frames: 1}},
+		{"8-bit rgb", PixelLayout{Rows: 16, Columns: 32, Samples: 3, BytesPerValue: 1, Frames: 1}},
+		{"8-bit rgb planar", PixelLayout{Rows: 16, Columns: 32, Samples: 3, BytesPerValue: 1, Planar: true, Frames: 1}},
+		{"16-bit rgb planar", PixelLayout{Rows: 8, Columns: 8, Samples: 3, BytesPerValue: 2, Planar: true, Frames: 1}},
+		{"odd length", PixelLayout{Rows: 3, Columns: 3, Samples: 1, BytesPerValue: 1, Frames: 1}},
+		{"odd length 16-bit rgb", PixelLayout{Rows: 3, Columns: 5, Samples: 3, BytesPerValue: 2, Frames: 1}},
+		{"one pixel", PixelLayout{Rows: 1, Columns: 1, Samples: 1, BytesPerValue: 1, Frames: 1}},
+		{"long runs", PixelLayout{Rows: 64, Columns: 64, Samples: 1, BytesPerValue: 1, Frames: 1}},
+		{"frames", PixelLayout{Rows: 5, Columns: 7, Samples: 1, BytesPerValue: 2, Frames: 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			native := pixels(tt.layout.FrameSize() * tt.layout.Frames)
+			fragments, err := EncodeRLE(native, tt.layout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(fragments) != tt.layout.Frames {
+				t.Fatalf("%d fragments, want %d", len(fragments), tt.layout.Frames)
+			}
+			for i, fragment := range fragments {
+				if len(fragment)%2 == 1 {
+					t.Errorf("fragment %d has odd length %d", i, len(fragment))
+				}
+				if segments := int(binary.LittleEndian.Uint32(fragment)); segments != tt.layout.Samples*tt.layout.BytesPerValue {
+					t.Errorf("fragment %d has %d segments", i, segments)
+				}
+			}
+			decoded, err := DecodeRLE(fragments, tt.layout)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decoded, native) {
+				t.Error("decoded pixel data differs")
+			}
+		})
+	}
+}
+
+func TestRLEMalformed(t *testing.T) {
+	layout := PixelLayout{Rows: 4, Columns: 4, Samples: 1, BytesPerValue: 2, Frames: 1}
+	valid, err := EncodeRLE(pixels(layout.FrameSize()), layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// fragment returns a copy of the valid fragment changed by the function
+	fragment := func(change func(f []byte) []byte) [][]byte {
+		f := append([]byte(nil), valid[0]...)
+		return [][]byte{change(f)}
+	}
+	tests := []struct {
+		name      string
+		fragments [][]byte
+	}{
+		{"no fragment", nil},
+		{"short header", fragment(func(f []byte) []byte { return f[:rleHeaderLength-1] })},
+		{"segment count", fragment(func(f []byte) []byte { binary.LittleEndian.PutUint32(f, 3); return f })},
+		{"offset beyond the fragment", fragment(func(f []byte) []byte { binary.LittleEndian.PutUint32(f[8:], uint32(len(f)+2)); return f })},
+		{"offsets not ascending", fragment(func(f []byte) []byte {
+			binary.LittleEndian.PutUint32(f[4:], binary.LittleEndian.Uint32(f[8:])+1)
+			return f
+		})},
+		{"offset into the header", fragment(func(f []byte) []byte { binary.LittleEndian.PutUint32(f[8:], 8); return f })},
+		{"truncated segment", fragment(func(f []byte) []byte { return f[:len(f)-4] })},
+		{"replicate run over the plane", fragment(func(f []byte) []byte {
+			start := binary.LittleEndian.Uint32(f[4:])
+			f[start], f[start+1] = byte(257-128), 1
+			return f
+		})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DecodeRLE(tt.fragments, layout); !errors.Is(err, ErrRLE) {
+				t.Errorf("error %v, want %v", err, ErrRLE)
+			}
+		})
+	}
+	if _, err := EncodeRLE(make([]byte, layout.FrameSize()-1), layout); !errors.Is(err, ErrRLE) {
+		t.Errorf("short pixel data: error %v, want %v", err, ErrRLE)
+	}
+}
@@ -0,0 +1,118 @@
+package dicomfile
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// TranscodableSyntaxes lists the transfer syntaxes that can be converted into each other
+var TranscodableSyntaxes = []string{
+	ImplicitVRLittleEndian,
+	ExplicitVRLittleEndian,
+	DeflatedExplicitVRLittleEndian,
+	RLELossless,
+}
+
+// CanTranscode returns true if a file can be converted between the transfer syntaxes
+func CanTranscode(from string, to string) bool {
+	if from == to {
+		return true
+	}
+	var fromOk, toOk bool
+	for _, ts := range TranscodableSyntaxes {
+		fromOk = fromOk || ts == from
+		toOk = toOk || ts == to
+	}
+	return fromOk && toOk
+}
+
+// Inflate decompresses a deflated dataset (raw deflate without zlib header)
+func Inflate(data []byte) ([]byte, error) {
+	reader := flate.NewReader(bytes.NewReader(data))
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// Deflate compresses everything written by the function into the writer
+func Deflate(w io.Writer, write func(io.Writer) error) error {
+	dw, err := flate.NewWriter(w, flate.DefaultCompression)
+	if err != nil {
+		return err
+	}
+	if err = write(dw); err != nil {
+		return err
+	}
+	return dw.Close()
+}
+
+// Transcode converts a DICOM file into the transfer syntax, unchanged data is returned as is
+func Transcode(data []byte, transferSyntax string) ([]byte, error) {
+	f, err := Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	if f.TransferSyntax == transferSyntax {
+		return data, nil
+	}
+	if !CanTranscode(f.TransferSyntax, transferSyntax) {
+		return nil, fmt.Errorf("transcoding from %s to %s not supported", f.TransferSyntax, transferSyntax)
+	}
+
+	// group lengths are retired and change with the encoding
+	var elements []*Element
+	for _, e := range f.Dataset.Elements {
+		if e.Tag&0xFFFF != 0 {
+			elements = append(elements, e)
+		}
+	}
+	f.Dataset.Elements = elements
+
+	// pixel data is decoded from or encoded to RLE
+	if pixel := f.Dataset.Find(TagPixelData); pixel != nil {
+		toRLE := transferSyntax == RLELossless
+		if pixel.Encapsulated != toRLE {
+			layout, err := NewPixelLayout(f.Dataset)
+			if err != nil {
+				return nil, err
+			}
+			if toRLE {
+				fragments, err := EncodeRLE(pixel.Value, layout)
+				if err != nil {
+					return nil, err
+				}
+				f.Dataset.Set(&Element{Tag: TagPixelData, VR: "OB", Encapsulated: true, Fragments: append([][]byte{offsetTable(fragments)}, fragments...)})
+			} else {
+				native, err := DecodeRLE(pixel.Fragments[1:], layout)
+				if err != nil {
+					return nil, err
+				}
+				vr := "OW"
+				if layout.BytesPerValue == 1 {
+					vr = "OB"
+				}
+				f.Dataset.Set(&Element{Tag: TagPixelData, VR: vr, Value: native})
+			}
+		}
+	}
+
+	// write the converted file
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	if err = f.Write(out, transferSyntax); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// offsetTable returns the basic offset table of the fragments, each one holding one frame
+func offsetTable(fragments [][]byte) []byte {
+	table := make([]byte, 4*len(fragments))
+	var offset uint32
+	for i, fragment := range fragments {
+		binary.LittleEndian.PutUint32(table[4*i:], offset)
+		offset += 8 + uint32(len(fragment))
+	}
+	return table
+}
@@ -0,0 +1,96 @@
+package dicomfile
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTranscode(t *testing.T) {
+	for _, from := range TranscodableSyntaxes {
+		for _, to := range TranscodableSyntaxes {
+			t.Run(from+" to "+to, func(t *testing.T) {
+				f, layout := testFile()
+				native := f.Dataset.Find(TagPixelData).Value
+				// group lengths are removed while transcoding
+				f.Dataset.Set(&Element{Tag: 0x00080000, VR: "UL", Value: make([]byte, 4)})
+				if from == RLELossless {
+					fragments, err := EncodeRLE(native, layout)
+					if err != nil {
+						t.Fatal(err)
+					}
+					f.Dataset.Set(&Element{Tag: TagPixelData, VR: "OB", Encapsulated: true, Fragments: append([][]byte{offsetTable(fragments)}, fragments...)})
+				}
+				var in bytes.Buffer
+				if err := f.Write(&in, from); err != nil {
+					t.Fatal(err)
+				}
+
+				data, err := Transcode(in.Bytes(), to)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if from == to {
+					if !bytes.Equal(data, in.Bytes()) {
+						t.Error("data changed without transcoding")
+					}
+					return
+				}
+				out, err := Parse(data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if out.TransferSyntax != to {
+					t.Errorf("transfer syntax %q, want %q", out.TransferSyntax, to)
+				}
+				if out.Dataset.Find(0x00080000) != nil {
+					t.Error("group length kept")
+				}
+				if got := out.Dataset.String(0x00100010); got != "Doe^John" {
+					t.Errorf("patient name %q", got)
+				}
+				pixel := out.Dataset.Find(TagPixelData)
+				if pixel.Encapsulated != (to == RLELossless) {
+					t.Fatalf("encapsulated %v", pixel.Encapsulated)
+				}
+				if pixel.Encapsulated {
+					if len(pixel.Fragments) != 1+layout.Frames || !bytes.Equal(pixel.Fragments[0], offsetTable(pixel.Fragments[1:])) {
+						t.Fatal("fragments do not hold one frame each after the offset table")
+					}
+					decoded, err := DecodeRLE(pixel.Fragments[1:], layout)
+					if err != nil {
+						t.Fatal(err)
+					}
+					pixel = &Element{Value: decoded}
+				}
+				if !bytes.Equal(pixel.Value, native) {
+					t.Error("pixel data differs")
+				}
+			})
+		}
+	}
+}
+
+func TestTranscodeUnsupported(t *testing.T) {
+	f, _ := testFile()
+	var in bytes.Buffer
+	if err := f.Write(&in, ExplicitVRLittleEndian); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name           string
+		transferSyntax string
+	}{
+		{"big endian", ExplicitVRBigEndian},
+		{"jpeg baseline", "1.2.840.10008.1.2.4.50"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if CanTranscode(ExplicitVRLittleEndian, tt.transferSyntax) {
+				t.Error("transcoding supported")
+			}
+			if _, err := Transcode(in.Bytes(), tt.transferSyntax); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+// Package dicomweb provides a client of the DICOMweb services (WADO-RS, STOW-RS, QIDO-RS and delete)
+// over HTTPS/1.1, HTTPS/2, HTTP/3 and the cleartext variants HTTP/1.1 and h2c.
+package dicomweb
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"httpxcommon/compression"
+	"httpxcommon/connstats"
+	"httpxcommon/digest"
+	"httpxcommon/httpcache"
+	"httpxcommon/transports"
+	"httpxcommon/tuning"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Type representing the options of a client
+type Options struct {
+	// http version of the transport: 1.1 | 2.0 | 3.0 | 1.1-plain | 2.0-plain
+	Protocol string
+	// certificates and verification of all protocols using TLS
+	TLS transports.TLSOptions
+	// optional registry tracking the connections
+	Stats *connstats.Registry
+	// optional quic configuration of HTTP/3 (flow control, keep alive, tracers)
+	QuicConfig *quic.Config
+	// optional tuning of QUIC, HTTP/2 and the sockets applied to the transport of the protocol
+	Tuning *tuning.Config
+	// optional http client used instead of the transport of the protocol
+	HTTPClient *http.Client
+	// optional content encoding requested on retrieve and used on store
+	Compression *compression.Options
+	// optional sha-256 digests of bodies and parts
+	Digest *digest.Options
+	// optional cache of retrieve responses revalidated with the server
+	Cache *httpcache.Cache
+	// optional limit of every request including the body, 0 for none
+	RequestTimeout time.Duration
+	// optional summary the failed operations are counted in
+	Errors *ErrorSummary
+	// retries of failed requests, GETs after transient errors and STOWs which were not stored (zero value: none)
+	Retry RetryPolicy
+	// optional statistics the retries are counted in per protocol
+	RetryStats *RetryStats
+}
+
+// Type representing a client of a DICOMweb service, it can be used concurrently
+type Client struct {
+	base    string
+	options Options
+	http    *http.Client
+	// protocol the retries are counted for
+	label string
+}
+
+// NewClient creates a client of the service at the base url (the part before /studies)
+func NewClient(baseURL string, opts Options) (*Client, error) {
+	c := &Client{base: strings.TrimSuffix(baseURL, "/"), options: opts, http: opts.HTTPClient}
+	label := transports.ProtocolLabel(opts.Protocol)
+	if c.http == nil {
+		factory, err := transports.Lookup(opts.Protocol)
+		if err != nil {
+			return nil, &ProtocolError{Protocol: opts.Protocol, Err: err}
+		}
+		if u, err := url.Parse(c.base); err != nil || u.Scheme != factory.Scheme() {
+			return nil, fmt.Errorf("%w: http version %s needs %s:// urls, got %s", ErrInvalidOption, opts.Protocol, factory.Scheme(), baseURL)
+		}
+		label = factory.Label()
+		settings := transports.Settings{TLS: opts.TLS, Stats: opts.Stats, QuicConfig: opts.QuicConfig, Tuning: opts.Tuning}
+		c.http = &http.Client{Transport: factory.NewTransport(settings)}
+	}
+	if opts.RequestTimeout > 0 || opts.Retry.MaxAttempts > 1 {
+		// the http client provided is not modified, the request timeout includes the retries
+		httpClient := *c.http
+		httpClient.Timeout = opts.RequestTimeout
+		if opts.Retry.MaxAttempts > 1 {
+			next := httpClient.Transport
+			if next == nil {
+				next = http.DefaultTransport
+			}
+			httpClient.Transport = &retryTransport{next: next, policy: opts.Retry, stats: opts.RetryStats, label: label}
+		}
+		c.http = &httpClient
+	}
+	c.label = label
+	if c.options.Compression == nil {
+		c.options.Compression = &compression.Options{}
+	}
+	if c.options.Digest == nil {
+		c.options.Digest = &digest.Options{}
+	}
+	return c, nil
+}
+
+// BaseURL returns the url of the service
+func (c *Client) BaseURL() string {
+	return c.base
+}
+
+// HTTPClient returns the http client used for the requests
+func (c *Client) HTTPClient() *http.Client {
+	return c.http
+}
+
+// Close closes the connections of the client, HTTP/3 connections are closed immediately
+func (c *Client) Close() error {
+	if closer, ok := c.http.Transport.(io.Closer); ok {
+		return closer.Close()
+	}
+	c.http.CloseIdleConnections()
+	return nil
+}
+
+// url returns the url of the resource with the suffix appended to its path
+func (c *Client) url(ref Ref, suffix string) string {
+	return c.base + ref.Path() + suffix
+}
+
+// record counts a failed operation in the error summary
+func (c *Client) record(err error) {
+	c.options.Errors.Add(err)
+}
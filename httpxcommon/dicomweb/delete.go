@@ -0,0 +1,49 @@
+package dicomweb
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"httpxcommon/partscommon"
+
+	"k8s.io/klog"
+)
+
+// Type representing the result of a delete
+type DeleteResult struct {
+	StatusCode int
+	Duration   time.Duration
+	// false if the resource did not exist
+	Found bool
+}
+
+// Delete deletes a study, series or instance, a missing resource is not an error
+func (c *Client) Delete(ctx context.Context, ref Ref) (result *DeleteResult, errRet error) {
+	s := time.Now()
+	defer func() { c.record(errRet) }()
+	result = &DeleteResult{}
+	url := c.url(ref, "")
+	klog.V(partscommon.KlogDebug).Info("Start the delete of url:" + url)
+	r, err := http.NewRequestWithContext(ctx, http.MethodDelete, url, nil)
+	if err != nil {
+		return result, err
+	}
+	partscommon.LogRequest(r)
+	res, err := c.http.Do(r)
+	result.Duration = time.Since(s)
+	if err != nil {
+		return result, err
+	}
+	defer res.Body.Close()
+	partscommon.LogResponse(res)
+	result.StatusCode = res.StatusCode
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusAccepted, http.StatusNoContent:
+		result.Found = true
+		return result, nil
+	case http.StatusNotFound:
+		return result, nil
+	}
+	return result, &StatusError{Method: http.MethodDelete, URL: url, StatusCode: res.StatusCode, Status: res.Status}
+}
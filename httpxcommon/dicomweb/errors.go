@@ -0,0 +1,191 @@
+package dicomweb
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"httpxcommon/multiparts"
+
+	"github.com/quic-go/quic-go"
+)
+
+// errors of the client, transport errors and context errors are returned wrapped
+var (
+	ErrInvalidURL    = errors.New("invalid DICOMweb url")
+	ErrInvalidOption = errors.New("invalid option")
+	ErrContentType   = errors.New("unexpected content type")
+)
+
+// Type representing a store rejected by the server completely or in part
+type StoreError = multiparts.StoreError
+
+// Type representing a response with an unexpected status
+type StatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s %s failed: %s", e.Method, e.URL, e.Status)
+}
+
+// Type representing an http version without transport
+type ProtocolError struct {
+	Protocol string
+	// cause reported by the transport registry, nil if unknown
+	Err error
+}
+
+func (e *ProtocolError) Error() string {
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+	return "unsupported http version: " + e.Protocol
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// Type representing the category of a failed operation
+type Category string
+
+// categories of errors
+const (
+	CategoryConnect  Category = "connect"
+	CategoryTLS      Category = "tls"
+	CategoryTimeout  Category = "timeout"
+	CategoryCanceled Category = "canceled"
+	CategoryStatus   Category = "http-status"
+	CategoryIO       Category = "io"
+	CategoryOther    Category = "other"
+)
+
+// Classify returns the category of an error returned by the client
+func Classify(err error) Category {
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidCert x509.CertificateInvalidError
+	var recordErr tls.RecordHeaderError
+	var transportErr *quic.TransportError
+	var handshakeErr *quic.HandshakeTimeoutError
+	var streamErr *quic.StreamError
+	var statusErr *StatusError
+	var storeErr *StoreError
+	var opErr *net.OpError
+	var pathErr *fs.PathError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return CategoryCanceled
+	case errors.As(err, &certErr), errors.As(err, &unknownAuthority), errors.As(err, &hostnameErr),
+		errors.As(err, &invalidCert), errors.As(err, &recordErr), strings.Contains(err.Error(), "tls: "),
+		errors.As(err, &transportErr) && transportErr.ErrorCode.IsCryptoError():
+		return CategoryTLS
+	case errors.As(err, &opErr) && opErr.Op == "dial", errors.Is(err, syscall.ECONNREFUSED), errors.As(err, &handshakeErr):
+		return CategoryConnect
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return CategoryTimeout
+	case errors.As(err, &statusErr), errors.As(err, &storeErr):
+		return CategoryStatus
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.As(err, &pathErr), errors.As(err, &opErr),
+		errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE),
+		errors.As(err, &streamErr), strings.Contains(err.Error(), "stream error: "):
+		// a reset stream of HTTP/2 or HTTP/3 fails the response like a dropped connection
+		return CategoryIO
+	}
+	return CategoryOther
+}
+
+// Type representing the failures of the operations of a client by category, it can be used concurrently
+type ErrorSummary struct {
+	mu     sync.Mutex
+	counts map[Category]int
+	// first error of every category
+	samples map[Category]string
+}
+
+// NewErrorSummary creates an empty summary
+func NewErrorSummary() *ErrorSummary {
+	return &ErrorSummary{counts: map[Category]int{}, samples: map[Category]string{}}
+}
+
+// Add counts the error in its category, nil errors are skipped
+func (s *ErrorSummary) Add(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	category := Classify(err)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.counts[category] == 0 {
+		s.samples[category] = err.Error()
+	}
+	s.counts[category]++
+}
+
+// Total returns the number of errors
+func (s *ErrorSummary) Total() int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	total := 0
+	for _, n := range s.counts {
+		total += n
+	}
+	return total
+}
+
+// Counts returns a copy of the number of errors by category
+func (s *ErrorSummary) Counts() map[Category]int {
+	counts := map[Category]int{}
+	if s == nil {
+		return counts
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c, n := range s.counts {
+		counts[c] = n
+	}
+	return counts
+}
+
+// Sample returns the first error of the category
+func (s *ErrorSummary) Sample(c Category) string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.samples[c]
+}
+
+// String returns the counts in category order, e.g. "connect=2 http-status=1"
+func (s *ErrorSummary) String() string {
+	counts := s.Counts()
+	categories := make([]string, 0, len(counts))
+	for c := range counts {
+		categories = append(categories, string(c))
+	}
+	sort.Strings(categories)
+	parts := make([]string, len(categories))
+	for i, c := range categories {
+		parts[i] = fmt.Sprintf("%s=%d", c, counts[Category(c)])
+	}
+	return strings.Join(parts, " ")
+}
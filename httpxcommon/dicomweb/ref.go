@@ -0,0 +1,75 @@
+package dicomweb
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"httpxcommon/partscommon"
+)
+
+// renditions of the retrieve
+const (
+	RenditionRendered  = "rendered"
+	RenditionThumbnail = "thumbnail"
+)
+
+// Type representing a study, series or instance, empty uids address all resources of the level
+type Ref struct {
+	Study    string
+	Series   string
+	Instance string
+}
+
+// Path returns the path of the resource relative to the base url
+func (r Ref) Path() string {
+	p := "/studies"
+	if len(r.Study) == 0 {
+		return p
+	}
+	p += "/" + r.Study
+	if len(r.Series) == 0 {
+		return p
+	}
+	p += "/series/" + r.Series
+	if len(r.Instance) == 0 {
+		return p
+	}
+	return p + "/instances/" + r.Instance
+}
+
+// String returns the path of the resource
+func (r Ref) String() string {
+	return r.Path()
+}
+
+// Type representing an url of a DICOMweb resource split into the base url, the resource and the rendition
+type Target struct {
+	Ref
+	// url of the service, the part before /studies
+	Base string
+	// rendered | thumbnail, empty for the instances
+	Rendition string
+	// query of the url (viewport, window, quality)
+	Query url.Values
+}
+
+// ParseURL splits the url of a study, series or instance
+func ParseURL(rawURL string) (*Target, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	i := strings.Index(u.Path, "/studies")
+	if len(u.Scheme) == 0 || len(u.Host) == 0 || i < 0 {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidURL, rawURL)
+	}
+	t := &Target{Base: u.Scheme + "://" + u.Host + u.Path[:i], Query: u.Query()}
+	t.Study, t.Series, t.Instance = partscommon.GetDICOMInfoFromUrl(u.Path[i:])
+	switch name := path.Base(u.Path); name {
+	case RenditionRendered, RenditionThumbnail:
+		t.Rendition = name
+	}
+	return t, nil
+}
@@ -0,0 +1,274 @@
+package dicomweb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"httpxcommon/compression"
+	"httpxcommon/digest"
+	"httpxcommon/httpcache"
+	"httpxcommon/httpxhelper"
+	"httpxcommon/manifest"
+	"httpxcommon/multiparts"
+	"httpxcommon/partscommon"
+	"httpxcommon/singleparts"
+
+	"k8s.io/klog"
+)
+
+// Type representing the options of a retrieve
+type RetrieveOptions struct {
+	// directory the instances are stored in as study/series/instance.dcm
+	Directory string
+	// transfer syntax uid requested, the server transcodes if needed (empty: as stored)
+	TransferSyntax string
+	// continue a partially downloaded instance using HTTP ranges (instances only)
+	Resume bool
+	// rendered | thumbnail, empty for the instances
+	Rendition string
+	// query of rendered images (viewport, window, quality)
+	Query url.Values
+	// collect the retrieved instances with size and SHA-256
+	Manifest bool
+}
+
+// Type representing the result of a retrieve
+type RetrieveResult struct {
+	StatusCode int
+	// bytes stored in the directory
+	Bytes    uint64
+	Duration time.Duration
+	// instances retrieved with size and SHA-256, nil if not requested
+	Instances *manifest.Manifest
+}
+
+// AcceptTransferSyntax returns the Accept header requesting the transfer syntax, single part for instances
+func AcceptTransferSyntax(ref Ref, transferSyntax string) string {
+	if len(ref.Instance) > 0 {
+		return "application/dicom; transfer-syntax=" + transferSyntax
+	}
+	return "multipart/related; type=\"application/dicom\"; transfer-syntax=" + transferSyntax
+}
+
+// Retrieve stores the instances, rendered images or thumbnails of the study, series or instance in the directory.
+// A body which fails while it is read is retrieved again according to the retry policy, resumed instances continue with a range.
+func (c *Client) Retrieve(ctx context.Context, ref Ref, opts RetrieveOptions) (result *RetrieveResult, errRet error) {
+	// keep start time
+	s := time.Now()
+	defer func() { c.record(errRet) }()
+	for retry := 0; ; retry++ {
+		result, errRet = c.retrieve(ctx, ref, opts)
+		result.Duration = time.Since(s)
+		if errRet == nil || !retryableBody(result.StatusCode, errRet) {
+			if retry > 0 && errRet == nil {
+				c.options.RetryStats.update(c.label, func(c *RetryCounts) { c.Recovered++ })
+			}
+			return result, errRet
+		}
+
+		// the last attempt or a canceled retrieve returns the failure as it is
+		if retry+1 >= c.options.Retry.MaxAttempts || ctx.Err() != nil {
+			if retry > 0 {
+				c.options.RetryStats.update(c.label, func(c *RetryCounts) { c.Exhausted++ })
+			}
+			return result, errRet
+		}
+		c.options.RetryStats.update(c.label, func(c *RetryCounts) {
+			if retry == 0 {
+				c.Requests++
+			}
+			c.Retries++
+		})
+		delay := c.options.Retry.delay(retry+1, 0)
+		klog.V(partscommon.KlogInfo).Info("Retry ", retry+1, " of GET ", c.url(ref, ""), " in ", delay, " after reading the body: ", errRet)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			c.options.RetryStats.update(c.label, func(c *RetryCounts) { c.Exhausted++ })
+			result.Duration = time.Since(s)
+			return result, errors.Join(errRet, ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
+
+// retryableBody returns true if the response was received and reading its body failed with a transient error
+func retryableBody(code int, err error) bool {
+	if code != http.StatusOK && code != http.StatusPartialContent {
+		return false
+	}
+	return retryableError(http.MethodGet, err)
+}
+
+// retrieve sends the request once and stores the response
+func (c *Client) retrieve(ctx context.Context, ref Ref, opts RetrieveOptions) (result *RetrieveResult, errRet error) {
+	result = &RetrieveResult{}
+	if opts.Manifest {
+		result.Instances = manifest.New()
+	}
+	resource := c.url(ref, "")
+	if len(opts.Rendition) > 0 {
+		resource += "/" + opts.Rendition
+	}
+	klog.V(partscommon.KlogDebug).Infof("Start the retrieve from url:" + resource)
+
+	// create a HTTP GET request
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, resource, nil)
+	if err != nil {
+		return result, err
+	}
+	if len(opts.Query) > 0 {
+		r.URL.RawQuery = opts.Query.Encode()
+	}
+
+	// continue partially downloaded instances (ranges are served uncompressed)
+	compress := c.options.Compression
+	dig := c.options.Digest
+	var sf singleparts.SinglepartFiles
+	sf.Compression = compress
+	sf.Stored = result.Instances
+	sf.Digest = dig
+	var resumeFile string
+	var offset int64
+	if opts.Resume && len(ref.Instance) > 0 && len(ref.Series) > 0 && len(opts.Rendition) == 0 {
+		resumeFile = partscommon.EnsureFilePath(opts.Directory, ref.Study, ref.Series, ref.Instance)
+		offset = sf.PrepareResume(r, resumeFile)
+	}
+	if len(opts.TransferSyntax) > 0 {
+		r.Header.Set("Accept", AcceptTransferSyntax(ref, opts.TransferSyntax))
+	}
+	// identity is requested explicitly, otherwise the transports ask for gzip and decompress transparently
+	if encoding := compress.BodyEncoding(); len(encoding) > 0 && len(resumeFile) == 0 {
+		r.Header.Set("Accept-Encoding", encoding)
+	} else {
+		r.Header.Set("Accept-Encoding", compression.EncodingIdentity)
+	}
+	if encoding := compress.PartEncoding(); len(encoding) > 0 && len(resumeFile) == 0 {
+		r.Header.Set(compression.AcceptPartEncodingHeader, encoding)
+	}
+	if dig.IsEnabled() {
+		r.Header.Set(digest.WantReprDigestHeader, digest.WantSHA256)
+		r.Header.Set(digest.WantContentDigestHeader, digest.WantSHA256)
+	}
+	// revalidate cached responses (not used for resumed downloads)
+	cache := c.options.Cache
+	var entry *httpcache.Entry
+	if len(resumeFile) == 0 {
+		entry = cache.PrepareRequest(r)
+	} else {
+		cache = nil
+	}
+	partscommon.LogRequest(r)
+	res, err := c.http.Do(r)
+	if err != nil {
+		return result, err
+	}
+	partscommon.LogResponse(res)
+	if errCache := cache.HandleResponse(res, entry); errCache != nil {
+		klog.Error("Error using cache: ", errCache)
+	}
+	defer res.Body.Close()
+	result.StatusCode = res.StatusCode
+	if res.ContentLength >= 0 {
+		res.Body = &lengthReadCloser{ReadCloser: res.Body, remaining: res.ContentLength}
+	}
+
+	// resumable instance download
+	if len(resumeFile) > 0 {
+		var errHandle error
+		errHandle, result.Bytes = sf.StoreResumableResponse(res, resumeFile, offset)
+		return result, errHandle
+	}
+	if res.StatusCode != http.StatusOK {
+		return result, &StatusError{Method: http.MethodGet, URL: resource, StatusCode: res.StatusCode, Status: res.Status}
+	}
+
+	// determine type and params
+	contentType, params, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+
+	// the digest of multipart bodies is sent as trailer (not available with HTTP/3), single parts are checked while storing
+	if dig.IsEnabled() && contentType == "multipart/related" {
+		bodyHash := digest.NewHash(dig.GetStats())
+		res.Body = digest.NewReadCloser(res.Body, bodyHash)
+		defer func() {
+			if errDigest := verifyBody(res, bodyHash); errDigest != nil && errRet == nil {
+				errRet = errDigest
+			}
+		}()
+	}
+	var errHandle error
+	switch contentType {
+
+	case "multipart/related":
+		if strings.HasPrefix(params["type"], "image/") {
+			// rendered images per instance
+			errHandle, result.Bytes = httpxhelper.SaveRenderedParts(res, opts.Directory, params["boundary"])
+		} else {
+			// save as multipart
+			var mf multiparts.MultipartFiles
+			mf.Compression = compress
+			mf.Stored = result.Instances
+			mf.Digest = dig
+			errHandle, result.Bytes = mf.SaveFilesFromResponse(res, opts.Directory, resource)
+		}
+
+	case "application/dicom":
+		{
+			// store singlepart message
+			var code int
+			code, result.Bytes = sf.StoreSinglePartMessage(&res.Header, &res.Body, opts.Directory, params)
+			switch {
+			case code != http.StatusOK && sf.Err != nil:
+				errHandle = fmt.Errorf("storing response of %s failed with status %d: %w", resource, code, sf.Err)
+			case code != http.StatusOK:
+				errHandle = fmt.Errorf("storing response of %s failed with status %d", resource, code)
+			}
+		}
+	case "image/jpeg", "image/png":
+		{
+			// store rendered image or thumbnail
+			errHandle, result.Bytes = httpxhelper.SaveRenderedImage(res, opts.Directory, contentType)
+		}
+	default:
+		errHandle = fmt.Errorf("%w: %q of %s", ErrContentType, contentType, resource)
+	}
+	return result, errHandle
+}
+
+// verifyBody reads the rest of the body and compares it with the digest of the trailer
+func verifyBody(res *http.Response, bodyHash *digest.Hash) error {
+	io.Copy(io.Discard, res.Body)
+	field := digest.Field(res.Trailer)
+	if len(field) == 0 {
+		klog.V(partscommon.KlogDebug).Info("No body digest in response with ", res.Proto)
+		return nil
+	}
+	if err := bodyHash.Verify(field); err != nil {
+		return fmt.Errorf("body of %s: %w", res.Request.URL, err)
+	}
+	return nil
+}
+
+// Type representing a body ending with io.ErrUnexpectedEOF if it is shorter than its Content-Length,
+// the HTTP/3 transport does not check the length of a stream ended early by the server
+type lengthReadCloser struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (r *lengthReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.remaining -= int64(n)
+	if err == io.EOF && r.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
@@ -0,0 +1,250 @@
+package dicomweb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"httpxcommon/partscommon"
+
+	"k8s.io/klog"
+)
+
+// Type representing the retry policy of the requests of a client
+type RetryPolicy struct {
+	// attempts of a request including the first one, 0 or 1 disables retries
+	MaxAttempts int
+	// delay before the first retry, doubled for every further retry
+	Backoff time.Duration
+	// upper limit of the delay, also of a Retry-After sent by the server
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy returns a policy of 3 attempts with a backoff from 200ms up to 5s
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{MaxAttempts: 3, Backoff: 200 * time.Millisecond, MaxBackoff: 5 * time.Second}
+}
+
+// delay returns the delay before the retry, the backoff of the attempt with jitter or the Retry-After of the server
+func (p RetryPolicy) delay(retry int, retryAfter time.Duration) time.Duration {
+	maxBackoff := p.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = 30 * time.Second
+	}
+	if retryAfter > 0 {
+		if retryAfter > maxBackoff {
+			return maxBackoff
+		}
+		return retryAfter
+	}
+	backoff := p.Backoff
+	for i := 1; i < retry && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	// equal jitter: half of the backoff is fixed, the other half random
+	if backoff <= 1 {
+		return backoff
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// retryableStatus returns true if the server did not process the request: 429 and 503 for every method, 502 and 504 for GETs
+func retryableStatus(method string, code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return method == http.MethodGet
+	}
+	return false
+}
+
+// retryableError returns true if the request can be sent again after the transport error.
+// GETs are idempotent and retried after transient errors, STOWs only if the connection failed before the request was sent.
+func retryableError(method string, err error) bool {
+	category := Classify(err)
+	switch method {
+	case http.MethodGet:
+		return category == CategoryConnect || category == CategoryTimeout || category == CategoryIO
+	case http.MethodPost:
+		return category == CategoryConnect
+	}
+	return false
+}
+
+// Type representing the retries of a protocol
+type RetryCounts struct {
+	// requests sent more than once
+	Requests int
+	// attempts after the first one
+	Retries int
+	// requests which succeeded after a retry
+	Recovered int
+	// requests which failed after the last attempt
+	Exhausted int
+}
+
+// Type representing the retries of the clients per protocol, it can be used concurrently
+type RetryStats struct {
+	mu     sync.Mutex
+	counts map[string]*RetryCounts
+}
+
+// NewRetryStats creates empty retry statistics
+func NewRetryStats() *RetryStats {
+	return &RetryStats{counts: map[string]*RetryCounts{}}
+}
+
+// update changes the counts of the protocol
+func (s *RetryStats) update(label string, f func(c *RetryCounts)) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.counts[label]
+	if !ok {
+		c = &RetryCounts{}
+		s.counts[label] = c
+	}
+	f(c)
+}
+
+// Counts returns a copy of the counts per protocol
+func (s *RetryStats) Counts() map[string]RetryCounts {
+	counts := map[string]RetryCounts{}
+	if s == nil {
+		return counts
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for label, c := range s.counts {
+		counts[label] = *c
+	}
+	return counts
+}
+
+// Print writes a line per protocol with retried requests
+func (s *RetryStats) Print(w io.Writer) {
+	counts := s.Counts()
+	labels := make([]string, 0, len(counts))
+	for label := range counts {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		c := counts[label]
+		fmt.Fprintf(w, " RETRIES %s requests: %d retries: %d recovered: %d exhausted: %d\n", label, c.Requests, c.Retries, c.Recovered, c.Exhausted)
+	}
+}
+
+// Type representing a round tripper sending failed requests again according to the retry policy
+type retryTransport struct {
+	next   http.RoundTripper
+	policy RetryPolicy
+	stats  *RetryStats
+	label  string
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// requests with a body which cannot be created again are sent once
+	if t.policy.MaxAttempts <= 1 || (req.Body != nil && req.Body != http.NoBody && req.GetBody == nil) {
+		return t.next.RoundTrip(req)
+	}
+	attempt := req
+	for retry := 0; ; retry++ {
+		res, err := t.next.RoundTrip(attempt)
+		var retryAfter time.Duration
+		switch {
+		case err != nil && retryableError(req.Method, err):
+		case err == nil && retryableStatus(req.Method, res.StatusCode):
+			retryAfter = parseRetryAfter(res.Header.Get("Retry-After"))
+			err = &StatusError{Method: req.Method, URL: req.URL.String(), StatusCode: res.StatusCode, Status: res.Status}
+		default:
+			if retry > 0 && err == nil {
+				t.stats.update(t.label, func(c *RetryCounts) { c.Recovered++ })
+			}
+			return res, err
+		}
+
+		// the last attempt or a canceled request returns the failure as it is
+		if retry+1 >= t.policy.MaxAttempts || req.Context().Err() != nil {
+			if retry > 0 {
+				t.stats.update(t.label, func(c *RetryCounts) { c.Exhausted++ })
+			}
+			if res != nil {
+				return res, nil
+			}
+			return nil, err
+		}
+		if res != nil {
+			io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+			res.Body.Close()
+		}
+		t.stats.update(t.label, func(c *RetryCounts) {
+			if retry == 0 {
+				c.Requests++
+			}
+			c.Retries++
+		})
+		delay := t.policy.delay(retry+1, retryAfter)
+		klog.V(partscommon.KlogInfo).Info("Retry ", retry+1, " of ", req.Method, " ", req.URL, " in ", delay, " after: ", err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			t.stats.update(t.label, func(c *RetryCounts) { c.Exhausted++ })
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+
+		// every attempt gets a new body
+		attempt = req.Clone(req.Context())
+		if req.GetBody != nil {
+			body, errBody := req.GetBody()
+			if errBody != nil {
+				return nil, errors.Join(err, errBody)
+			}
+			attempt.Body = body
+		}
+	}
+}
+
+// parseRetryAfter returns the delay of a Retry-After header in seconds or as http date, 0 if missing
+func parseRetryAfter(value string) time.Duration {
+	if len(value) == 0 {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// Close closes the connections of the transport
+func (t *retryTransport) Close() error {
+	if closer, ok := t.next.(io.Closer); ok {
+		return closer.Close()
+	}
+	t.CloseIdleConnections()
+	return nil
+}
+
+// CloseIdleConnections closes the idle connections of the transport
+func (t *retryTransport) CloseIdleConnections() {
+	if closer, ok := t.next.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,172 @@
+package dicomweb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"httpxcommon/partscommon"
+
+	"k8s.io/klog"
+)
+
+// media type of QIDO-RS results (PS3.18 DICOM JSON model)
+const MediaTypeDicomJSON = "application/dicom+json"
+
+// tags of the QIDO-RS attributes (DICOM JSON keys)
+const (
+	TagSOPClassUID                    = "00080016"
+	TagSOPInstanceUID                 = "00080018"
+	TagStudyDate                      = "00080020"
+	TagStudyTime                      = "00080030"
+	TagAccessionNumber                = "00080050"
+	TagModality                       = "00080060"
+	TagModalitiesInStudy              = "00080061"
+	TagStudyDescription               = "00081030"
+	TagSeriesDescription              = "0008103E"
+	TagRetrieveURL                    = "00081190"
+	TagPatientName                    = "00100010"
+	TagPatientID                      = "00100020"
+	TagStudyInstanceUID               = "0020000D"
+	TagSeriesInstanceUID              = "0020000E"
+	TagSeriesNumber                   = "00200011"
+	TagInstanceNumber                 = "00200013"
+	TagNumberOfStudyRelatedSeries     = "00201206"
+	TagNumberOfStudyRelatedInstances  = "00201208"
+	TagNumberOfSeriesRelatedInstances = "00201209"
+)
+
+// Type representing an attribute of the DICOM JSON model
+type Attribute struct {
+	VR    string        `json:"vr"`
+	Value []interface{} `json:"Value,omitempty"`
+}
+
+// Type representing a dataset of the DICOM JSON model keyed by tag
+type Dataset map[string]Attribute
+
+// Set sets the attribute, empty strings are left out of the values
+func (d Dataset) Set(tag string, vr string, values ...interface{}) {
+	a := Attribute{VR: vr}
+	for _, v := range values {
+		if s, ok := v.(string); ok && len(s) == 0 {
+			continue
+		}
+		if s, ok := v.(string); ok && vr == "PN" {
+			v = map[string]string{"Alphabetic": s}
+		}
+		a.Value = append(a.Value, v)
+	}
+	d[tag] = a
+}
+
+// String returns the first value of the attribute as string, empty if missing
+func (d Dataset) String(tag string) string {
+	values := d[tag].Strings()
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// Strings returns the values as strings, the alphabetic group of person names
+func (a Attribute) Strings() []string {
+	values := make([]string, 0, len(a.Value))
+	for _, value := range a.Value {
+		switch v := value.(type) {
+		case string:
+			values = append(values, v)
+		case float64:
+			values = append(values, strconv.FormatFloat(v, 'f', -1, 64))
+		case map[string]interface{}:
+			name, _ := v["Alphabetic"].(string)
+			values = append(values, name)
+		case map[string]string:
+			values = append(values, v["Alphabetic"])
+		default:
+			values = append(values, fmt.Sprint(v))
+		}
+	}
+	return values
+}
+
+// Type representing the result of a search
+type SearchResult struct {
+	StatusCode int
+	Duration   time.Duration
+	// matching studies, series or instances
+	Datasets []Dataset
+}
+
+// Search searches the studies (empty ref), the series of a study or the instances of a series matching the query (keyword or tag as key)
+func (c *Client) Search(ctx context.Context, ref Ref, query url.Values) (result *SearchResult, errRet error) {
+	s := time.Now()
+	defer func() { c.record(errRet) }()
+	result = &SearchResult{}
+	var suffix string
+	switch {
+	case len(ref.Study) == 0:
+		// all studies
+	case len(ref.Series) == 0:
+		ref, suffix = Ref{Study: ref.Study}, "/series"
+	default:
+		if len(ref.Instance) > 0 {
+			query = cloneQuery(query)
+			query.Set("SOPInstanceUID", ref.Instance)
+		}
+		ref, suffix = Ref{Study: ref.Study, Series: ref.Series}, "/instances"
+	}
+	resource := c.url(ref, suffix)
+	if len(query) > 0 {
+		resource += "?" + query.Encode()
+	}
+	klog.V(partscommon.KlogDebug).Info("Start the search of url:" + resource)
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, resource, nil)
+	if err != nil {
+		return result, err
+	}
+	r.Header.Set("Accept", MediaTypeDicomJSON)
+	partscommon.LogRequest(r)
+	res, err := c.http.Do(r)
+	if err != nil {
+		result.Duration = time.Since(s)
+		return result, err
+	}
+	defer res.Body.Close()
+	partscommon.LogResponse(res)
+	result.StatusCode = res.StatusCode
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNoContent:
+		result.Duration = time.Since(s)
+		return result, nil
+	default:
+		result.Duration = time.Since(s)
+		return result, &StatusError{Method: http.MethodGet, URL: resource, StatusCode: res.StatusCode, Status: res.Status}
+	}
+	contentType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if contentType != MediaTypeDicomJSON && contentType != "application/json" {
+		result.Duration = time.Since(s)
+		return result, fmt.Errorf("%w: %q of %s", ErrContentType, contentType, resource)
+	}
+	err = json.NewDecoder(res.Body).Decode(&result.Datasets)
+	result.Duration = time.Since(s)
+	if err != nil {
+		return result, fmt.Errorf("reading search result of %s: %w", resource, err)
+	}
+	return result, nil
+}
+
+// cloneQuery returns a copy of the query which can be modified
+func cloneQuery(query url.Values) url.Values {
+	clone := url.Values{}
+	for k, v := range query {
+		clone[k] = append([]string(nil), v...)
+	}
+	return clone
+}
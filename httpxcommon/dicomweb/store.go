@@ -0,0 +1,131 @@
+package dicomweb
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"httpxcommon/manifest"
+	"httpxcommon/multiparts"
+	"httpxcommon/partscommon"
+	"httpxcommon/singleparts"
+
+	"k8s.io/klog"
+)
+
+// Type representing the chunking of a store into requests
+type Chunking string
+
+// chunking of a store
+const (
+	// one POST per instance
+	ChunkingSingle Chunking = "single"
+	// one multipart POST with all instances
+	ChunkingMulti Chunking = "multi"
+)
+
+// Type representing the scheduling of single part requests
+type Mode string
+
+// modes of a store
+const (
+	// the instances are sent one after the other
+	ModeSync Mode = "sync"
+	// the instances are sent by a pool of workers
+	ModeAsync Mode = "async"
+)
+
+// ParseChunking returns the chunking of the name: single | multi
+func ParseChunking(name string) (Chunking, error) {
+	switch c := Chunking(name); c {
+	case ChunkingSingle, ChunkingMulti:
+		return c, nil
+	}
+	return "", fmt.Errorf("%w: chunking %q (single | multi)", ErrInvalidOption, name)
+}
+
+// ParseMode returns the mode of the name: sync | async
+func ParseMode(name string) (Mode, error) {
+	switch m := Mode(name); m {
+	case ModeSync, ModeAsync:
+		return m, nil
+	}
+	return "", fmt.Errorf("%w: mode %q (sync | async)", ErrInvalidOption, name)
+}
+
+// Type representing the options of a store
+type StoreOptions struct {
+	// directory with the instances (.dcm files)
+	Directory string
+	// single by default
+	Chunking Chunking
+	// sync by default, used by single chunking only
+	Mode Mode
+	// number of workers of the async mode, the number of CPUs if not set
+	Workers int
+}
+
+// Type representing the result of a store
+type StoreResult struct {
+	// bytes of the instances sent
+	Bytes    uint64
+	Duration time.Duration
+	// instances reported as stored by the server with size and SHA-256
+	Instances *manifest.Manifest
+	// requests which failed, the other instances were sent
+	FailedRequests int
+}
+
+// Store sends the instances of the directory to the study (all studies if empty), rejected instances are returned as StoreError.
+// With single chunking a failed instance does not stop the store, the first error is returned.
+func (c *Client) Store(ctx context.Context, study string, opts StoreOptions) (*StoreResult, error) {
+	if len(opts.Chunking) == 0 {
+		opts.Chunking = ChunkingSingle
+	}
+	if len(opts.Mode) == 0 {
+		opts.Mode = ModeSync
+	}
+	url := c.url(Ref{Study: study}, "")
+	klog.V(partscommon.KlogDebug).Infof("Chunking mode for store:" + string(opts.Chunking))
+	result := &StoreResult{Instances: manifest.New()}
+	var err error
+	var failed int64
+	switch opts.Chunking {
+	case ChunkingSingle:
+		// upload files (for each file one POST)
+		var sf singleparts.SinglepartFiles
+		sf.Compression = c.options.Compression
+		sf.Stored = result.Instances
+		sf.Digest = c.options.Digest
+		sf.Workers = opts.Workers
+		sf.OnError = func(path string, errFile error) {
+			atomic.AddInt64(&failed, 1)
+			c.record(errFile)
+		}
+		switch opts.Mode {
+		case ModeAsync:
+			err, result.Bytes, result.Duration = sf.AsyncPostFilesFromDirectory(ctx, c.http, url, opts.Directory)
+		case ModeSync:
+			err, result.Bytes, result.Duration = sf.SyncPostFilesFromDirectory(ctx, c.http, url, opts.Directory)
+		default:
+			_, err = ParseMode(string(opts.Mode))
+		}
+	case ChunkingMulti:
+		// upload files (one POST with all files in the body as multipart)
+		var mf multiparts.MultipartFiles
+		mf.Compression = c.options.Compression
+		mf.Stored = result.Instances
+		mf.Digest = c.options.Digest
+		err, result.Bytes, result.Duration = mf.PostFilesFromDirectory(ctx, c.http, url, opts.Directory)
+	default:
+		_, err = ParseChunking(string(opts.Chunking))
+	}
+	// errors of single instances are already counted
+	result.FailedRequests = int(atomic.LoadInt64(&failed))
+	if err != nil && result.FailedRequests == 0 {
+		result.FailedRequests = 1
+		c.record(err)
+	}
+	return result, err
+}
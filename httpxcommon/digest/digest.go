@@ -0,0 +1,200 @@
+package digest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"httpxcommon/partscommon"
+)
+
+// integrity fields of RFC 9530
+const (
+	ContentDigestHeader     = "Content-Digest"
+	ReprDigestHeader        = "Repr-Digest"
+	WantContentDigestHeader = "Want-Content-Digest"
+	WantReprDigestHeader    = "Want-Repr-Digest"
+)
+
+// the only algorithm used
+const AlgorithmSHA256 = "sha-256"
+
+// preference sent in Want-Content-Digest and Want-Repr-Digest
+const WantSHA256 = AlgorithmSHA256 + "=10"
+
+// ErrMismatch is returned if the received data does not match the digest
+var ErrMismatch = errors.New("digest mismatch")
+
+// Type representing the integrity statistics of a run
+type Stats struct {
+	mu         sync.Mutex
+	Bytes      uint64
+	HashTime   time.Duration
+	Verified   uint64
+	Mismatches uint64
+}
+
+func (s *Stats) Add(bytes uint64, hashTime time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Bytes += bytes
+	s.HashTime += hashTime
+}
+
+func (s *Stats) Check(ok bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ok {
+		s.Verified++
+	} else {
+		s.Mismatches++
+	}
+}
+
+func (s *Stats) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fmt.Sprintf("hashed: %s hash time: %v verified: %d mismatches: %d", partscommon.ByteCountSI(s.Bytes), s.HashTime, s.Verified, s.Mismatches)
+}
+
+// Type representing the digests used by a client or a request
+type Options struct {
+	Enabled bool
+	Stats   Stats
+}
+
+// IsEnabled returns false for nil options
+func (o *Options) IsEnabled() bool {
+	return o != nil && o.Enabled
+}
+
+// GetStats returns the statistics or nil if no options are used
+func (o *Options) GetStats() *Stats {
+	if o == nil {
+		return nil
+	}
+	return &o.Stats
+}
+
+// Sum returns the field value for the data, the hash time is added to the statistics
+func (o *Options) Sum(data []byte) string {
+	h := NewHash(o.GetStats())
+	h.Write(data)
+	return h.Value()
+}
+
+// Sum returns the field value for the data
+func Sum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return Value(sum[:])
+}
+
+// Value formats the sha-256 digest as structured field dictionary, like sha-256=:base64:
+func Value(sum []byte) string {
+	return AlgorithmSHA256 + "=:" + base64.StdEncoding.EncodeToString(sum) + ":"
+}
+
+// Parse returns the sha-256 digest of a Content-Digest or Repr-Digest field, nil if there is none
+func Parse(field string) ([]byte, error) {
+	for _, member := range strings.Split(field, ",") {
+		key, value, found := strings.Cut(strings.TrimSpace(member), "=")
+		if !found || strings.ToLower(key) != AlgorithmSHA256 {
+			continue
+		}
+		value, _, _ = strings.Cut(value, ";")
+		if len(value) < 2 || value[0] != ':' || value[len(value)-1] != ':' {
+			return nil, fmt.Errorf("invalid %s digest %q", AlgorithmSHA256, value)
+		}
+		sum, err := base64.StdEncoding.DecodeString(value[1 : len(value)-1])
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("invalid %s digest %q", AlgorithmSHA256, value)
+		}
+		return sum, nil
+	}
+	return nil, nil
+}
+
+// Wanted checks if a Want-Content-Digest or Want-Repr-Digest field asks for sha-256
+func Wanted(field string) bool {
+	for _, member := range strings.Split(field, ",") {
+		key, value, found := strings.Cut(strings.TrimSpace(member), "=")
+		if strings.ToLower(key) != AlgorithmSHA256 {
+			continue
+		}
+		weight, err := strconv.Atoi(strings.TrimSpace(value))
+		return !found || (err == nil && weight > 0)
+	}
+	return false
+}
+
+// Type representing a sha-256 hash calculated while streaming, the time is added to the statistics
+type Hash struct {
+	hash  hash.Hash
+	stats *Stats
+}
+
+func NewHash(stats *Stats) *Hash {
+	return &Hash{hash: sha256.New(), stats: stats}
+}
+
+func (h *Hash) Write(p []byte) (int, error) {
+	s := time.Now()
+	n, err := h.hash.Write(p)
+	h.stats.Add(uint64(n), time.Since(s))
+	return n, err
+}
+
+// Value returns the field value of the data written so far
+func (h *Hash) Value() string {
+	return Value(h.hash.Sum(nil))
+}
+
+// Verify compares the data written with a field, an empty field is not verified
+func (h *Hash) Verify(field string) error {
+	if len(field) == 0 {
+		return nil
+	}
+	expected, err := Parse(field)
+	if err != nil || expected == nil {
+		return err
+	}
+	ok := bytes.Equal(expected, h.hash.Sum(nil))
+	h.stats.Check(ok)
+	if !ok {
+		return fmt.Errorf("%w: expected %s got %s", ErrMismatch, Value(expected), h.Value())
+	}
+	return nil
+}
+
+// Field returns the first digest field of the header
+func Field(header interface{ Get(string) string }) string {
+	if field := header.Get(ContentDigestHeader); len(field) > 0 {
+		return field
+	}
+	return header.Get(ReprDigestHeader)
+}
+
+// Type representing a body read through the hash
+type hashingReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// NewReadCloser returns the body hashing all data read
+func NewReadCloser(body io.ReadCloser, h *Hash) io.ReadCloser {
+	return hashingReadCloser{Reader: io.TeeReader(body, h), Closer: body}
+}
@@ -0,0 +1,63 @@
+package digest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	sum := sha256.Sum256([]byte("data"))
+	value := Value(sum[:])
+	tests := []struct {
+		name    string
+		field   string
+		want    []byte
+		wantErr bool
+	}{
+		{"empty", "", nil, false},
+		{"sha-256", value, sum[:], false},
+		{"upper case algorithm", "SHA-256" + value[len(AlgorithmSHA256):], sum[:], false},
+		{"with other algorithms", "sha-512=:AAAA:, " + value, sum[:], false},
+		{"with parameters", value + ";p=1", sum[:], false},
+		{"only other algorithms", "sha-512=:AAAA:", nil, false},
+		{"missing colons", "sha-256=" + value[len(AlgorithmSHA256)+2:len(value)-1], nil, true},
+		{"invalid base64", "sha-256=:!!!!:", nil, true},
+		{"wrong length", "sha-256=:AAAA:", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.field)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("digest %x, want %x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWanted(t *testing.T) {
+	tests := []struct {
+		name  string
+		field string
+		want  bool
+	}{
+		{"empty", "", false},
+		{"sha-256", WantSHA256, true},
+		{"without weight", "sha-256", true},
+		{"upper case", "SHA-256=3", true},
+		{"zero weight", "sha-256=0", false},
+		{"invalid weight", "sha-256=x", false},
+		{"other algorithms", "sha-512=10, md5=1", false},
+		{"among others", "sha-512=10, sha-256=1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Wanted(tt.field); got != tt.want {
+				t.Errorf("Wanted(%q) = %v, want %v", tt.field, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package httpcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"httpxcommon/partscommon"
+
+	"k8s.io/klog"
+)
+
+// Type representing the cached response of one url
+type Entry struct {
+	Url             string    `json:"url"`
+	ETag            string    `json:"etag"`
+	LastModified    string    `json:"lastModified"`
+	ContentType     string    `json:"contentType"`
+	ContentEncoding string    `json:"contentEncoding"`
+	Size            int64     `json:"size"`
+	Stored          time.Time `json:"stored"`
+}
+
+// Type representing the cache statistics of a run
+type Stats struct {
+	mu          sync.Mutex
+	Hits        uint64
+	Misses      uint64
+	BytesSaved  uint64
+	BytesStored uint64
+}
+
+func (s *Stats) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fmt.Sprintf("hits: %d misses: %d saved: %s stored: %s", s.Hits, s.Misses, partscommon.ByteCountSI(s.BytesSaved), partscommon.ByteCountSI(s.BytesStored))
+}
+
+// Type representing a local cache of retrieve responses revalidated with the server
+type Cache struct {
+	dir   string
+	Stats Stats
+}
+
+func NewCache(dir string) (*Cache, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &Cache{dir: dir}, nil
+}
+
+// file names of an url in the cache directory
+func (c *Cache) paths(url string) (string, string) {
+	sum := sha256.Sum256([]byte(url))
+	key := hex.EncodeToString(sum[:])
+	return filepath.Join(c.dir, key+".json"), filepath.Join(c.dir, key+".body")
+}
+
+// PrepareRequest adds the validators of a cached response to the request
+func (c *Cache) PrepareRequest(r *http.Request) *Entry {
+	if c == nil {
+		return nil
+	}
+	metaFile, bodyFile := c.paths(r.URL.String())
+	data, err := os.ReadFile(metaFile)
+	if err != nil {
+		return nil
+	}
+	var entry Entry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		klog.Error("Ignoring broken cache entry ", metaFile, ": ", err)
+		return nil
+	}
+	if info, err := os.Stat(bodyFile); err != nil || info.Size() != entry.Size {
+		return nil
+	}
+	if len(entry.ETag) > 0 {
+		r.Header.Set("If-None-Match", entry.ETag)
+	}
+	if len(entry.LastModified) > 0 {
+		r.Header.Set("If-Modified-Since", entry.LastModified)
+	}
+	klog.V(partscommon.KlogDebug).Info("Revalidating cached response for ", entry.Url, " etag: ", entry.ETag)
+	return &entry
+}
+
+// HandleResponse replaces a 304 response by the cached response and stores cacheable responses
+func (c *Cache) HandleResponse(res *http.Response, entry *Entry) error {
+	if c == nil {
+		return nil
+	}
+	url := res.Request.URL.String()
+	metaFile, bodyFile := c.paths(url)
+
+	// not modified: replay the cached body
+	if res.StatusCode == http.StatusNotModified && entry != nil {
+		body, err := os.Open(bodyFile)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		res.Body = body
+		res.StatusCode = http.StatusOK
+		res.ContentLength = entry.Size
+		res.Header.Set("Content-Type", entry.ContentType)
+		res.Header.Del("Content-Encoding")
+		if len(entry.ContentEncoding) > 0 {
+			res.Header.Set("Content-Encoding", entry.ContentEncoding)
+		}
+		c.Stats.mu.Lock()
+		c.Stats.Hits++
+		c.Stats.BytesSaved += uint64(entry.Size)
+		c.Stats.mu.Unlock()
+		klog.V(partscommon.KlogDebug).Info("Using cached response for ", url, " size: ", entry.Size)
+		return nil
+	}
+	c.Stats.mu.Lock()
+	c.Stats.Misses++
+	c.Stats.mu.Unlock()
+
+	// only complete responses with validators are cached
+	if res.StatusCode != http.StatusOK || (len(res.Header.Get("ETag")) == 0 && len(res.Header.Get("Last-Modified")) == 0) {
+		return nil
+	}
+	tmp, err := os.CreateTemp(c.dir, "response-*")
+	if err != nil {
+		return err
+	}
+	res.Body = &teeBody{
+		source: res.Body,
+		tmp:    tmp,
+		cache:  c,
+		meta:   metaFile,
+		body:   bodyFile,
+		entry: Entry{
+			Url:             url,
+			ETag:            res.Header.Get("ETag"),
+			LastModified:    res.Header.Get("Last-Modified"),
+			ContentType:     res.Header.Get("Content-Type"),
+			ContentEncoding: res.Header.Get("Content-Encoding"),
+		},
+	}
+	return nil
+}
+
+// Type representing a response body copied into the cache while reading
+type teeBody struct {
+	source io.ReadCloser
+	tmp    *os.File
+	cache  *Cache
+	meta   string
+	body   string
+	entry  Entry
+	failed bool
+}
+
+func (t *teeBody) Read(p []byte) (int, error) {
+	n, err := t.source.Read(p)
+	if n > 0 && !t.failed {
+		if _, errWrite := t.tmp.Write(p[:n]); errWrite != nil {
+			klog.Error("Error writing cache file: ", errWrite)
+			t.failed = true
+		}
+		t.entry.Size += int64(n)
+	}
+	if err != nil && err != io.EOF {
+		t.failed = true
+	}
+	return n, err
+}
+
+// Close reads the rest of the body and commits the cache entry if the body was complete
+func (t *teeBody) Close() error {
+	if _, err := io.Copy(io.Discard, t); err != nil {
+		t.failed = true
+	}
+	errClose := t.source.Close()
+	t.tmp.Close()
+	if t.failed {
+		os.Remove(t.tmp.Name())
+		return errClose
+	}
+	t.entry.Stored = time.Now()
+	data, err := json.MarshalIndent(t.entry, "", "  ")
+	if err == nil {
+		err = os.Rename(t.tmp.Name(), t.body)
+	}
+	if err == nil {
+		err = os.WriteFile(t.meta, data, 0644)
+	}
+	if err != nil {
+		klog.Error("Error storing cache entry for ", t.entry.Url, ": ", err)
+		os.Remove(t.tmp.Name())
+		return errClose
+	}
+	t.cache.Stats.mu.Lock()
+	t.cache.Stats.BytesStored += uint64(t.entry.Size)
+	t.cache.Stats.mu.Unlock()
+	return errClose
+}
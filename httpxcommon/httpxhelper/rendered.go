@@ -0,0 +1,75 @@
+package httpxhelper
+
+import (
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"httpxcommon/partscommon"
+
+	"k8s.io/klog"
+)
+
+// file extensions of rendered images
+var renderedExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+}
+
+// RenderedFileName returns dir/study/series/instance/{rendered|thumbnail}.ext for the url path of a rendered image
+func RenderedFileName(dir string, urlPath string, contentType string) string {
+	studyinstanceuid, seriesinstanceuid, sopinstanceuid := partscommon.GetDICOMInfoFromUrl(urlPath)
+	name := path.Base(urlPath) + renderedExtensions[contentType]
+	return filepath.Join(dir, studyinstanceuid, seriesinstanceuid, sopinstanceuid, name)
+}
+
+// saveRendered copies the image into the file named after the url path
+func saveRendered(reader io.Reader, dir string, urlPath string, contentType string) (uint64, error) {
+	filename := RenderedFileName(dir, urlPath, contentType)
+	if err := os.MkdirAll(filepath.Dir(filename), os.ModePerm); err != nil {
+		return 0, err
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	size, err := io.Copy(file, reader)
+	klog.V(partscommon.KlogInfo).Infoln("Rendered image copied into file:", filename, " with size:", size)
+	return uint64(size), err
+}
+
+// SaveRenderedImage stores a single rendered image or thumbnail
+func SaveRenderedImage(res *http.Response, dir string, contentType string) (error, uint64) {
+	size, err := saveRendered(res.Body, dir, res.Request.URL.Path, contentType)
+	return err, size
+}
+
+// SaveRenderedParts stores the rendered images of a multipart message named by their Content-Location
+func SaveRenderedParts(res *http.Response, dir string, boundary string) (error, uint64) {
+	var size uint64
+	mr := multipart.NewReader(res.Body, boundary)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, size
+		}
+		if err != nil {
+			return err, size
+		}
+		contentType := part.Header.Get("Content-Type")
+		location := part.Header.Get("Content-Location")
+		if len(location) == 0 {
+			location = strings.TrimSuffix(res.Request.URL.Path, "/")
+		}
+		n, err := saveRendered(part, dir, location, contentType)
+		size += n
+		if err != nil {
+			return err, size
+		}
+	}
+}
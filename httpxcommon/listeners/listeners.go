@@ -0,0 +1,220 @@
+package listeners
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"httpxcommon/tuning"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// protocol labels passed to the connection state hooks
+const (
+	ProtocolHttp1  = "h1"
+	ProtocolHttps1 = "h1-tls"
+	ProtocolHttps2 = "h2"
+	ProtocolHttps3 = "h3"
+	ProtocolH2c    = "h2c"
+)
+
+// Protocol determines the protocol label of a request
+func Protocol(r *http.Request) string {
+	switch r.ProtoMajor {
+	case 3:
+		return ProtocolHttps3
+	case 2:
+		if r.TLS == nil {
+			return ProtocolH2c
+		}
+		return ProtocolHttps2
+	}
+	if r.TLS != nil {
+		return ProtocolHttps1
+	}
+	return ProtocolHttp1
+}
+
+// Type representing the listeners of all protocol versions sharing one handler
+type Listeners struct {
+	Handler  http.Handler
+	CertFile string
+	KeyFile  string
+	// optional hook per protocol label tracking the TCP connections
+	ConnState func(protocol string) func(net.Conn, http.ConnState)
+	// optional quic configuration for HTTP/3
+	QuicConfig *quic.Config
+	// optional tuning of QUIC, HTTP/2 and the sockets, nil for the defaults
+	Tuning *tuning.Config
+}
+
+func (l *Listeners) connState(protocol string) func(net.Conn, http.ConnState) {
+	if l.ConnState == nil {
+		return nil
+	}
+	return l.ConnState(protocol)
+}
+
+// listen opens the TCP listener with the socket buffers of the tuning, accepted connections inherit them
+func (l *Listeners) listen(addr string) (net.Listener, error) {
+	listenConfig := &net.ListenConfig{Control: l.Tuning.Control}
+	return listenConfig.Listen(context.Background(), "tcp", addr)
+}
+
+// ServeHttp1 listens for plain HTTP/1.1
+func (l *Listeners) ServeHttp1(addr string) error {
+	httpServer := &http.Server{
+		Handler:   l.Handler,
+		Addr:      addr,
+		ConnState: l.connState(ProtocolHttp1),
+	}
+	ln, err := l.listen(addr)
+	if err != nil {
+		return err
+	}
+	return httpServer.Serve(ln)
+}
+
+// ServeHttps1 listens for HTTPS/1.1 without upgrade to HTTP/2
+func (l *Listeners) ServeHttps1(addr string) error {
+	httpServer := &http.Server{
+		Handler:      l.Handler,
+		Addr:         addr,
+		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+		ConnState:    l.connState(ProtocolHttps1),
+	}
+	ln, err := l.listen(addr)
+	if err != nil {
+		return err
+	}
+	return httpServer.ServeTLS(ln, l.CertFile, l.KeyFile)
+}
+
+// ServeHttps2 listens for HTTPS/2
+func (l *Listeners) ServeHttps2(addr string) error {
+	var httpServer = http.Server{
+		Addr: addr, Handler: l.Handler,
+		ConnState: l.connState(ProtocolHttps2),
+	}
+	_ = http2.ConfigureServer(&httpServer, l.Tuning.Http2Server())
+	ln, err := l.listen(addr)
+	if err != nil {
+		return err
+	}
+	return httpServer.ServeTLS(ln, l.CertFile, l.KeyFile)
+}
+
+// ServeH2c listens for cleartext HTTP/2 with prior knowledge or Upgrade: h2c, other requests are served with HTTP/1.1
+func (l *Listeners) ServeH2c(addr string) error {
+	httpServer := &http.Server{
+		Handler: withoutBodyUpgrade(h2c.NewHandler(l.Handler, l.Tuning.Http2Server())),
+		Addr:    addr,
+	}
+	ln, err := l.listen(addr)
+	if err != nil {
+		return err
+	}
+	// h2c takes the connections over from net/http, they are tracked until they are closed
+	if connState := l.connState(ProtocolH2c); connState != nil {
+		httpServer.ConnState = func(conn net.Conn, state http.ConnState) {
+			if state == http.StateHijacked {
+				conn.(*h2cConn).hijacked.Store(true)
+				return
+			}
+			connState(conn, state)
+		}
+		ln = &h2cListener{Listener: ln, connState: connState}
+	}
+	return httpServer.Serve(ln)
+}
+
+// withoutBodyUpgrade serves requests with a body and Upgrade: h2c with HTTP/1.1,
+// h2c reads the whole body of an upgrade request into memory before switching
+func withoutBodyUpgrade(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body != nil && r.Body != http.NoBody && r.Header.Get("Upgrade") != "" {
+			r.Header.Del("Upgrade")
+			r.Header.Del("HTTP2-Settings")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Type representing a listener of connections reporting their close after h2c took them over
+type h2cListener struct {
+	net.Listener
+	connState func(net.Conn, http.ConnState)
+}
+
+func (l *h2cListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &h2cConn{Conn: conn, connState: l.connState}, nil
+}
+
+// Type representing an accepted connection, once hijacked the hook gets the last state on close
+type h2cConn struct {
+	net.Conn
+	connState func(net.Conn, http.ConnState)
+	hijacked  atomic.Bool
+	closed    sync.Once
+}
+
+func (c *h2cConn) Close() error {
+	if c.hijacked.Load() {
+		// idle updates the statistics while the socket is still open
+		c.closed.Do(func() {
+			c.connState(c, http.StateIdle)
+			c.connState(c, http.StateClosed)
+		})
+	}
+	return c.Conn.Close()
+}
+
+// SyscallConn gives access to the socket, e.g. for TCP_INFO
+func (c *h2cConn) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := c.Conn.(syscall.Conn)
+	if !ok {
+		return nil, errors.New("no raw socket available")
+	}
+	return sc.SyscallConn()
+}
+
+// ServeHttps3 listens for HTTP/3 using UDP
+func (l *Listeners) ServeHttps3(addr string) error {
+	conf := l.Tuning.QuicConfig(l.QuicConfig)
+	server := http3.Server{
+		Handler:         l.Handler,
+		Addr:            addr,
+		QuicConfig:      conf,
+		EnableDatagrams: conf.EnableDatagrams,
+	}
+	if !l.Tuning.HasSocketBuffers() {
+		return server.ListenAndServeTLS(l.CertFile, l.KeyFile)
+	}
+
+	// own UDP socket with the buffers of the tuning
+	cert, err := tls.LoadX509KeyPair(l.CertFile, l.KeyFile)
+	if err != nil {
+		return err
+	}
+	server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	listenConfig := &net.ListenConfig{Control: l.Tuning.Control}
+	conn, err := listenConfig.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return server.Serve(conn)
+}
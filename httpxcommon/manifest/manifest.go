@@ -0,0 +1,345 @@
+package manifest
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"httpxcommon/dicomfile"
+)
+
+// default file name of the manifest in the root of an output tree
+const FileName = "manifest.json"
+
+// suffix of files being written, renamed or removed when complete
+const partialSuffix = ".partial"
+
+// columns of the CSV format
+var csvHeader = []string{"studyInstanceUid", "seriesInstanceUid", "sopInstanceUid", "path", "size", "sha256"}
+
+// Type representing one instance of the manifest
+type Entry struct {
+	StudyInstanceUID  string `json:"studyInstanceUid"`
+	SeriesInstanceUID string `json:"seriesInstanceUid"`
+	SOPInstanceUID    string `json:"sopInstanceUid"`
+	// path relative to the root of the tree with forward slashes
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Type representing an instance that could not be stored
+type Failure struct {
+	SOPInstanceUID string `json:"sopInstanceUid"`
+	Path           string `json:"path,omitempty"`
+	Reason         string `json:"reason"`
+}
+
+// JSON document of the manifest, failures are listed in store responses
+type document struct {
+	Instances []Entry   `json:"instances"`
+	Failed    []Failure `json:"failed,omitempty"`
+}
+
+// Type representing the instances of a Study/Series/Instance.dcm tree with size and SHA-256
+type Manifest struct {
+	mu       sync.Mutex
+	entries  map[string]Entry
+	failures []Failure
+}
+
+func New() *Manifest {
+	return &Manifest{entries: make(map[string]Entry)}
+}
+
+// Add adds or replaces the entry of the instance
+func (m *Manifest) Add(e Entry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[e.SOPInstanceUID] = e
+}
+
+// Fail adds an instance that was rejected
+func (m *Manifest) Fail(f Failure) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failures = append(m.failures, f)
+}
+
+// Failures returns the rejected instances
+func (m *Manifest) Failures() []Failure {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Failure(nil), m.failures...)
+}
+
+// Lookup returns the entry of the instance
+func (m *Manifest) Lookup(sopInstanceUID string) (Entry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[sopInstanceUID]
+	return e, ok
+}
+
+// Entries returns all entries ordered by path
+func (m *Manifest) Entries() []Entry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entries := make([]Entry, 0, len(m.entries))
+	for _, e := range m.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries
+}
+
+func (m *Manifest) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.entries)
+}
+
+// isCSV selects the format by the file extension, JSON otherwise
+func isCSV(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".csv")
+}
+
+// Write writes the manifest as JSON or CSV (.csv extension), the file is replaced when complete
+func (m *Manifest) Write(path string) error {
+	partial := path + partialSuffix
+	f, err := os.Create(partial)
+	if err != nil {
+		return err
+	}
+	entries := m.Entries()
+	if isCSV(path) {
+		w := csv.NewWriter(f)
+		w.Write(csvHeader)
+		for _, e := range entries {
+			w.Write([]string{e.StudyInstanceUID, e.SeriesInstanceUID, e.SOPInstanceUID, e.Path, strconv.FormatInt(e.Size, 10), e.SHA256})
+		}
+		w.Flush()
+		err = w.Error()
+	} else {
+		err = m.WriteJSON(f)
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		os.Remove(partial)
+		return err
+	}
+	return os.Rename(partial, path)
+}
+
+// WriteJSON encodes the manifest as JSON object with the list of instances
+func (m *Manifest) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(document{Instances: m.Entries(), Failed: m.Failures()})
+}
+
+// ReadJSON adds the instances of a JSON manifest
+func (m *Manifest) ReadJSON(r io.Reader) error {
+	var doc document
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return err
+	}
+	for _, e := range doc.Instances {
+		m.Add(e)
+	}
+	for _, f := range doc.Failed {
+		m.Fail(f)
+	}
+	return nil
+}
+
+// Read reads a manifest written as JSON or CSV (.csv extension)
+func Read(path string) (*Manifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m := New()
+	if !isCSV(path) {
+		if err := m.ReadJSON(f); err != nil {
+			return nil, fmt.Errorf("manifest %s: %w", path, err)
+		}
+		return m, nil
+	}
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("manifest %s: %w", path, err)
+	}
+	for i, record := range records {
+		if i == 0 && len(record) > 0 && record[0] == csvHeader[0] {
+			continue
+		}
+		if len(record) != len(csvHeader) {
+			return nil, fmt.Errorf("manifest %s: line %d has %d columns", path, i+1, len(record))
+		}
+		size, err := strconv.ParseInt(record[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("manifest %s: line %d: %w", path, i+1, err)
+		}
+		m.Add(Entry{StudyInstanceUID: record[0], SeriesInstanceUID: record[1], SOPInstanceUID: record[2], Path: record[3], Size: size, SHA256: record[5]})
+	}
+	return m, nil
+}
+
+// Digest returns the hex encoded SHA-256 and the size of the data
+func Digest(r io.Reader) (string, int64, error) {
+	hash := sha256.New()
+	n, err := io.Copy(hash, r)
+	if err != nil {
+		return "", n, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), n, nil
+}
+
+// FileDigest returns the hex encoded SHA-256 and the size of a file
+func FileDigest(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	return Digest(f)
+}
+
+// NewEntry returns the entry of a file in the Study/Series/Instance.dcm layout, the path is relative to the root
+func NewEntry(root string, path string, digest string, size int64) Entry {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		rel = path
+	}
+	e := Entry{Path: filepath.ToSlash(rel), Size: size, SHA256: digest}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	parts := strings.Split(filepath.ToSlash(path), "/")
+	if n := len(parts); n >= 3 {
+		e.StudyInstanceUID, e.SeriesInstanceUID, e.SOPInstanceUID = parts[n-3], parts[n-2], strings.TrimSuffix(parts[n-1], ".dcm")
+	}
+	return e
+}
+
+// IsInstanceFile is false for manifests and partially written files, all other files of a tree are sent as instances
+func IsInstanceFile(path string) bool {
+	name := filepath.Base(path)
+	if strings.HasSuffix(name, partialSuffix) {
+		return false
+	}
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) != strings.TrimSuffix(FileName, filepath.Ext(FileName)) || (ext != filepath.Ext(FileName) && !isCSV(name))
+}
+
+// Build calculates the manifest of all instances of a tree, the uids are read from the files in any layout
+func Build(root string) (*Manifest, error) {
+	m := New()
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !IsInstanceFile(path) {
+			return err
+		}
+		digest, size, err := FileDigest(path)
+		if err != nil {
+			return err
+		}
+		e := NewEntry(root, path, digest, size)
+		if f, err := dicomfile.ReadFileHeader(path); err == nil && len(f.Dataset.String(dicomfile.TagSOPInstanceUID)) > 0 {
+			e.StudyInstanceUID = f.Dataset.String(dicomfile.TagStudyInstanceUID)
+			e.SeriesInstanceUID = f.Dataset.String(dicomfile.TagSeriesInstanceUID)
+			e.SOPInstanceUID = f.Dataset.String(dicomfile.TagSOPInstanceUID)
+		}
+		m.Add(e)
+		return nil
+	})
+	return m, err
+}
+
+// Load reads a manifest file or the manifest of a directory, a directory without manifest is calculated
+func Load(path string) (*Manifest, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return Read(path)
+	}
+	if _, err := os.Stat(filepath.Join(path, FileName)); err == nil {
+		return Read(filepath.Join(path, FileName))
+	}
+	return Build(path)
+}
+
+// Filter returns the instances of the study, series or instance, empty uids match all
+func (m *Manifest) Filter(studyInstanceUID string, seriesInstanceUID string, sopInstanceUID string) *Manifest {
+	filtered := New()
+	for _, e := range m.Entries() {
+		if (len(studyInstanceUID) == 0 || e.StudyInstanceUID == studyInstanceUID) &&
+			(len(seriesInstanceUID) == 0 || e.SeriesInstanceUID == seriesInstanceUID) &&
+			(len(sopInstanceUID) == 0 || e.SOPInstanceUID == sopInstanceUID) {
+			filtered.Add(e)
+		}
+	}
+	return filtered
+}
+
+// Type representing the differences between the expected and the actual instances
+type Diff struct {
+	Expected   int
+	Actual     int
+	Missing    []Entry
+	Unexpected []Entry
+	// pairs of expected and actual entry
+	Mismatched [][2]Entry
+}
+
+// Compare matches the instances by SOP Instance UID and compares size and SHA-256
+func Compare(expected *Manifest, actual *Manifest) Diff {
+	d := Diff{Expected: expected.Len(), Actual: actual.Len()}
+	for _, e := range expected.Entries() {
+		a, ok := actual.Lookup(e.SOPInstanceUID)
+		switch {
+		case !ok:
+			d.Missing = append(d.Missing, e)
+		case a.Size != e.Size || a.SHA256 != e.SHA256:
+			d.Mismatched = append(d.Mismatched, [2]Entry{e, a})
+		}
+	}
+	for _, a := range actual.Entries() {
+		if _, ok := expected.Lookup(a.SOPInstanceUID); !ok {
+			d.Unexpected = append(d.Unexpected, a)
+		}
+	}
+	return d
+}
+
+func (d Diff) Ok() bool {
+	return len(d.Missing) == 0 && len(d.Unexpected) == 0 && len(d.Mismatched) == 0
+}
+
+// Print writes the summary and one line per difference
+func (d Diff) Print(w io.Writer) {
+	fmt.Fprintf(w, "expected: %d actual: %d missing: %d unexpected: %d mismatched: %d\n", d.Expected, d.Actual, len(d.Missing), len(d.Unexpected), len(d.Mismatched))
+	for _, e := range d.Missing {
+		fmt.Fprintf(w, "  - %s %s (%d bytes)\n", e.SOPInstanceUID, e.Path, e.Size)
+	}
+	for _, a := range d.Unexpected {
+		fmt.Fprintf(w, "  + %s %s (%d bytes)\n", a.SOPInstanceUID, a.Path, a.Size)
+	}
+	for _, pair := range d.Mismatched {
+		fmt.Fprintf(w, "  ! %s size %d -> %d sha256 %s -> %s\n", pair[0].SOPInstanceUID, pair[0].Size, pair[1].Size, pair[0].SHA256, pair[1].SHA256)
+	}
+}
@@ -2,8 +2,14 @@ package multiparts
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"httpxcommon/compression"
+	"httpxcommon/digest"
+	"httpxcommon/manifest"
 	"httpxcommon/partscommon"
 	"io"
 	"io/ioutil"
@@ -22,7 +28,48 @@ import (
 )
 
 // Type representing http3 handling
-type MultipartFiles struct{}
+type MultipartFiles struct {
+	// optional compression of body or parts, nil for none
+	Compression *compression.Options
+	// optional content type of the parts, application/dicom if empty
+	ContentType string
+	// optional conversion of the file content before it is sent
+	Transform func(path string, data []byte) ([]byte, error)
+	// optional manifest of the stored instances, on send the instances reported by the server
+	Stored *manifest.Manifest
+	// optional digests of the parts (Repr-Digest) and the body (Content-Digest), nil for none
+	Digest *digest.Options
+	// keep the stored parts in temporary files until Commit, used if the body digest is verified after the last part
+	Pending bool
+	// cause of the last store which failed reading the body or writing a file, nil otherwise
+	Err error
+	// temporary files and instance files of the parts waiting for Commit
+	pending [][2]string
+}
+
+// Commit renames the pending parts to their instance files
+func (h *MultipartFiles) Commit() error {
+	var errRet error
+	for _, p := range h.pending {
+		if err := os.Rename(p[0], p[1]); err != nil {
+			klog.Error("Error storing instance: ", err)
+			os.Remove(p[0])
+			if errRet == nil {
+				errRet = err
+			}
+		}
+	}
+	h.pending = nil
+	return errRet
+}
+
+// Discard removes the pending parts, instance files stored earlier are kept
+func (h *MultipartFiles) Discard() {
+	for _, p := range h.pending {
+		os.Remove(p[0])
+	}
+	h.pending = nil
+}
 
 // boundary to be used
 func (h *MultipartFiles) GetBoundary() string {
@@ -41,10 +88,25 @@ func (h *MultipartFiles) StoreMultipartMessage(header *http.Header, body *io.Rea
 	s := time.Now()
 	var size uint64
 
+	// decompress whole body if needed
+	var reader io.Reader = *body
+	if encoding := header.Get("Content-Encoding"); len(encoding) > 0 && encoding != compression.EncodingIdentity {
+		dec, err := compression.NewReader(encoding, *body, h.Compression.GetStats())
+		if err != nil {
+			klog.Error(err)
+			h.Err = err
+			return http.StatusUnsupportedMediaType, 0
+		}
+		defer dec.Close()
+		reader = dec
+		klog.V(partscommon.KlogInfo).Info("Body content encoding: ", encoding)
+	}
+
 	// determine type and params
 	size = 0
+	mismatches := 0
 	boundary := params["boundary"]
-	mr := multipart.NewReader(*body, boundary)
+	mr := multipart.NewReader(reader, boundary)
 	klog.V(partscommon.KlogInfo).Info("Body boundary found: ", boundary, " in multipart/related messsage")
 out:
 	for {
@@ -58,8 +120,10 @@ out:
 			}
 		case err != nil:
 			{
+				// the parts stored so far are kept
 				klog.Error(err)
-				return http.StatusRequestedRangeNotSatisfiable, 0
+				h.Err = err
+				return http.StatusRequestedRangeNotSatisfiable, uint64(size)
 			}
 		}
 
@@ -75,23 +139,92 @@ out:
 		// create directories and calculate filename
 		filename := partscommon.EnsureFilePath(dir, studyinstanceuid, seriesinstanceuid, sopinstanceuid)
 
-		// create blank file
-		file, errFile := os.Create(filename)
+		// write into a temporary file, an existing instance is replaced only by a complete and verified part
+		file, errFile := partscommon.CreateTemp(filename)
 		if errFile != nil {
 			klog.Error(errFile)
-			return http.StatusNotFound, 0
+			h.Err = errFile
+			return http.StatusNotFound, uint64(size)
+		}
+		temp := file.Name()
+
+		// the digest covers the part as transmitted
+		var rawReader io.Reader = part
+		partHash := digest.NewHash(h.Digest.GetStats())
+		field := digest.Field(part.Header)
+		if !h.Digest.IsEnabled() {
+			field = ""
+		}
+		if len(field) > 0 {
+			rawReader = io.TeeReader(part, partHash)
+		}
+
+		// decompress part if needed
+		// the decoder is closed at the end of the part
+		var partReader io.Reader = rawReader
+		var partDec io.Closer = io.NopCloser(nil)
+		if encoding := part.Header.Get("Content-Encoding"); len(encoding) > 0 && encoding != compression.EncodingIdentity {
+			dec, err := compression.NewReader(encoding, rawReader, h.Compression.GetStats())
+			if err != nil {
+				klog.Error(err)
+				h.Err = err
+				file.Close()
+				os.Remove(temp)
+				return http.StatusUnsupportedMediaType, uint64(size)
+			}
+			partReader, partDec = dec, dec
 		}
-		defer file.Close()
+
 		// copy part to file
-		length, errCopy := io.Copy(file, part)
+		var w io.Writer = file
+		hash := sha256.New()
+		if h.Stored != nil {
+			w = io.MultiWriter(file, hash)
+		}
+		length, errCopy := io.Copy(w, partReader)
+		partDec.Close()
+		if errClose := file.Close(); errCopy == nil {
+			errCopy = errClose
+		}
 		if errCopy != nil {
+			// a truncated instance is not kept
 			klog.Error(errCopy)
-			return http.StatusConflict, 0
+			h.Err = errCopy
+			os.Remove(temp)
+			return http.StatusConflict, uint64(size)
+		}
+
+		// damaged parts are removed, the other parts are stored
+		if len(field) > 0 {
+			io.Copy(io.Discard, rawReader)
+			if errDigest := partHash.Verify(field); errDigest != nil {
+				klog.Error("Part ", originalfilename, ": ", errDigest)
+				os.Remove(temp)
+				if h.Stored != nil {
+					h.Stored.Fail(manifest.Failure{SOPInstanceUID: sopinstanceuid, Path: manifest.NewEntry(dir, filename, "", 0).Path, Reason: errDigest.Error()})
+				}
+				mismatches++
+				continue
+			}
+		}
+		if h.Pending {
+			h.pending = append(h.pending, [2]string{temp, filename})
+		} else if err := os.Rename(temp, filename); err != nil {
+			klog.Error(err)
+			h.Err = err
+			os.Remove(temp)
+			return http.StatusInternalServerError, uint64(size)
+		}
+		if h.Stored != nil {
+			h.Stored.Add(manifest.NewEntry(dir, filename, hex.EncodeToString(hash.Sum(nil)), length))
 		}
 		size += uint64(length)
 		klog.V(partscommon.KlogInfo).Infoln("Data copied into file:", filename, " with size:", length, " and time taken:", time.Since(sPart))
 	}
 	klog.V(partscommon.KlogDebug).Info("Time total taken: ", time.Since(s), " size:", size)
+	if mismatches > 0 {
+		return http.StatusConflict, uint64(size)
+	}
 	return http.StatusOK, uint64(size)
 }
 
@@ -103,7 +236,7 @@ func (h *MultipartFiles) SaveFilesFromResponse(rsp *http.Response, directory str
 	// get the study instance uid from url if available
 	u, err := url.Parse(urlIn)
 	if err != nil {
-		panic(err)
+		return err, 0
 	}
 	var studyinstanceuid string
 	urlPart := strings.Split(u.Path, "/")
@@ -120,6 +253,12 @@ func (h *MultipartFiles) SaveFilesFromResponse(rsp *http.Response, directory str
 	// store multipart message
 	code, size := h.StoreMultipartMessage(&rsp.Header, &rsp.Body, directory, params)
 	klog.V(partscommon.KlogInfo).Info("Code returned from storing multipart body:", code)
+	switch {
+	case code != http.StatusOK && h.Err != nil:
+		errRet = fmt.Errorf("storing multipart response of %s failed with status %d: %w", urlIn, code, h.Err)
+	case code != http.StatusOK:
+		errRet = fmt.Errorf("storing multipart response of %s failed with status %d", urlIn, code)
+	}
 
 	klog.V(partscommon.KlogDebug).Info("Time total taken: ", time.Since(s))
 	return errRet, size
@@ -144,23 +283,53 @@ func (h *MultipartFiles) ProcessFileSync(path string, writer *multipart.Writer)
 		return 0, err
 	}
 	defer file.Close()
+	if h.Transform != nil {
+		if fileContents, err = h.Transform(path, fileContents); err != nil {
+			return 0, err
+		}
+	}
 
 	// create single part
 	header := textproto.MIMEHeader{}
 	header.Set("Content-Type", "application/dicom")
+	if len(h.ContentType) > 0 {
+		header.Set("Content-Type", h.ContentType)
+	}
 	// header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", file.Name()))
 	joinedpath := filepath.Join(studyinstanceuid, seriesinstanceuid, sopinstanceuid)
 	klog.V(partscommon.KlogInfo).Info("Joined filename path:", joinedpath)
 	header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", joinedpath))
+	encoding := h.Compression.PartEncoding()
+	if len(encoding) > 0 {
+		header.Set("Content-Encoding", encoding)
+	}
+
+	// compressed parts are encoded ahead, the digest covers the part as transmitted
+	n := len(fileContents)
+	if len(encoding) > 0 {
+		encoded := &bytes.Buffer{}
+		enc, err := compression.NewWriter(encoding, encoded, h.Compression.GetStats())
+		if err != nil {
+			return 0, err
+		}
+		if _, err = enc.Write(fileContents); err != nil {
+			return 0, err
+		}
+		if err = enc.Close(); err != nil {
+			return 0, err
+		}
+		fileContents = encoded.Bytes()
+	}
+	if h.Digest.IsEnabled() {
+		header.Set(digest.ReprDigestHeader, h.Digest.Sum(fileContents))
+	}
 
-	// create the part
+	// create the part and write the file content
 	wPart, err := writer.CreatePart(header)
 	if err != nil {
 		return 0, err
 	}
-	// write the file content
-	var n int
-	if n, err = wPart.Write(fileContents); err != nil {
+	if _, err = wPart.Write(fileContents); err != nil {
 		return 0, err
 	}
 
@@ -194,12 +363,14 @@ func (h *MultipartFiles) UploadFilesFromDirectory(body io.Writer, directory stri
 			return err
 		}
 
-		// process every file
-		if !info.IsDir() {
+		// process every instance, manifests and partial files are skipped
+		if !info.IsDir() && manifest.IsInstanceFile(path) {
 			sFile := time.Now()
 			l, err := h.ProcessFileSync(path, writer)
 			if err != nil {
-				klog.V(partscommon.KlogDebug).Info("Error processing file: ", path, err)
+				// a missing or untranscodable instance or a failed write ends the message
+				klog.Error("Error processing file: ", path, ": ", err)
+				return fmt.Errorf("%s: %w", path, err)
 			}
 			klog.V(partscommon.KlogDebug).Info("Reading file: ", path, " in: ", time.Since(sFile), " size:", l)
 			len += l
@@ -207,7 +378,6 @@ func (h *MultipartFiles) UploadFilesFromDirectory(body io.Writer, directory stri
 		return nil
 	})
 	if errWalk != nil {
-		klog.V(partscommon.KlogDebug).Info("No files in directory: ", path)
 		return errWalk, len
 	}
 	klog.V(partscommon.KlogDebug).Info("Time total taken: ", time.Since(s), " size:", len)
@@ -216,7 +386,8 @@ func (h *MultipartFiles) UploadFilesFromDirectory(body io.Writer, directory stri
 	return nil, len
 }
 
-func (h *MultipartFiles) PostFilesFromDirectory(client *http.Client, url string, directory string) (error, uint64, time.Duration) {
+// PostFilesFromDirectory sends all instances of the directory in one multipart POST bound to the context
+func (h *MultipartFiles) PostFilesFromDirectory(ctx context.Context, client *http.Client, url string, directory string) (error, uint64, time.Duration) {
 	// create a new multipart writer and send all in one POST
 	var size uint64
 	s := time.Now()
@@ -229,20 +400,89 @@ func (h *MultipartFiles) PostFilesFromDirectory(client *http.Client, url string,
 		return errHandle, 0, 0
 	}
 
+	// compress whole body if needed
+	encoding := h.Compression.BodyEncoding()
+	if len(encoding) > 0 {
+		compressed := &bytes.Buffer{}
+		enc, err := compression.NewWriter(encoding, compressed, h.Compression.GetStats())
+		if err != nil {
+			return err, 0, 0
+		}
+		if _, err = enc.Write(body.Bytes()); err != nil {
+			return err, 0, 0
+		}
+		if err = enc.Close(); err != nil {
+			return err, 0, 0
+		}
+		body = compressed
+	}
+
 	// Create a HTTP post request
-	r, err := http.NewRequest(http.MethodPost, url, body)
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
 	if err != nil {
 		klog.Error("Error in creating POST request")
+		return err, 0, 0
 	}
 	ct := fmt.Sprintf("multipart/related; boundary=%q; type=\"application/dicom\"", h.GetBoundary())
 	r.Header.Add("Content-Type", ct)
 	r.Header.Add("Content-Length", strconv.Itoa(body.Len()))
+	if len(encoding) > 0 {
+		r.Header.Add("Content-Encoding", encoding)
+	}
+	if h.Digest.IsEnabled() {
+		r.Header.Set(digest.ContentDigestHeader, h.Digest.Sum(body.Bytes()))
+	}
 	partscommon.LogRequest(r)
 	res, err := client.Do(r)
 	if err != nil {
-		panic(err)
+		return err, 0, time.Since(s)
 	}
 	defer res.Body.Close()
 	partscommon.LogResponse(res)
+	if errStored := ReadStoredInstances(res, h.Stored); errStored != nil {
+		return errStored, size, time.Since(s)
+	}
 	return nil, size, time.Since(s)
 }
+
+// Type representing a store rejected by the server completely or in part
+type StoreError struct {
+	StatusCode int
+	Status     string
+	// instances rejected by the server, empty if the response did not list them
+	Failures []manifest.Failure
+}
+
+func (e *StoreError) Error() string {
+	if len(e.Failures) > 0 {
+		return fmt.Sprintf("store failed: %s, %d instances rejected, first %s: %s", e.Status, len(e.Failures), e.Failures[0].SOPInstanceUID, e.Failures[0].Reason)
+	}
+	return fmt.Sprintf("store failed: %s", e.Status)
+}
+
+// ReadStoredInstances checks the status of a store response and adds the instances reported by the server
+func ReadStoredInstances(res *http.Response, stored *manifest.Manifest) error {
+	contentType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if contentType != "application/json" {
+		if res.StatusCode < 200 || res.StatusCode > 299 {
+			return &StoreError{StatusCode: res.StatusCode, Status: res.Status}
+		}
+		return nil
+	}
+	response := manifest.New()
+	if err := response.ReadJSON(res.Body); err != nil {
+		return fmt.Errorf("reading stored instances: %w", err)
+	}
+	if stored != nil {
+		for _, e := range response.Entries() {
+			stored.Add(e)
+		}
+	}
+	if failures := response.Failures(); len(failures) > 0 {
+		return &StoreError{StatusCode: res.StatusCode, Status: res.Status, Failures: failures}
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return &StoreError{StatusCode: res.StatusCode, Status: res.Status}
+	}
+	return nil
+}
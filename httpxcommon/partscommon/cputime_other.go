@@ -0,0 +1,10 @@
+//go:build !unix && !windows
+
+package partscommon
+
+import "time"
+
+// ProcessCPUTime is not available on this platform
+func ProcessCPUTime() time.Duration {
+	return 0
+}
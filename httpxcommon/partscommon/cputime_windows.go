@@ -0,0 +1,24 @@
+//go:build windows
+
+package partscommon
+
+import (
+	"syscall"
+	"time"
+)
+
+// ProcessCPUTime returns the user and kernel CPU time used by the process
+func ProcessCPUTime() time.Duration {
+	handle, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return 0
+	}
+	var creation, exit, kernel, user syscall.Filetime
+	if err := syscall.GetProcessTimes(handle, &creation, &exit, &kernel, &user); err != nil {
+		return 0
+	}
+	// filetime values are in 100ns units
+	ticks := uint64(kernel.HighDateTime)<<32 | uint64(kernel.LowDateTime)
+	ticks += uint64(user.HighDateTime)<<32 | uint64(user.LowDateTime)
+	return time.Duration(ticks * 100)
+}
@@ -38,6 +38,28 @@ func GetDICOMInfo(originalfilename string) (string, string, string) {
 	return studyinstanceuid, seriesinstanceuid, sopinstanceuid
 }
 
+// GetDICOMInfoFromUrl extracts the uids from a path like /studies/{study}/series/{series}/instances/{instance}
+func GetDICOMInfoFromUrl(urlPath string) (string, string, string) {
+	studyinstanceuid, seriesinstanceuid, sopinstanceuid := "", "", ""
+	parts := strings.Split(strings.Trim(urlPath, "/"), "/")
+	for i := 0; i+1 < len(parts); i += 2 {
+		switch parts[i] {
+		case "studies":
+			studyinstanceuid = parts[i+1]
+		case "series":
+			seriesinstanceuid = parts[i+1]
+		case "instances":
+			sopinstanceuid = parts[i+1]
+		}
+	}
+	return studyinstanceuid, seriesinstanceuid, sopinstanceuid
+}
+
+// CreateTemp creates a temporary file next to the instance file, renamed when the instance is complete and verified
+func CreateTemp(filename string) (*os.File, error) {
+	return os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.partial")
+}
+
 func EnsureFilePath(dir string, studyinstanceuid string, seriesinstanceuid string, sopinstanceuid string) string {
 	// create directories for study and series level
 	directoryname := filepath.Join(dir, studyinstanceuid)
@@ -78,25 +100,28 @@ func GetGID() uint64 {
 	return n
 }
 
-func CheckDirectory(dir string) string {
+// CheckDirectory returns the directory, the current directory if empty, and an error if it is no existing directory
+func CheckDirectory(dir string) (string, error) {
 	// get current path
 	if dir == "" {
 		path, err := os.Getwd()
 		if err != nil {
-			panic("Failed to get current path")
+			return "", fmt.Errorf("Failed to get current path: %w", err)
 		}
 		klog.V(KlogDebug).Info("Using current directory as path: ", path)
-		return path
-	} else {
-		_, err := os.Stat(dir)
-		if err != nil {
-			if os.IsNotExist(err) {
-				// File or directory does not exist
-				panic("Directory " + dir + " does not exist. Please provide an existing directory !")
-			}
+		return path, nil
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("Directory %s does not exist. Please provide an existing directory !", dir)
 		}
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s is no directory. Please provide an existing directory !", dir)
 	}
-	return dir
+	return dir, nil
 }
 
 func ByteCountSI(b uint64) string {
@@ -2,8 +2,15 @@ package singleparts
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"httpxcommon/compression"
+	"httpxcommon/digest"
+	"httpxcommon/manifest"
+	"httpxcommon/multiparts"
 	"httpxcommon/partscommon"
 	"io"
 	"io/ioutil"
@@ -13,14 +20,31 @@ import (
 	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"k8s.io/klog"
 )
 
+// suffix of the file keeping the entity tag of a partially downloaded instance
+const PartialSuffix = ".partial"
+
 // Type representing http3 handling
-type SinglepartFiles struct{}
+type SinglepartFiles struct {
+	// optional compression of the body, nil for none
+	Compression *compression.Options
+	// optional manifest of the stored instances, on send the instances reported by the server
+	Stored *manifest.Manifest
+	// optional digest of the body (Content-Digest or Repr-Digest), nil for none
+	Digest *digest.Options
+	// number of workers of the async send, the number of CPUs if not set
+	Workers int
+	// optional callback for every instance which could not be sent, the send continues with the next one
+	OnError func(path string, err error)
+	// cause of the last store which failed reading the body or writing the file, nil otherwise
+	Err error
+}
 
 // get part file name
 func (h *SinglepartFiles) GetSinglePartFileName(p *http.Header) string {
@@ -46,25 +70,199 @@ func (h *SinglepartFiles) StoreSinglePartMessage(header *http.Header, body *io.R
 	filename := partscommon.EnsureFilePath(dir, studyinstanceuid, seriesinstanceuid, sopinstanceuid)
 	klog.V(partscommon.KlogInfo).Info("Target file name: ", filename)
 
-	// create blank file
-	file, errFile := os.Create(filename)
+	// write into a temporary file, an existing instance is replaced only by a complete and verified body
+	file, errFile := partscommon.CreateTemp(filename)
 	if errFile != nil {
 		klog.Error(errFile)
+		h.Err = errFile
 		return http.StatusNotFound, 0
 	}
+	temp := file.Name()
 	defer file.Close()
 
+	// the digest covers the body as transmitted
+	var rawReader io.Reader = *body
+	bodyHash := digest.NewHash(h.Digest.GetStats())
+	field := digest.Field(header)
+	if !h.Digest.IsEnabled() {
+		field = ""
+	}
+	if len(field) > 0 {
+		rawReader = io.TeeReader(*body, bodyHash)
+	}
+
+	// decompress body if needed
+	var reader io.Reader = rawReader
+	if encoding := header.Get("Content-Encoding"); len(encoding) > 0 && encoding != compression.EncodingIdentity {
+		dec, err := compression.NewReader(encoding, rawReader, h.Compression.GetStats())
+		if err != nil {
+			klog.Error(err)
+			h.Err = err
+			file.Close()
+			os.Remove(temp)
+			return http.StatusUnsupportedMediaType, 0
+		}
+		defer dec.Close()
+		reader = dec
+	}
+
 	// copy part to file
-	size, errCopy := io.Copy(file, *body)
+	var w io.Writer = file
+	hash := sha256.New()
+	if h.Stored != nil {
+		w = io.MultiWriter(file, hash)
+	}
+	size, errCopy := io.Copy(w, reader)
 	if errCopy != nil {
+		// a truncated instance is not kept
 		klog.Error(errCopy)
+		h.Err = errCopy
+		file.Close()
+		os.Remove(temp)
 		return http.StatusConflict, uint64(size)
 	}
+	if len(field) > 0 {
+		io.Copy(io.Discard, rawReader)
+		if errDigest := bodyHash.Verify(field); errDigest != nil {
+			klog.Error("Instance ", originalfilename, ": ", errDigest)
+			file.Close()
+			os.Remove(temp)
+			if h.Stored != nil {
+				h.Stored.Fail(manifest.Failure{SOPInstanceUID: sopinstanceuid, Path: manifest.NewEntry(dir, filename, "", 0).Path, Reason: errDigest.Error()})
+			}
+			return http.StatusConflict, uint64(size)
+		}
+	}
+	file.Close()
+	if err := os.Rename(temp, filename); err != nil {
+		klog.Error(err)
+		h.Err = err
+		os.Remove(temp)
+		return http.StatusInternalServerError, uint64(size)
+	}
+	if h.Stored != nil {
+		h.Stored.Add(manifest.NewEntry(dir, filename, hex.EncodeToString(hash.Sum(nil)), size))
+	}
 	klog.V(partscommon.KlogInfo).Infoln("Data copied into file:", filename, " with size:", size, " and time taken:", time.Since(s), " goroutine:", partscommon.GetGID())
 	return http.StatusOK, uint64(size)
 }
 
-func ReadFileAndPost(client *http.Client, url string, path string) (error, uint64, time.Duration, time.Duration) {
+// PrepareResume adds the range headers to continue a partially downloaded instance and returns the offset
+func (h *SinglepartFiles) PrepareResume(r *http.Request, filename string) int64 {
+	etag, err := os.ReadFile(filename + PartialSuffix)
+	if err != nil {
+		return 0
+	}
+	info, err := os.Stat(filename)
+	if err != nil || info.Size() == 0 {
+		return 0
+	}
+	r.Header.Set("Range", fmt.Sprintf("bytes=%d-", info.Size()))
+	r.Header.Set("If-Range", strings.TrimSpace(string(etag)))
+	klog.V(partscommon.KlogDebug).Info("Resuming download of ", filename, " at offset ", info.Size(), " with entity tag ", string(etag))
+	return info.Size()
+}
+
+// StoreResumableResponse writes a complete (200) or partial (206) instance into the file
+func (h *SinglepartFiles) StoreResumableResponse(res *http.Response, filename string, offset int64) (error, uint64) {
+	s := time.Now()
+	partial := filename + PartialSuffix
+	switch res.StatusCode {
+	case http.StatusOK:
+		offset = 0
+	case http.StatusPartialContent:
+		var start, end, total int64
+		if _, err := fmt.Sscanf(res.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total); err != nil || start != offset {
+			return fmt.Errorf("Unexpected content range %q for offset %d", res.Header.Get("Content-Range"), offset), 0
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the file was already complete
+		var total int64
+		if _, err := fmt.Sscanf(res.Header.Get("Content-Range"), "bytes */%d", &total); err == nil && total == offset {
+			klog.V(partscommon.KlogDebug).Info("Instance already complete: ", filename)
+			_ = os.Remove(partial)
+			return nil, 0
+		}
+		return fmt.Errorf("Range not satisfiable for %s at offset %d", filename, offset), 0
+	default:
+		return fmt.Errorf("Unexpected status %d for instance %s", res.StatusCode, filename), 0
+	}
+
+	// keep the entity tag while downloading, only strong validators can be used with If-Range
+	etag := res.Header.Get("ETag")
+	if len(etag) > 0 && !strings.HasPrefix(etag, "W/") && res.Header.Get("Content-Encoding") == "" {
+		if err := os.WriteFile(partial, []byte(etag), 0644); err != nil {
+			return err, 0
+		}
+	}
+
+	// append to the existing data or start from the beginning
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err, 0
+	}
+	defer file.Close()
+	if err := file.Truncate(offset); err != nil {
+		return err, 0
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err, 0
+	}
+	var body io.Reader = res.Body
+	if encoding := res.Header.Get("Content-Encoding"); len(encoding) > 0 && encoding != compression.EncodingIdentity {
+		dec, err := compression.NewReader(encoding, res.Body, h.Compression.GetStats())
+		if err != nil {
+			return err, 0
+		}
+		defer dec.Close()
+		body = dec
+	}
+	size, errCopy := io.Copy(file, body)
+	if errCopy != nil {
+		klog.Error("Download interrupted for ", filename, " at offset ", offset+size, ": ", errCopy)
+		return errCopy, uint64(size)
+	}
+	if res.ContentLength >= 0 && body == res.Body && size != res.ContentLength {
+		return fmt.Errorf("Incomplete download of %s: %d of %d bytes: %w", filename, size, res.ContentLength, io.ErrUnexpectedEOF), uint64(size)
+	}
+	_ = os.Remove(partial)
+
+	// the representation digest covers the complete instance including the earlier parts
+	if field := res.Header.Get(digest.ReprDigestHeader); h.Digest.IsEnabled() && len(field) > 0 && res.Header.Get("Content-Encoding") == "" {
+		reprHash := digest.NewHash(h.Digest.GetStats())
+		if err := hashFile(filename, reprHash); err != nil {
+			return err, uint64(size)
+		}
+		if err := reprHash.Verify(field); err != nil {
+			os.Remove(filename)
+			return fmt.Errorf("instance %s: %w", filename, err), uint64(size)
+		}
+	}
+	if h.Stored != nil {
+		// the digest covers the earlier parts of the file
+		sum, total, err := manifest.FileDigest(filename)
+		if err != nil {
+			return err, uint64(size)
+		}
+		h.Stored.Add(manifest.NewEntry(filepath.Dir(filepath.Dir(filepath.Dir(filename))), filename, sum, total))
+	}
+	klog.V(partscommon.KlogInfo).Infoln("Data copied into file:", filename, " from offset:", offset, " with size:", size, " and time taken:", time.Since(s))
+	return nil, uint64(size)
+}
+
+// hashFile writes the content of the file into the hash
+func hashFile(filename string, w io.Writer) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// ReadFileAndPost sends the instance in the file with one POST, the request is bound to the context
+func ReadFileAndPost(ctx context.Context, client *http.Client, url string, path string, opts *compression.Options, dig *digest.Options, stored *manifest.Manifest) (error, uint64, time.Duration, time.Duration) {
 	// read file
 	sFile1 := time.Now()
 	file, errOpen := os.Open(path)
@@ -87,39 +285,69 @@ func ReadFileAndPost(client *http.Client, url string, path string) (error, uint6
 		return errors.New("No correct structure for file"), 0, 0, 0
 	}
 
-	// Create a HTTP post request
+	// compress body if needed
 	sFile2 := time.Now()
-	r, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(fileContents))
+	body := bytes.NewBuffer(fileContents)
+	encoding := opts.SingleEncoding()
+	if len(encoding) > 0 {
+		body = &bytes.Buffer{}
+		enc, err := compression.NewWriter(encoding, body, opts.GetStats())
+		if err != nil {
+			return err, 0, 0, 0
+		}
+		if _, err = enc.Write(fileContents); err != nil {
+			return err, 0, 0, 0
+		}
+		if err = enc.Close(); err != nil {
+			return err, 0, 0, 0
+		}
+	}
+
+	// Create a HTTP post request
+	lenBody := len(fileContents)
+	lenEncoded := body.Len()
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
 	if err != nil {
 		klog.Error("Error in creating POST request")
 		return err, 0, 0, 0
 	}
 	r.Header.Add("Content-Type", "application/dicom")
-	lenBody := len(fileContents)
-	r.Header.Add("Content-Length", strconv.Itoa(lenBody))
+	r.Header.Add("Content-Length", strconv.Itoa(lenEncoded))
+	if len(encoding) > 0 {
+		r.Header.Add("Content-Encoding", encoding)
+	}
+	if dig.IsEnabled() {
+		r.Header.Set(digest.ContentDigestHeader, dig.Sum(body.Bytes()))
+	}
 	joinedpath := filepath.Join(studyinstanceuid, seriesinstanceuid, sopinstanceuid)
 	klog.V(partscommon.KlogInfo).Info("Joined filename path:", joinedpath)
 	r.Header.Add("Content-Disposition", fmt.Sprintf("attachment; filename=%q", joinedpath))
 	partscommon.LogRequest(r)
 	res, err := client.Do(r)
 	if err != nil {
-		panic(err)
+		return err, 0, duration1, time.Since(sFile2)
 	}
 	defer res.Body.Close()
 	partscommon.LogResponse(res)
+	errStored := multiparts.ReadStoredInstances(res, stored)
 	duration2 := time.Since(sFile2)
 
 	klog.V(partscommon.KlogInfo).Info("GID:", partscommon.GetGID(), " file:", path, " length:", lenBody, " fileI/O:", duration1, " POST:", duration2, " result:", res.StatusCode)
+	if errStored != nil {
+		return fmt.Errorf("%s: %w", path, errStored), 0, duration1, duration2
+	}
 	return nil, uint64(lenBody), duration1, duration2
 }
 
-func (h *SinglepartFiles) SyncPostFilesFromDirectory(client *http.Client, url string, directory string) (error, uint64, time.Duration) {
+// SyncPostFilesFromDirectory sends the instances one after the other, failed instances are reported to OnError and the first error is returned, a canceled context stops the walk
+func (h *SinglepartFiles) SyncPostFilesFromDirectory(ctx context.Context, client *http.Client, url string, directory string) (error, uint64, time.Duration) {
 	// build path
 	path := directory
 	klog.V(partscommon.KlogDebug).Info("Processing directory: ", path)
 	s := time.Now()
 	var dur1, dur2 time.Duration
 	var size uint64
+	var firstErr error
 
 	// walk through all files
 	errWalk := filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
@@ -128,23 +356,31 @@ func (h *SinglepartFiles) SyncPostFilesFromDirectory(client *http.Client, url st
 			return err
 		}
 
-		// process every file
-		if !info.IsDir() {
+		// process every instance, manifests and partial files are skipped
+		if !info.IsDir() && manifest.IsInstanceFile(path) {
 			// read file and post content
-			err, nrBytes, duration1, duration2 := ReadFileAndPost(client, url, path)
-			if err != nil {
-				klog.Error("Error in reading file: ", err)
-				return err
-			}
+			err, nrBytes, duration1, duration2 := ReadFileAndPost(ctx, client, url, path, h.Compression, h.Digest, h.Stored)
 			dur1 += duration1
 			dur2 += duration2
 			size += nrBytes
+			if err != nil {
+				klog.Error("Error in reading file: ", err)
+				if firstErr == nil {
+					firstErr = err
+				}
+				if h.OnError != nil {
+					h.OnError(path, err)
+				}
+			}
 		}
-		return nil
+		return ctx.Err()
 	})
+	if errWalk == nil {
+		errWalk = firstErr
+	}
 	if errWalk != nil {
-		klog.V(partscommon.KlogDebug).Info("No files in directory: ", path)
-		return errWalk, 0, 0
+		klog.V(partscommon.KlogDebug).Info("Walk stopped in directory: ", path)
+		return errWalk, size, time.Since(s)
 	}
 	total := time.Since(s)
 	klog.V(partscommon.KlogDebug).Info("Time total taken: ", total, " GID:", partscommon.GetGID(), " fileI/O:", dur1, " POST:", dur2)
@@ -157,20 +393,28 @@ type FileResult struct {
 	nr        uint64
 	duration1 time.Duration
 	duration2 time.Duration
+	// first error of the workers
+	err error
 }
 
-func FileWorker(client *http.Client, url string, id int, files <-chan string, done chan<- bool, result *FileResult) {
+func FileWorker(ctx context.Context, client *http.Client, url string, opts *compression.Options, dig *digest.Options, stored *manifest.Manifest, onError func(string, error), id int, files <-chan string, done chan<- bool, result *FileResult) {
 	klog.V(2).Info(" WORKER:", id, " goroutine:", partscommon.GetGID())
 	for {
 		file, more := <-files
 		if more {
 			klog.V(2).Info(" WORKER:", id, " start file:", file, " goroutine:", partscommon.GetGID())
 			// read file and post content
-			err, nrBytes, duration1, duration2 := ReadFileAndPost(client, url, file)
+			err, nrBytes, duration1, duration2 := ReadFileAndPost(ctx, client, url, file, opts, dig, stored)
 			if err != nil {
 				klog.Error("Error in reading file: ", err)
+				if onError != nil {
+					onError(file, err)
+				}
 			}
 			result.mu.Lock()
+			if err != nil && result.err == nil {
+				result.err = err
+			}
 			result.size += nrBytes
 			result.nr += 1
 			result.duration1 += duration1
@@ -184,14 +428,18 @@ func FileWorker(client *http.Client, url string, id int, files <-chan string, do
 	}
 }
 
-func (h *SinglepartFiles) AsyncPostFilesFromDirectory(client *http.Client, url string, directory string) (error, uint64, time.Duration) {
+// AsyncPostFilesFromDirectory sends the instances with a pool of workers, the first error is returned after all workers are done
+func (h *SinglepartFiles) AsyncPostFilesFromDirectory(ctx context.Context, client *http.Client, url string, directory string) (error, uint64, time.Duration) {
 	// build path
 	path := directory
 	klog.V(partscommon.KlogDebug).Info("Processing directory: ", path)
 	s := time.Now()
 
 	// create channels and a number of workers
-	numWorkers := runtime.NumCPU()
+	numWorkers := h.Workers
+	if numWorkers < 1 {
+		numWorkers = runtime.NumCPU()
+	}
 	files := make(chan string)
 	done := make(chan bool, numWorkers)
 	result := FileResult{
@@ -201,7 +449,7 @@ func (h *SinglepartFiles) AsyncPostFilesFromDirectory(client *http.Client, url s
 	// create workers
 	klog.V(2).Info("Create ", numWorkers, " workers")
 	for w := 1; w <= numWorkers; w++ {
-		go FileWorker(client, url, w, files, done, &result)
+		go FileWorker(ctx, client, url, h.Compression, h.Digest, h.Stored, h.OnError, w, files, done, &result)
 	}
 
 	// walk through all files
@@ -210,16 +458,16 @@ func (h *SinglepartFiles) AsyncPostFilesFromDirectory(client *http.Client, url s
 			klog.V(2).Info("No files in directory: ", path, err)
 			return err
 		}
-		// process every file
-		if !info.IsDir() {
-			files <- path
+		// process every instance, manifests and partial files are skipped
+		if !info.IsDir() && manifest.IsInstanceFile(path) {
+			select {
+			case files <- path:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
 		}
 		return nil
 	})
-	if errWalk != nil {
-		klog.V(2).Info("No files in directory: ", path)
-		return errWalk, 0, 0
-	}
 
 	// close the channel
 	close(files)
@@ -227,6 +475,14 @@ func (h *SinglepartFiles) AsyncPostFilesFromDirectory(client *http.Client, url s
 	for w := 1; w <= numWorkers; w++ {
 		<-done
 	}
+	if errWalk == nil {
+		errWalk = result.err
+	}
+	if errWalk != nil {
+		klog.V(2).Info("Walk stopped in directory: ", path)
+		close(done)
+		return errWalk, result.size, time.Since(s)
+	}
 	// close(results)
 	total := time.Since(s)
 	klog.V(partscommon.KlogDebug).Info("ASYNC Time total taken: ", total, " GID:", partscommon.GetGID(), " total size:", partscommon.ByteCountSI(result.size), " files:", result.nr, " I/O:", result.duration1, " POST:", result.duration2)
@@ -0,0 +1,56 @@
+// Package sizes parses and formats byte sizes of the command line flags and tuning parameters.
+package sizes
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// units of sizes, 1024 based
+var units = []struct {
+	suffix string
+	factor uint64
+}{
+	{"GB", 1 << 30}, {"G", 1 << 30},
+	{"MB", 1 << 20}, {"M", 1 << 20},
+	{"KB", 1 << 10}, {"K", 1 << 10},
+	{"B", 1},
+}
+
+// Parse parses a size like 512KB, 2M, 1.5MB or 1048576, fractions of a byte are cut off
+func Parse(value string) (uint64, error) {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	factor := uint64(1)
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s, factor = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.factor
+			break
+		}
+	}
+	if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+		if n > math.MaxUint64/factor {
+			return 0, fmt.Errorf("size %q too large", value)
+		}
+		return n * factor, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	if f*float64(factor) >= math.MaxUint64 {
+		return 0, fmt.Errorf("size %q too large", value)
+	}
+	return uint64(f * float64(factor)), nil
+}
+
+// Format returns the size with the largest unit dividing it
+func Format(size uint64) string {
+	for _, u := range units {
+		if len(u.suffix) == 2 && size >= u.factor && size%u.factor == 0 {
+			return strconv.FormatUint(size/u.factor, 10) + u.suffix
+		}
+	}
+	return strconv.FormatUint(size, 10)
+}
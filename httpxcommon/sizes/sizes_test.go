@@ -0,0 +1,65 @@
+package sizes
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    uint64
+		wantErr bool
+	}{
+		{"1048576", 1 << 20, false},
+		{"512KB", 512 << 10, false},
+		{"512k", 512 << 10, false},
+		{"2M", 2 << 20, false},
+		{"2MB", 2 << 20, false},
+		{" 16 MB ", 16 << 20, false},
+		{"1.5MB", 3 << 19, false},
+		{"1.5M", 3 << 19, false},
+		{"0.5GB", 1 << 29, false},
+		{"10B", 10, false},
+		{"1.5", 1, false},
+		{"18446744073709551615", 18446744073709551615, false},
+		{"", 0, true},
+		{"MB", 0, true},
+		{"-1MB", 0, true},
+		{"2TB", 0, true},
+		{"NaN", 0, true},
+		{"Inf", 0, true},
+		{"17179869184GB", 0, true},
+		{"1e30", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := Parse(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Parse(%q) = %d, want %d", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		size uint64
+		want string
+	}{
+		{0, "0"},
+		{1000, "1000"},
+		{1 << 10, "1KB"},
+		{3 << 19, "1536KB"},
+		{16 << 20, "16MB"},
+		{2 << 30, "2GB"},
+	}
+	for _, tt := range tests {
+		if got := Format(tt.size); got != tt.want {
+			t.Errorf("Format(%d) = %q, want %q", tt.size, got, tt.want)
+		}
+		if got, err := Parse(Format(tt.size)); err != nil || got != tt.size {
+			t.Errorf("Parse(Format(%d)) = %d %v", tt.size, got, err)
+		}
+	}
+}
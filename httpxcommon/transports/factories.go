@@ -0,0 +1,166 @@
+package transports
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"httpxcommon/tuning"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+)
+
+// dial returns a dial function setting the socket buffers of the tuning, connections are tracked if stats is set
+func dial(s Settings, label string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: s.Tuning.Control}
+	if s.Stats != nil {
+		return s.Stats.Track(label, dialer.DialContext)
+	}
+	return dialer.DialContext
+}
+
+// dialTLS returns a TLS dial function using the dial function for the TCP connection
+func dialTLS(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
+
+// dialQuic returns a quic dial function using an own UDP socket per connection with the socket buffers of the tuning
+func dialQuic(t *tuning.Config) func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+	return func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		listenConfig := &net.ListenConfig{Control: t.Control}
+		conn, err := listenConfig.ListenPacket(ctx, "udp", ":0")
+		if err != nil {
+			return nil, err
+		}
+		quicConn, err := quic.DialEarly(ctx, conn, udpAddr, tlsCfg, cfg)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		// the socket is not closed by quic-go if it was created outside
+		go func() {
+			<-quicConn.Context().Done()
+			conn.Close()
+		}()
+		return quicConn, nil
+	}
+}
+
+// scheme returns the url scheme of a transport with or without TLS
+func scheme(secure bool) string {
+	if secure {
+		return "https"
+	}
+	return "http"
+}
+
+// Type representing the factory of HTTP/1.1 transports with or without TLS
+type http1Factory struct {
+	tls bool
+}
+
+func (f http1Factory) Label() string {
+	if f.tls {
+		return "h1-tls"
+	}
+	return "h1"
+}
+
+func (f http1Factory) Scheme() string {
+	return scheme(f.tls)
+}
+
+func (f http1Factory) NewTransport(s Settings) http.RoundTripper {
+	transport := &http.Transport{
+		DialContext: dial(s, s.Prefix+f.Label()),
+	}
+	if f.tls {
+		transport.TLSClientConfig = s.TLS.Config("http/1.1")
+	}
+	return transport
+}
+
+// Type representing the factory of HTTP/2 transports with TLS or cleartext with prior knowledge (h2c)
+type http2Factory struct {
+	tls bool
+}
+
+func (f http2Factory) Label() string {
+	if f.tls {
+		return "h2"
+	}
+	return "h2c"
+}
+
+func (f http2Factory) Scheme() string {
+	return scheme(f.tls)
+}
+
+func (f http2Factory) NewTransport(s Settings) http.RoundTripper {
+	label := s.Prefix + f.Label()
+	transport := &http2.Transport{
+		StrictMaxConcurrentStreams: true,
+	}
+	s.Tuning.ConfigureHttp2Transport(transport)
+	if f.tls {
+		transport.TLSClientConfig = s.TLS.Config("h2")
+		if s.Stats != nil || s.Tuning.HasSocketBuffers() {
+			transport.DialTLSContext = dialTLS(dial(s, label))
+		}
+		return transport
+	}
+
+	// the TLS dial hook of the transport opens plain TCP connections
+	plain := dial(s, label)
+	transport.AllowHTTP = true
+	transport.DialTLSContext = func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+		return plain(ctx, network, addr)
+	}
+	return transport
+}
+
+// Type representing the factory of HTTP/3 transports
+type http3Factory struct{}
+
+func (f http3Factory) Label() string {
+	return "h3"
+}
+
+func (f http3Factory) Scheme() string {
+	return "https"
+}
+
+func (f http3Factory) NewTransport(s Settings) http.RoundTripper {
+	conf := s.Tuning.QuicConfig(s.QuicConfig)
+	if s.Stats != nil {
+		conf.Tracer = MultiplexTracers(s.Stats.QuicTracer(s.Prefix+f.Label()), conf.Tracer)
+	}
+	transport := &http3.RoundTripper{
+		TLSClientConfig: s.TLS.Config(),
+		QuicConfig:      conf,
+		EnableDatagrams: conf.EnableDatagrams,
+	}
+	if s.Tuning.HasSocketBuffers() {
+		transport.Dial = dialQuic(s.Tuning)
+	}
+	return transport
+}
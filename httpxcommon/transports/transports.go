@@ -0,0 +1,169 @@
+package transports
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"sync"
+
+	"httpxcommon/connstats"
+	"httpxcommon/partscommon"
+	"httpxcommon/tuning"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+	"k8s.io/klog"
+)
+
+// http versions supported by the transports
+const (
+	Http1 = "1.1"
+	Http2 = "2.0"
+	Http3 = "3.0"
+	// cleartext variants without TLS (http:// urls)
+	Http1Plain = "1.1-plain"
+	Http2Plain = "2.0-plain"
+)
+
+// Type representing the TLS options, they apply the same way to every protocol using TLS
+type TLSOptions struct {
+	// root certificates, nil for the system certificates
+	RootCAs *x509.CertPool
+	// skip certificate verification
+	Insecure bool
+	// optional server name used for SNI and verification instead of the host of the url
+	ServerName string
+}
+
+// Config returns the TLS configuration offering the application protocols
+func (o TLSOptions) Config(nextProtos ...string) *tls.Config {
+	return &tls.Config{
+		RootCAs:            o.RootCAs,
+		InsecureSkipVerify: o.Insecure,
+		ServerName:         o.ServerName,
+		NextProtos:         nextProtos,
+	}
+}
+
+// Type representing the settings every transport is created with
+type Settings struct {
+	TLS TLSOptions
+	// optional registry tracking the connections
+	Stats *connstats.Registry
+	// prefix of the labels of tracked connections
+	Prefix string
+	// optional quic configuration of HTTP/3, a copy is used
+	QuicConfig *quic.Config
+	// optional tuning of QUIC, HTTP/2 and the sockets, nil for the defaults
+	Tuning *tuning.Config
+}
+
+// Type representing the factory of the transport of a protocol
+type Factory interface {
+	// Label returns the short protocol name used for statistics: h1 | h1-tls | h2c | h2 | h3
+	Label() string
+	// Scheme returns the url scheme served by the transport: http | https
+	Scheme() string
+	// NewTransport creates a round tripper using the settings
+	NewTransport(s Settings) http.RoundTripper
+}
+
+// factories of the protocols
+var (
+	factoriesMu sync.RWMutex
+	factories   = map[string]Factory{
+		Http1:      http1Factory{tls: true},
+		Http1Plain: http1Factory{},
+		Http2:      http2Factory{tls: true},
+		Http2Plain: http2Factory{},
+		Http3:      http3Factory{},
+	}
+)
+
+// Register adds or replaces the factory of a protocol
+func Register(protocol string, f Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	factories[protocol] = f
+}
+
+// Lookup returns the factory of a protocol
+func Lookup(protocol string) (Factory, error) {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	f, ok := factories[protocol]
+	if !ok {
+		return nil, errors.New("Unsupported http version: " + protocol)
+	}
+	return f, nil
+}
+
+// Protocols returns the registered protocols in name order
+func Protocols() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	protocols := make([]string, 0, len(factories))
+	for p := range factories {
+		protocols = append(protocols, p)
+	}
+	sort.Strings(protocols)
+	return protocols
+}
+
+// New creates a client for the protocol using the settings
+func New(protocol string, s Settings) (*http.Client, error) {
+	f, err := Lookup(protocol)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: f.NewTransport(s)}, nil
+}
+
+// LoadCertPool returns the system certificates extended by the public certificate in the directory
+func LoadCertPool(certDir string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		return nil, err
+	}
+	caCertPath := path.Join(certDir, "cert", "cert-public.pem")
+	klog.V(partscommon.KlogDebug).Info("Trying to access public certificate: ", caCertPath)
+	caCertRaw, err := os.ReadFile(caCertPath)
+	if err != nil {
+		return nil, err
+	}
+	if ok := pool.AppendCertsFromPEM(caCertRaw); !ok {
+		return nil, errors.New("Could not add root ceritificate to pool.")
+	}
+	return pool, nil
+}
+
+// ProtocolLabel returns the short protocol name of the http version used for statistics
+func ProtocolLabel(httpVersion string) string {
+	if f, err := Lookup(httpVersion); err == nil {
+		return f.Label()
+	}
+	return httpVersion
+}
+
+// NewClient creates a client for the http version, labels of tracked connections get the prefix
+func NewClient(httpVersion string, pool *x509.CertPool, insecure bool, stats *connstats.Registry, prefix string) (*http.Client, error) {
+	return New(httpVersion, Settings{TLS: TLSOptions{RootCAs: pool, Insecure: insecure}, Stats: stats, Prefix: prefix})
+}
+
+// MultiplexTracers returns a tracer calling both tracers, nil tracers are skipped
+func MultiplexTracers(first func(context.Context, logging.Perspective, quic.ConnectionID) logging.ConnectionTracer, second func(context.Context, logging.Perspective, quic.ConnectionID) logging.ConnectionTracer) func(context.Context, logging.Perspective, quic.ConnectionID) logging.ConnectionTracer {
+	if first == nil {
+		return second
+	}
+	if second == nil {
+		return first
+	}
+	return func(ctx context.Context, p logging.Perspective, connID quic.ConnectionID) logging.ConnectionTracer {
+		return logging.NewMultiplexedConnectionTracer(first(ctx, p, connID), second(ctx, p, connID))
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix && !windows
+
+package tuning
+
+import "errors"
+
+// setSocketBuffers is not available on this platform
+func setSocketBuffers(fd uintptr, receive int, send int) error {
+	return errors.New("socket buffers cannot be set on this platform")
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package tuning
+
+import "syscall"
+
+// setSocketBuffers sets SO_RCVBUF and SO_SNDBUF of the socket, 0 keeps the system default
+func setSocketBuffers(fd uintptr, receive int, send int) error {
+	if receive > 0 {
+		if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, receive); err != nil {
+			return err
+		}
+	}
+	if send > 0 {
+		return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, send)
+	}
+	return nil
+}
@@ -0,0 +1,357 @@
+// Package tuning holds the transport parameters of QUIC, HTTP/2 and the sockets shared by server and client.
+// Zero values keep the defaults of quic-go, x/net/http2 and the operating system.
+package tuning
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"httpxcommon/sizes"
+
+	"github.com/quic-go/quic-go"
+	"golang.org/x/net/http2"
+)
+
+// scopes of the parameters
+const (
+	ScopeQuic   = "quic"
+	ScopeHttp2  = "http2"
+	ScopeSocket = "socket"
+)
+
+// sides a parameter applies to
+const (
+	SideBoth   = "both"
+	SideClient = "client"
+	SideServer = "server"
+)
+
+// defaults of the HTTP/2 server
+const (
+	DefaultHttp2MaxConcurrentStreams = 250
+	DefaultHttp2MaxReadFrameSize     = 1024 * 1024 * 16
+)
+
+// environment variable enabling GSO in quic-go and its value at start
+const gsoEnvironment = "QUIC_GO_ENABLE_GSO"
+
+var gsoInitial, gsoInitialSet = os.LookupEnv(gsoEnvironment)
+
+// Type representing the QUIC parameters of HTTP/3
+type QuicConfig struct {
+	// receive windows, auto-tuned from the initial up to the max value
+	InitialStreamReceiveWindow     uint64
+	MaxStreamReceiveWindow         uint64
+	InitialConnectionReceiveWindow uint64
+	MaxConnectionReceiveWindow     uint64
+	// concurrent bidirectional streams the peer may open
+	MaxIncomingStreams int64
+	KeepAlivePeriod    time.Duration
+	MaxIdleTimeout     time.Duration
+	// RFC 9221 datagrams
+	EnableDatagrams         bool
+	DisablePathMTUDiscovery bool
+	// generic segmentation offload, sends bursts of packets with one system call (Linux, process wide)
+	GSO bool
+}
+
+// Type representing the HTTP/2 parameters
+type Http2Config struct {
+	MaxConcurrentStreams uint32
+	MaxReadFrameSize     uint32
+	// receive windows of the server, the client of x/net/http2 uses fixed windows (4 MB per stream, 1 GB per connection)
+	StreamWindow     int32
+	ConnectionWindow int32
+	// interval of health check pings of idle client connections
+	ReadIdleTimeout time.Duration
+}
+
+// Type representing the buffers of TCP and UDP sockets
+type SocketConfig struct {
+	ReceiveBuffer int
+	SendBuffer    int
+}
+
+// Type representing the tuning of the transports
+type Config struct {
+	Quic   QuicConfig
+	Http2  Http2Config
+	Socket SocketConfig
+}
+
+// Type representing a parameter which can be set by name
+type Key struct {
+	Name  string
+	Help  string
+	Scope string
+	Side  string
+	set   func(c *Config, value string) error
+	get   func(c *Config) string
+}
+
+// keys of all parameters in name order
+var keys = []Key{
+	{Name: "http2.connection-window", Help: "receive window of a connection (server)", Scope: ScopeHttp2, Side: SideServer,
+		set: func(c *Config, v string) error { return setInt32Size(&c.Http2.ConnectionWindow, v) },
+		get: func(c *Config) string { return sizes.Format(uint64(c.Http2.ConnectionWindow)) }},
+	{Name: "http2.max-concurrent-streams", Help: "concurrent streams per connection (server, default 250)", Scope: ScopeHttp2, Side: SideServer,
+		set: func(c *Config, v string) error { return setUint32(&c.Http2.MaxConcurrentStreams, v) },
+		get: func(c *Config) string { return strconv.FormatUint(uint64(c.Http2.MaxConcurrentStreams), 10) }},
+	{Name: "http2.max-read-frame-size", Help: "largest frame accepted (16KB - 16MB, default 16MB)", Scope: ScopeHttp2, Side: SideBoth,
+		set: func(c *Config, v string) error { return setUint32Size(&c.Http2.MaxReadFrameSize, v) },
+		get: func(c *Config) string { return sizes.Format(uint64(c.Http2.MaxReadFrameSize)) }},
+	{Name: "http2.read-idle-timeout", Help: "health check ping after idle time (client, 0: off)", Scope: ScopeHttp2, Side: SideClient,
+		set: func(c *Config, v string) error { return setDuration(&c.Http2.ReadIdleTimeout, v) },
+		get: func(c *Config) string { return c.Http2.ReadIdleTimeout.String() }},
+	{Name: "http2.stream-window", Help: "receive window of a stream (server)", Scope: ScopeHttp2, Side: SideServer,
+		set: func(c *Config, v string) error { return setInt32Size(&c.Http2.StreamWindow, v) },
+		get: func(c *Config) string { return sizes.Format(uint64(c.Http2.StreamWindow)) }},
+	{Name: "quic.datagrams", Help: "enable RFC 9221 datagrams", Scope: ScopeQuic, Side: SideBoth,
+		set: func(c *Config, v string) error { return setBool(&c.Quic.EnableDatagrams, v) },
+		get: func(c *Config) string { return strconv.FormatBool(c.Quic.EnableDatagrams) }},
+	{Name: "quic.disable-mtu-discovery", Help: "send packets of at most 1252 bytes", Scope: ScopeQuic, Side: SideBoth,
+		set: func(c *Config, v string) error { return setBool(&c.Quic.DisablePathMTUDiscovery, v) },
+		get: func(c *Config) string { return strconv.FormatBool(c.Quic.DisablePathMTUDiscovery) }},
+	{Name: "quic.gso", Help: "generic segmentation offload (Linux, process wide)", Scope: ScopeQuic, Side: SideBoth,
+		set: func(c *Config, v string) error { return setBool(&c.Quic.GSO, v) },
+		get: func(c *Config) string { return strconv.FormatBool(c.Quic.GSO) }},
+	{Name: "quic.idle-timeout", Help: "close connections without activity (default 30s)", Scope: ScopeQuic, Side: SideBoth,
+		set: func(c *Config, v string) error { return setDuration(&c.Quic.MaxIdleTimeout, v) },
+		get: func(c *Config) string { return c.Quic.MaxIdleTimeout.String() }},
+	{Name: "quic.initial-connection-window", Help: "initial receive window of a connection (default 512KB)", Scope: ScopeQuic, Side: SideBoth,
+		set: func(c *Config, v string) error { return setSize(&c.Quic.InitialConnectionReceiveWindow, v) },
+		get: func(c *Config) string { return sizes.Format(c.Quic.InitialConnectionReceiveWindow) }},
+	{Name: "quic.initial-stream-window", Help: "initial receive window of a stream (default 512KB)", Scope: ScopeQuic, Side: SideBoth,
+		set: func(c *Config, v string) error { return setSize(&c.Quic.InitialStreamReceiveWindow, v) },
+		get: func(c *Config) string { return sizes.Format(c.Quic.InitialStreamReceiveWindow) }},
+	{Name: "quic.keep-alive", Help: "keep alive period (0: none)", Scope: ScopeQuic, Side: SideBoth,
+		set: func(c *Config, v string) error { return setDuration(&c.Quic.KeepAlivePeriod, v) },
+		get: func(c *Config) string { return c.Quic.KeepAlivePeriod.String() }},
+	{Name: "quic.max-connection-window", Help: "max receive window of a connection (default 15MB)", Scope: ScopeQuic, Side: SideBoth,
+		set: func(c *Config, v string) error { return setSize(&c.Quic.MaxConnectionReceiveWindow, v) },
+		get: func(c *Config) string { return sizes.Format(c.Quic.MaxConnectionReceiveWindow) }},
+	{Name: "quic.max-incoming-streams", Help: "concurrent streams the peer may open (default 100)", Scope: ScopeQuic, Side: SideBoth,
+		set: func(c *Config, v string) error { return setInt64(&c.Quic.MaxIncomingStreams, v) },
+		get: func(c *Config) string { return strconv.FormatInt(c.Quic.MaxIncomingStreams, 10) }},
+	{Name: "quic.max-stream-window", Help: "max receive window of a stream (default 6MB)", Scope: ScopeQuic, Side: SideBoth,
+		set: func(c *Config, v string) error { return setSize(&c.Quic.MaxStreamReceiveWindow, v) },
+		get: func(c *Config) string { return sizes.Format(c.Quic.MaxStreamReceiveWindow) }},
+	{Name: "socket.receive-buffer", Help: "SO_RCVBUF of TCP and UDP sockets (0: system default)", Scope: ScopeSocket, Side: SideBoth,
+		set: func(c *Config, v string) error { return setIntSize(&c.Socket.ReceiveBuffer, v) },
+		get: func(c *Config) string { return sizes.Format(uint64(c.Socket.ReceiveBuffer)) }},
+	{Name: "socket.send-buffer", Help: "SO_SNDBUF of TCP and UDP sockets (0: system default)", Scope: ScopeSocket, Side: SideBoth,
+		set: func(c *Config, v string) error { return setIntSize(&c.Socket.SendBuffer, v) },
+		get: func(c *Config) string { return sizes.Format(uint64(c.Socket.SendBuffer)) }},
+}
+
+// ErrUnknownKey is returned for parameters which do not exist
+var ErrUnknownKey = errors.New("unknown tuning parameter")
+
+// Keys returns all parameters in name order
+func Keys() []Key {
+	return keys
+}
+
+// Lookup returns the parameter of the name
+func Lookup(name string) (Key, error) {
+	for _, k := range keys {
+		if k.Name == name {
+			return k, nil
+		}
+	}
+	if name == "quic.pacing" || name == "quic.congestion-control" {
+		return Key{}, fmt.Errorf("%w: %s, quic-go v0.37 always paces with its Cubic/NewReno controller and cannot be configured", ErrUnknownKey, name)
+	}
+	return Key{}, fmt.Errorf("%w: %s", ErrUnknownKey, name)
+}
+
+// Set changes the parameter to the value, sizes accept KB, MB and GB (1024 based), durations Go syntax
+func (c *Config) Set(name string, value string) error {
+	k, err := Lookup(name)
+	if err != nil {
+		return err
+	}
+	if err := k.set(c, strings.TrimSpace(value)); err != nil {
+		return fmt.Errorf("tuning parameter %s: %w", name, err)
+	}
+	return nil
+}
+
+// Get returns the value of the parameter
+func (c *Config) Get(name string) (string, error) {
+	k, err := Lookup(name)
+	if err != nil {
+		return "", err
+	}
+	return k.get(c), nil
+}
+
+// SetList changes the parameters of a comma separated list of name=value pairs
+func (c *Config) SetList(list string) error {
+	for _, pair := range strings.Split(list, ",") {
+		if len(strings.TrimSpace(pair)) == 0 {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("tuning parameter %q: expected name=value", pair)
+		}
+		if err := c.Set(strings.TrimSpace(name), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load reads the parameters of a file with one name = value per line, lines starting with # are skipped
+func Load(path string) (*Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	c := &Config{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(text, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected name = value", path, line)
+		}
+		if err := c.Set(strings.TrimSpace(name), value); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+	}
+	return c, scanner.Err()
+}
+
+// Parse reads the parameters of the file (empty for none) and applies the comma separated name=value pairs
+func Parse(path string, list string) (*Config, error) {
+	c := &Config{}
+	if len(path) > 0 {
+		var err error
+		if c, err = Load(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.SetList(list); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// String returns the parameters differing from the defaults as comma separated name=value pairs
+func (c *Config) String() string {
+	if c == nil {
+		return "defaults"
+	}
+	var zero Config
+	var pairs []string
+	for _, k := range keys {
+		if value := k.get(c); value != k.get(&zero) {
+			pairs = append(pairs, k.Name+"="+value)
+		}
+	}
+	if len(pairs) == 0 {
+		return "defaults"
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// QuicConfig returns a copy of the base configuration (nil for none) with the QUIC parameters set
+func (c *Config) QuicConfig(base *quic.Config) *quic.Config {
+	conf := &quic.Config{}
+	if base != nil {
+		conf = base.Clone()
+	}
+	if c == nil {
+		return conf
+	}
+	q := c.Quic
+	setIfNonZero(&conf.InitialStreamReceiveWindow, q.InitialStreamReceiveWindow)
+	setIfNonZero(&conf.MaxStreamReceiveWindow, q.MaxStreamReceiveWindow)
+	setIfNonZero(&conf.InitialConnectionReceiveWindow, q.InitialConnectionReceiveWindow)
+	setIfNonZero(&conf.MaxConnectionReceiveWindow, q.MaxConnectionReceiveWindow)
+	setIfNonZero(&conf.MaxIncomingStreams, q.MaxIncomingStreams)
+	setIfNonZero(&conf.KeepAlivePeriod, q.KeepAlivePeriod)
+	setIfNonZero(&conf.MaxIdleTimeout, q.MaxIdleTimeout)
+	conf.EnableDatagrams = conf.EnableDatagrams || q.EnableDatagrams
+	conf.DisablePathMTUDiscovery = conf.DisablePathMTUDiscovery || q.DisablePathMTUDiscovery
+	return conf
+}
+
+// ApplyGSO sets the GSO of quic-go for the whole process, called once at start or before the runs of a sweep.
+// quic-go reads it when a socket is created, without quic.gso the environment of the process at start decides.
+func (c *Config) ApplyGSO() {
+	if c != nil && c.Quic.GSO {
+		os.Setenv(gsoEnvironment, "true")
+	} else if gsoInitialSet {
+		os.Setenv(gsoEnvironment, gsoInitial)
+	} else {
+		os.Unsetenv(gsoEnvironment)
+	}
+}
+
+// Http2Server returns the HTTP/2 server with the parameters set
+func (c *Config) Http2Server() *http2.Server {
+	server := &http2.Server{
+		MaxConcurrentStreams: DefaultHttp2MaxConcurrentStreams,
+		MaxReadFrameSize:     DefaultHttp2MaxReadFrameSize,
+	}
+	if c == nil {
+		return server
+	}
+	setIfNonZero(&server.MaxConcurrentStreams, c.Http2.MaxConcurrentStreams)
+	setIfNonZero(&server.MaxReadFrameSize, c.Http2.MaxReadFrameSize)
+	setIfNonZero(&server.MaxUploadBufferPerStream, c.Http2.StreamWindow)
+	setIfNonZero(&server.MaxUploadBufferPerConnection, c.Http2.ConnectionWindow)
+	return server
+}
+
+// ConfigureHttp2Transport sets the client parameters of the HTTP/2 transport
+func (c *Config) ConfigureHttp2Transport(t *http2.Transport) {
+	t.MaxReadFrameSize = DefaultHttp2MaxReadFrameSize
+	if c == nil {
+		return
+	}
+	setIfNonZero(&t.MaxReadFrameSize, c.Http2.MaxReadFrameSize)
+	setIfNonZero(&t.ReadIdleTimeout, c.Http2.ReadIdleTimeout)
+}
+
+// Control sets the socket buffers, it is used by net.Dialer and net.ListenConfig
+func (c *Config) Control(network, address string, raw syscall.RawConn) error {
+	if c == nil || (c.Socket.ReceiveBuffer == 0 && c.Socket.SendBuffer == 0) {
+		return nil
+	}
+	var errSet error
+	err := raw.Control(func(fd uintptr) {
+		errSet = setSocketBuffers(fd, c.Socket.ReceiveBuffer, c.Socket.SendBuffer)
+	})
+	if err != nil {
+		return err
+	}
+	return errSet
+}
+
+// HasSocketBuffers returns true if the buffers of the sockets are set
+func (c *Config) HasSocketBuffers() bool {
+	return c != nil && (c.Socket.ReceiveBuffer > 0 || c.Socket.SendBuffer > 0)
+}
+
+// setIfNonZero overwrites the target with values other than 0
+func setIfNonZero[T uint32 | int32 | uint64 | int64 | time.Duration](target *T, value T) {
+	if value != 0 {
+		*target = value
+	}
+}
@@ -0,0 +1,91 @@
+package tuning
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"httpxcommon/sizes"
+)
+
+func setSize(target *uint64, value string) error {
+	n, err := sizes.Parse(value)
+	if err != nil {
+		return err
+	}
+	*target = n
+	return nil
+}
+
+func setUint32Size(target *uint32, value string) error {
+	n, err := sizes.Parse(value)
+	if err != nil {
+		return err
+	}
+	if n > math.MaxUint32 {
+		return fmt.Errorf("size %q too large", value)
+	}
+	*target = uint32(n)
+	return nil
+}
+
+func setInt32Size(target *int32, value string) error {
+	n, err := sizes.Parse(value)
+	if err != nil {
+		return err
+	}
+	if n > math.MaxInt32 {
+		return fmt.Errorf("size %q too large", value)
+	}
+	*target = int32(n)
+	return nil
+}
+
+func setIntSize(target *int, value string) error {
+	n, err := sizes.Parse(value)
+	if err != nil {
+		return err
+	}
+	if n > math.MaxInt32 {
+		return fmt.Errorf("size %q too large", value)
+	}
+	*target = int(n)
+	return nil
+}
+
+func setUint32(target *uint32, value string) error {
+	n, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid number %q", value)
+	}
+	*target = uint32(n)
+	return nil
+}
+
+func setInt64(target *int64, value string) error {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid number %q", value)
+	}
+	*target = n
+	return nil
+}
+
+func setDuration(target *time.Duration, value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", value)
+	}
+	*target = d
+	return nil
+}
+
+func setBool(target *bool, value string) error {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("invalid boolean %q", value)
+	}
+	*target = b
+	return nil
+}
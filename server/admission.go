@@ -0,0 +1,233 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"httpxcommon/partscommon"
+
+	"k8s.io/klog"
+)
+
+// reasons of rejected requests used for the metrics
+const (
+	RejectRateGlobal   = "rate-global"
+	RejectRateClient   = "rate-client"
+	RejectConcurrency  = "concurrency"
+	RejectQueueTimeout = "queue-timeout"
+)
+
+// Type representing a token bucket refilled with rate tokens per second up to burst
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket creates a full bucket, a burst below 1 allows one request
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	b := math.Max(1, float64(burst))
+	return &TokenBucket{rate: rate, burst: b, tokens: b, last: time.Now()}
+}
+
+// Take removes a token, if none is left the time until the next token is returned
+func (b *TokenBucket) Take(now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// a bucket created after now was taken is not refilled backwards
+	if now.After(b.last) {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// give returns a token taken for a request rejected by another limit
+func (b *TokenBucket) give() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = math.Min(b.burst, b.tokens+1)
+}
+
+// full returns true if the bucket was refilled completely at the time
+func (b *TokenBucket) full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// Type representing the limit of concurrent requests of a route with an optional queue
+type routeLimit struct {
+	running chan struct{}
+	queued  chan struct{}
+}
+
+// Type representing the admission control of the server: rate limits globally and per client ip, concurrent requests per route
+type AdmissionControl struct {
+	// global rate, nil for unlimited
+	global *TokenBucket
+	// rate and burst per client ip, 0 for unlimited
+	clientRate  float64
+	clientBurst int
+	// concurrent requests per route and method, 0 for unlimited
+	maxConcurrent int
+	// requests waiting per route for a free slot and how long they wait
+	queueLength  int
+	queueTimeout time.Duration
+	metrics      *ServerMetrics
+
+	mu        sync.Mutex
+	clients   map[string]*TokenBucket
+	lastSweep time.Time
+	routes    map[string]*routeLimit
+}
+
+// NewAdmissionControl creates the admission control, nil if no limit is set
+func NewAdmissionControl(rate float64, burst int, clientRate float64, clientBurst int, maxConcurrent int, queueLength int, queueTimeout time.Duration, metrics *ServerMetrics) *AdmissionControl {
+	if rate <= 0 && clientRate <= 0 && maxConcurrent <= 0 {
+		return nil
+	}
+	a := &AdmissionControl{
+		clientRate:    clientRate,
+		clientBurst:   clientBurst,
+		maxConcurrent: maxConcurrent,
+		queueLength:   queueLength,
+		queueTimeout:  queueTimeout,
+		metrics:       metrics,
+		clients:       make(map[string]*TokenBucket),
+		lastSweep:     time.Now(),
+		routes:        make(map[string]*routeLimit),
+	}
+	if rate > 0 {
+		a.global = NewTokenBucket(rate, burst)
+	}
+	return a
+}
+
+// client returns the bucket of the client ip, buckets refilled completely are removed once a minute
+func (a *AdmissionControl) client(ip string, now time.Time) *TokenBucket {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if now.Sub(a.lastSweep) > time.Minute {
+		for key, b := range a.clients {
+			if b.full(now) {
+				delete(a.clients, key)
+			}
+		}
+		a.lastSweep = now
+	}
+	b, ok := a.clients[ip]
+	if !ok {
+		b = NewTokenBucket(a.clientRate, a.clientBurst)
+		a.clients[ip] = b
+	}
+	return b
+}
+
+// route returns the concurrency limit of the route
+func (a *AdmissionControl) route(name string) *routeLimit {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	l, ok := a.routes[name]
+	if !ok {
+		l = &routeLimit{running: make(chan struct{}, a.maxConcurrent), queued: make(chan struct{}, a.queueLength)}
+		a.routes[name] = l
+	}
+	return l
+}
+
+// acquire takes a slot of the route, waiting in the queue if there is space, and returns the release function
+func (a *AdmissionControl) acquire(r *http.Request, l *routeLimit) (func(), string) {
+	release := func() { <-l.running }
+	select {
+	case l.running <- struct{}{}:
+		return release, ""
+	default:
+	}
+	select {
+	case l.queued <- struct{}{}:
+	default:
+		return nil, RejectConcurrency
+	}
+	defer func() { <-l.queued }()
+	timer := time.NewTimer(a.queueTimeout)
+	defer timer.Stop()
+	select {
+	case l.running <- struct{}{}:
+		return release, ""
+	case <-timer.C:
+		return nil, RejectQueueTimeout
+	case <-r.Context().Done():
+		return nil, RejectQueueTimeout
+	}
+}
+
+// reject answers with the status and the Retry-After in seconds (at least 1)
+func (a *AdmissionControl) reject(w http.ResponseWriter, r *http.Request, route string, reason string, status int, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	klog.V(partscommon.KlogDebug).Info("Request rejected by admission control: ", reason, " ", r.Method, " ", r.URL.Path, " from ", r.RemoteAddr)
+	a.metrics.Rejected(GetProtocol(r), route, reason)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, http.StatusText(status)+": "+reason, status)
+}
+
+// Middleware admits requests within the rate limits, over the limit 429 (rate) or 503 (concurrency) is returned with Retry-After
+func (a *AdmissionControl) Middleware(next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := GetRoute(r)
+		if route == "/metrics" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		now := time.Now()
+		// the client is checked first so that a client over its limit does not use up the global tokens
+		var client *TokenBucket
+		if a.clientRate > 0 {
+			ip, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				ip = r.RemoteAddr
+			}
+			client = a.client(ip, now)
+			if ok, wait := client.Take(now); !ok {
+				a.reject(w, r, route, RejectRateClient, http.StatusTooManyRequests, wait)
+				return
+			}
+		}
+		if a.global != nil {
+			if ok, wait := a.global.Take(now); !ok {
+				if client != nil {
+					client.give()
+				}
+				a.reject(w, r, route, RejectRateGlobal, http.StatusTooManyRequests, wait)
+				return
+			}
+		}
+		if a.maxConcurrent > 0 {
+			s := time.Now()
+			release, reason := a.acquire(r, a.route(r.Method+" "+route))
+			if release == nil {
+				a.reject(w, r, route, reason, http.StatusServiceUnavailable, a.queueTimeout)
+				return
+			}
+			defer release()
+			a.metrics.Queued(GetProtocol(r), route, time.Since(s))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdmissionRateOrder(t *testing.T) {
+	tests := []struct {
+		name        string
+		rate        float64
+		burst       int
+		clientBurst int
+		remoteAddrs []string
+		want        []int
+		globalLeft  bool
+		client      string
+		clientLeft  bool
+	}{
+		// the requests over the client limit leave the global token to the other client
+		{"client over its limit", 0.001, 2, 1, []string{"10.0.0.1:1", "10.0.0.1:2", "10.0.0.2:1"}, []int{200, 429, 200}, false, "", false},
+		// the request rejected by the global limit gives the client token back
+		{"global over its limit", 0.001, 1, 1, []string{"10.0.0.1:1", "10.0.0.2:1"}, []int{200, 429}, false, "10.0.0.2", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewAdmissionControl(tt.rate, tt.burst, 0.001, tt.clientBurst, 0, 0, time.Second, testMetrics)
+			handler := a.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			for i, remoteAddr := range tt.remoteAddrs {
+				r := httptest.NewRequest(http.MethodGet, "/studies", nil)
+				r.RemoteAddr = remoteAddr
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, r)
+				if w.Code != tt.want[i] {
+					t.Errorf("request %d from %s: status %d, want %d", i, remoteAddr, w.Code, tt.want[i])
+				}
+			}
+			now := time.Now()
+			if ok, _ := a.global.Take(now); ok != tt.globalLeft {
+				t.Errorf("global token left %v, want %v", ok, tt.globalLeft)
+			}
+			if len(tt.client) > 0 {
+				if ok, _ := a.client(tt.client, now).Take(now); ok != tt.clientLeft {
+					t.Errorf("client %s token left %v, want %v", tt.client, ok, tt.clientLeft)
+				}
+			}
+		})
+	}
+}
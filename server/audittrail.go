@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// Type representing one entry of the audit trail
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Remote   string    `json:"remote"`
+	Protocol string    `json:"protocol"`
+	Method   string    `json:"method"`
+	Path     string    `json:"path"`
+	Status   int       `json:"status"`
+	Files    int       `json:"files"`
+	Bytes    int64     `json:"bytes"`
+	Message  string    `json:"message,omitempty"`
+}
+
+// Type representing the audit trail of modifying operations, written as JSON lines
+type AuditTrail struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewAuditTrail appends to the file, without a file the entries are only logged
+func NewAuditTrail(filename string) (*AuditTrail, error) {
+	a := &AuditTrail{}
+	if len(filename) > 0 {
+		file, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		a.file = file
+	}
+	return a, nil
+}
+
+// Record logs the entry and appends it to the audit file
+func (a *AuditTrail) Record(entry AuditEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		klog.Error(err)
+		return
+	}
+	klog.Info("AUDIT ", string(line))
+	if a.file == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err = a.file.Write(append(line, '\n')); err != nil {
+		klog.Error("Error writing audit trail: ", err)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"httpxcommon/partscommon"
+
+	"github.com/gorilla/mux"
+	"k8s.io/klog"
+)
+
+// Type representing delete of studies, series and instances
+type DeleteOperation struct {
+	dirOut   string
+	locks    *StudyLocks
+	readOnly bool
+	audit    *AuditTrail
+	// optional proxy whose markers are invalidated
+	proxy *ProxyOperation
+	// transfer syntaxes of the retrieves forgotten for deleted studies and series
+	syntaxes *SyntaxCache
+}
+
+// delete transaction on study, series or instance level
+func (h *DeleteOperation) Delete(w http.ResponseWriter, r *http.Request) {
+	s := time.Now()
+	partscommon.LogRequest(r)
+	entry := AuditEntry{Time: s.UTC(), Remote: r.RemoteAddr, Protocol: GetProtocol(r), Method: r.Method, Path: r.URL.Path}
+
+	// modifications are rejected in read-only mode
+	if h.readOnly {
+		w.Header().Set("Allow", http.MethodGet)
+		entry.Status = http.StatusMethodNotAllowed
+		entry.Message = "read-only mode"
+		h.audit.Record(entry)
+		w.WriteHeader(entry.Status)
+		return
+	}
+
+	// get the variables
+	vars := mux.Vars(r)
+	studyinstanceuid := vars["study"]
+	seriesinstanceuid := vars["series"]
+	sopinstanceuid := vars["instance"]
+	if len(studyinstanceuid) == 0 {
+		klog.Error("No study instance uid provided")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	klog.V(partscommon.KlogDebug).Info("Delete requested for study:", studyinstanceuid, " series:", seriesinstanceuid, " instance:", sopinstanceuid)
+
+	// wait for running retrieves and stores of the study
+	unlock := h.locks.Write(studyinstanceuid)
+	files, size, err := h.ProcessDelete(studyinstanceuid, seriesinstanceuid, sopinstanceuid)
+	unlock()
+	entry.Files = files
+	entry.Bytes = size
+	switch {
+	case os.IsNotExist(err):
+		entry.Status = http.StatusNotFound
+	case err != nil:
+		klog.Error("Error deleting: ", err)
+		entry.Status = http.StatusInternalServerError
+		entry.Message = err.Error()
+	default:
+		entry.Status = http.StatusNoContent
+	}
+	h.audit.Record(entry)
+	w.WriteHeader(entry.Status)
+	duration := time.Since(s)
+	partscommon.LogTotalTimeInfo("DELETE "+filepath.Join(studyinstanceuid, seriesinstanceuid, sopinstanceuid), duration, uint64(size), duration, false)
+}
+
+// ProcessDelete removes the files and the directories left empty, returns number of files and bytes removed
+func (h *DeleteOperation) ProcessDelete(study string, series string, instance string) (int, int64, error) {
+	path := filepath.Join(h.dirOut, study, series)
+	if len(instance) > 0 {
+		path = filepath.Join(path, instance+".dcm")
+	}
+	if _, err := os.Stat(path); err != nil {
+		return 0, 0, err
+	}
+
+	// count what is removed for the audit trail
+	var files int
+	var size int64
+	errWalk := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files++
+			size += info.Size()
+		}
+		return nil
+	})
+	if errWalk != nil {
+		return files, size, errWalk
+	}
+	if err := os.RemoveAll(path); err != nil {
+		return files, size, err
+	}
+
+	// remove series and study directories left empty
+	if len(instance) > 0 {
+		os.Remove(filepath.Join(h.dirOut, study, series))
+	}
+	if len(series) > 0 {
+		os.Remove(filepath.Join(h.dirOut, study))
+	}
+	if h.proxy != nil {
+		h.proxy.Invalidate(study, series)
+	}
+	if h.syntaxes != nil {
+		h.syntaxes.Remove(filepath.Join(h.dirOut, study, series))
+	}
+	return files, size, nil
+}
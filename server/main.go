@@ -2,28 +2,36 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"flag"
 	"fmt"
+	"httpxcommon/connstats"
+	"httpxcommon/diagnostics"
+	"httpxcommon/listeners"
 	"httpxcommon/partscommon"
+	"httpxcommon/transports"
+	"httpxcommon/tuning"
 	"io"
+	"net"
 	"net/http"
+	"os"
 	"path"
 	"path/filepath"
 	"runtime"
 	"strings"
 	"sync"
+	"time"
 
-	"crypto/tls"
 	_ "net/http/pprof"
 
-	"golang.org/x/net/http2"
-
 	"k8s.io/klog"
 
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/logging"
 )
 
 type binds []string
@@ -43,9 +51,17 @@ type Size interface {
 }
 
 // main handler function
-func setupHandler(www string, dirIn string) http.Handler {
+func setupHandler(www string, dirIn string, etagMode string, cacheControl string, metrics *ServerMetrics, proxy *ProxyOperation, readOnly bool, audit *AuditTrail, admission *AdmissionControl) http.Handler {
 	// route := http.NewServeMux()
 	route := mux.NewRouter()
+	route.Use(metrics.Middleware)
+	route.Use(admission.Middleware)
+	// the middlewares only run for matching routes, unmatched requests are measured here
+	route.NotFoundHandler = metrics.Middleware(http.NotFoundHandler())
+	route.MethodNotAllowedHandler = metrics.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}))
+	route.Handle("/metrics", promhttp.Handler())
 
 	// use a default file server per default if there is some domain defined
 	if len(www) > 0 {
@@ -63,7 +79,7 @@ func setupHandler(www string, dirIn string) http.Handler {
 		// read body part
 		body, err1 := io.ReadAll(r.Body)
 		if err1 != nil {
-			klog.V(partscommon.KlogDebug).Info("Error reading body while handling /echo: %s\n", err1.Error())
+			klog.V(partscommon.KlogDebug).Infof("Error reading body while handling /echo: %s\n", err1.Error())
 		}
 
 		// dump message
@@ -71,15 +87,51 @@ func setupHandler(www string, dirIn string) http.Handler {
 		w.Write(body)
 	})
 
-	// DICOM handlers
+	// DICOM handlers, deletes wait for running retrieves and stores of a study
+	locks := NewStudyLocks()
 	var ss StoreOperation
 	ss.dirOut = dirIn
+	ss.locks = locks
+	ss.readOnly = readOnly
+	route.HandleFunc("/studies", ss.StoreStudy).Methods("POST")
 	route.HandleFunc("/studies/{study}", ss.StoreStudy).Methods("POST")
 	var rs RetrieveOperation
 	rs.dirIn = dirIn
+	rs.validators = NewValidators(etagMode)
+	rs.cacheControl = cacheControl
+	rs.proxy = proxy
+	rs.locks = locks
+	rs.syntaxes = NewSyntaxCache()
 	route.HandleFunc("/studies/{study}", rs.RetrieveStudy).Methods("GET")
 	route.HandleFunc("/studies/{study}/series/{series}", rs.RetrieveSeries).Methods("GET")
 	route.HandleFunc("/studies/{study}/series/{series}/instances/{instance}", rs.RetrieveInstance).Methods("GET")
+	var qs SearchOperation
+	qs.dirIn = dirIn
+	qs.locks = locks
+	route.HandleFunc("/studies", qs.SearchStudies).Methods("GET")
+	route.HandleFunc("/studies/{study}/series", qs.SearchSeries).Methods("GET")
+	route.HandleFunc("/studies/{study}/series/{series}/instances", qs.SearchInstances).Methods("GET")
+	var rr RenderOperation
+	rr.dirIn = dirIn
+	rr.validators = rs.validators
+	rr.cacheControl = cacheControl
+	rr.locks = locks
+	route.HandleFunc("/studies/{study}/rendered", rr.Rendered).Methods("GET")
+	route.HandleFunc("/studies/{study}/series/{series}/rendered", rr.Rendered).Methods("GET")
+	route.HandleFunc("/studies/{study}/series/{series}/instances/{instance}/rendered", rr.Rendered).Methods("GET")
+	route.HandleFunc("/studies/{study}/thumbnail", rr.Thumbnail).Methods("GET")
+	route.HandleFunc("/studies/{study}/series/{series}/thumbnail", rr.Thumbnail).Methods("GET")
+	route.HandleFunc("/studies/{study}/series/{series}/instances/{instance}/thumbnail", rr.Thumbnail).Methods("GET")
+	var ds DeleteOperation
+	ds.dirOut = dirIn
+	ds.locks = locks
+	ds.readOnly = readOnly
+	ds.audit = audit
+	ds.proxy = proxy
+	ds.syntaxes = rs.syntaxes
+	route.HandleFunc("/studies/{study}", ds.Delete).Methods("DELETE")
+	route.HandleFunc("/studies/{study}/series/{series}", ds.Delete).Methods("DELETE")
+	route.HandleFunc("/studies/{study}/series/{series}/instances/{instance}", ds.Delete).Methods("DELETE")
 	return route
 }
 
@@ -103,6 +155,15 @@ func (h bufferedWriteCloser) Close() error {
 	return h.Closer.Close()
 }
 
+// CombineConnState calls all connection state hooks in the given order
+func CombineConnState(hooks ...func(net.Conn, http.ConnState)) func(net.Conn, http.ConnState) {
+	return func(conn net.Conn, state http.ConnState) {
+		for _, hook := range hooks {
+			hook(conn, state)
+		}
+	}
+}
+
 // GetCertificatePaths returns the paths to certificate and key
 func GetCertificatePaths(certPath string) (string, string) {
 	pubCert := path.Join(certPath, "cert", "cert-public.pem")
@@ -111,6 +172,12 @@ func GetCertificatePaths(certPath string) (string, string) {
 	return pubCert, privCert
 }
 
+// usageError prints the message and exits with the exit code of invalid flags
+func usageError(m ...any) {
+	fmt.Fprintln(os.Stderr, m...)
+	os.Exit(2)
+}
+
 func main() {
 	// logging setup
 	klog.InitFlags(nil)
@@ -131,16 +198,83 @@ func main() {
 	//enableQlog := flag.Bool("qlog", false, "output a qlog (in the same directory)")
 	dirIn := flag.String("dir", "", "directory to be used as main directory")
 	dirCert := flag.String("cert", certPath, "directory with public and private certificate: cert-priv.perm, cert-public.pem")
+	etagMode := flag.String("etag", ETagModTime, "entity tag of instances based on: mtime | sha256")
+	cacheControl := flag.String("cache-control", "no-cache", "Cache-Control header of retrieve responses, empty to omit")
+	admin := flag.String("admin", ":8090", "address of the admin listener with /metrics and /debug/pprof, empty to disable")
+	readOnly := flag.Bool("read-only", false, "reject store and delete requests")
+	auditFile := flag.String("audit", "", "file the audit trail of deletes is appended to as JSON lines, empty to log only")
+	upstream := flag.String("upstream", "", "base url of an upstream DICOMweb origin filling the directory on cache misses (proxy mode)")
+	upstreamHttp := flag.String("upstream-http", transports.Http2, "http version used for the upstream: 1.1 | 2.0 | 3.0 | 1.1-plain | 2.0-plain")
+	upstreamInsecure := flag.Bool("upstream-insecure", false, "skip certificate verification of the upstream")
+	rateLimit := flag.Float64("rate-limit", 0, "requests per second admitted over all clients, more get 429 (0: unlimited)")
+	rateBurst := flag.Int("rate-burst", 100, "requests admitted at once over all clients before the rate limit applies")
+	clientRateLimit := flag.Float64("client-rate-limit", 0, "requests per second admitted per client ip, more get 429 (0: unlimited)")
+	clientRateBurst := flag.Int("client-rate-burst", 20, "requests admitted at once per client ip before the rate limit applies")
+	maxConcurrent := flag.Int("max-concurrent", 0, "concurrent requests per route and method, more are queued or get 503 (0: unlimited)")
+	queueLength := flag.Int("queue-length", 0, "requests per route and method waiting for a free slot (0: no queue)")
+	queueTimeout := flag.Duration("queue-timeout", 5*time.Second, "time a queued request waits for a free slot before it gets 503")
+	tuningFile := flag.String("tuning", "", "file with transport parameters of QUIC, HTTP/2 and the sockets, one name = value per line")
+	tune := flag.String("tune", "", "transport parameters as comma separated name=value pairs, applied after -tuning, e.g. quic.max-stream-window=16MB")
 	flag.Parse()
 	klog.V(partscommon.KlogDebug).Info("Parameters www:", *www, " tcp:", *tcp)
 
 	// calculate cert path
-	partscommon.CheckDirectory(*dirCert)
+	if _, err := partscommon.CheckDirectory(*dirCert); err != nil {
+		usageError(err)
+	}
 	certFile, keyFile := GetCertificatePaths(*dirCert)
 
+	// main directory, the current directory if not set
+	dirMain, err := partscommon.CheckDirectory(*dirIn)
+	if err != nil {
+		usageError(err)
+	}
+
+	// transport parameters of the listeners and the upstream
+	tuneConfig, err := tuning.Parse(*tuningFile, *tune)
+	if err != nil {
+		klog.Fatal(err)
+	}
+	fmt.Println("Transport tuning:", tuneConfig.String())
+	// GSO of the HTTP/3 listener and upstream is process wide, set before the report shows it
+	tuneConfig.ApplyGSO()
+	// UDP buffers, GSO and ECN available to the HTTP/3 listener
+	diagnostics.Collect().Print(os.Stdout)
+
 	// setup handler
-	handler := setupHandler(*www, partscommon.CheckDirectory(*dirIn))
-	var quicConf *quic.Config = nil
+	metrics := NewServerMetrics()
+	stats := connstats.NewRegistry()
+
+	// proxy mode using an upstream origin, connections are tracked with the upstream prefix
+	var proxy *ProxyOperation
+	if len(*upstream) > 0 {
+		pool, err := transports.LoadCertPool(*dirCert)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		settings := transports.Settings{TLS: transports.TLSOptions{RootCAs: pool, Insecure: *upstreamInsecure}, Stats: stats, Prefix: "upstream-", Tuning: tuneConfig}
+		client, err := transports.New(*upstreamHttp, settings)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		proxy = &ProxyOperation{upstream: *upstream, protocol: transports.ProtocolLabel(*upstreamHttp), client: client, dirOut: dirMain, metrics: metrics}
+		fmt.Println("Running in proxy mode with upstream", *upstream, "using HTTP/"+*upstreamHttp)
+	}
+	audit, err := NewAuditTrail(*auditFile)
+	if err != nil {
+		klog.Fatal(err)
+	}
+	admission := NewAdmissionControl(*rateLimit, *rateBurst, *clientRateLimit, *clientRateBurst, *maxConcurrent, *queueLength, *queueTimeout, metrics)
+	if admission != nil {
+		fmt.Println("Admission control with rate limit:", *rateLimit, "/s client rate limit:", *clientRateLimit, "/s max concurrent per route:", *maxConcurrent, "queue:", *queueLength)
+	}
+	handler := setupHandler(*www, dirMain, *etagMode, *cacheControl, metrics, proxy, *readOnly, audit, admission)
+	statsTracer := stats.QuicTracer(ProtocolHttps3)
+	quicConf := &quic.Config{
+		Tracer: func(ctx context.Context, p logging.Perspective, connID quic.ConnectionID) logging.ConnectionTracer {
+			return logging.NewMultiplexedConnectionTracer(metrics.QuicTracer(ctx, p, connID), statsTracer(ctx, p, connID))
+		},
+	}
 	// if *enableQlog {
 	// 	quicConf := &quic.Config{}
 	// 	quicConf.Tracer = qlog.NewTracer(func(_ logging.Perspective, connID []byte) io.WriteCloser {
@@ -157,13 +291,35 @@ func main() {
 	// use waitgroup to wait for all threads to be finished
 	var wg sync.WaitGroup
 
+	// start admin listener with metrics, connection statistics and profiling (pprof registers on the default mux)
+	if len(*admin) > 0 {
+		http.Handle("/metrics", promhttp.Handler())
+		http.Handle("/debug/connections", stats)
+		go func() {
+			fmt.Println("Running admin server (metrics, pprof) on", *admin, "in goroutine:", partscommon.GetGID())
+			klog.V(partscommon.KlogDebug).Info(http.ListenAndServe(*admin, nil))
+		}()
+	}
+
+	// listeners of all protocols tracking the connections
+	listen := &listeners.Listeners{
+		Handler:  handler,
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		ConnState: func(protocol string) func(net.Conn, http.ConnState) {
+			return CombineConnState(metrics.ConnState(protocol), stats.ConnState(protocol))
+		},
+		QuicConfig: quicConf,
+		Tuning:     tuneConfig,
+	}
+
 	// start http listener on HTTP/1.1
 	// defer profile.Start().Stop()
 	wg.Add(1)
 	go func() {
 		fmt.Println("Running http server (HTTP /1.1) on port 8080 using TCP in goroutine:", partscommon.GetGID())
 		defer wg.Done()
-		klog.V(partscommon.KlogDebug).Info(http.ListenAndServe(":8080", handler))
+		klog.V(partscommon.KlogDebug).Info(listen.ServeHttp1(":8080"))
 	}()
 
 	// start http listener on HTTPS/1.1
@@ -171,12 +327,7 @@ func main() {
 	go func() {
 		fmt.Println("Running http server (HTTPS/1.1) on port 8081 using TCP in goroutine:", partscommon.GetGID())
 		defer wg.Done()
-		httpServer := &http.Server{
-			Handler:      handler,
-			Addr:         ":8081",
-			TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
-		}
-		klog.V(partscommon.KlogDebug).Info(httpServer.ListenAndServeTLS(certFile, keyFile))
+		klog.V(partscommon.KlogDebug).Info(listen.ServeHttps1(":8081"))
 	}()
 
 	// start http listener on HTTPS/2
@@ -184,14 +335,15 @@ func main() {
 	go func() {
 		fmt.Println("Running http server (HTTPS/2.0) on port 8082 using TCP in goroutine:", partscommon.GetGID())
 		defer wg.Done()
-		var httpServer = http.Server{
-			Addr: ":8082", Handler: handler,
-		}
-		var http2Server = http2.Server{
-			MaxConcurrentStreams: 250,
-			MaxReadFrameSize:     1024 * 1024 * 16}
-		_ = http2.ConfigureServer(&httpServer, &http2Server)
-		klog.V(partscommon.KlogDebug).Info(httpServer.ListenAndServeTLS(certFile, keyFile))
+		klog.V(partscommon.KlogDebug).Info(listen.ServeHttps2(":8082"))
+	}()
+
+	// start http listener on cleartext HTTP/2 (h2c)
+	wg.Add(1)
+	go func() {
+		fmt.Println("Running http server (HTTP /2.0 h2c) on port 8084 using TCP in goroutine:", partscommon.GetGID())
+		defer wg.Done()
+		klog.V(partscommon.KlogDebug).Info(listen.ServeH2c(":8084"))
 	}()
 
 	// start http listener on HTTPS/3
@@ -208,12 +360,7 @@ func main() {
 				err = http3.ListenAndServe(bCap, certFile, keyFile, handler)
 			} else {
 				fmt.Println("Running http server (HTTPS/3.0) on port 8083 using UDP in goroutine:", partscommon.GetGID())
-				server := http3.Server{
-					Handler:    handler,
-					Addr:       bCap,
-					QuicConfig: quicConf,
-				}
-				err = server.ListenAndServeTLS(certFile, keyFile)
+				err = listen.ServeHttps3(bCap)
 			}
 			if err != nil {
 				fmt.Println(err)
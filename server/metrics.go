@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"httpxcommon/listeners"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+)
+
+// protocol labels used for the metrics
+const (
+	ProtocolHttp1    = listeners.ProtocolHttp1
+	ProtocolHttps1   = listeners.ProtocolHttps1
+	ProtocolHttps2   = listeners.ProtocolHttps2
+	ProtocolHttps3   = listeners.ProtocolHttps3
+	RouteNotMatching = "unmatched"
+)
+
+// Type representing the prometheus metrics of the server
+type ServerMetrics struct {
+	requests    *prometheus.CounterVec
+	latency     *prometheus.HistogramVec
+	bytesIn     *prometheus.CounterVec
+	bytesOut    *prometheus.CounterVec
+	connections *prometheus.GaugeVec
+	streams     *prometheus.GaugeVec
+	proxy       *prometheus.CounterVec
+	upstream    *prometheus.HistogramVec
+	rejected    *prometheus.CounterVec
+	admission   *prometheus.HistogramVec
+}
+
+// NewServerMetrics registers all server metrics in the default prometheus registry
+func NewServerMetrics() *ServerMetrics {
+	return &ServerMetrics{
+		requests: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "httpx_server_requests_total",
+			Help: "Number of handled requests by protocol, route, method and status.",
+		}, []string{"protocol", "route", "method", "status"}),
+		latency: promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "httpx_server_request_duration_seconds",
+			Help:    "Request latency by protocol, route, method and status.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 18),
+		}, []string{"protocol", "route", "method", "status"}),
+		bytesIn: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "httpx_server_received_bytes_total",
+			Help: "Request body bytes received by protocol, route and status.",
+		}, []string{"protocol", "route", "status"}),
+		bytesOut: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "httpx_server_sent_bytes_total",
+			Help: "Response body bytes sent by protocol, route and status.",
+		}, []string{"protocol", "route", "status"}),
+		connections: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "httpx_server_active_connections",
+			Help: "Currently open connections by protocol.",
+		}, []string{"protocol"}),
+		streams: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "httpx_server_active_streams",
+			Help: "Requests (streams) currently in flight by protocol.",
+		}, []string{"protocol"}),
+		proxy: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "httpx_server_proxy_requests_total",
+			Help: "Retrieve requests in proxy mode by level and result (hit, miss, error).",
+		}, []string{"level", "result"}),
+		upstream: promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "httpx_server_upstream_duration_seconds",
+			Help:    "Upstream latency of proxied retrieves by protocol, level and phase (header, total).",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 18),
+		}, []string{"protocol", "level", "phase"}),
+		rejected: promauto.NewCounterVec(prometheus.CounterOpts{
+			Name: "httpx_server_rejected_requests_total",
+			Help: "Requests rejected by the admission control by protocol, route and reason (rate-global, rate-client, concurrency, queue-timeout).",
+		}, []string{"protocol", "route", "reason"}),
+		admission: promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "httpx_server_admission_wait_seconds",
+			Help:    "Time admitted requests waited for a free slot of the route by protocol and route.",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 2, 18),
+		}, []string{"protocol", "route"}),
+	}
+}
+
+// GetProtocol determines the protocol label of a request
+func GetProtocol(r *http.Request) string {
+	return listeners.Protocol(r)
+}
+
+// GetRoute determines the route template matched by the gorilla router
+func GetRoute(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return RouteNotMatching
+	}
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return RouteNotMatching
+	}
+	return template
+}
+
+// Middleware measures every request handled by the router
+func (m *ServerMetrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := time.Now()
+		protocol := GetProtocol(r)
+		route := GetRoute(r)
+		m.streams.WithLabelValues(protocol).Inc()
+		defer m.streams.WithLabelValues(protocol).Dec()
+
+		// count bytes in both directions
+		body := &countingReadCloser{ReadCloser: r.Body}
+		r.Body = body
+		writer := &countingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(writer, r)
+
+		status := strconv.Itoa(writer.status)
+		m.requests.WithLabelValues(protocol, route, r.Method, status).Inc()
+		m.latency.WithLabelValues(protocol, route, r.Method, status).Observe(time.Since(s).Seconds())
+		m.bytesIn.WithLabelValues(protocol, route, status).Add(float64(body.size))
+		m.bytesOut.WithLabelValues(protocol, route, status).Add(float64(writer.size))
+	})
+}
+
+// Rejected counts a request rejected by the admission control
+func (m *ServerMetrics) Rejected(protocol string, route string, reason string) {
+	m.rejected.WithLabelValues(protocol, route, reason).Inc()
+}
+
+// Queued records the wait of an admitted request for a free slot
+func (m *ServerMetrics) Queued(protocol string, route string, wait time.Duration) {
+	m.admission.WithLabelValues(protocol, route).Observe(wait.Seconds())
+}
+
+// ConnState tracks the open TCP connections of a listener
+func (m *ServerMetrics) ConnState(protocol string) func(net.Conn, http.ConnState) {
+	return func(_ net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			m.connections.WithLabelValues(protocol).Inc()
+		case http.StateClosed, http.StateHijacked:
+			m.connections.WithLabelValues(protocol).Dec()
+		}
+	}
+}
+
+// QuicTracer tracks the open QUIC connections
+func (m *ServerMetrics) QuicTracer(_ context.Context, _ logging.Perspective, _ quic.ConnectionID) logging.ConnectionTracer {
+	m.connections.WithLabelValues(ProtocolHttps3).Inc()
+	return &connectionMetricsTracer{gauge: m.connections.WithLabelValues(ProtocolHttps3)}
+}
+
+// Type representing a tracer decrementing the connection gauge when closed
+type connectionMetricsTracer struct {
+	logging.NullConnectionTracer
+	gauge prometheus.Gauge
+}
+
+func (t *connectionMetricsTracer) Close() {
+	t.gauge.Dec()
+}
+
+// Type representing a request body counting the bytes read
+type countingReadCloser struct {
+	io.ReadCloser
+	size uint64
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.size += uint64(n)
+	return n, err
+}
+
+// Type representing a response writer keeping status and bytes written
+type countingResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	size        uint64
+	wroteHeader bool
+}
+
+func (c *countingResponseWriter) WriteHeader(code int) {
+	if !c.wroteHeader {
+		c.status = code
+		c.wroteHeader = true
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *countingResponseWriter) Write(p []byte) (int, error) {
+	c.wroteHeader = true
+	n, err := c.ResponseWriter.Write(p)
+	c.size += uint64(n)
+	return n, err
+}
+
+func (c *countingResponseWriter) Flush() {
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"httpxcommon/dicomfile"
+	"httpxcommon/manifest"
+)
+
+// media types of retrieve responses
+const (
+	MediaTypeDicom     = "application/dicom"
+	MediaTypeMultipart = "multipart/related"
+	MediaTypeZip       = "application/zip"
+	TransferSyntaxAny  = "*"
+)
+
+// ErrNotAcceptable is returned if no representation matches the Accept header
+var ErrNotAcceptable = errors.New("no acceptable representation")
+
+// Type representing one media range of the Accept header
+type MediaRange struct {
+	MediaType string
+	Params    map[string]string
+	Quality   float64
+}
+
+// Type representing the negotiated representation of a retrieve
+type Representation struct {
+	MediaType string
+	// requested transfer syntax, empty if the files are delivered as stored
+	TransferSyntax string
+}
+
+// ContentType returns the media type of a part or single part with the transfer syntax
+func (rep Representation) ContentType() string {
+	if len(rep.TransferSyntax) > 0 {
+		return MediaTypeDicom + "; transfer-syntax=" + rep.TransferSyntax
+	}
+	return MediaTypeDicom
+}
+
+// ETag derives the entity tag of the representation from the entity tag of the stored data
+func (rep Representation) ETag(etag string) string {
+	var suffix string
+	if rep.MediaType == MediaTypeZip {
+		suffix += "-zip"
+	}
+	if len(rep.TransferSyntax) > 0 {
+		suffix += "-" + rep.TransferSyntax
+	}
+	if len(suffix) == 0 {
+		return etag
+	}
+	return strings.TrimSuffix(etag, "\"") + suffix + "\""
+}
+
+// specificity orders media ranges of the same quality, the more specific range takes precedence (RFC 9110 12.5.1)
+func (m MediaRange) specificity() int {
+	switch {
+	case m.MediaType == "*/*":
+		return 0
+	case strings.HasSuffix(m.MediaType, "/*"):
+		return 1
+	}
+	specificity := 2
+	for name := range m.Params {
+		if name != "q" {
+			specificity++
+		}
+	}
+	return specificity
+}
+
+// ParseAccept returns the media ranges ordered by quality and specificity, a missing header accepts everything
+func ParseAccept(accept string) []MediaRange {
+	if len(strings.TrimSpace(accept)) == 0 {
+		accept = "*/*"
+	}
+	var ranges []MediaRange
+	for _, item := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(item))
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+		if quality <= 0 {
+			continue
+		}
+		ranges = append(ranges, MediaRange{MediaType: mediaType, Params: params, Quality: quality})
+	}
+	sort.SliceStable(ranges, func(i, j int) bool {
+		if ranges[i].Quality != ranges[j].Quality {
+			return ranges[i].Quality > ranges[j].Quality
+		}
+		return ranges[i].specificity() > ranges[j].specificity()
+	})
+	return ranges
+}
+
+// mediaTypeForLevel maps a media range to the media type delivered on the level, empty if not supported
+func mediaTypeForLevel(m MediaRange, level string) string {
+	switch m.MediaType {
+	case "*/*":
+		if level == LevelInstance {
+			return MediaTypeDicom
+		}
+		return MediaTypeMultipart
+	case MediaTypeMultipart, "multipart/*":
+		if t, ok := m.Params["type"]; ok && t != MediaTypeDicom {
+			return ""
+		}
+		return MediaTypeMultipart
+	case "application/*":
+		if level == LevelInstance {
+			return MediaTypeDicom
+		}
+		return MediaTypeZip
+	case MediaTypeDicom:
+		if level == LevelInstance {
+			return MediaTypeDicom
+		}
+	case MediaTypeZip:
+		return MediaTypeZip
+	}
+	return ""
+}
+
+// NegotiateRepresentation selects the first acceptable representation, deliverable decides on a requested transfer syntax
+func NegotiateRepresentation(accept string, level string, deliverable func(transferSyntax string) bool) (Representation, error) {
+	for _, m := range ParseAccept(accept) {
+		mediaType := mediaTypeForLevel(m, level)
+		if len(mediaType) == 0 {
+			continue
+		}
+		transferSyntax := m.Params["transfer-syntax"]
+		if transferSyntax == TransferSyntaxAny {
+			transferSyntax = ""
+		}
+		if len(transferSyntax) > 0 && !deliverable(transferSyntax) {
+			continue
+		}
+		return Representation{MediaType: mediaType, TransferSyntax: transferSyntax}, nil
+	}
+	return Representation{}, ErrNotAcceptable
+}
+
+// Type representing the transfer syntaxes of the stored files, read once when needed
+type StoredSyntaxes struct {
+	path string
+	// validator of the directory the syntaxes were read for
+	etag     string
+	once     sync.Once
+	syntaxes map[string]bool
+	err      error
+}
+
+func NewStoredSyntaxes(path string) *StoredSyntaxes {
+	return &StoredSyntaxes{path: path}
+}
+
+// Get reads the transfer syntaxes of all files below the path
+func (s *StoredSyntaxes) Get() (map[string]bool, error) {
+	s.once.Do(func() {
+		s.syntaxes = make(map[string]bool)
+		s.err = filepath.Walk(s.path, func(file string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() || !manifest.IsInstanceFile(file) {
+				return err
+			}
+			ts, err := dicomfile.ReadFileTransferSyntax(file)
+			if err != nil {
+				return err
+			}
+			s.syntaxes[ts] = true
+			return nil
+		})
+	})
+	return s.syntaxes, s.err
+}
+
+// Type representing the transfer syntaxes of studies and series, kept while the directory is unchanged
+type SyntaxCache struct {
+	mu      sync.Mutex
+	entries map[string]*StoredSyntaxes
+}
+
+func NewSyntaxCache() *SyntaxCache {
+	return &SyntaxCache{entries: make(map[string]*StoredSyntaxes)}
+}
+
+// Lookup returns the transfer syntaxes of the directory, the files are read again when its validator changed
+func (c *SyntaxCache) Lookup(path string, etag string) *StoredSyntaxes {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stored, ok := c.entries[path]
+	if !ok || stored.etag != etag {
+		stored = &StoredSyntaxes{path: path, etag: etag}
+		c.entries[path] = stored
+	}
+	return stored
+}
+
+// Remove forgets the transfer syntaxes of the directory and all directories below
+func (c *SyntaxCache) Remove(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for p := range c.entries {
+		if p == path || strings.HasPrefix(p, path+string(filepath.Separator)) {
+			delete(c.entries, p)
+		}
+	}
+}
+
+// Deliverable is true if all files are stored in or can be transcoded to the transfer syntax
+func (s *StoredSyntaxes) Deliverable(transferSyntax string) bool {
+	syntaxes, err := s.Get()
+	if err != nil || len(syntaxes) == 0 {
+		return false
+	}
+	for stored := range syntaxes {
+		if !dicomfile.CanTranscode(stored, transferSyntax) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"httpxcommon/dicomfile"
+)
+
+func TestParseAccept(t *testing.T) {
+	tests := []struct {
+		name   string
+		accept string
+		want   []string
+	}{
+		{"missing header", "", []string{"*/*"}},
+		{"blank header", "  ", []string{"*/*"}},
+		{"order kept", "application/zip, multipart/related", []string{MediaTypeZip, MediaTypeMultipart}},
+		{"by quality", "application/zip;q=0.5, multipart/related;q=0.9", []string{MediaTypeMultipart, MediaTypeZip}},
+		{"by specificity", "*/*, application/*, multipart/related; type=\"application/dicom\"", []string{MediaTypeMultipart, "application/*", "*/*"}},
+		{"quality before specificity", "multipart/related; type=\"application/dicom\";q=0.5, */*", []string{"*/*", MediaTypeMultipart}},
+		{"zero quality dropped", "application/zip;q=0, application/dicom", []string{MediaTypeDicom}},
+		{"invalid quality dropped", "application/zip;q=high, application/dicom", []string{MediaTypeDicom}},
+		{"invalid range dropped", "/;, application/dicom", []string{MediaTypeDicom}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ranges := ParseAccept(tt.accept)
+			if len(ranges) != len(tt.want) {
+				t.Fatalf("%d ranges %v, want %v", len(ranges), ranges, tt.want)
+			}
+			for i, m := range ranges {
+				if m.MediaType != tt.want[i] {
+					t.Errorf("range %d: %q, want %q", i, m.MediaType, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestNegotiateRepresentation(t *testing.T) {
+	// only explicit VR little endian can be delivered
+	deliverable := func(transferSyntax string) bool {
+		return transferSyntax == dicomfile.ExplicitVRLittleEndian
+	}
+	tests := []struct {
+		name   string
+		accept string
+		level  string
+		want   Representation
+		err    error
+	}{
+		{"study as stored", "", LevelStudy, Representation{MediaType: MediaTypeMultipart}, nil},
+		{"instance as stored", "", LevelInstance, Representation{MediaType: MediaTypeDicom}, nil},
+		{"study as zip", "application/*", LevelStudy, Representation{MediaType: MediaTypeZip}, nil},
+		{"instance from application range", "application/*", LevelInstance, Representation{MediaType: MediaTypeDicom}, nil},
+		{"series single part", MediaTypeDicom, LevelSeries, Representation{}, ErrNotAcceptable},
+		{"multipart of other parts", "multipart/related; type=\"image/jpeg\"", LevelStudy, Representation{}, ErrNotAcceptable},
+		{"any transfer syntax", "multipart/related; type=\"application/dicom\"; transfer-syntax=*", LevelStudy, Representation{MediaType: MediaTypeMultipart}, nil},
+		{"deliverable transfer syntax", "application/dicom; transfer-syntax=" + dicomfile.ExplicitVRLittleEndian, LevelInstance,
+			Representation{MediaType: MediaTypeDicom, TransferSyntax: dicomfile.ExplicitVRLittleEndian}, nil},
+		{"next range if not deliverable", "application/dicom; transfer-syntax=" + dicomfile.RLELossless + ", application/dicom;q=0.5", LevelInstance,
+			Representation{MediaType: MediaTypeDicom}, nil},
+		{"not deliverable", "application/dicom; transfer-syntax=" + dicomfile.RLELossless, LevelInstance, Representation{}, ErrNotAcceptable},
+		{"not acceptable", "image/png", LevelStudy, Representation{}, ErrNotAcceptable},
+		{"zip on every level", MediaTypeZip, LevelInstance, Representation{MediaType: MediaTypeZip}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rep, err := NegotiateRepresentation(tt.accept, tt.level, deliverable)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			if rep != tt.want {
+				t.Errorf("representation %+v, want %+v", rep, tt.want)
+			}
+		})
+	}
+}
+
+func TestRepresentationETag(t *testing.T) {
+	tests := []struct {
+		name string
+		rep  Representation
+		want string
+	}{
+		{"as stored", Representation{MediaType: MediaTypeMultipart}, `"abc"`},
+		{"zip", Representation{MediaType: MediaTypeZip}, `"abc-zip"`},
+		{"transfer syntax", Representation{MediaType: MediaTypeDicom, TransferSyntax: dicomfile.RLELossless}, `"abc-` + dicomfile.RLELossless + `"`},
+		{"zip with transfer syntax", Representation{MediaType: MediaTypeZip, TransferSyntax: dicomfile.RLELossless}, `"abc-zip-` + dicomfile.RLELossless + `"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rep.ETag(`"abc"`); got != tt.want {
+				t.Errorf("etag %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"httpxcommon/dicomweb"
+	"httpxcommon/transports"
+)
+
+// startProxy serves an empty directory filled from an upstream serving one instance
+func startProxy(t *testing.T) (*httptest.Server, *int) {
+	ref := dicomweb.Ref{Study: "1.2.3", Series: "1.2.3.4", Instance: "1.2.3.4.5"}
+	dirUpstream := t.TempDir()
+	writeInstance(t, dirUpstream, ref)
+	upstreamRequests := new(int)
+	upstreamHandler := setupHandler("", dirUpstream, ETagModTime, "", testMetrics, nil, true, nil, nil)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*upstreamRequests++
+		upstreamHandler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(upstream.Close)
+
+	dirProxy := t.TempDir()
+	proxy := &ProxyOperation{upstream: upstream.URL, protocol: transports.ProtocolLabel(transports.Http1), client: upstream.Client(), dirOut: dirProxy, metrics: testMetrics}
+	server := httptest.NewServer(setupHandler("", dirProxy, ETagModTime, "", testMetrics, proxy, true, nil, nil))
+	t.Cleanup(server.Close)
+	return server, upstreamRequests
+}
+
+func TestProxyMissNegotiates(t *testing.T) {
+	tests := []struct {
+		name      string
+		path      string
+		accept    string
+		status    int
+		mediaType string
+		upstream  int
+	}{
+		{"study as stored", "/studies/1.2.3", "", http.StatusOK, MediaTypeMultipart, 1},
+		{"study as zip", "/studies/1.2.3", MediaTypeZip, http.StatusOK, MediaTypeZip, 1},
+		{"series as zip", "/studies/1.2.3/series/1.2.3.4", MediaTypeZip, http.StatusOK, MediaTypeZip, 1},
+		{"study not acceptable", "/studies/1.2.3", "image/png", http.StatusNotAcceptable, "", 0},
+		{"instance as stored", "/studies/1.2.3/series/1.2.3.4/instances/1.2.3.4.5", MediaTypeDicom, http.StatusOK, MediaTypeDicom, 1},
+		{"instance not acceptable", "/studies/1.2.3/series/1.2.3.4/instances/1.2.3.4.5", "text/plain", http.StatusNotAcceptable, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, upstreamRequests := startProxy(t)
+
+			// the miss and the following hit deliver the same representation
+			for _, round := range []string{"miss", "hit"} {
+				req, err := http.NewRequest(http.MethodGet, server.URL+tt.path, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(tt.accept) > 0 {
+					req.Header.Set("Accept", tt.accept)
+				}
+				res, err := server.Client().Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				io.Copy(io.Discard, res.Body)
+				res.Body.Close()
+				if res.StatusCode != tt.status {
+					t.Fatalf("%s: status %d, want %d", round, res.StatusCode, tt.status)
+				}
+				if mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type")); len(tt.mediaType) > 0 && mediaType != tt.mediaType {
+					t.Errorf("%s: content type %q, want %q", round, mediaType, tt.mediaType)
+				}
+			}
+			if *upstreamRequests != tt.upstream {
+				t.Errorf("%d upstream requests, want %d", *upstreamRequests, tt.upstream)
+			}
+		})
+	}
+}
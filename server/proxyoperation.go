@@ -0,0 +1,299 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"httpxcommon/multiparts"
+	"httpxcommon/partscommon"
+
+	"k8s.io/klog"
+)
+
+// levels and results used for the proxy metrics
+const (
+	LevelStudy    = "study"
+	LevelSeries   = "series"
+	LevelInstance = "instance"
+	ProxyHit      = "hit"
+	ProxyMiss     = "miss"
+	ProxyError    = "error"
+)
+
+// directory below the main directory keeping the markers of completely cached studies and series
+const ProxyMarkerDir = ".proxy"
+
+// ErrUpstream is returned if the upstream origin could not deliver the requested data
+var ErrUpstream = errors.New("upstream retrieve failed")
+
+// Type representing the proxy to an upstream DICOMweb origin
+type ProxyOperation struct {
+	upstream string
+	protocol string
+	client   *http.Client
+	dirOut   string
+	metrics  *ServerMetrics
+}
+
+// Lookup checks if the requested level is completely available in the local directory
+func (p *ProxyOperation) Lookup(level string, study string, series string, instance string) bool {
+	var cached bool
+	switch level {
+	case LevelStudy:
+		cached = p.isMarked(p.markerName(study, ""))
+	case LevelSeries:
+		cached = p.isMarked(p.markerName(study, "")) || p.isMarked(p.markerName(study, series))
+	case LevelInstance:
+		_, err := os.Stat(filepath.Join(p.dirOut, study, series, instance+".dcm"))
+		cached = err == nil
+	}
+	if cached {
+		p.metrics.proxy.WithLabelValues(level, ProxyHit).Inc()
+		klog.V(partscommon.KlogStatistics).Info("PROXY HIT ", level, " ", filepath.Join(study, series, instance))
+	}
+	return cached
+}
+
+func (p *ProxyOperation) markerName(study string, series string) string {
+	if len(series) > 0 {
+		return filepath.Join(p.dirOut, ProxyMarkerDir, "series_"+study+"_"+series)
+	}
+	return filepath.Join(p.dirOut, ProxyMarkerDir, "study_"+study)
+}
+
+func (p *ProxyOperation) isMarked(marker string) bool {
+	_, err := os.Stat(marker)
+	return err == nil
+}
+
+func (p *ProxyOperation) mark(marker string) error {
+	if err := os.MkdirAll(filepath.Dir(marker), os.ModePerm); err != nil {
+		return err
+	}
+	return os.WriteFile(marker, []byte(time.Now().UTC().Format(time.RFC3339)), 0644)
+}
+
+// Invalidate removes the markers of a deleted study or series so the data is fetched again
+func (p *ProxyOperation) Invalidate(study string, series string) {
+	os.Remove(p.markerName(study, ""))
+	if len(series) > 0 {
+		os.Remove(p.markerName(study, series))
+		return
+	}
+	markers, _ := filepath.Glob(p.markerName(study, "*"))
+	for _, marker := range markers {
+		os.Remove(marker)
+	}
+}
+
+// Retrieve fetches the requested level from upstream, stores it locally and streams it to the client
+func (p *ProxyOperation) Retrieve(w http.ResponseWriter, r *http.Request, level string, study string, series string, instance string) (error, uint64) {
+	out := &countingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+	err, size := p.fill(out, r, level, study, series, instance)
+	// the status is sent already, the client must not take the truncated body as complete
+	if err != nil && out.wroteHeader {
+		klog.Error("Aborting response of ", r.URL.Path, " after ", size, " bytes: ", err)
+		panic(http.ErrAbortHandler)
+	}
+	return err, size
+}
+
+// Fill fetches the requested level from upstream and stores it locally without a response,
+// the client gets the negotiated representation from the local directory afterwards
+func (p *ProxyOperation) Fill(r *http.Request, level string, study string, series string, instance string) error {
+	err, _ := p.fill(&countingResponseWriter{ResponseWriter: &discardResponseWriter{header: http.Header{}}, status: http.StatusOK}, r, level, study, series, instance)
+	return err
+}
+
+// fill stores the requested level from upstream and writes it as multipart or single part
+func (p *ProxyOperation) fill(out *countingResponseWriter, r *http.Request, level string, study string, series string, instance string) (error, uint64) {
+	p.metrics.proxy.WithLabelValues(level, ProxyMiss).Inc()
+	klog.V(partscommon.KlogStatistics).Info("PROXY MISS ", level, " ", filepath.Join(study, series, instance))
+
+	// request the same resource from upstream, not bound to the client so the cache is filled anyway
+	s := time.Now()
+	url := strings.TrimRight(p.upstream, "/") + r.URL.Path
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		p.metrics.proxy.WithLabelValues(level, ProxyError).Inc()
+		return err, 0
+	}
+	partscommon.LogRequest(req)
+	res, err := p.client.Do(req)
+	if err != nil {
+		p.metrics.proxy.WithLabelValues(level, ProxyError).Inc()
+		return fmt.Errorf("%w: %s", ErrUpstream, err.Error()), 0
+	}
+	defer res.Body.Close()
+	partscommon.LogResponse(res)
+	latency := time.Since(s)
+	p.metrics.upstream.WithLabelValues(p.protocol, level, "header").Observe(latency.Seconds())
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		p.metrics.proxy.WithLabelValues(level, ProxyError).Inc()
+		return os.ErrNotExist, 0
+	case res.StatusCode != http.StatusOK:
+		p.metrics.proxy.WithLabelValues(level, ProxyError).Inc()
+		return fmt.Errorf("%w: status %s from %s", ErrUpstream, res.Status, url), 0
+	}
+
+	// store and stream at the same time
+	var size uint64
+	if level == LevelInstance {
+		err, size = p.streamInstance(out, res, study, series, instance)
+	} else {
+		err, size = p.streamMultipart(out, res)
+	}
+	total := time.Since(s)
+	p.metrics.upstream.WithLabelValues(p.protocol, level, "total").Observe(total.Seconds())
+	if err != nil {
+		p.metrics.proxy.WithLabelValues(level, ProxyError).Inc()
+		return err, size
+	}
+	klog.V(partscommon.KlogStatistics).Info("UPSTREAM ", p.protocol, " ", url, " latency: ", latency)
+	partscommon.LogTotalTimeInfo("UPSTREAM "+strings.ToUpper(level)+" "+url, total, size, total, false)
+
+	// mark study or series as complete for further requests
+	switch level {
+	case LevelStudy:
+		err = p.mark(p.markerName(study, ""))
+	case LevelSeries:
+		err = p.mark(p.markerName(study, series))
+	}
+	if err != nil {
+		klog.Error("Error marking cached data: ", err)
+	}
+	return nil, size
+}
+
+func (p *ProxyOperation) streamInstance(w http.ResponseWriter, res *http.Response, study string, series string, instance string) (error, uint64) {
+	// header for the single part as if served locally
+	joinedpath := filepath.Join(study, series, instance)
+	w.Header().Set("Content-Type", "application/dicom")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", joinedpath))
+	if res.ContentLength >= 0 {
+		w.Header().Set("Content-Length", fmt.Sprint(res.ContentLength))
+	}
+	w.WriteHeader(http.StatusOK)
+
+	// copy into file and response
+	forward := &forwardWriter{Writer: w}
+	filename := partscommon.EnsureFilePath(p.dirOut, study, series, instance)
+	err, size := p.storeAndForward(filename, forward, res.Body)
+	if err != nil {
+		return err, size
+	}
+	return forward.err, size
+}
+
+func (p *ProxyOperation) streamMultipart(w http.ResponseWriter, res *http.Response) (error, uint64) {
+	_, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrUpstream, err.Error()), 0
+	}
+	mr := multipart.NewReader(res.Body, params["boundary"])
+
+	// global header of the downstream message
+	var mf multiparts.MultipartFiles
+	ct := fmt.Sprintf("multipart/related; boundary=%q; type=\"application/dicom\"", mf.GetBoundary())
+	w.Header().Set("Content-Type", ct)
+	forward := &forwardWriter{Writer: w}
+	writer := multipart.NewWriter(forward)
+	if err := writer.SetBoundary(mf.GetBoundary()); err != nil {
+		return err, 0
+	}
+
+	// every part is stored and forwarded as soon as it arrives
+	var size uint64
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrUpstream, err.Error()), size
+		}
+		name := mf.GetMultiPartFileName(part)
+		study, series, instance := partscommon.GetDICOMInfo(name)
+		if len(study) == 0 || len(series) == 0 || len(instance) == 0 {
+			return fmt.Errorf("%w: no valid file name in part: %q", ErrUpstream, name), size
+		}
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", "application/dicom")
+		header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Join(study, series, instance)))
+		wPart, err := writer.CreatePart(header)
+		if err != nil {
+			return err, size
+		}
+		filename := partscommon.EnsureFilePath(p.dirOut, study, series, instance)
+		err, l := p.storeAndForward(filename, wPart, part)
+		size += l
+		if err != nil {
+			return err, size
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	writer.Close()
+	return forward.err, size
+}
+
+// storeAndForward copies the data into a temporary file renamed when complete, readers of the directory skip it as partial file
+func (p *ProxyOperation) storeAndForward(filename string, w io.Writer, r io.Reader) (error, uint64) {
+	file, err := partscommon.CreateTemp(filename)
+	if err != nil {
+		return err, 0
+	}
+	defer os.Remove(file.Name())
+	length, err := io.Copy(file, io.TeeReader(r, w))
+	errClose := file.Close()
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrUpstream, err.Error()), uint64(length)
+	}
+	if errClose != nil {
+		return errClose, uint64(length)
+	}
+	if err = os.Rename(file.Name(), filename); err != nil {
+		return err, uint64(length)
+	}
+	klog.V(partscommon.KlogInfo).Info("Cached file: ", filename, " with size: ", length)
+	return nil, uint64(length)
+}
+
+// Type representing a response nobody receives, used to fill the cache only
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (d *discardResponseWriter) Header() http.Header {
+	return d.header
+}
+
+func (d *discardResponseWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (d *discardResponseWriter) WriteHeader(int) {}
+
+// Type representing a writer ignoring all writes after the first error, a failing client does not stop caching
+type forwardWriter struct {
+	io.Writer
+	err error
+}
+
+func (f *forwardWriter) Write(p []byte) (int, error) {
+	if f.err == nil {
+		_, f.err = f.Writer.Write(p)
+	}
+	return len(p), nil
+}
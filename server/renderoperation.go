@@ -0,0 +1,348 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"httpxcommon/dicomfile"
+	"httpxcommon/partscommon"
+
+	"github.com/gorilla/mux"
+	"k8s.io/klog"
+)
+
+// media types and defaults of rendered responses
+const (
+	MediaTypeJpeg      = "image/jpeg"
+	MediaTypePng       = "image/png"
+	ThumbnailViewport  = 128
+	DefaultJpegQuality = 90
+)
+
+// ErrRenderParameter is returned for invalid query parameters of rendered requests
+var ErrRenderParameter = errors.New("invalid rendering parameter")
+
+// Type representing the rendering requested by Accept and the query parameters
+type RenderParams struct {
+	MediaType      string
+	Window         *dicomfile.Window
+	ViewportWidth  int
+	ViewportHeight int
+	Quality        int
+}
+
+// ParseRenderParams reads Accept and the query parameters window=center,width[,function], viewport=vw,vh and quality (PS3.18 8.3.5)
+func ParseRenderParams(r *http.Request, thumbnail bool) (RenderParams, error) {
+	p := RenderParams{Quality: DefaultJpegQuality}
+	for _, m := range ParseAccept(r.Header.Get("Accept")) {
+		switch m.MediaType {
+		case MediaTypeJpeg, "image/*", "*/*":
+			p.MediaType = MediaTypeJpeg
+		case MediaTypePng:
+			p.MediaType = MediaTypePng
+		}
+		if len(p.MediaType) > 0 {
+			break
+		}
+	}
+	if len(p.MediaType) == 0 {
+		return p, ErrNotAcceptable
+	}
+
+	query := r.URL.Query()
+	if window := query.Get("window"); len(window) > 0 {
+		values := strings.Split(window, ",")
+		if len(values) < 2 || len(values) > 3 {
+			return p, fmt.Errorf("%w: window=%s", ErrRenderParameter, window)
+		}
+		center, errCenter := strconv.ParseFloat(values[0], 64)
+		width, errWidth := strconv.ParseFloat(values[1], 64)
+		if errCenter != nil || errWidth != nil || width < 1 {
+			return p, fmt.Errorf("%w: window=%s", ErrRenderParameter, window)
+		}
+		if len(values) == 3 && !strings.EqualFold(values[2], "linear") {
+			return p, fmt.Errorf("%w: window function %s not supported", ErrRenderParameter, values[2])
+		}
+		p.Window = &dicomfile.Window{Center: center, Width: width}
+	}
+
+	// thumbnails are limited to a small viewport if none is requested
+	if thumbnail {
+		p.ViewportWidth, p.ViewportHeight = ThumbnailViewport, ThumbnailViewport
+	}
+	if viewport := query.Get("viewport"); len(viewport) > 0 {
+		values := strings.Split(viewport, ",")
+		var err error
+		if p.ViewportWidth, err = strconv.Atoi(values[0]); err != nil || p.ViewportWidth < 0 {
+			return p, fmt.Errorf("%w: viewport=%s", ErrRenderParameter, viewport)
+		}
+		p.ViewportHeight = 0
+		if len(values) > 1 && len(values[1]) > 0 {
+			if p.ViewportHeight, err = strconv.Atoi(values[1]); err != nil || p.ViewportHeight < 0 {
+				return p, fmt.Errorf("%w: viewport=%s", ErrRenderParameter, viewport)
+			}
+		}
+	}
+	if quality := query.Get("quality"); len(quality) > 0 {
+		var err error
+		if p.Quality, err = strconv.Atoi(quality); err != nil || p.Quality < 1 || p.Quality > 100 {
+			return p, fmt.Errorf("%w: quality=%s", ErrRenderParameter, quality)
+		}
+	}
+	return p, nil
+}
+
+// ETag derives the entity tag of the rendered representation from the entity tag of the stored data
+func (p RenderParams) ETag(etag string) string {
+	hash := fnv.New32a()
+	fmt.Fprintf(hash, "%s:%d:%d:%d", p.MediaType, p.ViewportWidth, p.ViewportHeight, p.Quality)
+	if p.Window != nil {
+		fmt.Fprintf(hash, ":%g:%g", p.Window.Center, p.Window.Width)
+	}
+	return fmt.Sprintf("%s-r%x\"", strings.TrimSuffix(etag, "\""), hash.Sum32())
+}
+
+// Encode writes the image scaled to the viewport in the media type
+func (p RenderParams) Encode(w io.Writer, img image.Image) error {
+	b := img.Bounds()
+	width, height := dicomfile.FitViewport(b.Dx(), b.Dy(), p.ViewportWidth, p.ViewportHeight)
+	img = dicomfile.Scale(img, width, height)
+	if p.MediaType == MediaTypePng {
+		return png.Encode(w, img)
+	}
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: p.Quality})
+}
+
+// Type representing the time spent per rendering step
+type RenderTiming struct {
+	Images  int
+	Skipped int
+	Decode  time.Duration
+	Encode  time.Duration
+}
+
+// Type representing rendered and thumbnail retrieve of studies, series and instances
+type RenderOperation struct {
+	dirIn        string
+	validators   *Validators
+	cacheControl string
+	locks        *StudyLocks
+}
+
+// rendered transaction on study, series or instance level
+func (h *RenderOperation) Rendered(w http.ResponseWriter, r *http.Request) {
+	h.Render(w, r, false)
+}
+
+// thumbnail transaction on study, series or instance level
+func (h *RenderOperation) Thumbnail(w http.ResponseWriter, r *http.Request) {
+	h.Render(w, r, true)
+}
+
+func (h *RenderOperation) Render(w http.ResponseWriter, r *http.Request, thumbnail bool) {
+	s := time.Now()
+	partscommon.LogRequest(r)
+
+	// get the variables
+	vars := mux.Vars(r)
+	studyinstanceuid := vars["study"]
+	seriesinstanceuid := vars["series"]
+	sopinstanceuid := vars["instance"]
+	if len(studyinstanceuid) == 0 {
+		klog.Error("No study instance uid provided")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	params, err := ParseRenderParams(r, thumbnail)
+	if err != nil {
+		klog.Error("Error in rendering parameters: ", err)
+		w.WriteHeader(RenderErrorStatus(err))
+		return
+	}
+	klog.V(partscommon.KlogDebug).Info("Render requested for study:", studyinstanceuid, " series:", seriesinstanceuid, " instance:", sopinstanceuid, " thumbnail:", thumbnail)
+
+	// render from the stored files, a delete of the study waits until finished
+	unlock := h.locks.Read(studyinstanceuid)
+	defer unlock()
+	var timing RenderTiming
+	err, size := h.ProcessRender(w, r, studyinstanceuid, seriesinstanceuid, sopinstanceuid, params, thumbnail, &timing)
+	if err != nil {
+		klog.Error("Error rendering: ", err)
+		w.WriteHeader(RenderErrorStatus(err))
+		return
+	}
+	what := "RENDERED "
+	if thumbnail {
+		what = "THUMBNAIL "
+	}
+	what += filepath.Join(studyinstanceuid, seriesinstanceuid, sopinstanceuid)
+	klog.V(partscommon.KlogStatistics).Info(what, " images: ", timing.Images, " skipped: ", timing.Skipped, " decode: ", timing.Decode, " encode: ", timing.Encode)
+	duration := time.Since(s)
+	partscommon.LogTotalTimeInfo(what, duration, size, duration, false)
+}
+
+// RenderErrorStatus maps the error of a rendered request to the response status
+func RenderErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrRenderParameter):
+		return http.StatusBadRequest
+	case errors.Is(err, dicomfile.ErrUnsupportedImage):
+		return http.StatusNotAcceptable
+	}
+	return RetrieveErrorStatus(err, http.StatusInternalServerError)
+}
+
+// ProcessRender sends one image for instances and thumbnails, a multipart message with an image per instance otherwise
+func (h *RenderOperation) ProcessRender(w http.ResponseWriter, r *http.Request, study string, series string, instance string, params RenderParams, thumbnail bool, timing *RenderTiming) (error, uint64) {
+	// validators of the stored files
+	path := filepath.Join(h.dirIn, study, series)
+	var files []string
+	var etag string
+	var lastModified time.Time
+	if len(instance) > 0 {
+		path = filepath.Join(path, instance+".dcm")
+		info, err := os.Stat(path)
+		if err != nil {
+			return err, 0
+		}
+		if etag, err = h.validators.InstanceETag(path, info); err != nil {
+			return err, 0
+		}
+		lastModified = info.ModTime()
+		files = []string{path}
+	} else {
+		var err error
+		if etag, lastModified, err = h.validators.DirectoryValidators(path); err != nil {
+			return err, 0
+		}
+		if files, err = listFiles(path); err != nil {
+			return err, 0
+		}
+	}
+	etag = params.ETag(etag)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	w.Header().Add("Vary", "Accept")
+	if len(h.cacheControl) > 0 {
+		w.Header().Set("Cache-Control", h.cacheControl)
+	}
+	if NotModified(r, etag, lastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil, 0
+	}
+
+	// single image, rendered before the header to report errors
+	if len(instance) > 0 || thumbnail {
+		file := representativeFile(files)
+		img, err := renderFile(file, params, timing)
+		if err != nil {
+			return err, 0
+		}
+		s := time.Now()
+		body := &countingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		w.Header().Set("Content-Type", params.MediaType)
+		w.Header().Set("Server-Timing", fmt.Sprintf("decode;dur=%.3f", float64(timing.Decode.Microseconds())/1000))
+		err = params.Encode(body, img)
+		timing.Encode += time.Since(s)
+		return err, body.size
+	}
+
+	// one part per instance, files without renderable pixel data are skipped
+	body := &countingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+	writer := multipart.NewWriter(body)
+	w.Header().Set("Content-Type", fmt.Sprintf("multipart/related; type=%q; boundary=%q", params.MediaType, writer.Boundary()))
+	for _, file := range files {
+		img, err := renderFile(file, params, timing)
+		if err != nil {
+			klog.Warning("Skipping ", file, ": ", err)
+			timing.Skipped++
+			continue
+		}
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Type", params.MediaType)
+		rel, _ := filepath.Rel(h.dirIn, strings.TrimSuffix(file, ".dcm"))
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		if len(parts) == 3 {
+			header.Set("Content-Location", "/studies/"+parts[0]+"/series/"+parts[1]+"/instances/"+parts[2]+"/rendered")
+		}
+		part, err := writer.CreatePart(header)
+		if err != nil {
+			return err, body.size
+		}
+		s := time.Now()
+		err = params.Encode(part, img)
+		timing.Encode += time.Since(s)
+		if err != nil {
+			return err, body.size
+		}
+	}
+	err := writer.Close()
+	return err, body.size
+}
+
+// renderFile decodes the first frame of the file
+func renderFile(file string, params RenderParams, timing *RenderTiming) (image.Image, error) {
+	s := time.Now()
+	defer func() { timing.Decode += time.Since(s) }()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	f, err := dicomfile.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", dicomfile.ErrUnsupportedImage, err)
+	}
+	window := params.Window
+	if window == nil {
+		if w, ok := dicomfile.WindowFromDataset(f.Dataset); ok {
+			window = &w
+		}
+	}
+	img, err := f.Render(0, window)
+	if err == nil {
+		timing.Images++
+	}
+	return img, err
+}
+
+// listFiles returns all instance files below the path in name order
+func listFiles(path string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(file, ".dcm") {
+			return err
+		}
+		files = append(files, file)
+		return nil
+	})
+	if err == nil && len(files) == 0 {
+		err = os.ErrNotExist
+	}
+	sort.Strings(files)
+	return files, err
+}
+
+// representativeFile returns the middle instance of the first series
+func representativeFile(files []string) string {
+	var series []string
+	for _, file := range files {
+		if filepath.Dir(file) == filepath.Dir(files[0]) {
+			series = append(series, file)
+		}
+	}
+	return series[len(series)/2]
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"httpxcommon/dicomweb"
+	"httpxcommon/singleparts"
+	"httpxcommon/transports"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// metrics are registered once per process
+var testMetrics = NewServerMetrics()
+
+// cut after which the first complete response is aborted
+const resumeCut = 300 * 1024
+
+// cutWriter sends the first bytes of the body and aborts the response like a broken connection
+type cutWriter struct {
+	http.ResponseWriter
+	written int
+}
+
+func (w *cutWriter) Write(p []byte) (int, error) {
+	if w.written+len(p) <= resumeCut {
+		n, err := w.ResponseWriter.Write(p)
+		w.written += n
+		return n, err
+	}
+	n, _ := w.ResponseWriter.Write(p[:resumeCut-w.written])
+	w.written += n
+	w.ResponseWriter.(http.Flusher).Flush()
+	panic(http.ErrAbortHandler)
+}
+
+// cutFirstResponse aborts the first response without a Range header in the middle of the body
+func cutFirstResponse(next http.Handler) http.Handler {
+	var cut atomic.Bool
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.Header.Get("Range")) == 0 && cut.CompareAndSwap(false, true) {
+			next.ServeHTTP(&cutWriter{ResponseWriter: w}, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeInstance stores an instance of random content below the directory
+func writeInstance(t *testing.T, dir string, ref dicomweb.Ref) []byte {
+	data := make([]byte, 1024*1024)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, ref.Study, ref.Series, ref.Instance+".dcm")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// startServer serves the handler with the protocol and returns the base url and the trusted certificates
+func startServer(t *testing.T, protocol string, handler http.Handler) (string, *x509.CertPool) {
+	srv := httptest.NewUnstartedServer(handler)
+	srv.EnableHTTP2 = protocol == transports.Http2
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	if protocol != transports.Http3 {
+		return srv.URL, pool
+	}
+
+	// HTTP/3 with the certificate of the test server
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http3.Server{Handler: handler, TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: srv.TLS.Certificates})}
+	go server.Serve(conn)
+	t.Cleanup(func() {
+		server.Close()
+		conn.Close()
+	})
+	return "https://" + conn.LocalAddr().String(), pool
+}
+
+func TestResumeInstance(t *testing.T) {
+	ref := dicomweb.Ref{Study: "1.2.3", Series: "1.2.3.4", Instance: "1.2.3.4.5"}
+	for _, protocol := range []string{transports.Http1, transports.Http2, transports.Http3} {
+		t.Run(transports.ProtocolLabel(protocol), func(t *testing.T) {
+			dirIn := t.TempDir()
+			data := writeInstance(t, dirIn, ref)
+			handler := setupHandler("", dirIn, ETagModTime, "", testMetrics, nil, true, nil, nil)
+			base, pool := startServer(t, protocol, cutFirstResponse(handler))
+
+			client, err := dicomweb.NewClient(base, dicomweb.Options{Protocol: protocol, TLS: transports.TLSOptions{RootCAs: pool}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			dirOut := t.TempDir()
+			opts := dicomweb.RetrieveOptions{Directory: dirOut, Resume: true}
+			path := filepath.Join(dirOut, ref.Study, ref.Series, ref.Instance+".dcm")
+
+			// the first response is cut in the middle of the body
+			if _, err := client.Retrieve(context.Background(), ref, opts); err == nil {
+				t.Fatal("interrupted retrieve succeeded")
+			}
+			info, err := os.Stat(path)
+			if err != nil || info.Size() == 0 || info.Size() >= int64(len(data)) {
+				t.Fatalf("no partial instance after the interrupted retrieve: %v %v", info, err)
+			}
+			if _, err := os.Stat(path + singleparts.PartialSuffix); err != nil {
+				t.Fatal("no entity tag kept for the resume: ", err)
+			}
+
+			// the second retrieve continues at the end of the partial file
+			result, err := client.Retrieve(context.Background(), ref, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.StatusCode != http.StatusPartialContent {
+				t.Fatalf("resumed with status %d, want %d", result.StatusCode, http.StatusPartialContent)
+			}
+			if result.Bytes != uint64(int64(len(data))-info.Size()) {
+				t.Errorf("resumed with %d bytes, want %d", result.Bytes, int64(len(data))-info.Size())
+			}
+			stored, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(stored, data) {
+				t.Fatalf("resumed instance differs: %d of %d bytes", len(stored), len(data))
+			}
+			if _, err := os.Stat(path + singleparts.PartialSuffix); !os.IsNotExist(err) {
+				t.Error("entity tag kept after the complete retrieve: ", err)
+			}
+		})
+	}
+}
+
+func TestRetryInterruptedBody(t *testing.T) {
+	ref := dicomweb.Ref{Study: "1.2.3", Series: "1.2.3.4", Instance: "1.2.3.4.5"}
+	for _, resume := range []bool{false, true} {
+		for _, protocol := range []string{transports.Http1, transports.Http2, transports.Http3} {
+			t.Run(fmt.Sprintf("%s resume %v", transports.ProtocolLabel(protocol), resume), func(t *testing.T) {
+				dirIn := t.TempDir()
+				data := writeInstance(t, dirIn, ref)
+				handler := setupHandler("", dirIn, ETagModTime, "", testMetrics, nil, true, nil, nil)
+				base, pool := startServer(t, protocol, cutFirstResponse(handler))
+
+				retry := dicomweb.RetryPolicy{MaxAttempts: 2, Backoff: time.Millisecond}
+				stats := dicomweb.NewRetryStats()
+				client, err := dicomweb.NewClient(base, dicomweb.Options{Protocol: protocol, TLS: transports.TLSOptions{RootCAs: pool}, Retry: retry, RetryStats: stats})
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer client.Close()
+				dirOut := t.TempDir()
+
+				// the cut body is retrieved again, resumed instances continue at the end of the partial file
+				result, err := client.Retrieve(context.Background(), ref, dicomweb.RetrieveOptions{Directory: dirOut, Resume: resume})
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := http.StatusOK
+				if resume {
+					want = http.StatusPartialContent
+				}
+				if result.StatusCode != want {
+					t.Errorf("retried with status %d, want %d", result.StatusCode, want)
+				}
+				stored, err := os.ReadFile(filepath.Join(dirOut, ref.Study, ref.Series, ref.Instance+".dcm"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(stored, data) {
+					t.Fatalf("retried instance differs: %d of %d bytes", len(stored), len(data))
+				}
+				if counts := stats.Counts()[transports.ProtocolLabel(protocol)]; counts.Retries != 1 || counts.Recovered != 1 {
+					t.Errorf("retry counts %+v, want one recovered retry", counts)
+				}
+			})
+		}
+	}
+}
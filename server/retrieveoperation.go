@@ -1,13 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"httpxcommon/compression"
+	"httpxcommon/digest"
 	"httpxcommon/multiparts"
 	"httpxcommon/partscommon"
 	"httpxcommon/singleparts"
 	"io"
 	"net/http"
+	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -16,7 +22,14 @@ import (
 
 // Type representing retrieve of an study
 type RetrieveOperation struct {
-	dirIn string
+	dirIn        string
+	validators   *Validators
+	cacheControl string
+	// optional upstream origin filling the directory on cache misses
+	proxy *ProxyOperation
+	locks *StudyLocks
+	// transfer syntaxes of the studies and series for the negotiation
+	syntaxes *SyntaxCache
 }
 
 // retrieve transaction on study level
@@ -25,7 +38,7 @@ func (h *RetrieveOperation) RetrieveStudy(w http.ResponseWriter, r *http.Request
 	s := time.Now()
 	body, err1 := io.ReadAll(r.Body)
 	if err1 != nil {
-		klog.V(partscommon.KlogDebug).Info("Error reading body while handling /studies: %s\n", err1.Error())
+		klog.V(partscommon.KlogDebug).Infof("Error reading body while handling /studies: %s\n", err1.Error())
 	}
 
 	// dump message
@@ -42,11 +55,13 @@ func (h *RetrieveOperation) RetrieveStudy(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	// load files from directory
-	err, size := h.ProcessStudy(w, studyinstanceuid)
+	// load files from directory, a delete of the study waits until finished
+	unlock := h.locks.Read(studyinstanceuid)
+	defer unlock()
+	err, size := h.ProcessStudy(w, r, studyinstanceuid)
 	if err != nil {
 		klog.Error("Error processing study:", err)
-		w.WriteHeader(http.StatusNotFound)
+		w.WriteHeader(RetrieveErrorStatus(err, http.StatusNotFound))
 		return
 	}
 	w.Write(body)
@@ -60,7 +75,7 @@ func (h *RetrieveOperation) RetrieveSeries(w http.ResponseWriter, r *http.Reques
 	s := time.Now()
 	body, err1 := io.ReadAll(r.Body)
 	if err1 != nil {
-		klog.V(partscommon.KlogDebug).Info("Error reading body while handling /studies: %s\n", err1.Error())
+		klog.V(partscommon.KlogDebug).Infof("Error reading body while handling /studies: %s\n", err1.Error())
 	}
 
 	// dump message
@@ -85,10 +100,14 @@ func (h *RetrieveOperation) RetrieveSeries(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	// load files from directory
-	err, size := h.ProcessSeries(w, studyinstanceuid, seriesinstanceuid)
+	// load files from directory, a delete of the study waits until finished
+	unlock := h.locks.Read(studyinstanceuid)
+	defer unlock()
+	err, size := h.ProcessSeries(w, r, studyinstanceuid, seriesinstanceuid)
 	if err != nil {
 		klog.Error("Error processing study:", err)
+		w.WriteHeader(RetrieveErrorStatus(err, http.StatusNotFound))
+		return
 	}
 	w.Write(body)
 	duration := time.Since(s)
@@ -128,71 +147,349 @@ func (h *RetrieveOperation) RetrieveInstance(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	// load files from directory
-	err, size := h.ProcessInstance(w, studyinstanceuid, seriesinstanceuid, sopinstanceuid)
+	// load files from directory, a delete of the study waits until finished
+	unlock := h.locks.Read(studyinstanceuid)
+	defer unlock()
+	err, size := h.ProcessInstance(w, r, studyinstanceuid, seriesinstanceuid, sopinstanceuid)
 	if err != nil {
-		klog.Error("Error reading instance: %s\n", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		klog.Errorf("Error reading instance: %s\n", err.Error())
+		w.WriteHeader(RetrieveErrorStatus(err, http.StatusInternalServerError))
 		return
 	}
 	duration := time.Since(s)
 	partscommon.LogTotalTimeInfo("RETRIEVE INSTANCE "+studyinstanceuid+"/"+seriesinstanceuid+"/"+sopinstanceuid, duration, size, duration, false)
 }
 
-func (h *RetrieveOperation) ProcessStudy(w http.ResponseWriter, study string) (error, uint64) {
-	//global header
-	var mf multiparts.MultipartFiles
-	ct := fmt.Sprintf("multipart/related; boundary=%q; type=\"application/dicom\"", mf.GetBoundary())
-	klog.V(partscommon.KlogDebug).Info("Setting Content-Type to ", ct)
-	w.Header().Set("Content-Type", ct)
+// RetrieveErrorStatus maps the error of a retrieve to the response status
+func RetrieveErrorStatus(err error, fallback int) int {
+	switch {
+	case errors.Is(err, ErrUpstream):
+		return http.StatusBadGateway
+	case errors.Is(err, ErrNotAcceptable):
+		return http.StatusNotAcceptable
+	case os.IsNotExist(err):
+		return http.StatusNotFound
+	}
+	return fallback
+}
+
+// proxyMiss streams the upstream data if the client accepts it as stored, otherwise the cache is filled and
+// the caller serves the negotiated representation from the local directory like on a hit
+func (h *RetrieveOperation) proxyMiss(w http.ResponseWriter, r *http.Request, level string, study string, series string, instance string) (error, bool, uint64) {
+	// the transfer syntaxes are not known before the fill, an acceptable representation must exist at all
+	rep, err := NegotiateRepresentation(r.Header.Get("Accept"), level, func(string) bool { return true })
+	if err != nil {
+		klog.Error("Not acceptable: ", r.Header.Get("Accept"), " for ", r.URL.Path)
+		return err, false, 0
+	}
+	asStored := MediaTypeMultipart
+	if level == LevelInstance {
+		asStored = MediaTypeDicom
+	}
+	if rep.MediaType == asStored && len(rep.TransferSyntax) == 0 {
+		err, size := h.proxy.Retrieve(w, r, level, study, series, instance)
+		return err, true, size
+	}
+	return h.proxy.Fill(r, level, study, series, instance), false, 0
+}
+
+func (h *RetrieveOperation) ProcessStudy(w http.ResponseWriter, r *http.Request, study string) (error, uint64) {
+	// fill the cache from upstream if needed
+	if h.proxy != nil && !h.proxy.Lookup(LevelStudy, study, "", "") {
+		if err, streamed, size := h.proxyMiss(w, r, LevelStudy, study, "", ""); err != nil || streamed {
+			return err, size
+		}
+	}
 
 	// build path
 	path := filepath.Join(h.dirIn, study)
+	return h.ProcessDirectory(w, r, path, LevelStudy)
+}
 
-	// upload files
-	err, size := mf.UploadFilesFromDirectory(w, path)
+func (h *RetrieveOperation) ProcessSeries(w http.ResponseWriter, r *http.Request, study string, series string) (error, uint64) {
+	// fill the cache from upstream if needed
+	if h.proxy != nil && !h.proxy.Lookup(LevelSeries, study, series, "") {
+		if err, streamed, size := h.proxyMiss(w, r, LevelSeries, study, series, ""); err != nil || streamed {
+			return err, size
+		}
+	}
+
+	// build path
+	path := filepath.Join(h.dirIn, study, series)
+	return h.ProcessDirectory(w, r, path, LevelSeries)
+}
+
+func (h *RetrieveOperation) ProcessDirectory(w http.ResponseWriter, r *http.Request, path string, level string) (error, uint64) {
+	// validators derived from the directory content
+	etag, lastModified, err := h.validators.DirectoryValidators(path)
 	if err != nil {
-		klog.Error("Error uploading files:", err)
-		return err, size
+		klog.Error("Error reading directory:", err)
+		return err, 0
 	}
-	return nil, size
+
+	// media type and transfer syntax requested by Accept, the headers are read again when the directory changed
+	stored := h.syntaxes.Lookup(path, etag)
+	rep, err := NegotiateRepresentation(r.Header.Get("Accept"), level, stored.Deliverable)
+	if err != nil {
+		klog.Error("Not acceptable: ", r.Header.Get("Accept"), " for ", path)
+		return err, 0
+	}
+	return h.ProcessBundle(w, r, path, rep, etag, lastModified)
 }
 
-func (h *RetrieveOperation) ProcessSeries(w http.ResponseWriter, study string, series string) (error, uint64) {
+// ProcessBundle sends all files below the path as multipart or zip message
+func (h *RetrieveOperation) ProcessBundle(w http.ResponseWriter, r *http.Request, path string, rep Representation, etag string, lastModified time.Time) (error, uint64) {
+	s := time.Now()
+	etag = rep.ETag(etag)
+	w.Header().Add("Vary", "Accept")
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	if len(h.cacheControl) > 0 {
+		w.Header().Set("Cache-Control", h.cacheControl)
+	}
+	if NotModified(r, etag, lastModified) {
+		klog.V(partscommon.KlogDebug).Info("Not modified: ", path, " etag: ", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return nil, 0
+	}
+
 	//global header
 	var mf multiparts.MultipartFiles
 	ct := fmt.Sprintf("multipart/related; boundary=%q; type=\"application/dicom\"", mf.GetBoundary())
+	transcoder := NewTranscoder(rep.TransferSyntax)
+	if transcoder != nil {
+		ct += "; transfer-syntax=" + rep.TransferSyntax
+		mf.ContentType = rep.ContentType()
+		mf.Transform = transcoder.Transform
+	}
+	if rep.MediaType == MediaTypeZip {
+		ct = MediaTypeZip
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(path)+".zip"))
+	}
 	klog.V(partscommon.KlogDebug).Info("Setting Content-Type to ", ct)
 	w.Header().Set("Content-Type", ct)
 
-	// build path
-	path := filepath.Join(h.dirIn, study, series)
+	// negotiate compression of the parts or the whole body
+	compress := &compression.Options{Encoding: compression.Negotiate(r.Header.Get(compression.AcceptPartEncodingHeader)), Scope: compression.ScopePart}
+	if compress.PartEncoding() == "" || rep.MediaType == MediaTypeZip {
+		compress.Encoding = compression.Negotiate(r.Header.Get("Accept-Encoding"))
+		compress.Scope = compression.ScopeBody
+	}
+	mf.Compression = compress
+
+	// digests of the parts and of the body as trailer (HTTP/3 in quic-go has no trailers)
+	out := &countingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+	var body io.Writer = out
+	var bodyHash *digest.Hash
+	var dig *digest.Options
+	if WantsDigest(r) {
+		dig = &digest.Options{Enabled: true}
+		mf.Digest = dig
+		if r.ProtoMajor < 3 {
+			bodyHash = digest.NewHash(dig.GetStats())
+			w.Header().Set("Trailer", digest.ContentDigestHeader)
+			body = io.MultiWriter(out, bodyHash)
+		}
+	}
+	var enc *compression.Encoder
+	var err error
+	if encoding := compress.BodyEncoding(); len(encoding) > 0 {
+		w.Header().Set("Content-Encoding", encoding)
+		w.Header().Add("Vary", "Accept-Encoding")
+		if enc, err = compression.NewWriter(encoding, body, &compress.Stats); err != nil {
+			return err, 0
+		}
+		body = enc
+	}
 
 	// upload files
-	err, size := mf.UploadFilesFromDirectory(w, path)
+	var size uint64
+	if rep.MediaType == MediaTypeZip {
+		err, size = WriteZip(body, path, transcoder)
+	} else {
+		err, size = mf.UploadFilesFromDirectory(body, path)
+	}
 	if err != nil {
 		klog.Error("Error uploading files:", err)
+		// the status is sent already, the client must not take the truncated body as complete
+		if out.wroteHeader {
+			klog.Error("Aborting response of ", path, " after ", size, " bytes")
+			panic(http.ErrAbortHandler)
+		}
 		return err, size
 	}
+	if enc != nil {
+		enc.Close()
+	}
+	if bodyHash != nil {
+		w.Header().Set(digest.ContentDigestHeader, bodyHash.Value())
+	}
+	if dig != nil {
+		klog.V(partscommon.KlogStatistics).Info("RETRIEVE ", path, " digest ", dig.Stats.String())
+	}
+	if compress.SingleEncoding() != "" {
+		klog.V(partscommon.KlogStatistics).Info("RETRIEVE ", path, " compression ", compress.Encoding, "/", compress.Scope, " ", compress.Stats.String())
+	}
+	transcoder.LogTranscoding(path, time.Since(s), size)
 	return nil, size
 }
 
-func (h *RetrieveOperation) ProcessInstance(w http.ResponseWriter, study string, series string, instance string) (error, uint64) {
+func (h *RetrieveOperation) ProcessInstance(w http.ResponseWriter, r *http.Request, study string, series string, instance string) (error, uint64) {
+	// fill the cache from upstream if needed
+	if h.proxy != nil && !h.proxy.Lookup(LevelInstance, study, series, instance) {
+		if err, streamed, size := h.proxyMiss(w, r, LevelInstance, study, series, instance); err != nil || streamed {
+			return err, size
+		}
+	}
+
+	// build path
+	path := filepath.Join(h.dirIn, study, series, instance+".dcm")
+	file, err := os.Open(path)
+	if err != nil {
+		return err, 0
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err, 0
+	}
+	etag, err := h.validators.InstanceETag(path, info)
+	if err != nil {
+		return err, 0
+	}
+
+	// media type and transfer syntax requested by Accept, bundles are sent like a series
+	stored := NewStoredSyntaxes(path)
+	rep, err := NegotiateRepresentation(r.Header.Get("Accept"), LevelInstance, stored.Deliverable)
+	if err != nil {
+		klog.Error("Not acceptable: ", r.Header.Get("Accept"), " for ", path)
+		return err, 0
+	}
+	if rep.MediaType != MediaTypeDicom {
+		return h.ProcessBundle(w, r, path, rep, etag, info.ModTime())
+	}
+
 	// global header for single part message
 	var sf singleparts.SinglepartFiles
-	w.Header().Set("Content-Type", "application/dicom")
+	w.Header().Set("Content-Type", rep.ContentType())
 	joinedpath := filepath.Join(study, series, instance)
 	klog.V(partscommon.KlogInfo).Info("Joined filename path:", joinedpath)
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", joinedpath))
+	w.Header().Add("Vary", "Accept")
+	etag = rep.ETag(etag)
 
-	// build path
-	path := filepath.Join(h.dirIn, study, series, instance+".dcm")
+	// transcode in memory if the file is not stored in the requested transfer syntax
+	var content io.ReadSeeker = file
+	var transcoded []byte
+	if transcoder := NewTranscoder(rep.TransferSyntax); transcoder != nil {
+		data, err := io.ReadAll(file)
+		if err != nil {
+			return err, 0
+		}
+		if transcoded, err = transcoder.Transform(path, data); err != nil {
+			return err, 0
+		}
+		content = bytes.NewReader(transcoded)
+		w.Header().Set("Server-Timing", fmt.Sprintf("transcode;dur=%.3f", float64(transcoder.Duration().Microseconds())/1000))
+		klog.V(partscommon.KlogStatistics).Info("TRANSCODE ", path, " ", transcoder.String())
+	}
+
+	// negotiate compression of the body, the single part is handled the same way
+	encoding := compression.Negotiate(r.Header.Get("Accept-Encoding"))
+	if encoding == compression.EncodingIdentity {
+		encoding = compression.Negotiate(r.Header.Get(compression.AcceptPartEncodingHeader))
+	}
+
+	// ranges and conditional requests are served for the identity representation
+	if len(h.cacheControl) > 0 {
+		w.Header().Set("Cache-Control", h.cacheControl)
+	}
+	if encoding == compression.EncodingIdentity || len(r.Header.Get("Range")) > 0 {
+		// the representation digest covers the whole instance, also for ranges
+		if WantsDigest(r) {
+			reprHash := digest.NewHash(nil)
+			if _, err := io.Copy(reprHash, content); err != nil {
+				return err, 0
+			}
+			if _, err := content.Seek(0, io.SeekStart); err != nil {
+				return err, 0
+			}
+			w.Header().Set(digest.ReprDigestHeader, reprHash.Value())
+		}
+		w.Header().Set("ETag", etag)
+		body := &countingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		http.ServeContent(body, r, "", info.ModTime(), content)
+		klog.V(partscommon.KlogDebug).Info("Served instance ", path, " with status ", body.status, " range: ", r.Header.Get("Range"))
+		return nil, body.size
+	}
+
+	// compressed representation has its own entity tag
+	etag = strings.TrimSuffix(etag, "\"") + "-" + encoding + "\""
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+	if NotModified(r, etag, info.ModTime()) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil, 0
+	}
+	w.Header().Set("Content-Encoding", encoding)
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	// the digest of the encoded representation is sent ahead, the body is encoded into memory
+	sent := &countingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+	var out io.Writer = sent
+	var encoded *bytes.Buffer
+	if WantsDigest(r) {
+		encoded = &bytes.Buffer{}
+		out = encoded
+	}
+	var stats compression.Stats
+	enc, err := compression.NewWriter(encoding, out, &stats)
+	if err != nil {
+		return err, 0
+	}
 
 	// upload files
-	err, size := sf.UploadFile(w, path)
+	var size uint64
+	if transcoded != nil {
+		var n int
+		n, err = enc.Write(transcoded)
+		size = uint64(n)
+	} else {
+		err, size = sf.UploadFile(&encodingResponseWriter{ResponseWriter: w, Writer: enc}, path)
+	}
+	if err == nil {
+		err = enc.Close()
+	}
 	if err != nil {
 		klog.Error("Error uploading file:", err)
+		// the status is sent already, the client must not take the truncated body as complete
+		if sent.wroteHeader {
+			klog.Error("Aborting response of ", path, " after ", size, " bytes")
+			panic(http.ErrAbortHandler)
+		}
 		return err, size
 	}
+
+	// only a complete body is sent with its digest
+	if encoded != nil {
+		w.Header().Set(digest.ReprDigestHeader, digest.Sum(encoded.Bytes()))
+		w.Write(encoded.Bytes())
+	}
+	klog.V(partscommon.KlogStatistics).Info("RETRIEVE ", path, " compression ", encoding, " ", stats.String())
 	return nil, size
 }
+
+// WantsDigest checks if the request asks for sha-256 digests (RFC 9530)
+func WantsDigest(r *http.Request) bool {
+	return digest.Wanted(r.Header.Get(digest.WantReprDigestHeader)) || digest.Wanted(r.Header.Get(digest.WantContentDigestHeader))
+}
+
+// Type representing a response writer compressing the body
+type encodingResponseWriter struct {
+	http.ResponseWriter
+	io.Writer
+}
+
+func (e *encodingResponseWriter) Write(p []byte) (int, error) {
+	return e.Writer.Write(p)
+}
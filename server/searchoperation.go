@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"httpxcommon/dicomfile"
+	"httpxcommon/dicomweb"
+	"httpxcommon/partscommon"
+
+	"github.com/gorilla/mux"
+	"k8s.io/klog"
+)
+
+// levels of a search
+const (
+	SearchStudies   = "studies"
+	SearchSeries    = "series"
+	SearchInstances = "instances"
+)
+
+// errors of a search query
+var ErrSearchQuery = errors.New("invalid search query")
+
+// Type representing an attribute of the search results
+type SearchAttribute struct {
+	Keyword string
+	Tag     string
+	VR      string
+}
+
+// attributes returned and matched per level
+var searchAttributes = map[string][]SearchAttribute{
+	SearchStudies: {
+		{"StudyInstanceUID", dicomweb.TagStudyInstanceUID, "UI"},
+		{"StudyDate", dicomweb.TagStudyDate, "DA"},
+		{"StudyTime", dicomweb.TagStudyTime, "TM"},
+		{"AccessionNumber", dicomweb.TagAccessionNumber, "SH"},
+		{"ModalitiesInStudy", dicomweb.TagModalitiesInStudy, "CS"},
+		{"StudyDescription", dicomweb.TagStudyDescription, "LO"},
+		{"PatientName", dicomweb.TagPatientName, "PN"},
+		{"PatientID", dicomweb.TagPatientID, "LO"},
+		{"NumberOfStudyRelatedSeries", dicomweb.TagNumberOfStudyRelatedSeries, "IS"},
+		{"NumberOfStudyRelatedInstances", dicomweb.TagNumberOfStudyRelatedInstances, "IS"},
+	},
+	SearchSeries: {
+		{"StudyInstanceUID", dicomweb.TagStudyInstanceUID, "UI"},
+		{"SeriesInstanceUID", dicomweb.TagSeriesInstanceUID, "UI"},
+		{"Modality", dicomweb.TagModality, "CS"},
+		{"SeriesNumber", dicomweb.TagSeriesNumber, "IS"},
+		{"SeriesDescription", dicomweb.TagSeriesDescription, "LO"},
+		{"NumberOfSeriesRelatedInstances", dicomweb.TagNumberOfSeriesRelatedInstances, "IS"},
+	},
+	SearchInstances: {
+		{"StudyInstanceUID", dicomweb.TagStudyInstanceUID, "UI"},
+		{"SeriesInstanceUID", dicomweb.TagSeriesInstanceUID, "UI"},
+		{"SOPInstanceUID", dicomweb.TagSOPInstanceUID, "UI"},
+		{"SOPClassUID", dicomweb.TagSOPClassUID, "UI"},
+		{"InstanceNumber", dicomweb.TagInstanceNumber, "IS"},
+	},
+}
+
+// Type representing the matching keys, limit and offset of a search
+type SearchQuery struct {
+	matches map[SearchAttribute]string
+	limit   int
+	offset  int
+}
+
+// ParseSearchQuery parses the query of a level, attributes are given by keyword or tag
+func ParseSearchQuery(query url.Values, level string) (SearchQuery, error) {
+	q := SearchQuery{matches: map[SearchAttribute]string{}}
+	for key, values := range query {
+		var err error
+		switch key {
+		case "limit":
+			q.limit, err = strconv.Atoi(values[0])
+		case "offset":
+			q.offset, err = strconv.Atoi(values[0])
+		case "includefield", "fuzzymatching":
+			// all supported attributes are returned, matching is exact
+		default:
+			attribute, ok := findSearchAttribute(level, key)
+			if !ok {
+				return q, fmt.Errorf("%w: %s not supported on level %s", ErrSearchQuery, key, level)
+			}
+			if len(values[0]) > 0 {
+				q.matches[attribute] = values[0]
+			}
+		}
+		if err != nil || q.limit < 0 || q.offset < 0 {
+			return q, fmt.Errorf("%w: %s=%s", ErrSearchQuery, key, values[0])
+		}
+	}
+	return q, nil
+}
+
+// findSearchAttribute looks up the attribute of the level by keyword or tag
+func findSearchAttribute(level string, key string) (SearchAttribute, bool) {
+	for _, a := range searchAttributes[level] {
+		if a.Keyword == key || strings.EqualFold(a.Tag, key) {
+			return a, true
+		}
+	}
+	return SearchAttribute{}, false
+}
+
+// Match checks all matching keys on the dataset
+func (q SearchQuery) Match(ds dicomweb.Dataset) bool {
+	for a, pattern := range q.matches {
+		if !matchAttribute(ds[a.Tag], a.VR, pattern) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchAttribute applies list matching of uids, range matching of dates and wildcards to any value
+func matchAttribute(attribute dicomweb.Attribute, vr string, pattern string) bool {
+	values := attribute.Strings()
+	switch {
+	case len(values) == 0:
+		return pattern == "*"
+	case vr == "UI":
+		for _, uid := range strings.FieldsFunc(pattern, func(r rune) bool { return r == ',' || r == '\\' }) {
+			if uid == values[0] {
+				return true
+			}
+		}
+		return false
+	case vr == "DA" && strings.Contains(pattern, "-"):
+		from, to, _ := strings.Cut(pattern, "-")
+		return values[0] >= from && (len(to) == 0 || values[0] <= to)
+	}
+	for _, value := range values {
+		if vr == "PN" {
+			value, pattern = strings.ToUpper(value), strings.ToUpper(pattern)
+		}
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Type representing search (QIDO-RS) of studies, series and instances in the directory
+type SearchOperation struct {
+	dirIn string
+	locks *StudyLocks
+}
+
+// search transaction on studies
+func (h *SearchOperation) SearchStudies(w http.ResponseWriter, r *http.Request) {
+	h.Search(w, r, SearchStudies)
+}
+
+// search transaction on the series of a study
+func (h *SearchOperation) SearchSeries(w http.ResponseWriter, r *http.Request) {
+	h.Search(w, r, SearchSeries)
+}
+
+// search transaction on the instances of a series
+func (h *SearchOperation) SearchInstances(w http.ResponseWriter, r *http.Request) {
+	h.Search(w, r, SearchInstances)
+}
+
+// Search answers the query of the level with the DICOM JSON model
+func (h *SearchOperation) Search(w http.ResponseWriter, r *http.Request, level string) {
+	// dump message
+	s := time.Now()
+	partscommon.LogRequest(r)
+
+	// get the variables
+	vars := mux.Vars(r)
+	studyinstanceuid := vars["study"]
+	seriesinstanceuid := vars["series"]
+	query, err := ParseSearchQuery(r.URL.Query(), level)
+	if err != nil {
+		klog.Error(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(studyinstanceuid) > 0 {
+		unlock := h.locks.Read(studyinstanceuid)
+		defer unlock()
+	}
+	err, results := h.ProcessSearch(BaseURL(r), level, studyinstanceuid, seriesinstanceuid, query)
+	if err != nil {
+		klog.Error("Error processing search:", err)
+		w.WriteHeader(RetrieveErrorStatus(err, http.StatusInternalServerError))
+		return
+	}
+	body, err := json.Marshal(results)
+	if err != nil {
+		klog.Error("Error encoding search results:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", dicomweb.MediaTypeDicomJSON)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(body)
+	duration := time.Since(s)
+	partscommon.LogTotalTimeInfo("SEARCH "+level+" "+studyinstanceuid+"/"+seriesinstanceuid+" results: "+strconv.Itoa(len(results)), duration, uint64(len(body)), duration, false)
+}
+
+// BaseURL returns the url of the service the request was sent to
+func BaseURL(r *http.Request) string {
+	scheme := "https"
+	if r.TLS == nil && r.ProtoMajor < 3 {
+		scheme = "http"
+	}
+	return scheme + "://" + r.Host
+}
+
+// ProcessSearch builds the datasets of the level from the directory and applies the query, a missing study or series is not found
+func (h *SearchOperation) ProcessSearch(base string, level string, study string, series string, query SearchQuery) (error, []dicomweb.Dataset) {
+	var candidates []dicomweb.Dataset
+	switch level {
+	case SearchStudies:
+		studies, err := listDirectories(h.dirIn)
+		if err != nil {
+			return err, nil
+		}
+		for _, study := range studies {
+			candidates = append(candidates, h.studyDataset(base, study))
+		}
+	case SearchSeries:
+		seriesList, err := listDirectories(filepath.Join(h.dirIn, study))
+		if err != nil {
+			return err, nil
+		}
+		for _, series := range seriesList {
+			if ds, _ := h.seriesDataset(base, study, series); ds != nil {
+				candidates = append(candidates, ds)
+			}
+		}
+	case SearchInstances:
+		files, err := listFiles(filepath.Join(h.dirIn, study, series))
+		if err != nil {
+			return err, nil
+		}
+		for _, file := range files {
+			candidates = append(candidates, instanceDataset(base, study, series, file))
+		}
+	}
+
+	// matching, then paging of the results
+	results := []dicomweb.Dataset{}
+	for _, ds := range candidates {
+		if query.Match(ds) {
+			results = append(results, ds)
+		}
+	}
+	if query.offset >= len(results) {
+		return nil, []dicomweb.Dataset{}
+	}
+	results = results[query.offset:]
+	if query.limit > 0 && query.limit < len(results) {
+		results = results[:query.limit]
+	}
+	return nil, results
+}
+
+// studyDataset returns the study attributes of the header of its first instance and the modalities of all series
+func (h *SearchOperation) studyDataset(base string, study string) dicomweb.Dataset {
+	ds := dicomweb.Dataset{}
+	ds.Set(dicomweb.TagStudyInstanceUID, "UI", study)
+	ds.Set(dicomweb.TagRetrieveURL, "UR", base+dicomweb.Ref{Study: study}.Path())
+	seriesList, _ := listDirectories(filepath.Join(h.dirIn, study))
+	var modalities []interface{}
+	seen := map[string]bool{}
+	instances := 0
+	filled := false
+	for _, series := range seriesList {
+		seriesDs, header := h.seriesDataset(base, study, series)
+		if seriesDs == nil {
+			continue
+		}
+		if modality := seriesDs.String(dicomweb.TagModality); len(modality) > 0 && !seen[modality] {
+			seen[modality] = true
+			modalities = append(modalities, modality)
+		}
+		n, _ := strconv.Atoi(seriesDs.String(dicomweb.TagNumberOfSeriesRelatedInstances))
+		instances += n
+		if !filled && header != nil {
+			filled = true
+			for _, a := range searchAttributes[SearchStudies] {
+				if a.VR != "IS" && a.Tag != dicomweb.TagStudyInstanceUID && a.Tag != dicomweb.TagModalitiesInStudy {
+					ds.Set(a.Tag, a.VR, headerString(header, a.Tag))
+				}
+			}
+		}
+	}
+	ds.Set(dicomweb.TagModalitiesInStudy, "CS", modalities...)
+	ds.Set(dicomweb.TagNumberOfStudyRelatedSeries, "IS", len(seriesList))
+	ds.Set(dicomweb.TagNumberOfStudyRelatedInstances, "IS", instances)
+	return ds
+}
+
+// seriesDataset returns the series attributes of the header of its first instance, nil for a series without instances
+func (h *SearchOperation) seriesDataset(base string, study string, series string) (dicomweb.Dataset, *dicomfile.Dataset) {
+	files, err := listFiles(filepath.Join(h.dirIn, study, series))
+	if err != nil {
+		return nil, nil
+	}
+	ds := dicomweb.Dataset{}
+	ds.Set(dicomweb.TagStudyInstanceUID, "UI", study)
+	ds.Set(dicomweb.TagSeriesInstanceUID, "UI", series)
+	ds.Set(dicomweb.TagRetrieveURL, "UR", base+dicomweb.Ref{Study: study, Series: series}.Path())
+	ds.Set(dicomweb.TagNumberOfSeriesRelatedInstances, "IS", len(files))
+	f, err := dicomfile.ReadFileHeader(files[0])
+	if err != nil {
+		klog.V(partscommon.KlogDebug).Info("No header of instance: ", files[0], " error: ", err)
+		return ds, nil
+	}
+	ds.Set(dicomweb.TagModality, "CS", headerString(f.Dataset, dicomweb.TagModality))
+	ds.Set(dicomweb.TagSeriesDescription, "LO", headerString(f.Dataset, dicomweb.TagSeriesDescription))
+	setNumber(ds, dicomweb.TagSeriesNumber, headerString(f.Dataset, dicomweb.TagSeriesNumber))
+	return ds, f.Dataset
+}
+
+// instanceDataset returns the instance attributes of the header of the file
+func instanceDataset(base string, study string, series string, file string) dicomweb.Dataset {
+	instance := strings.TrimSuffix(filepath.Base(file), ".dcm")
+	ds := dicomweb.Dataset{}
+	ds.Set(dicomweb.TagStudyInstanceUID, "UI", study)
+	ds.Set(dicomweb.TagSeriesInstanceUID, "UI", series)
+	ds.Set(dicomweb.TagSOPInstanceUID, "UI", instance)
+	ds.Set(dicomweb.TagRetrieveURL, "UR", base+dicomweb.Ref{Study: study, Series: series, Instance: instance}.Path())
+	f, err := dicomfile.ReadFileHeader(file)
+	if err != nil {
+		klog.V(partscommon.KlogDebug).Info("No header of instance: ", file, " error: ", err)
+		return ds
+	}
+	ds.Set(dicomweb.TagSOPClassUID, "UI", headerString(f.Dataset, dicomweb.TagSOPClassUID))
+	setNumber(ds, dicomweb.TagInstanceNumber, headerString(f.Dataset, dicomweb.TagInstanceNumber))
+	return ds
+}
+
+// headerString returns the trimmed value of the element of the DICOM JSON tag
+func headerString(ds *dicomfile.Dataset, tag string) string {
+	t, err := strconv.ParseUint(tag, 16, 32)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(ds.String(uint32(t)))
+}
+
+// setNumber sets an IS attribute as number, invalid values are left out
+func setNumber(ds dicomweb.Dataset, tag string, value string) {
+	if n, err := strconv.Atoi(value); err == nil {
+		ds.Set(tag, "IS", n)
+	}
+}
+
+// listDirectories returns the names of the sub directories in name order, hidden directories are skipped
+func listDirectories(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
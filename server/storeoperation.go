@@ -1,10 +1,14 @@
 package main
 
 import (
+	"httpxcommon/compression"
+	"httpxcommon/digest"
 	"httpxcommon/httpxhelper"
+	"httpxcommon/manifest"
 	"httpxcommon/multiparts"
 	"httpxcommon/partscommon"
 	"httpxcommon/singleparts"
+	"io"
 	"mime"
 	"net/http"
 	"time"
@@ -15,7 +19,9 @@ import (
 
 // Type representing store of an study
 type StoreOperation struct {
-	dirOut string
+	dirOut   string
+	locks    *StudyLocks
+	readOnly bool
 }
 
 // store transaction on study level
@@ -31,29 +37,104 @@ func (h *StoreOperation) StoreStudy(w http.ResponseWriter, r *http.Request) {
 		klog.V(partscommon.KlogDebug).Info("Store requested for study with instance uid: ", studyinstanceuid)
 	}
 
+	// modifications are rejected in read-only mode
+	if h.readOnly {
+		klog.Warning("Store rejected in read-only mode for study: ", studyinstanceuid)
+		w.Header().Set("Allow", http.MethodGet)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	unlock := h.locks.Read(studyinstanceuid)
+	defer unlock()
+
 	// determine type and params
 	var code int
 	var size uint64
+	compress := &compression.Options{}
+	stored := manifest.New()
+
+	// digests of the parts and the body are verified while storing
+	dig := &digest.Options{Enabled: true}
+	bodyHash := digest.NewHash(dig.GetStats())
+	bodyField := r.Header.Get(digest.ContentDigestHeader)
 	contentType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if len(bodyField) > 0 && contentType == "multipart/related" {
+		r.Body = digest.NewReadCloser(r.Body, bodyHash)
+	}
 	switch contentType {
 
 	case "multipart/related":
 		{
 			// store multipart message
 			var mf multiparts.MultipartFiles
+			mf.Compression = compress
+			mf.Stored = stored
+			mf.Digest = dig
+			mf.Pending = len(bodyField) > 0
 			code, size = mf.StoreMultipartMessage(&r.Header, &r.Body, h.dirOut, params)
+
+			// a damaged body rejects all instances of the message
+			if len(bodyField) > 0 {
+				io.Copy(io.Discard, r.Body)
+				if err := bodyHash.Verify(bodyField); err != nil {
+					klog.Error("STORE ", studyinstanceuid, " body: ", err)
+					code = http.StatusConflict
+					mf.Discard()
+					stored = RejectStored(stored, err)
+				} else if err := mf.Commit(); err != nil {
+					klog.Error("STORE ", studyinstanceuid, ": ", err)
+					code = http.StatusInternalServerError
+				}
+			}
 		}
 
 	case "application/dicom":
 		{
 			// store singlepart message
 			var sf singleparts.SinglepartFiles
+			sf.Compression = compress
+			sf.Stored = stored
+			sf.Digest = dig
 			code, size = sf.StoreSinglePartMessage(&r.Header, &r.Body, h.dirOut, params)
 		}
 	default:
-		w.WriteHeader(http.StatusPreconditionRequired)
+		code = http.StatusPreconditionRequired
+	}
+
+	// partially stored messages are accepted (PS3.18 STOW-RS)
+	failures := len(stored.Failures())
+	if failures > 0 && stored.Len() > 0 {
+		code = http.StatusAccepted
+	}
+
+	// the stored instances with size and SHA-256 allow the client to verify the transfer
+	if code == http.StatusOK || failures > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		if err := stored.WriteJSON(w); err != nil {
+			klog.Error("Error writing stored instances: ", err)
+		}
+	} else {
+		w.WriteHeader(code)
 	}
-	w.WriteHeader(code)
 	duration := time.Since(s)
 	partscommon.LogTotalTimeInfo("STORE "+studyinstanceuid, duration, size, duration, false)
+	if compress.Stats.EncodedBytes > 0 {
+		klog.V(partscommon.KlogStatistics).Info("STORE "+studyinstanceuid, " decompression ", compress.Stats.String())
+	}
+	if dig.Stats.Bytes > 0 {
+		klog.V(partscommon.KlogStatistics).Info("STORE "+studyinstanceuid, " digest ", dig.Stats.String())
+	}
+}
+
+// RejectStored lists the stored instances as failed, their temporary files are discarded by the caller
+func RejectStored(stored *manifest.Manifest, reason error) *manifest.Manifest {
+	rejected := manifest.New()
+	for _, f := range stored.Failures() {
+		rejected.Fail(f)
+	}
+	for _, e := range stored.Entries() {
+		rejected.Fail(manifest.Failure{SOPInstanceUID: e.SOPInstanceUID, Path: e.Path, Reason: reason.Error()})
+	}
+	return rejected
 }
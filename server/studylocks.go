@@ -0,0 +1,59 @@
+package main
+
+import "sync"
+
+// Type representing reader/writer locks per study, retrieves and stores share a study, deletes are exclusive
+type StudyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*studyLock
+}
+
+type studyLock struct {
+	sync.RWMutex
+	refs int
+}
+
+func NewStudyLocks() *StudyLocks {
+	return &StudyLocks{locks: make(map[string]*studyLock)}
+}
+
+func (l *StudyLocks) acquire(study string) *studyLock {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lock, ok := l.locks[study]
+	if !ok {
+		lock = &studyLock{}
+		l.locks[study] = lock
+	}
+	lock.refs++
+	return lock
+}
+
+func (l *StudyLocks) release(study string, lock *studyLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lock.refs--
+	if lock.refs == 0 {
+		delete(l.locks, study)
+	}
+}
+
+// Read locks the study for reading or storing and returns the unlock function
+func (l *StudyLocks) Read(study string) func() {
+	lock := l.acquire(study)
+	lock.RLock()
+	return func() {
+		lock.RUnlock()
+		l.release(study, lock)
+	}
+}
+
+// Write locks the study exclusively and returns the unlock function
+func (l *StudyLocks) Write(study string) func() {
+	lock := l.acquire(study)
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		l.release(study, lock)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"httpxcommon/dicomfile"
+	"httpxcommon/partscommon"
+
+	"k8s.io/klog"
+)
+
+// Type representing the transcoding of retrieved files into the negotiated transfer syntax
+type Transcoder struct {
+	transferSyntax string
+	mu             sync.Mutex
+	files          int
+	transcoded     int
+	failed         int
+	inputBytes     uint64
+	outputBytes    uint64
+	duration       time.Duration
+}
+
+// NewTranscoder returns nil if the files are delivered as stored
+func NewTranscoder(transferSyntax string) *Transcoder {
+	if len(transferSyntax) == 0 {
+		return nil
+	}
+	return &Transcoder{transferSyntax: transferSyntax}
+}
+
+// Transform converts the file content, files already in the transfer syntax are returned unchanged
+func (t *Transcoder) Transform(path string, data []byte) ([]byte, error) {
+	s := time.Now()
+	out, err := dicomfile.Transcode(data, t.transferSyntax)
+	duration := time.Since(s)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.files++
+	t.duration += duration
+	t.inputBytes += uint64(len(data))
+	if err != nil {
+		t.failed++
+		klog.Error("Error transcoding ", path, " to ", t.transferSyntax, ": ", err)
+		return nil, err
+	}
+	t.outputBytes += uint64(len(out))
+	if len(out) != len(data) || (len(out) > 0 && &out[0] != &data[0]) {
+		t.transcoded++
+	}
+	return out, nil
+}
+
+// Duration returns the time spent transcoding
+func (t *Transcoder) Duration() time.Duration {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.duration
+}
+
+func (t *Transcoder) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return fmt.Sprintf("to %s files: %d transcoded: %d failed: %d in: %s out: %s time: %s", t.transferSyntax, t.files, t.transcoded, t.failed,
+		partscommon.ByteCountSI(t.inputBytes), partscommon.ByteCountSI(t.outputBytes), t.duration)
+}
+
+// LogTranscoding reports transcode time separately from the transfer time
+func (t *Transcoder) LogTranscoding(what string, total time.Duration, size uint64) {
+	if t == nil {
+		return
+	}
+	klog.V(partscommon.KlogStatistics).Info("TRANSCODE ", what, " ", t.String())
+	partscommon.LogTotalTimeInfo("TRANSFER "+what+" (without transcoding)", total, size, total-t.Duration(), false)
+}
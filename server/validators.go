@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// modes to calculate the entity tag of an instance
+const (
+	ETagModTime = "mtime"
+	ETagSha256  = "sha256"
+)
+
+// Type representing a cached content hash of a file
+type cachedHash struct {
+	size    int64
+	modTime time.Time
+	etag    string
+}
+
+// Type representing the validators (entity tags) of the stored files
+type Validators struct {
+	mode   string
+	mu     sync.Mutex
+	hashes map[string]cachedHash
+}
+
+func NewValidators(mode string) *Validators {
+	return &Validators{mode: mode, hashes: make(map[string]cachedHash)}
+}
+
+// InstanceETag returns a strong entity tag for an instance file
+func (h *Validators) InstanceETag(path string, info os.FileInfo) (string, error) {
+	if h.mode != ETagSha256 {
+		return fmt.Sprintf("\"%x-%x\"", info.Size(), info.ModTime().UnixNano()), nil
+	}
+
+	// content hash is calculated once per file version
+	h.mu.Lock()
+	cached, ok := h.hashes[path]
+	h.mu.Unlock()
+	if ok && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached.etag, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	etag := "\"" + hex.EncodeToString(hash.Sum(nil)) + "\""
+	h.mu.Lock()
+	h.hashes[path] = cachedHash{size: info.Size(), modTime: info.ModTime(), etag: etag}
+	h.mu.Unlock()
+	return etag, nil
+}
+
+// DirectoryValidators returns a weak entity tag and the last modification of a study or series directory
+func (h *Validators) DirectoryValidators(path string) (string, time.Time, error) {
+	hash := sha256.New()
+	var lastModified time.Time
+	found := false
+	errWalk := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if lastModified.Before(info.ModTime()) {
+			lastModified = info.ModTime()
+		}
+		if !info.IsDir() {
+			found = true
+			rel, _ := filepath.Rel(path, file)
+			fmt.Fprintf(hash, "%s:%x:%x\n", filepath.ToSlash(rel), info.Size(), info.ModTime().UnixNano())
+		}
+		return nil
+	})
+	if errWalk != nil {
+		return "", lastModified, errWalk
+	}
+	if !found {
+		return "", lastModified, os.ErrNotExist
+	}
+	return "W/\"" + hex.EncodeToString(hash.Sum(nil)[:16]) + "\"", lastModified, nil
+}
+
+// NotModified evaluates If-None-Match and If-Modified-Since of a request
+func NotModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); len(inm) > 0 {
+		// weak comparison is used for GET
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); len(ims) > 0 {
+		t, err := http.ParseTime(ims)
+		if err == nil && !lastModified.Truncate(time.Second).After(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"archive/zip"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"httpxcommon/manifest"
+	"httpxcommon/partscommon"
+
+	"k8s.io/klog"
+)
+
+// WriteZip writes all files below the path as zip archive with entries StudyInstanceUid/SeriesInstanceUid/InstanceUid.dcm, files are transcoded if needed
+func WriteZip(body io.Writer, path string, transcoder *Transcoder) (error, uint64) {
+	s := time.Now()
+	writer := zip.NewWriter(body)
+	var size uint64
+	errWalk := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// partial files of running stores and proxy fills and manifests are no instances
+		if info.IsDir() || !manifest.IsInstanceFile(file) {
+			return nil
+		}
+		study, series, instance := partscommon.GetDICOMInfo(file)
+		header := &zip.FileHeader{
+			Name:     filepath.ToSlash(filepath.Join(study, series, instance+".dcm")),
+			Method:   zip.Store,
+			Modified: info.ModTime(),
+		}
+		entry, err := writer.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if transcoder != nil {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			if data, err = transcoder.Transform(file, data); err != nil {
+				return err
+			}
+			n, err := entry.Write(data)
+			size += uint64(n)
+			return err
+		}
+		in, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		n, err := io.Copy(entry, in)
+		size += uint64(n)
+		return err
+	})
+	if errWalk != nil {
+		return errWalk, size
+	}
+	klog.V(partscommon.KlogDebug).Info("Zip of ", path, " written in: ", time.Since(s), " size:", size)
+	return writer.Close(), size
+}